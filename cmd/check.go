@@ -286,6 +286,22 @@ func (cp *channelProcessor) process() error {
 		cp.logger.log("No parts found in database")
 	}
 
+	// Messages of previous file versions are still referenced
+	var versionParts []datatypes.JSONSlice[api.Part]
+	if err := cp.db.Model(&models.FileVersion{}).
+		Where("user_id = ?", cp.userId).
+		Where("channel_id = ?", cp.id).
+		Pluck("parts", &versionParts).Error; err != nil {
+		return fmt.Errorf("failed to query file versions for channel %d: %w", cp.id, err)
+	}
+	for _, parts := range versionParts {
+		for _, p := range parts {
+			if p.ID != 0 {
+				allPartIDs[p.ID] = true
+			}
+		}
+	}
+
 	for msgID := range msgMap {
 		if msgID == 1 {
 			continue
@@ -399,9 +415,9 @@ func (cp *channelProcessor) loadFiles() ([]file, error) {
 		Where("type = ?", "file")
 
 	if cleanPending && cp.dryRun {
-		db = db.Where("status IN ?", []string{"active", "pending_deletion"})
+		db = db.Where("status IN ?", []string{"active", "trashed", "pending_deletion"})
 	} else {
-		db = db.Where("status = ?", "active")
+		db = db.Where("status IN ?", []string{"active", "trashed"})
 	}
 
 	if err := db.Count(&totalFiles).Error; err != nil {
@@ -423,9 +439,9 @@ func (cp *channelProcessor) loadFiles() ([]file, error) {
 			Limit(batchSize)
 
 		if cleanPending && cp.dryRun {
-			query = query.Where("status IN ?", []string{"active", "pending_deletion"})
+			query = query.Where("status IN ?", []string{"active", "trashed", "pending_deletion"})
 		} else {
-			query = query.Where("status = ?", "active")
+			query = query.Where("status IN ?", []string{"active", "trashed"})
 		}
 
 		if lastID != "" {
@@ -0,0 +1,584 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// rekeyMarker names the pending_deletion rows holding the replaced parts
+// until their messages are deleted.
+const rekeyMarker = "rekey"
+
+// rekeyContent is one stored content: the parts shared by every file and
+// version that reference them.
+type rekeyContent struct {
+	ChannelId int64
+	Parts     datatypes.JSONSlice[api.Part]
+	// PartsJSON is parts as stored, to match the rows referencing them.
+	PartsJSON string
+	Size      int64
+}
+
+type rekeyProcessor struct {
+	db       *gorm.DB
+	cfg      *config.RekeyCmdConfig
+	client   *telegram.Client
+	api      *tg.Client
+	cache    cache.Cacher
+	userId   int64
+	botID    string
+	keyId    string
+	oldNames *crypt.Cipher
+	newNames *crypt.Cipher
+}
+
+func NewRekeyCmd() *cobra.Command {
+	var cfg config.RekeyCmdConfig
+	loader := config.NewConfigLoader()
+	cmd := &cobra.Command{
+		Use:   "rekey",
+		Short: "Re-encrypt encrypted files with a new encryption key",
+		Long: `Re-encrypt every encrypted file of a user with a new key. Each part is read with the
+current tg.uploads.encryption-key, encrypted again with the new key and a fresh salt and
+uploaded as a new message. The files are then switched to the new parts and the old
+messages deleted. Encrypted names are re-encrypted as well. Files encrypted with the
+data key of the user are left alone; the data key is wrapped with the new key instead
+when it was wrapped with the encryption key.
+
+Stop the server while rekeying and set tg.uploads.encryption-key to the new key before
+starting it again. An interrupted run resumes where it stopped when run again with the
+same new key.
+
+Examples:
+  # Preview the files to re-encrypt (dry-run)
+  teldrive rekey --user alice --new-key "new secret" --dry-run
+
+  # Re-encrypt 8 files at a time
+  teldrive rekey --user alice --new-key "new secret" --concurrent 8`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runRekeyCmd(cmd, &cfg)
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loader.Load(cmd, &cfg); err != nil {
+				return err
+			}
+			return checkRequiredRekeyFlags(&cfg)
+		},
+	}
+	loader.RegisterFlags(cmd.Flags(), reflect.TypeFor[config.RekeyCmdConfig]())
+	return cmd
+}
+
+func checkRequiredRekeyFlags(cfg *config.RekeyCmdConfig) error {
+	var missingFields []string
+	if cfg.DB.DataSource == "" {
+		missingFields = append(missingFields, "db-data-source")
+	}
+	if cfg.TG.Uploads.EncryptionKey == "" {
+		missingFields = append(missingFields, "tg-uploads-encryption-key")
+	}
+	if cfg.NewKey == "" {
+		missingFields = append(missingFields, "new-key")
+	}
+	if len(missingFields) > 0 {
+		return fmt.Errorf("required configuration values not set: %s", strings.Join(missingFields, ", "))
+	}
+	if cfg.NewKey == cfg.TG.Uploads.EncryptionKey {
+		return errors.New("new key is the same as the current encryption key")
+	}
+	return nil
+}
+
+// keyID identifies the new key in teldrive.rekeyed_parts and
+// teldrive.rekeyed_names without storing
+// anything the key could be recovered from cheaply.
+func keyID(names *crypt.Cipher) (string, error) {
+	return names.EncryptName("teldrive-rekey")
+}
+
+// loadContents returns the encrypted contents of the user not yet re-encrypted
+// with the new key. Content shared by several files or versions is returned
+// once. Content encrypted with the data key of the user does not depend on
+// the instance key and is left alone.
+func (rp *rekeyProcessor) loadContents() ([]rekeyContent, error) {
+	var contents []rekeyContent
+	err := rp.db.Raw(`
+	SELECT channel_id, parts, parts::text AS parts_json, max(size) AS size FROM (
+		SELECT channel_id, parts, size FROM teldrive.files
+		WHERE user_id = ? AND type = 'file' AND encrypted AND status IN ('active', 'trashed')
+		UNION ALL
+		SELECT channel_id, parts, size FROM teldrive.file_versions
+		WHERE user_id = ? AND encrypted
+	) c
+	WHERE c.parts IS NOT NULL AND jsonb_array_length(c.parts) > 0
+	AND COALESCE(c.parts->0->>'salt', '') NOT LIKE 'user:%' AND NOT EXISTS (
+		SELECT 1 FROM teldrive.rekeyed_parts r
+		WHERE r.key_id = ? AND r.channel_id = c.channel_id AND r.part_id = (c.parts->0->>'id')::int
+	)
+	GROUP BY channel_id, parts
+	ORDER BY channel_id
+	`, rp.userId, rp.userId, rp.keyId).Scan(&contents).Error
+	return contents, err
+}
+
+// partName re-encrypts the Telegram file name of a part if it was encrypted
+// with the old key.
+func (rp *rekeyProcessor) partName(name string) string {
+	plain, err := rp.oldNames.DecryptName(name)
+	if err != nil {
+		return name
+	}
+	if encrypted, err := rp.newNames.EncryptName(plain); err == nil {
+		return encrypted
+	}
+	return name
+}
+
+// rekeyContent uploads every part of c encrypted with the new key and moves
+// all rows referencing c to the new parts in one transaction. The old parts
+// are recorded for deletion in the same transaction, so an interrupted run
+// never loses track of either set of messages.
+func (rp *rekeyProcessor) rekeyContent(ctx context.Context, c *rekeyContent) error {
+	ids := utils.Map(c.Parts, func(part api.Part) int { return part.ID })
+	messages, err := tgc.GetMessages(ctx, rp.api, ids, c.ChannelId)
+	if err != nil {
+		return err
+	}
+	documents := map[int]*tg.Document{}
+	for _, message := range messages {
+		if item, ok := message.(*tg.Message); ok {
+			if media, ok := item.Media.(*tg.MessageMediaDocument); ok {
+				if document, ok := media.Document.(*tg.Document); ok {
+					documents[item.ID] = document
+				}
+			}
+		}
+	}
+
+	file := &models.File{
+		ID:        fmt.Sprintf("rekey-%d-%d", c.ChannelId, ids[0]),
+		ChannelId: &c.ChannelId,
+		Encrypted: utils.Ptr(true),
+	}
+	uploaded := []int{}
+	newParts := datatypes.JSONSlice[api.Part]{}
+	fail := func(err error) error {
+		if len(uploaded) > 0 {
+			rp.deleteMessages(context.WithoutCancel(ctx), c.ChannelId, uploaded)
+		}
+		return err
+	}
+	for _, part := range c.Parts {
+		document, ok := documents[part.ID]
+		if !ok {
+			return fail(fmt.Errorf("part %d is missing", part.ID))
+		}
+		size, err := crypt.DecryptedSize(document.Size)
+		if err != nil || size <= 0 {
+			return fail(fmt.Errorf("part %d is not encrypted", part.ID))
+		}
+		name := strconv.Itoa(part.ID)
+		for _, attribute := range document.Attributes {
+			if filename, ok := attribute.(*tg.DocumentAttributeFilename); ok {
+				name = rp.partName(filename.FileName)
+			}
+		}
+
+		parts := []types.Part{{ID: int64(part.ID), Size: document.Size, DecryptedSize: size, Salt: part.Salt.Value}}
+		r, err := reader.NewReader(ctx, rp.api, rp.cache, file, parts, 0, size-1, &rp.cfg.TG, rp.botID)
+		if err != nil {
+			return fail(err)
+		}
+		salt, err := crypt.NewSalt()
+		if err != nil {
+			r.Close()
+			return fail(err)
+		}
+		cipher, err := crypt.NewCipher(rp.cfg.NewKey, salt)
+		if err != nil {
+			r.Close()
+			return fail(err)
+		}
+		encrypted, err := cipher.EncryptData(r)
+		if err != nil {
+			r.Close()
+			return fail(err)
+		}
+		message, err := tgc.UploadDocument(ctx, rp.api, c.ChannelId, name, encrypted,
+			crypt.EncryptedSize(size), rp.cfg.TG.Uploads.Threads)
+		r.Close()
+		if err != nil {
+			return fail(err)
+		}
+		uploaded = append(uploaded, message.ID)
+		newParts = append(newParts, api.Part{ID: message.ID, Salt: api.NewOptString(salt)})
+	}
+
+	var marker models.File
+	err = rp.db.Transaction(func(tx *gorm.DB) error {
+		var updated int64
+		for _, table := range []string{"teldrive.files", "teldrive.file_versions"} {
+			res := tx.Exec("UPDATE "+table+" SET parts = ? WHERE user_id = ? AND channel_id = ? AND encrypted AND parts = ?::jsonb",
+				newParts, rp.userId, c.ChannelId, c.PartsJSON)
+			if res.Error != nil {
+				return res.Error
+			}
+			updated += res.RowsAffected
+		}
+		if updated == 0 {
+			return errors.New("content changed while it was re-encrypted")
+		}
+		for _, id := range uploaded {
+			if err := tx.Exec("INSERT INTO teldrive.rekeyed_parts (key_id, channel_id, part_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+				rp.keyId, c.ChannelId, id).Error; err != nil {
+				return err
+			}
+		}
+		oldParts := c.Parts
+		marker = models.File{
+			Name:      rekeyMarker,
+			Type:      "file",
+			MimeType:  "application/octet-stream",
+			UserId:    rp.userId,
+			Status:    "pending_deletion",
+			Parts:     &oldParts,
+			ChannelId: &c.ChannelId,
+		}
+		return tx.Create(&marker).Error
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := rp.deleteMessages(ctx, c.ChannelId, ids); err != nil {
+		// The marker stays behind for the clean files job or the next run
+		return nil
+	}
+	return rp.db.Where("id = ?", marker.ID).Delete(&models.File{}).Error
+}
+
+// cleanMarkers deletes the old messages a previous run could not delete.
+func (rp *rekeyProcessor) cleanMarkers(ctx context.Context) (int, error) {
+	var markers []models.File
+	if err := rp.db.Where("user_id = ? AND name = ? AND status = 'pending_deletion'", rp.userId, rekeyMarker).
+		Find(&markers).Error; err != nil {
+		return 0, err
+	}
+	for _, marker := range markers {
+		if marker.Parts == nil || marker.ChannelId == nil {
+			continue
+		}
+		ids := utils.Map(*marker.Parts, func(part api.Part) int { return part.ID })
+		if err := rp.deleteMessages(ctx, *marker.ChannelId, ids); err != nil {
+			return 0, err
+		}
+		if err := rp.db.Where("id = ?", marker.ID).Delete(&models.File{}).Error; err != nil {
+			return 0, err
+		}
+	}
+	return len(markers), nil
+}
+
+func (rp *rekeyProcessor) deleteMessages(ctx context.Context, channelId int64, ids []int) error {
+	channel, err := tgc.GetChannelById(ctx, rp.api, channelId)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(ids); start += 100 {
+		batch := ids[start:min(start+100, len(ids))]
+		if _, err := rp.api.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{Channel: channel, ID: batch}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyNames re-encrypts the stored names that were encrypted with the old
+// key. Names are converted one by one and recorded in teldrive.rekeyed_names,
+// so a run can stop at any point: a name already encrypted with the new key
+// may still decrypt with the old one and cannot be told apart by its form.
+func (rp *rekeyProcessor) rekeyNames(dryRun bool) (int64, error) {
+	var count int64
+	var files []models.File
+	err := rp.db.Model(&models.File{}).Select("id", "name").
+		Where("user_id = ? AND name_encrypted", rp.userId).
+		Where("NOT EXISTS (SELECT 1 FROM teldrive.rekeyed_names r WHERE r.key_id = ? AND r.file_id = files.id)", rp.keyId).
+		FindInBatches(&files, 1000, func(tx *gorm.DB, batch int) error {
+			for _, f := range files {
+				plain, err := rp.oldNames.DecryptName(f.Name)
+				if err != nil {
+					continue
+				}
+				count++
+				if dryRun {
+					continue
+				}
+				name, err := rp.newNames.EncryptName(plain)
+				if err != nil {
+					return err
+				}
+				if err := rp.db.Transaction(func(tx *gorm.DB) error {
+					if err := tx.Model(&models.File{}).Where("id = ?", f.ID).Update("name", name).Error; err != nil {
+						return err
+					}
+					return tx.Exec("INSERT INTO teldrive.rekeyed_names (key_id, file_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+						rp.keyId, f.ID).Error
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	return count, err
+}
+
+// rekeyDataKey wraps the data key of the user with the new key when it is
+// wrapped with the encryption key, which is the case without keys.master-key.
+// Keys protected by a passphrase or a separate master key do not change.
+func (rp *rekeyProcessor) rekeyDataKey(dryRun bool) (bool, error) {
+	if rp.cfg.Keys.MasterKey != "" {
+		return false, nil
+	}
+	var userKey models.UserKey
+	err := rp.db.Where("user_id = ? AND protection = ?", rp.userId, "master").First(&userKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	key, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, rp.cfg.TG.Uploads.EncryptionKey)
+	if errors.Is(err, crypt.ErrBadPassphrase) {
+		// Already wrapped with the new key by an earlier run
+		if _, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, rp.cfg.NewKey); err == nil {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	if dryRun {
+		return true, nil
+	}
+	wrapped, salt, err := crypt.WrapKey(key, rp.cfg.NewKey)
+	if err != nil {
+		return false, err
+	}
+	return true, rp.db.Model(&models.UserKey{}).Where("user_id = ?", rp.userId).
+		Updates(map[string]any{"wrapped_key": wrapped, "salt": salt, "updated_at": time.Now().UTC()}).Error
+}
+
+func runRekeyCmd(cmd *cobra.Command, cfg *config.RekeyCmdConfig) {
+	ctx := cmd.Context()
+
+	logCfg := &config.DBLoggingConfig{
+		Level: "fatal",
+	}
+	db, err := database.NewDatabase(ctx, &cfg.DB, logCfg, zap.NewNop())
+	if err != nil {
+		color.Red("Failed to connect to database: %v\n", err)
+		os.Exit(1)
+	}
+	if err := database.MigrateDB(db); err != nil {
+		color.Red("Failed to migrate database: %v\n", err)
+		os.Exit(1)
+	}
+
+	users := []models.User{}
+	if err := db.Model(&models.User{}).Find(&users).Error; err != nil {
+		color.Red("Failed to retrieve users from database: %v\n", err)
+		os.Exit(1)
+	}
+	user, err := selectUser(cfg.User, users)
+	if err != nil {
+		color.Red("Failed to select user: %v\n", err)
+		os.Exit(1)
+	}
+
+	session := models.Session{}
+	if err := db.Model(&models.Session{}).
+		Where("user_id = ?", user.UserId).
+		Order("created_at desc").
+		First(&session).Error; err != nil {
+		color.Red("Failed to get user session - ensure user has logged in: %v\n", err)
+		os.Exit(1)
+	}
+
+	oldNames, err := crypt.NewNameCipher(cfg.TG.Uploads.EncryptionKey)
+	if err != nil {
+		color.Red("Failed to derive the current key: %v\n", err)
+		os.Exit(1)
+	}
+	newNames, err := crypt.NewNameCipher(cfg.NewKey)
+	if err != nil {
+		color.Red("Failed to derive the new key: %v\n", err)
+		os.Exit(1)
+	}
+	keyId, err := keyID(newNames)
+	if err != nil {
+		color.Red("Failed to derive the new key: %v\n", err)
+		os.Exit(1)
+	}
+
+	middlewares := tgc.NewMiddleware(&cfg.TG, tgc.WithFloodWait(), tgc.WithRateLimit())
+	client, err := tgc.AuthClient(ctx, &cfg.TG, session.Session, middlewares...)
+	if err != nil {
+		color.Red("Failed to create client: %v\n", err)
+		os.Exit(1)
+	}
+
+	rp := &rekeyProcessor{
+		db:       db,
+		cfg:      cfg,
+		client:   client,
+		api:      client.API(),
+		cache:    cache.NewMemoryCache(10 * 1024 * 1024),
+		userId:   user.UserId,
+		botID:    strconv.FormatInt(user.UserId, 10),
+		keyId:    keyId,
+		oldNames: oldNames,
+		newNames: newNames,
+	}
+
+	dryRun := cfg.DryRun
+	if dryRun {
+		color.Yellow("Running in dry-run mode - no changes will be made\n")
+	}
+
+	var totalContents, totalRekeyed, totalFailed, totalCleaned int
+	var totalSize int64
+	var totalNames int64
+	var dataKeyRewrapped bool
+
+	err = tgc.RunWithAuth(ctx, client, "", func(ctx context.Context) error {
+		if !dryRun {
+			cleaned, err := rp.cleanMarkers(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to delete messages left by a previous run: %w", err)
+			}
+			totalCleaned = cleaned
+		}
+
+		contents, err := rp.loadContents()
+		if err != nil {
+			return fmt.Errorf("failed to load files: %w", err)
+		}
+		totalContents = len(contents)
+
+		byChannel := map[int64][]rekeyContent{}
+		channelIds := []int64{}
+		for _, c := range contents {
+			if _, ok := byChannel[c.ChannelId]; !ok {
+				channelIds = append(channelIds, c.ChannelId)
+			}
+			byChannel[c.ChannelId] = append(byChannel[c.ChannelId], c)
+			totalSize += c.Size
+		}
+
+		color.Cyan("Re-encrypting %d files in %d channels with concurrency %d...\n\n", len(contents), len(channelIds), cfg.Concurrent)
+
+		for _, id := range channelIds {
+			contents := byChannel[id]
+			logger := newChannelLogger(id)
+			if dryRun {
+				logger.success(fmt.Sprintf("Would re-encrypt %d files", len(contents)))
+				continue
+			}
+			logger.log(fmt.Sprintf("Re-encrypting %d files...", len(contents)))
+
+			var done, failed atomic.Int64
+			var g errgroup.Group
+			g.SetLimit(max(cfg.Concurrent, 1))
+			for i := range contents {
+				g.Go(func() error {
+					if err := rp.rekeyContent(ctx, &contents[i]); err != nil {
+						failed.Add(1)
+						logger.error(fmt.Sprintf("Part %d: %v", contents[i].Parts[0].ID, err))
+					}
+					logger.progress(done.Add(1), int64(len(contents)), "Re-encrypting")
+					return nil
+				})
+			}
+			g.Wait()
+
+			totalFailed += int(failed.Load())
+			totalRekeyed += len(contents) - int(failed.Load())
+			if failed.Load() > 0 {
+				logger.error(fmt.Sprintf("%d files failed", failed.Load()))
+			} else {
+				logger.success(fmt.Sprintf("Re-encrypted %d files", len(contents)))
+			}
+		}
+
+		if totalFailed > 0 {
+			// Names and the data key follow once every file uses the new key
+			return nil
+		}
+		totalNames, err = rp.rekeyNames(dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt names: %w", err)
+		}
+		dataKeyRewrapped, err = rp.rekeyDataKey(dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to wrap the data key: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		color.Red("\nRekey failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	color.Cyan("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	color.Cyan("                    Rekey Summary                   \n")
+	color.Cyan("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	fmt.Printf("  %-25s %d\n", "Files Pending:", totalContents)
+	fmt.Printf("  %-25s %d\n", "Bytes Pending:", totalSize)
+	if dryRun {
+		fmt.Printf("  %-25s %d\n", "Would Re-encrypt Names:", totalNames)
+		fmt.Printf("  %-25s %t\n", "Would Rewrap Data Key:", dataKeyRewrapped)
+	} else {
+		fmt.Printf("  %-25s %d\n", "Files Re-encrypted:", totalRekeyed)
+		fmt.Printf("  %-25s %d\n", "Files Failed:", totalFailed)
+		fmt.Printf("  %-25s %d\n", "Names Re-encrypted:", totalNames)
+		fmt.Printf("  %-25s %t\n", "Data Key Rewrapped:", dataKeyRewrapped)
+		fmt.Printf("  %-25s %d\n", "Leftovers Cleaned:", totalCleaned)
+	}
+	color.Cyan("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+
+	if dryRun {
+		return
+	}
+	if totalFailed > 0 {
+		color.Red("\nSome files could not be re-encrypted - run the command again to retry them\n")
+		os.Exit(1)
+	}
+	color.Green("\n✓ All files re-encrypted - set tg.uploads.encryption-key to the new key\n")
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/datatypes"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	rekeyTestUserID  = 987654321
+	rekeyTestChannel = 888888
+	rekeyOldKey      = "old secret"
+	rekeyNewKey      = "new secret"
+)
+
+type invokerFunc func(ctx context.Context, input bin.Encoder, output bin.Decoder) error
+
+func (f invokerFunc) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	return f(ctx, input, output)
+}
+
+// rekeyTestProcessor returns a processor for a fresh test user on the
+// database of the integration tests, skipping without one. Deleted messages
+// are appended to deleted.
+func rekeyTestProcessor(t *testing.T, deleted *[]int) *rekeyProcessor {
+	dsn := os.Getenv("TELDRIVE_DB_DATASOURCE")
+	if dsn == "" {
+		t.Skip("TELDRIVE_DB_DATASOURCE not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{TablePrefix: "teldrive.", SingularTable: false},
+		NowFunc:        func() time.Time { return time.Now().UTC() },
+		Logger:         logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+	require.NoError(t, database.MigrateDB(db))
+
+	oldNames, err := crypt.NewNameCipher(rekeyOldKey)
+	require.NoError(t, err)
+	newNames, err := crypt.NewNameCipher(rekeyNewKey)
+	require.NoError(t, err)
+	keyId, err := keyID(newNames)
+	require.NoError(t, err)
+
+	clean := func() {
+		db.Exec("DELETE FROM teldrive.rekeyed_parts WHERE key_id = ?", keyId)
+		for _, table := range []string{"file_versions", "files", "user_keys", "users"} {
+			db.Exec("DELETE FROM teldrive."+table+" WHERE user_id = ?", rekeyTestUserID)
+		}
+	}
+	clean()
+	t.Cleanup(clean)
+	require.NoError(t, db.Create(&models.User{UserId: rekeyTestUserID, Name: "rekey", UserName: "rekey"}).Error)
+
+	client := tg.NewClient(invokerFunc(func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		var result bin.Encoder
+		switch req := input.(type) {
+		case *tg.ChannelsGetChannelsRequest:
+			result = &tg.MessagesChats{Chats: []tg.ChatClass{&tg.Channel{ID: rekeyTestChannel, Photo: &tg.ChatPhotoEmpty{}}}}
+		case *tg.ChannelsDeleteMessagesRequest:
+			*deleted = append(*deleted, req.ID...)
+			result = &tg.MessagesAffectedMessages{}
+		default:
+			t.Fatalf("unexpected request %T", input)
+		}
+		var b bin.Buffer
+		if err := result.Encode(&b); err != nil {
+			return err
+		}
+		return output.Decode(&b)
+	}))
+
+	cfg := &config.RekeyCmdConfig{NewKey: rekeyNewKey}
+	cfg.TG.Uploads.EncryptionKey = rekeyOldKey
+	return &rekeyProcessor{
+		db:       db,
+		cfg:      cfg,
+		api:      client,
+		userId:   rekeyTestUserID,
+		keyId:    keyId,
+		oldNames: oldNames,
+		newNames: newNames,
+	}
+}
+
+func rekeyParts(id int, salt string) *datatypes.JSONSlice[api.Part] {
+	return &datatypes.JSONSlice[api.Part]{{ID: id, Salt: api.NewOptString(salt)}}
+}
+
+func createRekeyFile(t *testing.T, rp *rekeyProcessor, name string, parts *datatypes.JSONSlice[api.Part]) models.File {
+	file := models.File{
+		Name:      name,
+		Type:      "file",
+		MimeType:  "application/octet-stream",
+		Size:      utils.Ptr(int64(100)),
+		Encrypted: utils.Ptr(true),
+		UserId:    rekeyTestUserID,
+		Status:    "active",
+		Parts:     parts,
+		ChannelId: utils.Ptr(int64(rekeyTestChannel)),
+	}
+	require.NoError(t, rp.db.Create(&file).Error)
+	return file
+}
+
+func TestRekeyLoadContents(t *testing.T) {
+	rp := rekeyTestProcessor(t, &[]int{})
+
+	pending := createRekeyFile(t, rp, "pending.bin", rekeyParts(10, "salt"))
+	createRekeyFile(t, rp, "datakey.bin", rekeyParts(11, "user:salt"))
+	createRekeyFile(t, rp, "rekeyed.bin", rekeyParts(12, "salt"))
+	require.NoError(t, rp.db.Exec("INSERT INTO teldrive.rekeyed_parts (key_id, channel_id, part_id) VALUES (?, ?, ?)",
+		rp.keyId, rekeyTestChannel, 12).Error)
+	// A version sharing the parts of its file is the same content
+	require.NoError(t, rp.db.Create(&models.FileVersion{
+		FileId:    pending.ID,
+		UserId:    rekeyTestUserID,
+		Size:      utils.Ptr(int64(100)),
+		Parts:     rekeyParts(10, "salt"),
+		ChannelId: utils.Ptr(int64(rekeyTestChannel)),
+		Encrypted: utils.Ptr(true),
+	}).Error)
+
+	contents, err := rp.loadContents()
+	require.NoError(t, err)
+	require.Len(t, contents, 1)
+	assert.Equal(t, 10, contents[0].Parts[0].ID)
+	assert.Equal(t, int64(rekeyTestChannel), contents[0].ChannelId)
+}
+
+func TestRekeyCleanMarkers(t *testing.T) {
+	var deleted []int
+	rp := rekeyTestProcessor(t, &deleted)
+	marker := models.File{
+		Name:      rekeyMarker,
+		Type:      "file",
+		MimeType:  "application/octet-stream",
+		UserId:    rekeyTestUserID,
+		Status:    "pending_deletion",
+		Parts:     &datatypes.JSONSlice[api.Part]{{ID: 20}, {ID: 21}},
+		ChannelId: utils.Ptr(int64(rekeyTestChannel)),
+	}
+	require.NoError(t, rp.db.Create(&marker).Error)
+	// Files that are not markers stay
+	other := createRekeyFile(t, rp, "other.bin", rekeyParts(22, "salt"))
+
+	cleaned, err := rp.cleanMarkers(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, cleaned)
+	assert.Equal(t, []int{20, 21}, deleted)
+
+	var count int64
+	require.NoError(t, rp.db.Model(&models.File{}).Where("id = ?", marker.ID).Count(&count).Error)
+	assert.Zero(t, count)
+	require.NoError(t, rp.db.Model(&models.File{}).Where("id = ?", other.ID).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestRekeyNamesResume(t *testing.T) {
+	rp := rekeyTestProcessor(t, &[]int{})
+	oldName, err := rp.oldNames.EncryptName("report.pdf")
+	require.NoError(t, err)
+	file := createRekeyFile(t, rp, oldName, rekeyParts(30, "salt"))
+	require.NoError(t, rp.db.Model(&models.File{}).Where("id = ?", file.ID).Update("name_encrypted", true).Error)
+
+	count, err := rp.rekeyNames(true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = rp.rekeyNames(false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// A second run leaves names converted by the first alone, even those
+	// the old key would decrypt as well
+	count, err = rp.rekeyNames(false)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	var stored models.File
+	require.NoError(t, rp.db.Where("id = ?", file.ID).First(&stored).Error)
+	plain, err := rp.newNames.DecryptName(stored.Name)
+	require.NoError(t, err)
+	assert.Equal(t, "report.pdf", plain)
+}
+
+func TestRekeyDataKey(t *testing.T) {
+	rp := rekeyTestProcessor(t, &[]int{})
+	dataKey, err := crypt.NewSalt()
+	require.NoError(t, err)
+	wrapped, salt, err := crypt.WrapKey(dataKey, rekeyOldKey)
+	require.NoError(t, err)
+	require.NoError(t, rp.db.Create(&models.UserKey{
+		UserId:     rekeyTestUserID,
+		WrappedKey: wrapped,
+		Salt:       salt,
+		Protection: "master",
+	}).Error)
+
+	rewrapped, err := rp.rekeyDataKey(true)
+	require.NoError(t, err)
+	assert.True(t, rewrapped)
+
+	rewrapped, err = rp.rekeyDataKey(false)
+	require.NoError(t, err)
+	assert.True(t, rewrapped)
+
+	var userKey models.UserKey
+	require.NoError(t, rp.db.Where("user_id = ?", rekeyTestUserID).First(&userKey).Error)
+	key, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, rekeyNewKey)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, key)
+
+	// A key already wrapped with the new key is left as it is
+	rewrapped, err = rp.rekeyDataKey(false)
+	require.NoError(t, err)
+	assert.False(t, rewrapped)
+	var again models.UserKey
+	require.NoError(t, rp.db.Where("user_id = ?", rekeyTestUserID).First(&again).Error)
+	assert.Equal(t, userKey.WrappedKey, again.WrappedKey)
+}
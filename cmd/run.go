@@ -128,6 +128,9 @@ func runApplication(ctx context.Context, conf *config.ServerCmdConfig) {
 		redisClient = client
 		cacher = cache.NewCache(bgCtx, conf.Cache.MaxSize, redisClient, lg)
 		botSelector = tgc.NewBotSelector(redisClient)
+		if conf.TG.BotSelection == "health" {
+			botSelector = tgc.NewHealthBotSelector(redisClient)
+		}
 		redisOnce.Do(func() { close(redisReady) })
 	}()
 
@@ -192,7 +195,7 @@ func runApplication(ctx context.Context, conf *config.ServerCmdConfig) {
 	// Start cron jobs in background if enabled
 	if conf.CronJobs.Enable {
 		go func() {
-			if err := cron.StartCronJobs(bgCtx, db, conf); err != nil {
+			if err := cron.StartCronJobs(bgCtx, db, conf, cacher, eventBroadcaster); err != nil {
 				lg.Error("cron.init.failed", zap.Error(err))
 				initErrCh <- fmt.Errorf("cron scheduler failed: %w", err)
 				return
@@ -252,7 +255,8 @@ func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, l
 		return nil // unreachable but required for compilation
 	}
 
-	extendedSrv := services.NewExtendedMiddleware(srv, services.NewExtendedService(apiSrv))
+	extendedSvc := services.NewExtendedService(apiSrv)
+	extendedSrv := services.NewExtendedMiddleware(srv, extendedSvc)
 
 	mux := chi.NewRouter()
 
@@ -260,8 +264,11 @@ func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, l
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "HEAD"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type"},
-		MaxAge:         86400,
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "Tus-Resumable", "Upload-Length",
+			"Upload-Offset", "Upload-Metadata", "Upload-Checksum", "Upload-Defer-Length"},
+		ExposedHeaders: []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+			"Tus-Checksum-Algorithm", "Upload-Offset", "Upload-Length", "Upload-Expires"},
+		MaxAge: 86400,
 	}))
 	mux.Use(chimiddleware.RealIP)
 	mux.Use(middleware.InjectLogger(lg))
@@ -273,6 +280,12 @@ func setupServer(cfg *config.ServerCmdConfig, db *gorm.DB, cache cache.Cacher, l
 	}))
 	mux.Use(appcontext.Middleware)
 	mux.Mount("/api/", http.StripPrefix("/api", extendedSrv))
+	if cfg.WebDAV.Enable {
+		mux.Mount("/webdav", services.NewWebDAVHandler(extendedSvc, "/webdav"))
+	}
+	if cfg.S3.Enable {
+		mux.Mount("/s3", services.NewS3Handler(extendedSvc, "/s3"))
+	}
 	mux.Handle("/*", middleware.SPAHandler(ui.StaticFS))
 
 	return &http.Server{
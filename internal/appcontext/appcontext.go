@@ -19,6 +19,23 @@ func newAppContext(w http.ResponseWriter, r *http.Request) *Context {
 	}
 }
 
+type contextKey struct{}
+
+// Value makes the request context reachable through contexts derived from
+// it, see FromContext.
+func (c *Context) Value(key any) any {
+	if key == (contextKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+// FromContext returns the request context ctx was derived from.
+func FromContext(ctx context.Context) (*Context, bool) {
+	c, ok := ctx.Value(contextKey{}).(*Context)
+	return c, ok
+}
+
 func (c *Context) Write(code int, message string) {
 	c.Writer.WriteHeader(code)
 	c.Writer.Write([]byte(message))
@@ -58,6 +58,12 @@ func GetJWTUser(c context.Context) *types.JWTClaims {
 	return authUser
 }
 
+// WithUser returns a copy of ctx carrying the authenticated user claims, for
+// handlers that are served outside of the generated security handler.
+func WithUser(ctx context.Context, claims *types.JWTClaims) context.Context {
+	return context.WithValue(ctx, authKey, claims)
+}
+
 func VerifyUser(ctx context.Context, db *gorm.DB, cache cache.Cacher, secret, authCookie string) (*types.JWTClaims, error) {
 	claims, err := Decode(secret, authCookie)
 
@@ -114,7 +120,7 @@ func (s *securityHandler) handleAuth(ctx context.Context, token string) (context
 	if err != nil {
 		return nil, &ogenerrors.SecurityError{Err: err}
 	}
-	return context.WithValue(ctx, authKey, claims), nil
+	return WithUser(ctx, claims), nil
 }
 
 func NewSecurityHandler(db *gorm.DB, cache cache.Cacher, cfg *config.JWTConfig) api.SecurityHandler {
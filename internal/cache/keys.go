@@ -22,6 +22,10 @@ func KeyFileMessages(fileID string) string {
 	return Key("files", "messages", fileID)
 }
 
+func KeyFileVersion(versionID string) string {
+	return Key("files", "versions", versionID)
+}
+
 func KeyFileLocation(instance, botID, fileID string, partID any) string {
 	return Key("files", "location", "bot", "instance", fileID, partID, botID, instance)
 }
@@ -58,6 +58,14 @@ type ServerCmdConfig struct {
 	Cache    CacheConfig
 	Redis    RedisConfig
 	Events   EventConfig
+	Files    FilesConfig
+	WebDAV   WebDAVConfig `koanf:"webdav"`
+	S3       S3Config
+	Tus      TusConfig
+	Imports  ImportConfig
+	Scrub    ScrubConfig
+	Quota    QuotaConfig
+	Keys     KeysConfig
 }
 
 type CheckCmdConfig struct {
@@ -72,6 +80,17 @@ type CheckCmdConfig struct {
 	CleanPending bool          `default:"false" description:"Clean files with pending_deletion status"`
 }
 
+type RekeyCmdConfig struct {
+	Log        LoggingConfig `skipPflag:"true"`
+	DB         DBConfig      `skipPflag:"true"`
+	TG         TGConfig      `skipPflag:"true"`
+	Keys       KeysConfig    `skipPflag:"true"`
+	NewKey     string        `default:"" description:"Encryption key to re-encrypt files with"`
+	DryRun     bool          `default:"false" description:"List the files to re-encrypt without making changes"`
+	User       string        `default:"" description:"Telegram username to rekey (prompts if not specified)"`
+	Concurrent int           `default:"4" description:"Number of files re-encrypted at the same time"`
+}
+
 type ServerConfig struct {
 	Port             int           `default:"8080" description:"HTTP port for the server to listen on"`
 	GracefulShutdown time.Duration `default:"10s" description:"Grace period for server shutdown"`
@@ -147,23 +166,83 @@ type DBConfig struct {
 	Pool        DBPool
 }
 
+type FilesConfig struct {
+	Dedup            bool          `default:"false" description:"Reuse the parts of identical files (same hash and size) instead of storing duplicates"`
+	EncryptNames     bool          `default:"false" description:"Store the names of encrypted files and of folders encrypted with the name cipher"`
+	TrashRetention   time.Duration `default:"30d" description:"How long trashed files are kept before being purged (0 = keep forever)"`
+	MaxVersions      int           `default:"10" description:"Maximum previous versions kept per file (0 = unlimited)"`
+	VersionRetention time.Duration `default:"30d" description:"How long previous file versions are kept (0 = keep forever)"`
+}
+
+type WebDAVConfig struct {
+	Enable   bool  `default:"false" description:"Serve the file tree over WebDAV at /webdav"`
+	PartSize int64 `default:"536870912" description:"Size of the parts files written over WebDAV are uploaded in (multiple of 16MB)"`
+}
+
+type S3Config struct {
+	Enable   bool  `default:"false" description:"Serve an S3 compatible API at /s3"`
+	PartSize int64 `default:"536870912" description:"Size of the parts objects written with PutObject are uploaded in (multiple of 16MB)"`
+}
+
+type TusConfig struct {
+	PartSize int64  `default:"536870912" description:"Size of the parts tus uploads are stored in (multiple of 16MB)"`
+	MaxSize  int64  `default:"0" description:"Maximum size of a tus upload in bytes (0 = unlimited)"`
+	SpoolDir string `default:"" description:"Directory a tus request buffers the part it receives in until it is stored (empty for the system temp directory)"`
+}
+
+type ImportConfig struct {
+	MaxJobs              int  `default:"4" description:"Number of URL imports run at the same time"`
+	MaxRetries           int  `default:"10" description:"Attempts to resume an interrupted URL import"`
+	AllowPrivateNetworks bool `default:"false" description:"Allow importing from loopback and private network addresses"`
+}
+
+type KeysConfig struct {
+	PerUser    bool          `default:"false" description:"Encrypt uploads with a data key of their own for every user"`
+	MasterKey  string        `default:"" description:"Key that wraps the data keys of users without a passphrase (defaults to the upload encryption key)"`
+	UnlockIdle time.Duration `default:"15m" description:"How long a data key unlocked with a passphrase stays in memory unused"`
+}
+
+type QuotaConfig struct {
+	MaxSize  int64    `default:"0" description:"Default storage quota per user in bytes (0 = unlimited)"`
+	MaxFiles int64    `default:"0" description:"Default maximum number of files per user (0 = unlimited)"`
+	Admins   []string `default:"" description:"Telegram usernames allowed to set the quotas of users"`
+}
+
+type ScrubConfig struct {
+	Enable    bool          `default:"false" description:"Periodically read back stored files and check them against their hash"`
+	Interval  time.Duration `default:"1h" description:"Interval between scrub runs"`
+	BatchSize int           `default:"20" description:"Maximum number of files verified per run"`
+	Rate      int64         `default:"8388608" description:"Maximum scrub read rate in bytes per second (0 = unlimited)"`
+	MaxAge    time.Duration `default:"30d" description:"How long a verification is trusted before the file is checked again"`
+}
+
 type CronJobConfig struct {
-	Enable               bool          `default:"true" description:"Enable scheduled background jobs"`
-	LockerInstance       string        `default:"cron-locker" description:"Distributed unique cron locker name"`
-	CleanFilesInterval   time.Duration `default:"1h" description:"Interval for cleaning expired files"`
-	CleanUploadsInterval time.Duration `default:"12h" description:"Interval for cleaning incomplete uploads"`
-	FolderSizeInterval   time.Duration `default:"2h" description:"Interval for updating folder sizes"`
+	Enable                bool          `default:"true" description:"Enable scheduled background jobs"`
+	LockerInstance        string        `default:"cron-locker" description:"Distributed unique cron locker name"`
+	CleanFilesInterval    time.Duration `default:"1h" description:"Interval for cleaning expired files"`
+	CleanUploadsInterval  time.Duration `default:"12h" description:"Interval for cleaning incomplete uploads"`
+	FolderSizeInterval    time.Duration `default:"2h" description:"Interval for updating folder sizes"`
+	CleanVersionsInterval time.Duration `default:"6h" description:"Interval for removing expired file versions"`
+	CheckBotsInterval     time.Duration `default:"24h" description:"Interval for checking bot tokens and disabling dead bots"`
 }
 
 type TGStream struct {
-	Concurrency  int           `default:"1" description:"Number of concurrent threads for concurrent reader"`
-	Buffers      int           `default:"8" description:"Number of stream buffers"`
-	ChunkTimeout time.Duration `default:"30s" description:"Chunk download timeout"`
-	BotsLimit    int           `default:"0" description:"Maximum number of bots for streaming (0 = use all bots)"`
+	Concurrency    int           `default:"1" description:"Number of concurrent threads for concurrent reader"`
+	Adaptive       bool          `default:"false" description:"Tune the number of concurrent threads per bot from the measured throughput"`
+	MinConcurrency int           `default:"1" description:"Minimum number of concurrent threads when adaptive"`
+	MaxConcurrency int           `default:"8" description:"Maximum number of concurrent threads when adaptive"`
+	Buffers        int           `default:"8" description:"Number of stream buffers"`
+	ChunkTimeout   time.Duration `default:"30s" description:"Chunk download timeout"`
+	BotsLimit      int           `default:"0" description:"Maximum number of bots for streaming (0 = use all bots)"`
+	Striped        bool          `default:"false" description:"Download the chunks of a stream through all streaming bots at once"`
+	CacheDir       string        `default:"" description:"Directory downloaded chunks are cached in (empty to disable the chunk cache)"`
+	CacheSize      int64         `default:"1073741824" description:"Maximum size of the chunk cache in bytes"`
+	Prefetch       int           `default:"2" description:"Number of chunks read ahead into the chunk cache"`
 }
 
 type TGUpload struct {
 	EncryptionKey string        `default:"" description:"Encryption key for uploads"`
+	EncryptNames  bool          `default:"false" description:"Encrypt the Telegram file names of encrypted parts"`
 	Threads       int           `default:"8" description:"Number of upload threads"`
 	MaxRetries    int           `default:"10" description:"Maximum upload retry attempts"`
 	Retention     time.Duration `default:"7d" description:"Upload retention period"`
@@ -187,6 +266,7 @@ type TGConfig struct {
 	LangPack          string        `default:"webk" description:"Language pack"`
 	SessionInstance   string        `default:"teldrive" description:"Bot session instance name for multi-instance deployments"`
 	AutoChannelCreate bool          `default:"true" description:"Auto Create Channel"`
+	BotSelection      string        `default:"round-robin" description:"How bots are picked for uploads and streams: round-robin or health"`
 	ChannelLimit      int64         `default:"500000" description:"Channel message limit before auto channel creation"`
 	Uploads           TGUpload
 	Stream            TGStream
@@ -57,6 +57,8 @@ func TestConfigLoader_LoadDefaults(t *testing.T) {
 	assert.Equal(t, time.Hour, cfg.CronJobs.CleanFilesInterval)
 	assert.Equal(t, 12*time.Hour, cfg.CronJobs.CleanUploadsInterval)
 	assert.Equal(t, 2*time.Hour, cfg.CronJobs.FolderSizeInterval)
+	assert.Equal(t, 6*time.Hour, cfg.CronJobs.CleanVersionsInterval)
+	assert.Equal(t, 24*time.Hour, cfg.CronJobs.CheckBotsInterval)
 	assert.Equal(t, true, cfg.TG.RateLimit)
 	assert.Equal(t, 5, cfg.TG.RateBurst)
 	assert.Equal(t, 100, cfg.TG.Rate)
@@ -64,13 +66,48 @@ func TestConfigLoader_LoadDefaults(t *testing.T) {
 	assert.Equal(t, 8, cfg.TG.PoolSize)
 	assert.Equal(t, true, cfg.TG.AutoChannelCreate)
 	assert.Equal(t, int64(500000), cfg.TG.ChannelLimit)
+	assert.Equal(t, "round-robin", cfg.TG.BotSelection)
 	assert.Equal(t, 1, cfg.TG.Stream.Concurrency)
 	assert.Equal(t, 8, cfg.TG.Stream.Buffers)
 	assert.Equal(t, 30*time.Second, cfg.TG.Stream.ChunkTimeout)
+	assert.Equal(t, "", cfg.TG.Stream.CacheDir)
+	assert.Equal(t, int64(1073741824), cfg.TG.Stream.CacheSize)
+	assert.Equal(t, 2, cfg.TG.Stream.Prefetch)
+	assert.False(t, cfg.TG.Stream.Adaptive)
+	assert.Equal(t, 1, cfg.TG.Stream.MinConcurrency)
+	assert.Equal(t, 8, cfg.TG.Stream.MaxConcurrency)
+	assert.False(t, cfg.TG.Stream.Striped)
 	assert.Equal(t, 8, cfg.TG.Uploads.Threads)
 	assert.Equal(t, 10, cfg.TG.Uploads.MaxRetries)
 	assert.Equal(t, 7*24*time.Hour, cfg.TG.Uploads.Retention)
+	assert.Equal(t, false, cfg.TG.Uploads.EncryptNames)
 	assert.Equal(t, 30*24*time.Hour, cfg.JWT.SessionTime)
+	assert.Equal(t, false, cfg.Files.Dedup)
+	assert.Equal(t, false, cfg.Files.EncryptNames)
+	assert.Equal(t, 30*24*time.Hour, cfg.Files.TrashRetention)
+	assert.Equal(t, 10, cfg.Files.MaxVersions)
+	assert.Equal(t, 30*24*time.Hour, cfg.Files.VersionRetention)
+	assert.Equal(t, false, cfg.WebDAV.Enable)
+	assert.Equal(t, int64(512*1024*1024), cfg.WebDAV.PartSize)
+	assert.Equal(t, false, cfg.S3.Enable)
+	assert.Equal(t, int64(512*1024*1024), cfg.S3.PartSize)
+	assert.Equal(t, int64(512*1024*1024), cfg.Tus.PartSize)
+	assert.Equal(t, int64(0), cfg.Tus.MaxSize)
+	assert.Equal(t, "", cfg.Tus.SpoolDir)
+	assert.Equal(t, 4, cfg.Imports.MaxJobs)
+	assert.Equal(t, 10, cfg.Imports.MaxRetries)
+	assert.Equal(t, false, cfg.Imports.AllowPrivateNetworks)
+	assert.Equal(t, false, cfg.Keys.PerUser)
+	assert.Equal(t, "", cfg.Keys.MasterKey)
+	assert.Equal(t, 15*time.Minute, cfg.Keys.UnlockIdle)
+	assert.Equal(t, int64(0), cfg.Quota.MaxSize)
+	assert.Equal(t, int64(0), cfg.Quota.MaxFiles)
+	assert.Empty(t, cfg.Quota.Admins)
+	assert.Equal(t, false, cfg.Scrub.Enable)
+	assert.Equal(t, time.Hour, cfg.Scrub.Interval)
+	assert.Equal(t, 20, cfg.Scrub.BatchSize)
+	assert.Equal(t, int64(8388608), cfg.Scrub.Rate)
+	assert.Equal(t, 30*24*time.Hour, cfg.Scrub.MaxAge)
 
 	// Redis config defaults
 	assert.Equal(t, "", cfg.Redis.Addr)
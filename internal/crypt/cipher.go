@@ -6,6 +6,8 @@ import (
 	"crypto/aes"
 	gocipher "crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -24,6 +26,7 @@ const (
 	blockHeaderSize     = secretbox.Overhead
 	blockDataSize       = 64 * 1024
 	blockSize           = blockHeaderSize + blockDataSize
+	saltLength          = 32
 )
 
 var (
@@ -64,6 +67,16 @@ type Cipher struct {
 	cryptoRand io.Reader
 }
 
+// NewSalt returns a random salt for the content of a new part.
+func NewSalt() (string, error) {
+	randomBytes := make([]byte, saltLength)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(randomBytes)
+	return base64.URLEncoding.EncodeToString(sum[:]), nil
+}
+
 func NewCipher(password, salt string) (*Cipher, error) {
 	c := &Cipher{
 		cryptoRand: rand.Reader,
@@ -81,6 +94,9 @@ func NewCipher(password, salt string) (*Cipher, error) {
 func (c *Cipher) Key(password, salt string) (err error) {
 	const keySize = len(c.dataKey) + len(c.nameKey) + len(c.nameTweak)
 	saltBytes := []byte(salt)
+	if salt == RcloneSalt {
+		saltBytes = []byte(nameSalt)
+	}
 	key, err := scrypt.Key([]byte(password), saltBytes, 16384, 8, 1, keySize)
 	if err != nil {
 		return err
@@ -168,13 +184,13 @@ type encrypter struct {
 	err      error
 }
 
-func (c *Cipher) newEncrypter(in io.Reader, nonce *nonce) (*encrypter, error) {
+func (c *Cipher) newEncrypter(in io.Reader, nonce *nonce, magic []byte) (*encrypter, error) {
 	fh := &encrypter{
 		in:      in,
 		c:       c,
 		buf:     c.getBlock(),
 		readBuf: c.getBlock(),
-		bufSize: fileHeaderSize,
+		bufSize: len(magic) + fileNonceSize,
 	}
 
 	if nonce != nil {
@@ -186,9 +202,9 @@ func (c *Cipher) newEncrypter(in io.Reader, nonce *nonce) (*encrypter, error) {
 		}
 	}
 
-	copy((*fh.buf)[:], fileMagicBytes)
+	copy((*fh.buf)[:], magic)
 
-	copy((*fh.buf)[fileMagicSize:], fh.nonce[:])
+	copy((*fh.buf)[len(magic):], fh.nonce[:])
 	return fh, nil
 }
 
@@ -234,7 +250,7 @@ func (fh *encrypter) Close() error {
 }
 
 func (c *Cipher) EncryptData(in io.Reader) (io.ReadCloser, error) {
-	return c.newEncrypter(in, nil)
+	return c.newEncrypter(in, nil, fileMagicBytes)
 }
 
 type decrypter struct {
@@ -0,0 +1,100 @@
+package crypt
+
+import (
+	gocipher "crypto/cipher"
+)
+
+// EME (ECB-Mix-ECB) is the wide-block cipher mode of Halevi and Rogaway used
+// to encrypt names. It is deterministic, so equal names encrypt equally, and
+// every output byte depends on every input byte. Input must be a non-empty
+// multiple of the block size of at most 128 blocks.
+
+type emeDirection bool
+
+const (
+	emeDecrypt emeDirection = false
+	emeEncrypt emeDirection = true
+)
+
+// emeMultByTwo doubles in in GF(2^128) as defined by EME.
+func emeMultByTwo(out, in []byte) {
+	var tmp [16]byte
+	tmp[0] = 2 * in[0]
+	if in[15] >= 128 {
+		tmp[0] ^= 135
+	}
+	for j := 1; j < 16; j++ {
+		tmp[j] = 2 * in[j]
+		if in[j-1] >= 128 {
+			tmp[j]++
+		}
+	}
+	copy(out, tmp[:])
+}
+
+func emeXor(out, a, b []byte) {
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+}
+
+func emeBlock(bc gocipher.Block, dst, src []byte, direction emeDirection) {
+	if direction == emeEncrypt {
+		bc.Encrypt(dst, src)
+	} else {
+		bc.Decrypt(dst, src)
+	}
+}
+
+// emeTransform encrypts or decrypts data with bc and the 16 byte tweak.
+func emeTransform(bc gocipher.Block, tweak, data []byte, direction emeDirection) []byte {
+	const n = 16
+	m := len(data) / n
+	if m == 0 || m > n*8 || len(data)%n != 0 || len(tweak) != n {
+		panic("eme: invalid input size")
+	}
+
+	// L_j = 2^(j+1) * E(0)
+	lTable := make([][]byte, m)
+	li := make([]byte, n)
+	bc.Encrypt(li, make([]byte, n))
+	for j := range m {
+		emeMultByTwo(li, li)
+		lTable[j] = append([]byte(nil), li...)
+	}
+
+	out := make([]byte, len(data))
+	ppj := make([]byte, n)
+	for j := range m {
+		emeXor(ppj, data[j*n:(j+1)*n], lTable[j])
+		emeBlock(bc, out[j*n:(j+1)*n], ppj, direction)
+	}
+
+	mp := make([]byte, n)
+	emeXor(mp, out[:n], tweak)
+	for j := 1; j < m; j++ {
+		emeXor(mp, mp, out[j*n:(j+1)*n])
+	}
+	mc := make([]byte, n)
+	emeBlock(bc, mc, mp, direction)
+	mask := make([]byte, n)
+	emeXor(mask, mp, mc)
+	for j := 1; j < m; j++ {
+		emeMultByTwo(mask, mask)
+		emeXor(out[j*n:(j+1)*n], out[j*n:(j+1)*n], mask)
+	}
+
+	first := make([]byte, n)
+	emeXor(first, mc, tweak)
+	for j := 1; j < m; j++ {
+		emeXor(first, first, out[j*n:(j+1)*n])
+	}
+	copy(out[:n], first)
+
+	for j := range m {
+		block := out[j*n : (j+1)*n]
+		emeBlock(bc, block, block, direction)
+		emeXor(block, block, lTable[j])
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package crypt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrKeyLocked     = errors.New("encryption key is locked")
+	ErrBadPassphrase = errors.New("wrong passphrase or master key")
+)
+
+// userSaltPrefix marks the salts of parts encrypted with a per-user data key
+// rather than the instance encryption key.
+const userSaltPrefix = "user:"
+
+const dataKeySize = 32
+
+type dataKeyCtxKey struct{}
+
+// UserSalt marks salt as belonging to a part encrypted with a data key.
+func UserSalt(salt string) string {
+	return userSaltPrefix + salt
+}
+
+// IsUserSalt reports whether salt belongs to a part encrypted with a data key.
+func IsUserSalt(salt string) bool {
+	return strings.HasPrefix(salt, userSaltPrefix)
+}
+
+// NewDataKey returns a random data key, used in place of the instance
+// encryption key for the content of a single user.
+func NewDataKey() (string, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// WrapKey seals dataKey with a key-encryption key derived from kek, which is
+// either the master key or a passphrase. It returns the sealed key and the
+// salt the key-encryption key was derived with.
+func WrapKey(dataKey, kek string) (wrapped, salt string, err error) {
+	if salt, err = NewSalt(); err != nil {
+		return "", "", err
+	}
+	key, err := deriveKEK(kek, salt)
+	if err != nil {
+		return "", "", err
+	}
+	var n [fileNonceSize]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return "", "", err
+	}
+	sealed := secretbox.Seal(n[:], []byte(dataKey), &n, key)
+	return base64.RawURLEncoding.EncodeToString(sealed), salt, nil
+}
+
+// UnwrapKey opens a data key sealed by WrapKey.
+func UnwrapKey(wrapped, salt, kek string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < fileNonceSize {
+		return "", ErrBadPassphrase
+	}
+	key, err := deriveKEK(kek, salt)
+	if err != nil {
+		return "", err
+	}
+	var n [fileNonceSize]byte
+	copy(n[:], sealed)
+	dataKey, ok := secretbox.Open(nil, sealed[fileNonceSize:], &n, key)
+	if !ok {
+		return "", ErrBadPassphrase
+	}
+	return string(dataKey), nil
+}
+
+func deriveKEK(kek, salt string) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(kek), []byte(salt), 16384, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// WithDataKey returns a copy of ctx carrying the data key of the user whose
+// files are read with it.
+func WithDataKey(ctx context.Context, dataKey string) context.Context {
+	return context.WithValue(ctx, dataKeyCtxKey{}, dataKey)
+}
+
+// DataKey returns the data key carried by ctx.
+func DataKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(dataKeyCtxKey{}).(string)
+	return key, ok && key != ""
+}
+
+// PartKey returns the password the part with salt was encrypted with: the
+// data key in ctx for user salts, defaultKey otherwise.
+func PartKey(ctx context.Context, salt, defaultKey string) (string, error) {
+	if !IsUserSalt(salt) {
+		return defaultKey, nil
+	}
+	key, ok := DataKey(ctx)
+	if !ok {
+		return "", ErrKeyLocked
+	}
+	return key, nil
+}
@@ -0,0 +1,51 @@
+package crypt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapKey(t *testing.T) {
+	dataKey, err := NewDataKey()
+	require.NoError(t, err)
+
+	wrapped, salt, err := WrapKey(dataKey, "passphrase")
+	require.NoError(t, err)
+	assert.NotContains(t, wrapped, dataKey)
+
+	got, err := UnwrapKey(wrapped, salt, "passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, got)
+
+	_, err = UnwrapKey(wrapped, salt, "other")
+	assert.ErrorIs(t, err, ErrBadPassphrase)
+	_, err = UnwrapKey("not base64!", salt, "passphrase")
+	assert.ErrorIs(t, err, ErrBadPassphrase)
+
+	again, _, err := WrapKey(dataKey, "passphrase")
+	require.NoError(t, err)
+	assert.NotEqual(t, wrapped, again)
+}
+
+func TestPartKey(t *testing.T) {
+	salt, err := NewSalt()
+	require.NoError(t, err)
+	userSalt := UserSalt(salt)
+	assert.True(t, IsUserSalt(userSalt))
+	assert.False(t, IsUserSalt(salt))
+
+	key, err := PartKey(context.Background(), salt, "instance")
+	require.NoError(t, err)
+	assert.Equal(t, "instance", key)
+
+	_, err = PartKey(context.Background(), userSalt, "instance")
+	assert.ErrorIs(t, err, ErrKeyLocked)
+
+	ctx := WithDataKey(context.Background(), "data")
+	key, err = PartKey(ctx, userSalt, "instance")
+	require.NoError(t, err)
+	assert.Equal(t, "data", key)
+}
@@ -0,0 +1,100 @@
+package crypt
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrorNotAnEncryptedName = errors.New("not an encrypted name")
+	ErrorBadNamePadding     = errors.New("bad padding on encrypted name")
+	ErrorNameTooLong        = errors.New("name too long to encrypt")
+)
+
+// nameSalt derives the name cipher. Names have to encrypt the same way for
+// every file, so unlike content they use one fixed salt per key. It is
+// rclone's default salt, so names match those of an rclone crypt remote with
+// the same password and no salt.
+const nameSalt = "\xa8\x0d\xf4\x3a\x8f\xbd\x03\x08\xa7\xca\xb8\x3e\x58\x1f\x86\xb1"
+
+// maxNameBlocks is the longest name EME can encrypt, in cipher blocks.
+const maxNameBlocks = 128
+
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NewNameCipher returns the cipher names are encrypted with under password.
+func NewNameCipher(password string) (*Cipher, error) {
+	return NewCipher(password, nameSalt)
+}
+
+// EncryptName encrypts a single path segment: PKCS#7 padded, EME encrypted
+// and base32hex encoded in lower case. Equal names give equal results.
+func (c *Cipher) EncryptName(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	padding := nameCipherBlockSize - len(name)%nameCipherBlockSize
+	if (len(name)+padding)/nameCipherBlockSize > maxNameBlocks {
+		return "", ErrorNameTooLong
+	}
+	padded := make([]byte, len(name)+padding)
+	copy(padded, name)
+	for i := len(name); i < len(padded); i++ {
+		padded[i] = byte(padding)
+	}
+	ciphertext := emeTransform(c.block, c.nameTweak[:], padded, emeEncrypt)
+	return strings.ToLower(nameEncoding.EncodeToString(ciphertext)), nil
+}
+
+// DecryptName reverses EncryptName.
+func (c *Cipher) DecryptName(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	ciphertext, err := nameEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil {
+		return "", ErrorNotAnEncryptedName
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%nameCipherBlockSize != 0 ||
+		len(ciphertext)/nameCipherBlockSize > maxNameBlocks {
+		return "", ErrorNotAnEncryptedName
+	}
+	padded := emeTransform(c.block, c.nameTweak[:], ciphertext, emeDecrypt)
+	padding := int(padded[len(padded)-1])
+	if padding == 0 || padding > nameCipherBlockSize {
+		return "", ErrorBadNamePadding
+	}
+	for _, b := range padded[len(padded)-padding:] {
+		if int(b) != padding {
+			return "", ErrorBadNamePadding
+		}
+	}
+	return string(padded[:len(padded)-padding]), nil
+}
+
+// EncryptPath encrypts every segment of a slash separated path.
+func (c *Cipher) EncryptPath(path string) (string, error) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		encrypted, err := c.EncryptName(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = encrypted
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// DecryptPath decrypts every segment of a path made by EncryptPath.
+func (c *Cipher) DecryptPath(path string) (string, error) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		decrypted, err := c.DecryptName(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = decrypted
+	}
+	return strings.Join(segments, "/"), nil
+}
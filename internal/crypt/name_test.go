@@ -0,0 +1,63 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// zeroKeyCipher has all keys zero, which rclone uses for an empty password,
+// so its output can be compared with rclone's.
+func zeroKeyCipher(t *testing.T) *Cipher {
+	c := &Cipher{}
+	var err error
+	c.block, err = aes.NewCipher(c.nameKey[:])
+	require.NoError(t, err)
+	return c
+}
+
+func TestEncryptNameVectors(t *testing.T) {
+	c := zeroKeyCipher(t)
+	for plain, want := range map[string]string{
+		"1":        "p0e52nreeaj0a5ea7s64m4j72s",
+		"1/12":     "p0e52nreeaj0a5ea7s64m4j72s/l42g6771hnv3an9cgc8cr2n1ng",
+		"1/12/123": "p0e52nreeaj0a5ea7s64m4j72s/l42g6771hnv3an9cgc8cr2n1ng/qgm4avr35m5loi1th53ato71v0",
+	} {
+		got, err := c.EncryptPath(plain)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		back, err := c.DecryptPath(got)
+		require.NoError(t, err)
+		assert.Equal(t, plain, back)
+	}
+}
+
+func TestNameRoundTrip(t *testing.T) {
+	c, err := NewNameCipher("secret")
+	require.NoError(t, err)
+	for _, name := range []string{"a", "exactly16bytes!!", "report final (2).pdf", "ünïcødé 文件", strings.Repeat("x", 1000)} {
+		encrypted, err := c.EncryptName(name)
+		require.NoError(t, err)
+		assert.NotEqual(t, name, encrypted)
+		again, err := c.EncryptName(name)
+		require.NoError(t, err)
+		assert.Equal(t, encrypted, again, "encryption is deterministic")
+		decrypted, err := c.DecryptName(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, name, decrypted)
+	}
+}
+
+func TestDecryptNameRejectsPlaintext(t *testing.T) {
+	c, err := NewNameCipher("secret")
+	require.NoError(t, err)
+	for _, name := range []string{"report.pdf", "hello", "p0e52nreeaj0a5ea7s64m4j72s"} {
+		_, err := c.DecryptName(name)
+		assert.Error(t, err, name)
+	}
+	_, err = c.EncryptName(strings.Repeat("x", maxNameBlocks*nameCipherBlockSize))
+	assert.ErrorIs(t, err, ErrorNameTooLong)
+}
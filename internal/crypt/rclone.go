@@ -0,0 +1,171 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Content encrypts the same way as in rclone crypt objects, only the header
+// differs: rclone has its own magic string and derives the data key from the
+// password and a fixed salt rather than a salt per part. Parts recorded with
+// RcloneSalt use rclone's key, so their blocks can be moved between the two
+// formats as they are.
+const (
+	// RcloneSalt is the salt recorded for parts encrypted with the key of an
+	// rclone crypt remote.
+	RcloneSalt = "rclone"
+
+	// EncryptedBlockSize is the size of an encrypted block. Objects are only
+	// split into parts at whole blocks.
+	EncryptedBlockSize = blockSize
+
+	// RcloneHeaderSize is the size of the header of an rclone crypt object.
+	RcloneHeaderSize = len(rcloneMagic) + fileNonceSize
+
+	rcloneMagic = "RCLONE\x00\x00"
+)
+
+var (
+	ErrorRcloneBadMagic = errors.New("not an rclone crypt object - bad magic string")
+	ErrorRcloneNonce    = errors.New("parts are not consecutive blocks of one object")
+)
+
+// NewRcloneCipher returns the cipher of an rclone crypt remote with password
+// and no salt (password2). Objects and names it encrypts can be read by the
+// remote and the other way round.
+func NewRcloneCipher(password string) (*Cipher, error) {
+	return NewCipher(password, RcloneSalt)
+}
+
+// RcloneSize returns the size of the rclone crypt object holding size bytes
+// of content.
+func RcloneSize(size int64) int64 {
+	return EncryptedSize(size) - int64(fileHeaderSize-RcloneHeaderSize)
+}
+
+// PartSize returns the size of an encrypted part holding n bytes of blocks.
+func PartSize(n int64) int64 {
+	return int64(fileHeaderSize) + n
+}
+
+// EncryptRclone encrypts in as an rclone crypt object.
+func (c *Cipher) EncryptRclone(in io.Reader) (io.ReadCloser, error) {
+	return c.newEncrypter(in, nil, []byte(rcloneMagic))
+}
+
+// RcloneHeader is the header of an rclone crypt object.
+type RcloneHeader struct {
+	nonce nonce
+}
+
+// ReadRcloneHeader reads the header of an rclone crypt object, leaving r at
+// its first block.
+func ReadRcloneHeader(r io.Reader) (*RcloneHeader, error) {
+	var buf [RcloneHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrorEncryptedFileTooShort
+		}
+		return nil, err
+	}
+	if string(buf[:len(rcloneMagic)]) != rcloneMagic {
+		return nil, ErrorRcloneBadMagic
+	}
+	h := &RcloneHeader{}
+	if err := h.nonce.fromBuf(buf[len(rcloneMagic):]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Part returns an encrypted part holding the blocks read from r, the first of
+// which is block number first of the object. The part decrypts with
+// RcloneSalt as salt.
+func (h *RcloneHeader) Part(first int64, r io.Reader) io.Reader {
+	n := h.nonce
+	n.add(uint64(first))
+	header := make([]byte, 0, fileHeaderSize)
+	header = append(append(header, fileMagicBytes...), n[:]...)
+	return io.MultiReader(bytes.NewReader(header), r)
+}
+
+// JoinRclone returns the rclone crypt object made of the encrypted parts read
+// one after the other from r, whose sizes are given. The parts have to hold
+// consecutive blocks of one object, as parts made by RcloneHeader.Part do.
+func JoinRclone(r io.Reader, sizes []int64) io.Reader {
+	return &rcloneJoiner{r: r, sizes: sizes}
+}
+
+type rcloneJoiner struct {
+	r     io.Reader
+	sizes []int64
+	// nonce is the nonce the next part has to start with.
+	nonce     nonce
+	started   bool
+	header    []byte
+	remaining int64
+	err       error
+}
+
+func (j *rcloneJoiner) Read(p []byte) (int, error) {
+	for len(j.header) == 0 && j.remaining == 0 {
+		if j.err != nil {
+			return 0, j.err
+		}
+		if len(j.sizes) == 0 {
+			return 0, io.EOF
+		}
+		if j.err = j.nextPart(); j.err != nil {
+			return 0, j.err
+		}
+	}
+	if len(j.header) > 0 {
+		n := copy(p, j.header)
+		j.header = j.header[n:]
+		return n, nil
+	}
+	if int64(len(p)) > j.remaining {
+		p = p[:j.remaining]
+	}
+	n, err := j.r.Read(p)
+	j.remaining -= int64(n)
+	if err == io.EOF {
+		err = nil
+		if j.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// nextPart replaces the header of the next part by the object header for the
+// first part and checks that later parts continue the object.
+func (j *rcloneJoiner) nextPart() error {
+	size := j.sizes[0]
+	j.sizes = j.sizes[1:]
+	var buf [fileHeaderSize]byte
+	if _, err := io.ReadFull(j.r, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if !bytes.Equal(buf[:fileMagicSize], fileMagicBytes) {
+		return ErrorEncryptedBadMagic
+	}
+	var n nonce
+	if err := n.fromBuf(buf[fileMagicSize:]); err != nil {
+		return err
+	}
+	if !j.started {
+		j.started = true
+		j.header = append([]byte(rcloneMagic), n[:]...)
+	} else if n != j.nonce {
+		return ErrorRcloneNonce
+	}
+	j.remaining = size - int64(fileHeaderSize)
+	n.add(uint64((j.remaining + blockSize - 1) / blockSize))
+	j.nonce = n
+	return nil
+}
@@ -0,0 +1,102 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rclonePart is "hello, rclone" encrypted by Cipher with the key of an rclone
+// remote with password "teldrive" and the nonce 00 01 02 ... 17.
+const rclonePart = "54454c44524956450000" +
+	"000102030405060708090a0b0c0d0e0f1011121314151617" +
+	"6c1c15e1989fc878dfe190e3ea35daa8e8041dd52288200cee9b3b0bea"
+
+func TestRcloneVector(t *testing.T) {
+	part, err := hex.DecodeString(rclonePart)
+	require.NoError(t, err)
+	// The same content as an rclone object only differs in the magic string
+	object := append([]byte(rcloneMagic), part[fileMagicSize:]...)
+
+	c, err := NewRcloneCipher("teldrive")
+	require.NoError(t, err)
+	var n nonce
+	require.NoError(t, n.fromBuf(part[fileMagicSize:]))
+	r, err := c.newEncrypter(bytes.NewReader([]byte("hello, rclone")), &n, []byte(rcloneMagic))
+	require.NoError(t, err)
+	encrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, object, encrypted)
+	assert.Equal(t, RcloneSize(13), int64(len(object)))
+
+	joined, err := io.ReadAll(JoinRclone(bytes.NewReader(part), []int64{int64(len(part))}))
+	require.NoError(t, err)
+	assert.Equal(t, object, joined)
+
+	in := bytes.NewReader(object)
+	h, err := ReadRcloneHeader(in)
+	require.NoError(t, err)
+	split, err := io.ReadAll(h.Part(0, in))
+	require.NoError(t, err)
+	assert.Equal(t, part, split)
+
+	c, err = NewCipher("teldrive", RcloneSalt)
+	require.NoError(t, err)
+	dr, err := c.DecryptData(io.NopCloser(bytes.NewReader(split)))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, rclone", string(plain))
+}
+
+func TestRcloneSplitJoin(t *testing.T) {
+	c, err := NewRcloneCipher("teldrive")
+	require.NoError(t, err)
+	plain := bytes.Repeat([]byte("0123456789abcdef"), blockDataSize*7/32)
+	r, err := c.EncryptRclone(bytes.NewReader(plain))
+	require.NoError(t, err)
+	object, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, RcloneSize(int64(len(plain))), int64(len(object)))
+
+	// Split into parts of two blocks each
+	in := bytes.NewReader(object)
+	h, err := ReadRcloneHeader(in)
+	require.NoError(t, err)
+	var parts [][]byte
+	for first := int64(0); in.Len() > 0; first += 2 {
+		part, err := io.ReadAll(h.Part(first, io.LimitReader(in, 2*EncryptedBlockSize)))
+		require.NoError(t, err)
+		parts = append(parts, part)
+	}
+	require.Len(t, parts, 2)
+
+	var content, stored []byte
+	var sizes []int64
+	for _, part := range parts {
+		dr, err := c.DecryptData(io.NopCloser(bytes.NewReader(part)))
+		require.NoError(t, err)
+		p, err := io.ReadAll(dr)
+		require.NoError(t, err)
+		content = append(content, p...)
+		stored = append(stored, part...)
+		sizes = append(sizes, int64(len(part)))
+	}
+	assert.Equal(t, plain, content)
+	assert.Equal(t, PartSize(2*EncryptedBlockSize), sizes[0])
+
+	joined, err := io.ReadAll(JoinRclone(bytes.NewReader(stored), sizes))
+	require.NoError(t, err)
+	assert.Equal(t, object, joined)
+
+	swapped := append(append([]byte{}, parts[1]...), parts[0]...)
+	_, err = io.ReadAll(JoinRclone(bytes.NewReader(swapped), []int64{sizes[1], sizes[0]}))
+	assert.ErrorIs(t, err, ErrorRcloneNonce)
+
+	_, err = ReadRcloneHeader(bytes.NewReader(stored))
+	assert.ErrorIs(t, err, ErrorRcloneBadMagic)
+}
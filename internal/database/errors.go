@@ -28,3 +28,10 @@ func IsKeyConflictErr(err error) bool {
 	}
 	return false
 }
+
+// IsLockNotAvailableErr reports whether err is a NOWAIT lock that was held
+// by another transaction.
+func IsLockNotAvailableErr(err error) bool {
+	var e *pgconn.PgError
+	return errors.As(err, &e) && e.Code == "55P03"
+}
@@ -0,0 +1,61 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS trashed_at timestamptz;
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS trash_root_id uuid;
+
+CREATE INDEX IF NOT EXISTS idx_files_trash ON teldrive.files (user_id, trashed_at DESC) WHERE status = 'trashed';
+CREATE INDEX IF NOT EXISTS idx_files_trash_root ON teldrive.files (trash_root_id) WHERE trash_root_id IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION teldrive.create_directories(u_id bigint, long_path text)
+ RETURNS SETOF teldrive.files
+ LANGUAGE plpgsql
+AS $function$
+DECLARE
+    path_parts TEXT[];
+    current_directory_id UUID;
+    new_directory_id UUID;
+    directory_name TEXT;
+    path_so_far TEXT;
+BEGIN
+    path_parts := string_to_array(regexp_replace(long_path, '^/+', ''), '/');
+
+    path_so_far := '';
+
+    SELECT id INTO current_directory_id
+    FROM teldrive.files
+    WHERE parent_id is NULL AND user_id = u_id AND type = 'folder';
+
+    FOR directory_name IN SELECT unnest(path_parts) LOOP
+        path_so_far := CONCAT(path_so_far, '/', directory_name);
+
+        SELECT id INTO new_directory_id
+        FROM teldrive.files
+        WHERE parent_id = current_directory_id
+          AND "name" = directory_name
+          AND "user_id" = u_id
+          AND status = 'active';
+
+        IF new_directory_id IS NULL THEN
+            INSERT INTO teldrive.files ("name", "type", mime_type, parent_id, "user_id")
+            VALUES (directory_name, 'folder', 'drive/folder', current_directory_id, u_id)
+            RETURNING id INTO new_directory_id;
+        END IF;
+
+        current_directory_id := new_directory_id;
+    END LOOP;
+
+    RETURN QUERY SELECT * FROM teldrive.files WHERE id = current_directory_id;
+END;
+$function$
+;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE teldrive.files SET status = 'pending_deletion' WHERE status = 'trashed' AND type = 'file';
+DELETE FROM teldrive.files WHERE status = 'trashed' AND type = 'folder';
+DROP INDEX IF EXISTS teldrive.idx_files_trash;
+DROP INDEX IF EXISTS teldrive.idx_files_trash_root;
+ALTER TABLE teldrive.files DROP COLUMN IF EXISTS trashed_at;
+ALTER TABLE teldrive.files DROP COLUMN IF EXISTS trash_root_id;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.file_versions (
+    id uuid NOT NULL DEFAULT uuid7(),
+    file_id uuid NOT NULL,
+    user_id bigint NOT NULL,
+    size bigint NULL,
+    parts jsonb NULL,
+    channel_id bigint NULL,
+    encrypted boolean DEFAULT false,
+    hash text NULL,
+    updated_at timestamptz NULL,
+    created_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT file_versions_pkey PRIMARY KEY (id),
+    CONSTRAINT fk_file FOREIGN KEY (file_id) REFERENCES teldrive.files (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_versions_file_id ON teldrive.file_versions (file_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_file_versions_created_at ON teldrive.file_versions (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS teldrive.file_versions;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS idx_files_user_hash ON teldrive.files (user_id, hash, size) WHERE hash IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_file_versions_user_hash ON teldrive.file_versions (user_id, hash) WHERE hash IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS teldrive.idx_files_user_hash;
+DROP INDEX IF EXISTS teldrive.idx_file_versions_user_hash;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.s3_keys (
+    access_key text NOT NULL,
+    secret_key text NOT NULL,
+    user_id bigint NOT NULL,
+    name text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT s3_keys_pkey PRIMARY KEY (access_key),
+    CONSTRAINT s3_keys_user_id_fkey FOREIGN KEY (user_id) REFERENCES teldrive.users (user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_s3_keys_user_id ON teldrive.s3_keys (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS teldrive.s3_keys;
+-- +goose StatementEnd
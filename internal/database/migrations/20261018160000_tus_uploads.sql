@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.tus_uploads (
+    id uuid NOT NULL,
+    user_id bigint NOT NULL,
+    name text NOT NULL,
+    parent_id uuid NOT NULL,
+    mime_type text NOT NULL,
+    size bigint NOT NULL,
+    uploaded bigint NOT NULL DEFAULT 0,
+    parts integer NOT NULL DEFAULT 0,
+    part_size bigint NOT NULL,
+    pending bigint NOT NULL DEFAULT 0,
+    tail bytea,
+    channel_id bigint,
+    encrypted boolean NOT NULL DEFAULT false,
+    lease_id uuid,
+    lease_until timestamptz,
+    created_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    updated_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT tus_uploads_pkey PRIMARY KEY (id),
+    CONSTRAINT tus_uploads_user_id_fkey FOREIGN KEY (user_id) REFERENCES teldrive.users (user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_tus_uploads_created_at ON teldrive.tus_uploads (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS teldrive.tus_uploads;
+-- +goose StatementEnd
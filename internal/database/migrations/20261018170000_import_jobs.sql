@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.import_jobs (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id bigint NOT NULL,
+    url text NOT NULL,
+    headers jsonb,
+    path text NOT NULL,
+    name text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'pending',
+    size bigint,
+    downloaded bigint NOT NULL DEFAULT 0,
+    file_id uuid,
+    error text,
+    created_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    updated_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT import_jobs_pkey PRIMARY KEY (id),
+    CONSTRAINT import_jobs_user_id_fkey FOREIGN KEY (user_id) REFERENCES teldrive.users (user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_jobs_user_id ON teldrive.import_jobs (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_import_jobs_status ON teldrive.import_jobs (status, updated_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS teldrive.import_jobs;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.file_verifications (
+    file_id uuid NOT NULL,
+    user_id bigint NOT NULL,
+    hash text NOT NULL,
+    status text NOT NULL,
+    missing_parts jsonb,
+    error text,
+    verified_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT file_verifications_pkey PRIMARY KEY (file_id),
+    CONSTRAINT file_verifications_file_id_fkey FOREIGN KEY (file_id) REFERENCES teldrive.files (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_verifications_user_id ON teldrive.file_verifications (user_id, status);
+CREATE INDEX IF NOT EXISTS idx_file_verifications_verified_at ON teldrive.file_verifications (verified_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS teldrive.file_verifications;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS checksum_algorithm text;
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS checksum text;
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS checksum_verified boolean NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE teldrive.uploads DROP COLUMN IF EXISTS checksum_verified;
+ALTER TABLE teldrive.uploads DROP COLUMN IF EXISTS checksum;
+ALTER TABLE teldrive.uploads DROP COLUMN IF EXISTS checksum_algorithm;
+-- +goose StatementEnd
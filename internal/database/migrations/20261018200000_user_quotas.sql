@@ -0,0 +1,66 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS quota_size bigint;
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS quota_files bigint;
+
+-- Storage used by each user: files that are not pending deletion, trashed
+-- ones included. Maintained by a trigger so reads never scan the files table.
+CREATE TABLE IF NOT EXISTS teldrive.user_usage (
+    user_id bigint NOT NULL,
+    size bigint NOT NULL DEFAULT 0,
+    files bigint NOT NULL DEFAULT 0,
+    trashed_size bigint NOT NULL DEFAULT 0,
+    CONSTRAINT user_usage_pkey PRIMARY KEY (user_id)
+);
+
+INSERT INTO teldrive.user_usage (user_id, size, files, trashed_size)
+SELECT user_id, COALESCE(SUM(size), 0), COUNT(*), COALESCE(SUM(size) FILTER (WHERE status = 'trashed'), 0)
+FROM teldrive.files
+WHERE type = 'file' AND status <> 'pending_deletion'
+GROUP BY user_id
+ON CONFLICT (user_id) DO NOTHING;
+
+CREATE OR REPLACE FUNCTION teldrive.add_user_usage(u_id bigint, delta_size bigint, delta_files bigint, delta_trashed bigint)
+ RETURNS void
+ LANGUAGE sql
+AS $function$
+    INSERT INTO teldrive.user_usage AS u (user_id, size, files, trashed_size)
+    VALUES (u_id, delta_size, delta_files, delta_trashed)
+    ON CONFLICT (user_id) DO UPDATE SET
+        size = u.size + EXCLUDED.size,
+        files = u.files + EXCLUDED.files,
+        trashed_size = u.trashed_size + EXCLUDED.trashed_size;
+$function$;
+
+CREATE OR REPLACE FUNCTION teldrive.track_user_usage()
+ RETURNS trigger
+ LANGUAGE plpgsql
+AS $function$
+BEGIN
+    IF TG_OP <> 'INSERT' AND OLD.type = 'file' AND OLD.status <> 'pending_deletion' THEN
+        PERFORM teldrive.add_user_usage(OLD.user_id, -COALESCE(OLD.size, 0), -1,
+            CASE WHEN OLD.status = 'trashed' THEN -COALESCE(OLD.size, 0) ELSE 0 END);
+    END IF;
+    IF TG_OP <> 'DELETE' AND NEW.type = 'file' AND NEW.status <> 'pending_deletion' THEN
+        PERFORM teldrive.add_user_usage(NEW.user_id, COALESCE(NEW.size, 0), 1,
+            CASE WHEN NEW.status = 'trashed' THEN COALESCE(NEW.size, 0) ELSE 0 END);
+    END IF;
+    RETURN NULL;
+END;
+$function$;
+
+DROP TRIGGER IF EXISTS files_user_usage ON teldrive.files;
+CREATE TRIGGER files_user_usage
+    AFTER INSERT OR DELETE OR UPDATE OF size, status, type, user_id ON teldrive.files
+    FOR EACH ROW EXECUTE FUNCTION teldrive.track_user_usage();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS files_user_usage ON teldrive.files;
+DROP FUNCTION IF EXISTS teldrive.track_user_usage();
+DROP FUNCTION IF EXISTS teldrive.add_user_usage(bigint, bigint, bigint, bigint);
+DROP TABLE IF EXISTS teldrive.user_usage;
+ALTER TABLE teldrive.users DROP COLUMN IF EXISTS quota_files;
+ALTER TABLE teldrive.users DROP COLUMN IF EXISTS quota_size;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.rekeyed_parts (
+    key_id text NOT NULL,
+    channel_id bigint NOT NULL,
+    part_id integer NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    PRIMARY KEY (key_id, channel_id, part_id)
+);
+
+CREATE TABLE IF NOT EXISTS teldrive.rekeyed_names (
+    key_id text NOT NULL,
+    file_id uuid NOT NULL REFERENCES teldrive.files(id) ON DELETE CASCADE,
+    created_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    PRIMARY KEY (key_id, file_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS teldrive.rekeyed_names;
+DROP TABLE IF EXISTS teldrive.rekeyed_parts;
+-- +goose StatementEnd
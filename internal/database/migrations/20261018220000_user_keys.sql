@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Data keys of users, sealed with a key derived from the master key or from
+-- a passphrase of the user, depending on protection.
+CREATE TABLE IF NOT EXISTS teldrive.user_keys (
+    user_id bigint NOT NULL,
+    wrapped_key text NOT NULL,
+    salt text NOT NULL,
+    protection text NOT NULL DEFAULT 'master',
+    created_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    updated_at timestamptz NOT NULL DEFAULT timezone('utc'::text, now()),
+    CONSTRAINT user_keys_pkey PRIMARY KEY (user_id),
+    CONSTRAINT user_keys_user_id_fkey FOREIGN KEY (user_id) REFERENCES teldrive.users (user_id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS teldrive.user_keys;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Outcome of the last check of a bot. Disabled bots are left out of
+-- streams and uploads until they pass a check or are added again.
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false;
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS last_error text;
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS checked_at timestamptz;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE teldrive.bots DROP COLUMN IF EXISTS checked_at;
+ALTER TABLE teldrive.bots DROP COLUMN IF EXISTS last_error;
+ALTER TABLE teldrive.bots DROP COLUMN IF EXISTS disabled;
+-- +goose StatementEnd
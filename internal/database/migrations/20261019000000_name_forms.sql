@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Whether name holds the encrypted form of the name, so names are never
+-- guessed to be encrypted from how they look.
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS name_encrypted boolean NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE teldrive.files DROP COLUMN IF EXISTS name_encrypted;
+-- +goose StatementEnd
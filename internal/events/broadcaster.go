@@ -17,11 +17,23 @@ import (
 type EventType string
 
 const (
-	OpCreate EventType = "file_create"
-	OpUpdate EventType = "file_update"
-	OpDelete EventType = "file_delete"
-	OpMove   EventType = "file_move"
-	OpCopy   EventType = "file_copy"
+	OpCreate  EventType = "file_create"
+	OpUpdate  EventType = "file_update"
+	OpDelete  EventType = "file_delete"
+	OpMove    EventType = "file_move"
+	OpCopy    EventType = "file_copy"
+	OpRestore EventType = "file_restore"
+	// OpCopyProgress reports the progress of a folder copy
+	OpCopyProgress EventType = "file_copy_progress"
+	// OpImportProgress reports the bytes downloaded by a URL import, and
+	// OpImportDone and OpImportFailed its outcome
+	OpImportProgress EventType = "file_import_progress"
+	OpImportDone     EventType = "file_import_done"
+	OpImportFailed   EventType = "file_import_failed"
+	// OpVerifyFailed reports a file whose stored content failed a scrub
+	OpVerifyFailed EventType = "file_verify_failed"
+	// OpBotDisabled reports a bot that was disabled after failing a check
+	OpBotDisabled EventType = "bot_disabled"
 )
 
 const (
@@ -0,0 +1,206 @@
+package http_range
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+type condResult int
+
+const (
+	condNone condResult = iota
+	condTrue
+	condFalse
+)
+
+// Preconditions evaluates the conditional headers of r against the current
+// validators of the representation, in the order given by RFC 9110 section
+// 13.2.2. It returns the status to reply with when a precondition ends the
+// request (304 or 412), or 0 to continue. useRange reports whether the Range
+// header should be honoured; it is false when If-Range does not match, in
+// which case the full representation must be sent.
+func Preconditions(r *http.Request, etag string, modtime time.Time) (status int, useRange bool) {
+	ch := checkIfMatch(r, etag)
+	if ch == condNone {
+		ch = checkIfUnmodifiedSince(r, modtime)
+	}
+	if ch == condFalse {
+		return http.StatusPreconditionFailed, false
+	}
+
+	switch checkIfNoneMatch(r, etag) {
+	case condFalse:
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return http.StatusNotModified, false
+		}
+		return http.StatusPreconditionFailed, false
+	case condNone:
+		if checkIfModifiedSince(r, modtime) == condFalse {
+			return http.StatusNotModified, false
+		}
+	}
+
+	if r.Header.Get("Range") == "" {
+		return 0, false
+	}
+	return 0, checkIfRange(r, etag, modtime) != condFalse
+}
+
+func checkIfMatch(r *http.Request, etag string) condResult {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return condNone
+	}
+	for {
+		im = textproto.TrimString(im)
+		if len(im) == 0 {
+			break
+		}
+		if im[0] == ',' {
+			im = im[1:]
+			continue
+		}
+		if im[0] == '*' {
+			return condTrue
+		}
+		tag, remain := scanETag(im)
+		if tag == "" {
+			break
+		}
+		if etagStrongMatch(tag, etag) {
+			return condTrue
+		}
+		im = remain
+	}
+	return condFalse
+}
+
+func checkIfUnmodifiedSince(r *http.Request, modtime time.Time) condResult {
+	ius := r.Header.Get("If-Unmodified-Since")
+	if ius == "" || modtime.IsZero() {
+		return condNone
+	}
+	t, err := http.ParseTime(ius)
+	if err != nil {
+		return condNone
+	}
+	// Header dates have second precision.
+	if !modtime.Truncate(time.Second).After(t) {
+		return condTrue
+	}
+	return condFalse
+}
+
+func checkIfNoneMatch(r *http.Request, etag string) condResult {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return condNone
+	}
+	buf := inm
+	for {
+		buf = textproto.TrimString(buf)
+		if len(buf) == 0 {
+			break
+		}
+		if buf[0] == ',' {
+			buf = buf[1:]
+			continue
+		}
+		if buf[0] == '*' {
+			return condFalse
+		}
+		tag, remain := scanETag(buf)
+		if tag == "" {
+			break
+		}
+		if etagWeakMatch(tag, etag) {
+			return condFalse
+		}
+		buf = remain
+	}
+	return condTrue
+}
+
+func checkIfModifiedSince(r *http.Request, modtime time.Time) condResult {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return condNone
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modtime.IsZero() {
+		return condNone
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return condNone
+	}
+	if !modtime.Truncate(time.Second).After(t) {
+		return condFalse
+	}
+	return condTrue
+}
+
+func checkIfRange(r *http.Request, etag string, modtime time.Time) condResult {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return condNone
+	}
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return condNone
+	}
+	tag, _ := scanETag(ir)
+	if tag != "" {
+		if etagStrongMatch(tag, etag) {
+			return condTrue
+		}
+		return condFalse
+	}
+	// If-Range with a date only matches an exact Last-Modified.
+	if modtime.IsZero() {
+		return condFalse
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return condFalse
+	}
+	if t.Unix() == modtime.Unix() {
+		return condTrue
+	}
+	return condFalse
+}
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming the ETag is returned.
+func scanETag(s string) (etag string, remain string) {
+	s = textproto.TrimString(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
@@ -0,0 +1,59 @@
+package http_range
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreconditions(t *testing.T) {
+	const etag = `"abc"`
+	modtime := time.Date(2026, 10, 1, 12, 0, 0, 500, time.UTC)
+	before := modtime.Add(-time.Hour).Format(http.TimeFormat)
+	at := modtime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		status   int
+		useRange bool
+	}{
+		{name: "unconditional"},
+		{name: "range", headers: map[string]string{"Range": "bytes=0-1"}, useRange: true},
+		{name: "if-none-match hit", headers: map[string]string{"If-None-Match": `"x", "abc"`}, status: http.StatusNotModified},
+		{name: "if-none-match weak hit", headers: map[string]string{"If-None-Match": `W/"abc"`}, status: http.StatusNotModified},
+		{name: "if-none-match star", headers: map[string]string{"If-None-Match": "*"}, status: http.StatusNotModified},
+		{name: "if-none-match miss", headers: map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": at}},
+		{name: "if-none-match on post", method: http.MethodPost, headers: map[string]string{"If-None-Match": etag}, status: http.StatusPreconditionFailed},
+		{name: "if-modified-since unchanged", headers: map[string]string{"If-Modified-Since": at}, status: http.StatusNotModified},
+		{name: "if-modified-since changed", headers: map[string]string{"If-Modified-Since": before}},
+		{name: "if-match miss", headers: map[string]string{"If-Match": `"x"`}, status: http.StatusPreconditionFailed},
+		{name: "if-match weak", headers: map[string]string{"If-Match": `W/"abc"`}, status: http.StatusPreconditionFailed},
+		{name: "if-match hit", headers: map[string]string{"If-Match": etag, "If-Unmodified-Since": before}},
+		{name: "if-unmodified-since changed", headers: map[string]string{"If-Unmodified-Since": before}, status: http.StatusPreconditionFailed},
+		{name: "if-range etag hit", headers: map[string]string{"Range": "bytes=0-1", "If-Range": etag}, useRange: true},
+		{name: "if-range etag miss", headers: map[string]string{"Range": "bytes=0-1", "If-Range": `"x"`}},
+		{name: "if-range weak etag", headers: map[string]string{"Range": "bytes=0-1", "If-Range": `W/"abc"`}},
+		{name: "if-range date hit", headers: map[string]string{"Range": "bytes=0-1", "If-Range": at}, useRange: true},
+		{name: "if-range date miss", headers: map[string]string{"Range": "bytes=0-1", "If-Range": before}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			status, useRange := Preconditions(r, etag, modtime)
+			assert.Equal(t, tt.status, status)
+			assert.Equal(t, tt.useRange, useRange)
+		})
+	}
+}
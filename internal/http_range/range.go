@@ -2,6 +2,7 @@ package http_range
 
 import (
 	"errors"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -11,10 +12,17 @@ type Range struct {
 	End   int64
 }
 
+// Length returns the number of bytes covered by the range.
+func (r *Range) Length() int64 {
+	return r.End - r.Start + 1
+}
+
 var (
 	ErrNoOverlap = errors.New("invalid range: failed to overlap")
 
 	ErrInvalid = errors.New("invalid range")
+
+	ErrTooManyRanges = errors.New("invalid range: too many ranges")
 )
 
 func Parse(header string, size int64) ([]*Range, error) {
@@ -28,7 +36,10 @@ func Parse(header string, size int64) ([]*Range, error) {
 	ranges := make([]*Range, 0, len(arr))
 
 	for _, value := range arr {
-		r := strings.Split(value, "-")
+		r := strings.Split(strings.TrimSpace(value), "-")
+		if len(r) != 2 {
+			return nil, ErrInvalid
+		}
 		start, startErr := strconv.ParseInt(r[0], 10, 64)
 		end, endErr := strconv.ParseInt(r[1], 10, 64)
 
@@ -64,3 +75,45 @@ func Parse(header string, size int64) ([]*Range, error) {
 
 	return ranges, nil
 }
+
+// Coalesce sorts ranges by start and merges the ones that overlap or are
+// adjacent, so every byte is sent at most once.
+func Coalesce(ranges []*Range) []*Range {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b *Range) int {
+		switch {
+		case a.Start < b.Start:
+			return -1
+		case a.Start > b.Start:
+			return 1
+		}
+		return 0
+	})
+	res := []*Range{{Start: sorted[0].Start, End: sorted[0].End}}
+	for _, r := range sorted[1:] {
+		last := res[len(res)-1]
+		if r.Start <= last.End+1 {
+			last.End = max(last.End, r.End)
+			continue
+		}
+		res = append(res, &Range{Start: r.Start, End: r.End})
+	}
+	return res
+}
+
+// ParseCoalesced parses header, merges overlapping ranges and rejects
+// requests that still ask for more than maxRanges distinct ranges.
+func ParseCoalesced(header string, size int64, maxRanges int) ([]*Range, error) {
+	ranges, err := Parse(header, size)
+	if err != nil {
+		return nil, err
+	}
+	ranges = Coalesce(ranges)
+	if maxRanges > 0 && len(ranges) > maxRanges {
+		return nil, ErrTooManyRanges
+	}
+	return ranges, nil
+}
@@ -0,0 +1,66 @@
+package http_range
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []*Range
+		err    error
+	}{
+		{name: "single", header: "bytes=0-99", want: []*Range{{0, 99}}},
+		{name: "open end", header: "bytes=900-", want: []*Range{{900, 999}}},
+		{name: "suffix", header: "bytes=-100", want: []*Range{{900, 999}}},
+		{name: "clamped end", header: "bytes=500-5000", want: []*Range{{500, 999}}},
+		{name: "multiple with spaces", header: "bytes=0-9, 20-29", want: []*Range{{0, 9}, {20, 29}}},
+		{name: "no overlap", header: "bytes=2000-3000", err: ErrNoOverlap},
+		{name: "missing unit", header: "0-10", err: ErrInvalid},
+		{name: "malformed", header: "bytes=10", err: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.header, 1000)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []*Range
+		want   []*Range
+	}{
+		{name: "disjoint", ranges: []*Range{{0, 9}, {20, 29}}, want: []*Range{{0, 9}, {20, 29}}},
+		{name: "overlapping", ranges: []*Range{{0, 15}, {10, 29}}, want: []*Range{{0, 29}}},
+		{name: "adjacent", ranges: []*Range{{0, 9}, {10, 19}}, want: []*Range{{0, 19}}},
+		{name: "contained", ranges: []*Range{{0, 100}, {10, 20}}, want: []*Range{{0, 100}}},
+		{name: "unsorted", ranges: []*Range{{50, 59}, {0, 9}, {5, 12}}, want: []*Range{{0, 12}, {50, 59}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Coalesce(tt.ranges))
+		})
+	}
+}
+
+func TestParseCoalescedLimit(t *testing.T) {
+	_, err := ParseCoalesced("bytes=0-1,10-11,20-21", 1000, 2)
+	assert.ErrorIs(t, err, ErrTooManyRanges)
+
+	// Ranges merged by coalescing do not count against the limit
+	got, err := ParseCoalesced("bytes=0-1,2-3,4-5", 1000, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []*Range{{0, 5}}, got)
+}
@@ -0,0 +1,295 @@
+package reader
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ChunkKey identifies a chunk of a part. The chunk size is part of the key as
+// readers of short ranges use smaller chunks at the same offsets.
+type ChunkKey struct {
+	ChannelId int64
+	MessageId int64
+	Offset    int64
+	Limit     int64
+}
+
+func (k ChunkKey) name() string {
+	return fmt.Sprintf("%d-%d-%d-%d", k.ChannelId, k.MessageId, k.Offset, k.Limit)
+}
+
+func isChunkName(name string) bool {
+	var k ChunkKey
+	n, err := fmt.Sscanf(name, "%d-%d-%d-%d", &k.ChannelId, &k.MessageId, &k.Offset, &k.Limit)
+	return err == nil && n == 4 && k.name() == name
+}
+
+// ChunkCacheStats are the counters of a ChunkCache since it was opened.
+type ChunkCacheStats struct {
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Prefetches int64 `json:"prefetches"`
+	Evictions  int64 `json:"evictions"`
+	Entries    int   `json:"entries"`
+	Size       int64 `json:"size"`
+	Limit      int64 `json:"limit"`
+}
+
+type chunkEntry struct {
+	name string
+	size int64
+}
+
+// ChunkCache keeps downloaded chunks in files under a directory and removes
+// the least recently used ones once they take more than the size limit. It
+// is shared by all streams: a chunk read by several streams at the same time
+// is downloaded once.
+type ChunkCache struct {
+	dir      string
+	limit    int64
+	prefetch int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+
+	group singleflight.Group
+	// slots bounds the prefetches running at the same time.
+	slots chan struct{}
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	prefetches atomic.Int64
+	evictions  atomic.Int64
+}
+
+// NewChunkCache opens the chunk cache in dir, keeping the chunks cached there
+// before. prefetch is the number of chunks following a read chunk that are
+// downloaded ahead.
+func NewChunkCache(dir string, limit int64, prefetch int) (*ChunkCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &ChunkCache{
+		dir:      dir,
+		limit:    limit,
+		prefetch: max(prefetch, 0),
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		slots:    make(chan struct{}, max(prefetch, 1)*4),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type cached struct {
+		chunkEntry
+		used time.Time
+	}
+	var found []cached
+	for _, f := range files {
+		if !f.Type().IsRegular() {
+			continue
+		}
+		// Left over by writes that did not finish
+		if strings.HasPrefix(f.Name(), ".") {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		info, err := f.Info()
+		if err != nil || !isChunkName(f.Name()) {
+			continue
+		}
+		found = append(found, cached{chunkEntry{f.Name(), info.Size()}, info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].used.Before(found[j].used) })
+	for _, f := range found {
+		c.entries[f.name] = c.lru.PushFront(&chunkEntry{f.name, f.size})
+		c.size += f.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Get returns the chunk from the cache or downloads it with fetch.
+func (c *ChunkCache) Get(ctx context.Context, key ChunkKey, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if data, ok := c.load(key.name()); ok {
+		c.hits.Add(1)
+		return data, nil
+	}
+	c.misses.Add(1)
+	return c.fetch(ctx, key.name(), fetch)
+}
+
+// Prefetch downloads the chunk in the background unless it is cached or being
+// downloaded already. The download is not cancelled with ctx and has timeout
+// to finish.
+func (c *ChunkCache) Prefetch(ctx context.Context, key ChunkKey, timeout time.Duration, fetch func(ctx context.Context) ([]byte, error)) {
+	name := key.name()
+	c.mu.Lock()
+	_, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		return
+	}
+	c.prefetches.Add(1)
+	go func() {
+		defer func() { <-c.slots }()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+		c.fetch(ctx, name, fetch)
+	}()
+}
+
+// Stats returns the counters of the cache.
+func (c *ChunkCache) Stats() ChunkCacheStats {
+	c.mu.Lock()
+	entries, size := c.lru.Len(), c.size
+	c.mu.Unlock()
+	return ChunkCacheStats{
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Prefetches: c.prefetches.Load(),
+		Evictions:  c.evictions.Load(),
+		Entries:    entries,
+		Size:       size,
+		Limit:      c.limit,
+	}
+}
+
+// fetch downloads the chunk once for all callers asking for it at the same
+// time and stores it.
+func (c *ChunkCache) fetch(ctx context.Context, name string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	for {
+		leader := false
+		ch := c.group.DoChan(name, func() (any, error) {
+			leader = true
+			data, err := fetch(ctx)
+			if err != nil {
+				return nil, err
+			}
+			c.store(name, data)
+			return data, nil
+		})
+		select {
+		case res := <-ch:
+			if res.Err == nil {
+				return res.Val.([]byte), nil
+			}
+			// The download was cancelled for the caller that started it
+			if !leader && ctx.Err() == nil &&
+				(errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded)) {
+				continue
+			}
+			return nil, res.Err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *ChunkCache) load(name string) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		c.mu.Lock()
+		c.remove(name)
+		c.mu.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *ChunkCache) store(name string, data []byte) {
+	f, err := os.CreateTemp(c.dir, ".chunk-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[name]; ok {
+		c.size -= el.Value.(*chunkEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[name] = c.lru.PushFront(&chunkEntry{name, int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// evict removes the least recently used chunks until the cache fits its
+// limit. c.mu must be held.
+func (c *ChunkCache) evict() {
+	for c.size > c.limit && c.lru.Len() > 0 {
+		name := c.lru.Back().Value.(*chunkEntry).name
+		c.remove(name)
+		os.Remove(filepath.Join(c.dir, name))
+		c.evictions.Add(1)
+	}
+}
+
+// remove drops the chunk from the index. c.mu must be held.
+func (c *ChunkCache) remove(name string) {
+	el, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.size -= el.Value.(*chunkEntry).size
+	c.lru.Remove(el)
+	delete(c.entries, name)
+}
+
+type chunkCacheKey struct{}
+
+// WithChunkCache returns a context whose readers read chunks through c. A nil
+// c reads them from Telegram.
+func WithChunkCache(ctx context.Context, c *ChunkCache) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, chunkCacheKey{}, c)
+}
+
+func chunkCacheFrom(ctx context.Context) *ChunkCache {
+	c, _ := ctx.Value(chunkCacheKey{}).(*ChunkCache)
+	return c
+}
@@ -0,0 +1,118 @@
+package reader
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chunkOf(b byte) func(context.Context) ([]byte, error) {
+	return func(context.Context) ([]byte, error) { return bytes.Repeat([]byte{b}, 10), nil }
+}
+
+func TestChunkCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewChunkCache(dir, 25, 0)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	for i := range int64(3) {
+		data, err := c.Get(ctx, ChunkKey{1, 2, i * 10, 10}, chunkOf(byte(i)))
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10), data)
+	}
+	// The first chunk made way for the third one
+	s := c.Stats()
+	assert.Equal(t, ChunkCacheStats{Misses: 3, Evictions: 1, Entries: 2, Size: 20, Limit: 25}, s)
+
+	fail := func(context.Context) ([]byte, error) { return nil, assert.AnError }
+	data, err := c.Get(ctx, ChunkKey{1, 2, 10, 10}, fail)
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 10), data)
+	_, err = c.Get(ctx, ChunkKey{1, 2, 0, 10}, fail)
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, int64(1), c.Stats().Hits)
+
+	// Chunks are kept when the cache is opened again
+	c, err = NewChunkCache(dir, 25, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, c.Stats().Entries)
+	_, err = c.Get(ctx, ChunkKey{1, 2, 20, 10}, fail)
+	require.NoError(t, err)
+}
+
+func TestChunkCacheSingleFlight(t *testing.T) {
+	c, err := NewChunkCache(t.TempDir(), 100, 0)
+	require.NoError(t, err)
+
+	var downloads atomic.Int32
+	release := make(chan struct{})
+	fetch := func(context.Context) ([]byte, error) {
+		downloads.Add(1)
+		<-release
+		return []byte("chunk"), nil
+	}
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := c.Get(context.Background(), ChunkKey{1, 2, 0, 5}, fetch)
+			assert.NoError(t, err)
+			assert.Equal(t, "chunk", string(data))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), downloads.Load())
+}
+
+func TestChunkCacheCancelledLeader(t *testing.T) {
+	c, err := NewChunkCache(t.TempDir(), 100, 0)
+	require.NoError(t, err)
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go c.Get(leaderCtx, ChunkKey{1, 2, 0, 5}, func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+
+	done := make(chan []byte)
+	go func() {
+		data, err := c.Get(context.Background(), ChunkKey{1, 2, 0, 5}, func(context.Context) ([]byte, error) {
+			return []byte("chunk"), nil
+		})
+		assert.NoError(t, err)
+		done <- data
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.Equal(t, "chunk", string(<-done))
+}
+
+func TestChunkCachePrefetch(t *testing.T) {
+	c, err := NewChunkCache(t.TempDir(), 100, 1)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Prefetches outlive the request starting them
+	c.Prefetch(ctx, ChunkKey{1, 2, 0, 10}, time.Second, chunkOf(7))
+	require.Eventually(t, func() bool { return c.Stats().Entries == 1 }, time.Second, 10*time.Millisecond)
+	c.Prefetch(ctx, ChunkKey{1, 2, 0, 10}, time.Second, chunkOf(7))
+
+	data, err := c.Get(context.Background(), ChunkKey{1, 2, 0, 10}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{7}, 10), data)
+	assert.Equal(t, ChunkCacheStats{Hits: 1, Prefetches: 1, Entries: 1, Size: 10, Limit: 100}, c.Stats())
+}
@@ -0,0 +1,85 @@
+package reader
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+// botLimits holds the concurrency learned for each bot, shared by all of its
+// streams.
+var botLimits sync.Map // map[string]*concurrencyLimit
+
+// concurrencyLimit is the number of chunks a bot downloads at the same time.
+// It grows by one while that keeps the throughput of a stream up and the
+// chunks well within their timeout, and is halved on flood waits and chunk
+// timeouts.
+type concurrencyLimit struct {
+	mu      sync.Mutex
+	limit   int
+	min     int
+	max     int
+	timeout time.Duration
+}
+
+func newConcurrencyLimit(cnf *config.TGStream) *concurrencyLimit {
+	lower := max(cnf.MinConcurrency, 1)
+	upper := max(cnf.MaxConcurrency, lower)
+	return &concurrencyLimit{
+		limit:   min(max(cnf.Concurrency, lower), upper),
+		min:     lower,
+		max:     upper,
+		timeout: cnf.ChunkTimeout,
+	}
+}
+
+// botConcurrency returns the limit of botID, or nil when the concurrency is
+// not adaptive.
+func botConcurrency(botID string, cnf *config.TGStream) *concurrencyLimit {
+	if !cnf.Adaptive {
+		return nil
+	}
+	l, _ := botLimits.LoadOrStore(botID, newConcurrencyLimit(cnf))
+	return l.(*concurrencyLimit)
+}
+
+func (l *concurrencyLimit) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// batchDone records that n chunks were downloaded together in elapsed at
+// throughput bytes per second, and returns the new limit. last is the
+// throughput of the previous batch of the stream.
+func (l *concurrencyLimit) batchDone(n int, elapsed time.Duration, throughput, last float64) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.timeout > 0 && elapsed > l.timeout/2:
+		// Close to timing out, the bot is being throttled
+		l.limit = max(l.limit*3/4, l.min)
+	case n < l.limit:
+		// The stream did not use the whole limit, nothing was learned
+	case last > 0 && throughput < last*0.9:
+		l.limit = max(l.limit-1, l.min)
+	default:
+		l.limit = min(l.limit+1, l.max)
+	}
+	return l.limit
+}
+
+// batchFailed records a failed batch and returns the new limit and whether
+// the batch is worth retrying with it.
+func (l *concurrencyLimit) batchFailed(err error) (int, bool) {
+	if _, ok := tgerr.AsFloodWait(err); !ok && !errors.Is(err, ErrChunkTimeout) {
+		return l.current(), false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = max(l.limit/2, l.min)
+	return l.limit, true
+}
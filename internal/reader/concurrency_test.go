@@ -0,0 +1,103 @@
+package reader
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	l := newConcurrencyLimit(&config.TGStream{Concurrency: 2, MinConcurrency: 1, MaxConcurrency: 4, ChunkTimeout: 10 * time.Second})
+	assert.Equal(t, 2, l.current())
+
+	assert.Equal(t, 3, l.batchDone(2, time.Second, 100, 0))
+	assert.Equal(t, 4, l.batchDone(3, time.Second, 150, 100))
+	assert.Equal(t, 4, l.batchDone(4, time.Second, 200, 150))
+	// More chunks at a time did not pay off
+	assert.Equal(t, 3, l.batchDone(4, time.Second, 100, 200))
+	// Batches smaller than the limit teach nothing
+	assert.Equal(t, 3, l.batchDone(1, time.Second, 10, 100))
+	// Slow batches back off
+	assert.Equal(t, 2, l.batchDone(3, 6*time.Second, 100, 100))
+
+	n, retry := l.batchFailed(tgerr.New(420, "FLOOD_WAIT_5"))
+	assert.True(t, retry)
+	assert.Equal(t, 1, n)
+	n, retry = l.batchFailed(io.ErrUnexpectedEOF)
+	assert.False(t, retry)
+	assert.Equal(t, 1, n)
+}
+
+func TestBotConcurrency(t *testing.T) {
+	cnf := &config.TGStream{Concurrency: 3, MaxConcurrency: 8}
+	assert.Nil(t, botConcurrency("bot", cnf))
+
+	cnf.Adaptive = true
+	l := botConcurrency("shared-bot", cnf)
+	assert.Same(t, l, botConcurrency("shared-bot", cnf))
+	assert.NotSame(t, l, botConcurrency("other-bot", cnf))
+	assert.Equal(t, 3, l.current())
+}
+
+// flakySource serves chunks of a part whose bytes are their offsets modulo
+// 256, timing out for the first failures calls.
+type flakySource struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *flakySource) ChunkSize(start, end int64) int64 { return 4 }
+
+func (s *flakySource) Chunk(ctx context.Context, offset, limit int64) ([]byte, error) {
+	s.mu.Lock()
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mu.Unlock()
+	if fail {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	chunk := make([]byte, limit)
+	for i := range chunk {
+		chunk[i] = byte(offset + int64(i))
+	}
+	return chunk, nil
+}
+
+func TestTGMultiReaderAdaptive(t *testing.T) {
+	cnf := &config.TGConfig{Stream: config.TGStream{
+		Concurrency: 4, Adaptive: true, MinConcurrency: 1, MaxConcurrency: 4,
+		Buffers: 8, ChunkTimeout: 20 * time.Millisecond,
+	}}
+	src := &flakySource{failures: 1}
+	tuner := newConcurrencyLimit(&cnf.Stream)
+	r, err := newTGMultiReader(context.Background(), 2, 61, cnf, src, func(int) *concurrencyLimit { return tuner })
+	require.NoError(t, err)
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Len(t, data, 60)
+	for i, b := range data {
+		assert.Equal(t, byte(i+2), b)
+	}
+	// The timed out batch was retried with fewer chunks at a time
+	assert.Equal(t, 1, r.retries)
+
+	// Without tuning the timeout ends the stream
+	cnf.Stream.Adaptive = false
+	r, err = newTGMultiReader(context.Background(), 2, 61, cnf, &flakySource{failures: 1}, nil)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = io.ReadAll(r)
+	assert.Error(t, err)
+}
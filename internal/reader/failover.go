@@ -0,0 +1,150 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNoFallback = errors.New("no bot left to fall back to")
+
+	// errBotReplaced is returned for a chunk that timed out after its bot
+	// was replaced, so that the batch is downloaded again with the new bot.
+	errBotReplaced = errors.New("bot replaced")
+)
+
+// maxFailovers is the number of times a stream downloads a batch again after
+// replacing a bot that timed out.
+const maxFailovers = 8
+
+// Fallback starts the client of another bot, or of the user session once no
+// bot is left, for a reader whose bot failed. It returns ErrNoFallback when
+// there is nothing left to start.
+type Fallback func(ctx context.Context) (Stripe, error)
+
+type fallbackKey struct{}
+
+// WithFallback returns a context whose readers move to the clients started
+// by fallback when their bots fail.
+func WithFallback(ctx context.Context, fallback Fallback) context.Context {
+	if fallback == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, fallbackKey{}, fallback)
+}
+
+func fallbackFrom(ctx context.Context) Fallback {
+	fallback, _ := ctx.Value(fallbackKey{}).(Fallback)
+	return fallback
+}
+
+// isBotFailure reports whether err means the bot cannot download the file for
+// now, while another bot could.
+func isBotFailure(err error) bool {
+	if _, ok := tgerr.AsFloodWait(err); ok {
+		return true
+	}
+	return tgerr.IsCode(err, 401) || tgerr.Is(err,
+		"CHANNEL_PRIVATE", "CHANNEL_INVALID", "CHAT_ADMIN_REQUIRED", "CHAT_FORBIDDEN")
+}
+
+// botSlot is a client of a reader that is replaced by a fallback when its bot
+// fails. Every replacement starts a new generation.
+type botSlot struct {
+	mu       sync.Mutex
+	stripe   Stripe
+	gen      int
+	fallback Fallback
+}
+
+func (s *botSlot) get() (Stripe, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stripe, s.gen
+}
+
+// replace replaces the client of generation gen after it failed with cause,
+// unless another chunk replaced it already. It returns cause when no
+// fallback is left.
+func (s *botSlot) replace(ctx context.Context, gen int, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != gen {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+	next, err := s.fallback(ctx)
+	if err != nil {
+		logger.Error("stream.failover_failed", zap.Error(err), zap.NamedError("cause", cause),
+			zap.String("bot_id", s.stripe.BotID))
+		return cause
+	}
+	logger.Warn("stream.failover", zap.Error(cause),
+		zap.String("bot_id", s.stripe.BotID), zap.String("next_bot_id", next.BotID))
+	s.stripe = next
+	s.gen++
+	return nil
+}
+
+// failoverSource downloads the chunks of a part through the client of a slot
+// and moves on to its fallback when the bot fails. build returns the source
+// of the part for a client; fresh asks it not to use a cached location.
+type failoverSource struct {
+	slot    *botSlot
+	build   func(stripe Stripe, fresh bool) ChunkSource
+	timeout time.Duration
+
+	mu  sync.Mutex
+	gen int
+	src ChunkSource
+}
+
+func (f *failoverSource) source() (ChunkSource, int) {
+	stripe, gen := f.slot.get()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.src == nil || f.gen != gen {
+		f.src = f.build(stripe, gen > 0)
+		f.gen = gen
+	}
+	return f.src, gen
+}
+
+func (f *failoverSource) ChunkSize(start, end int64) int64 {
+	src, _ := f.source()
+	return src.ChunkSize(start, end)
+}
+
+func (f *failoverSource) Chunk(ctx context.Context, offset int64, limit int64) ([]byte, error) {
+	for {
+		src, gen := f.source()
+		chunk, err := src.Chunk(ctx, offset, limit)
+		switch {
+		case err == nil:
+			return chunk, nil
+		case isBotFailure(err):
+			if f.slot.replace(ctx, gen, err) != nil {
+				return nil, err
+			}
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil:
+			// The chunk timed out, as it does while the bot waits out a
+			// long flood wait
+			replaceCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), f.timeout)
+			replaced := f.slot.replace(replaceCtx, gen, err)
+			cancel()
+			if replaced != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: %w", errBotReplaced, err)
+		default:
+			return nil, err
+		}
+	}
+}
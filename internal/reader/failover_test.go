@@ -0,0 +1,86 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+// failingSource fails every chunk with err, or times out when err is nil.
+type failingSource struct{ err error }
+
+func (s *failingSource) ChunkSize(start, end int64) int64 { return 4 }
+
+func (s *failingSource) Chunk(ctx context.Context, offset, limit int64) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func failoverReader(t *testing.T, bots map[string]ChunkSource, order ...string) (*tgMultiReader, *[]string) {
+	var fresh []string
+	fallbacks := order[1:]
+	slot := &botSlot{stripe: Stripe{BotID: order[0]}, fallback: func(ctx context.Context) (Stripe, error) {
+		if len(fallbacks) == 0 {
+			return Stripe{}, ErrNoFallback
+		}
+		next := fallbacks[0]
+		fallbacks = fallbacks[1:]
+		return Stripe{BotID: next}, nil
+	}}
+	src := &failoverSource{slot: slot, timeout: time.Second, build: func(stripe Stripe, isFresh bool) ChunkSource {
+		if isFresh {
+			fresh = append(fresh, stripe.BotID)
+		}
+		return bots[stripe.BotID]
+	}}
+	cnf := &config.TGConfig{Stream: config.TGStream{Concurrency: 2, Buffers: 8, ChunkTimeout: 20 * time.Millisecond}}
+	r, err := newTGMultiReader(context.Background(), 0, 39, cnf, src, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Close() })
+	return r, &fresh
+}
+
+func TestFailoverSource(t *testing.T) {
+	bots := map[string]ChunkSource{
+		"flooded": &failingSource{err: tgerr.New(420, "FLOOD_WAIT_300")},
+		"revoked": &failingSource{err: tgerr.New(401, "AUTH_KEY_UNREGISTERED")},
+		"slow":    &failingSource{},
+		"user":    &flakySource{},
+	}
+	r, fresh := failoverReader(t, bots, "flooded", "revoked", "slow", "user")
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Len(t, data, 40)
+	for i, b := range data {
+		assert.Equal(t, byte(i), b)
+	}
+	// Every replacement looks its location up again
+	assert.Equal(t, []string{"revoked", "slow", "user"}, *fresh)
+	assert.Equal(t, 1, r.failovers)
+}
+
+func TestFailoverExhausted(t *testing.T) {
+	other := errors.New("no such file")
+	bots := map[string]ChunkSource{
+		"flooded": &failingSource{err: tgerr.New(420, "FLOOD_WAIT_300")},
+		"broken":  &failingSource{err: other},
+	}
+	r, _ := failoverReader(t, bots, "flooded", "broken")
+	_, err := io.ReadAll(r)
+	assert.Error(t, err)
+
+	r, _ = failoverReader(t, map[string]ChunkSource{"slow": &failingSource{}}, "slow")
+	_, err = io.ReadAll(r)
+	assert.Error(t, err)
+	assert.Equal(t, 0, r.failovers)
+}
@@ -33,21 +33,25 @@ type Reader struct {
 	closeOnce   sync.Once
 	closeErr    error
 	botID       string
+	// slots are the clients chunks are downloaded through, the reader's own
+	// client first and then the stripes.
+	slots []*botSlot
 }
 
-func calculatePartByteRanges(start, end, partSize int64) []Range {
+// calculatePartByteRanges splits the bytes from start to end of a file over
+// its parts, which have sizes. Parts need not all be the same size.
+func calculatePartByteRanges(start, end int64, sizes []int64) []Range {
 	ranges := make([]Range, 0)
-	startPart := start / partSize
-	endPart := end / partSize
-
-	for part := startPart; part <= endPart; part++ {
-		partStart := max(start-part*partSize, 0)
-		partEnd := min(partSize-1, end-part*partSize)
-		ranges = append(ranges, Range{
-			Start:  partStart,
-			End:    partEnd,
-			PartNo: part,
-		})
+	var offset int64
+	for part, size := range sizes {
+		if offset+size > start && offset <= end {
+			ranges = append(ranges, Range{
+				Start:  max(start-offset, 0),
+				End:    min(size-1, end-offset),
+				PartNo: int64(part),
+			})
+		}
+		offset += size
 	}
 	return ranges
 }
@@ -63,21 +67,28 @@ func NewReader(ctx context.Context,
 	botID string,
 ) (io.ReadCloser, error) {
 
-	size := parts[0].Size
-	if *file.Encrypted {
-		size = parts[0].DecryptedSize
+	sizes := make([]int64, len(parts))
+	for i, part := range parts {
+		sizes[i] = part.Size
+		if *file.Encrypted {
+			sizes[i] = part.DecryptedSize
+		}
 	}
 	r := &Reader{
 		ctx:       ctx,
 		parts:     parts,
 		file:      file,
 		remaining: end - start + 1,
-		ranges:    calculatePartByteRanges(start, end, size),
+		ranges:    calculatePartByteRanges(start, end, sizes),
 		config:    config,
 		client:    client,
 		cache:     cache,
 		botID:     botID,
 	}
+	fallback := fallbackFrom(ctx)
+	for _, stripe := range append([]Stripe{{Client: client, BotID: botID}}, stripesFrom(ctx)...) {
+		r.slots = append(r.slots, &botSlot{stripe: stripe, fallback: fallback})
+	}
 
 	if err := r.initializeReader(); err != nil {
 		return nil, err
@@ -135,26 +146,48 @@ func (r *Reader) getPartReader() (io.ReadCloser, error) {
 	currentRange := r.ranges[r.pos]
 	partId := r.parts[currentRange.PartNo].ID
 
-	chunkSrc := &chunkSource{
-		channelId:   *r.file.ChannelId,
-		partId:      partId,
-		client:      r.client,
-		concurrency: r.concurrency,
-		cache:       r.cache,
-		key:         cache.KeyFileLocation(r.config.SessionInstance, r.botID, r.file.ID, partId),
+	build := func(stripe Stripe, fresh bool) ChunkSource {
+		key := cache.KeyFileLocation(r.config.SessionInstance, stripe.BotID, r.file.ID, partId)
+		if fresh {
+			r.cache.Delete(r.ctx, key)
+		}
+		return &chunkSource{
+			channelId:   *r.file.ChannelId,
+			partId:      partId,
+			client:      stripe.Client,
+			concurrency: r.concurrency,
+			cache:       r.cache,
+			key:         key,
+			chunks:      chunkCacheFrom(r.ctx),
+			size:        r.parts[currentRange.PartNo].Size,
+			timeout:     r.config.Stream.ChunkTimeout,
+		}
+	}
+	sources := make([]ChunkSource, len(r.slots))
+	for i, slot := range r.slots {
+		if slot.fallback == nil {
+			sources[i] = build(slot.stripe, false)
+		} else {
+			sources[i] = &failoverSource{slot: slot, build: build, timeout: r.config.Stream.ChunkTimeout}
+		}
+	}
+	chunkSrc := sources[0]
+	if len(sources) > 1 {
+		chunkSrc = &stripedSource{sources: sources}
+	}
+	var tuner func(stripe int) *concurrencyLimit
+	if r.config.Stream.Adaptive {
+		tuner = r.botConcurrency
 	}
-
-	var (
-		reader io.ReadCloser
-		err    error
-	)
-
-	reader, err = newTGMultiReader(r.ctx, currentRange.Start, currentRange.End, r.config, chunkSrc)
 
 	if *r.file.Encrypted {
 		salt := r.parts[r.ranges[r.pos].PartNo].Salt
-		cipher, _ := crypt.NewCipher(r.config.Uploads.EncryptionKey, salt)
-		reader, err = cipher.DecryptDataSeek(r.ctx,
+		key, err := crypt.PartKey(r.ctx, salt, r.config.Uploads.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher, _ := crypt.NewCipher(key, salt)
+		return cipher.DecryptDataSeek(r.ctx,
 			func(ctx context.Context,
 				underlyingOffset,
 				underlyingLimit int64) (io.ReadCloser, error) {
@@ -164,11 +197,18 @@ func (r *Reader) getPartReader() (io.ReadCloser, error) {
 					end = min(r.parts[r.ranges[r.pos].PartNo].Size-1, underlyingOffset+underlyingLimit-1)
 				}
 
-				return newTGMultiReader(r.ctx, underlyingOffset, end, r.config, chunkSrc)
+				return newTGMultiReader(r.ctx, underlyingOffset, end, r.config, chunkSrc, tuner)
 
 			}, currentRange.Start, currentRange.End-currentRange.Start+1)
 	}
 
-	return reader, err
+	return newTGMultiReader(r.ctx, currentRange.Start, currentRange.End, r.config, chunkSrc, tuner)
+
+}
 
+// botConcurrency returns the limit of the bot that currently downloads the
+// chunks of stripe i, which changes when the bot fails over.
+func (r *Reader) botConcurrency(i int) *concurrencyLimit {
+	stripe, _ := r.slots[i].get()
+	return botConcurrency(stripe.BotID, &r.config.Stream)
 }
@@ -0,0 +1,21 @@
+package reader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculatePartByteRanges(t *testing.T) {
+	sizes := []int64{10, 10, 4, 6}
+	assert.Equal(t, []Range{{Start: 0, End: 9, PartNo: 0}}, calculatePartByteRanges(0, 9, sizes))
+	assert.Equal(t, []Range{
+		{Start: 5, End: 9, PartNo: 0},
+		{Start: 0, End: 9, PartNo: 1},
+		{Start: 0, End: 3, PartNo: 2},
+		{Start: 0, End: 1, PartNo: 3},
+	}, calculatePartByteRanges(5, 25, sizes))
+	// Parts of different sizes, as tus uploads store them
+	assert.Equal(t, []Range{{Start: 2, End: 3, PartNo: 2}, {Start: 0, End: 5, PartNo: 3}},
+		calculatePartByteRanges(22, 29, sizes))
+}
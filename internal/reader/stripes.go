@@ -0,0 +1,50 @@
+package reader
+
+import (
+	"context"
+
+	"github.com/gotd/td/tg"
+)
+
+// Stripe is a bot client that streams share the chunks of a file with, next
+// to the client the reader was created with.
+type Stripe struct {
+	Client *tg.Client
+	BotID  string
+}
+
+type stripesKey struct{}
+
+// WithStripes returns a context whose readers download the chunks of a file
+// through their own client and the stripes in turn.
+func WithStripes(ctx context.Context, stripes []Stripe) context.Context {
+	if len(stripes) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, stripesKey{}, stripes)
+}
+
+func stripesFrom(ctx context.Context) []Stripe {
+	stripes, _ := ctx.Value(stripesKey{}).([]Stripe)
+	return stripes
+}
+
+// stripedSource downloads consecutive chunks through its sources in turn.
+// Each source has the file location looked up by its own bot.
+type stripedSource struct {
+	sources []ChunkSource
+}
+
+func (s *stripedSource) ChunkSize(start, end int64) int64 {
+	return s.sources[0].ChunkSize(start, end)
+}
+
+func (s *stripedSource) Chunk(ctx context.Context, offset int64, limit int64) ([]byte, error) {
+	return s.sources[(offset/limit)%int64(len(s.sources))].Chunk(ctx, offset, limit)
+}
+
+// width is the number of chunks downloaded at the same time for every chunk
+// a single bot would download.
+func (s *stripedSource) width() int {
+	return len(s.sources)
+}
@@ -0,0 +1,88 @@
+package reader
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+// botSource serves chunks like flakySource and records their offsets.
+type botSource struct {
+	flakySource
+	delay   time.Duration
+	offsets []int64
+}
+
+func (s *botSource) Chunk(ctx context.Context, offset, limit int64) ([]byte, error) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.offsets = append(s.offsets, offset)
+	s.mu.Unlock()
+	return s.flakySource.Chunk(ctx, offset, limit)
+}
+
+func TestStripedReader(t *testing.T) {
+	cnf := &config.TGConfig{Stream: config.TGStream{Concurrency: 1, Buffers: 8, ChunkTimeout: time.Second}}
+	// The slow bot finishes its chunks last, they still come in order
+	bots := []*botSource{{delay: 5 * time.Millisecond}, {}, {}}
+	src := &stripedSource{}
+	for _, bot := range bots {
+		src.sources = append(src.sources, bot)
+	}
+	r, err := newTGMultiReader(context.Background(), 1, 46, cnf, src, nil)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Len(t, r.concurrency, 3)
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Len(t, data, 46)
+	for i, b := range data {
+		assert.Equal(t, byte(i+1), b)
+	}
+	assert.Equal(t, []int64{0, 12, 24, 36}, bots[0].offsets)
+	assert.Equal(t, []int64{4, 16, 28, 40}, bots[1].offsets)
+	assert.Equal(t, []int64{8, 20, 32, 44}, bots[2].offsets)
+}
+
+func TestStripedReaderAdaptive(t *testing.T) {
+	cnf := &config.TGConfig{Stream: config.TGStream{
+		Concurrency: 4, Adaptive: true, MinConcurrency: 1, MaxConcurrency: 4,
+		Buffers: 8, ChunkTimeout: 100 * time.Millisecond,
+	}}
+	// The slow bot gets close to the chunk timeout, the fast one does not
+	bots := []*botSource{{delay: 60 * time.Millisecond}, {delay: 5 * time.Millisecond}}
+	src := &stripedSource{}
+	tuners := make([]*concurrencyLimit, len(bots))
+	for i, bot := range bots {
+		src.sources = append(src.sources, bot)
+		tuners[i] = newConcurrencyLimit(&cnf.Stream)
+	}
+	r, err := newTGMultiReader(context.Background(), 0, 95, cnf, src, func(stripe int) *concurrencyLimit {
+		return tuners[stripe]
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Len(t, data, 96)
+	for i, b := range data {
+		assert.Equal(t, byte(i), b)
+	}
+	// Only the slow bot backed off
+	assert.Equal(t, 1, tuners[0].current())
+	assert.Greater(t, tuners[1].current(), tuners[0].current())
+}
+
+func TestWithStripes(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, ctx, WithStripes(ctx, nil))
+	stripes := []Stripe{{BotID: "1"}, {BotID: "2"}}
+	assert.Equal(t, stripes, stripesFrom(WithStripes(ctx, stripes)))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 	"time"
 
@@ -35,6 +36,10 @@ type chunkSource struct {
 	client      *tg.Client
 	key         string
 	cache       cache.Cacher
+	// chunks caches the chunks of the part, which has size bytes, if set.
+	chunks  *ChunkCache
+	size    int64
+	timeout time.Duration
 }
 
 func (c *chunkSource) ChunkSize(start, end int64) int64 {
@@ -42,6 +47,28 @@ func (c *chunkSource) ChunkSize(start, end int64) int64 {
 }
 
 func (c *chunkSource) Chunk(ctx context.Context, offset int64, limit int64) ([]byte, error) {
+	if c.chunks == nil {
+		return c.download(ctx, offset, limit)
+	}
+	for i := 1; i <= c.chunks.prefetch; i++ {
+		next := offset + int64(i)*limit
+		if next >= c.size {
+			break
+		}
+		c.chunks.Prefetch(ctx, c.chunkKey(next, limit), c.timeout, func(ctx context.Context) ([]byte, error) {
+			return c.download(ctx, next, limit)
+		})
+	}
+	return c.chunks.Get(ctx, c.chunkKey(offset, limit), func(ctx context.Context) ([]byte, error) {
+		return c.download(ctx, offset, limit)
+	})
+}
+
+func (c *chunkSource) chunkKey(offset, limit int64) ChunkKey {
+	return ChunkKey{ChannelId: c.channelId, MessageId: c.partId, Offset: offset, Limit: limit}
+}
+
+func (c *chunkSource) download(ctx context.Context, offset int64, limit int64) ([]byte, error) {
 	var (
 		location tg.InputDocumentFileLocation
 		err      error
@@ -70,7 +97,6 @@ type tgMultiReader struct {
 	chunkSize   int64
 	bufferChan  chan *buffer
 	cur         *buffer
-	concurrency int
 	leftCut     int64
 	rightCut    int64
 	totalParts  int
@@ -79,14 +105,39 @@ type tgMultiReader struct {
 	timeout     time.Duration
 	logger      *zap.Logger
 	closeOnce   sync.Once
+	// concurrency is the number of chunks downloaded at the same time
+	// through the bot of each stripe.
+	concurrency []int
+	// tuner returns the limit of the bot of a stripe, which adapts the
+	// concurrency of the stripe between batches, if set.
+	tuner func(stripe int) *concurrencyLimit
+	// throughput is that of each stripe in the previous batch.
+	throughput []float64
+	retries    int
+	failovers  int
+}
+
+// stripeError is the error of a chunk downloaded through the bot of stripe.
+type stripeError struct {
+	stripe int
+	err    error
 }
 
+func (e *stripeError) Error() string { return e.err.Error() }
+
+func (e *stripeError) Unwrap() error { return e.err }
+
+// maxBatchRetries is the number of times a batch is downloaded again with a
+// lower concurrency after a flood wait or a chunk timeout.
+const maxBatchRetries = 3
+
 func newTGMultiReader(
 	ctx context.Context,
 	start int64,
 	end int64,
 	config *config.TGConfig,
 	chunkSrc ChunkSource,
+	tuner func(stripe int) *concurrencyLimit,
 ) (*tgMultiReader, error) {
 	chunkSize := chunkSrc.ChunkSize(start, end)
 	offset := start - (start % chunkSize)
@@ -94,20 +145,37 @@ func newTGMultiReader(
 	ctx, cancel := context.WithCancel(ctx)
 
 	r := &tgMultiReader{
-		ctx:         ctx,
-		cancel:      cancel,
-		limit:       end - start + 1,
-		bufferChan:  make(chan *buffer, config.Stream.Buffers),
-		concurrency: config.Stream.Concurrency,
-		leftCut:     start - offset,
-		rightCut:    (end % chunkSize) + 1,
-		totalParts:  int((end - offset + chunkSize) / chunkSize),
-		offset:      offset,
-		chunkSize:   chunkSize,
-		chunkSrc:    chunkSrc,
-		timeout:     config.Stream.ChunkTimeout,
-		logger:      logging.FromContext(ctx),
+		ctx:        ctx,
+		cancel:     cancel,
+		limit:      end - start + 1,
+		bufferChan: make(chan *buffer, config.Stream.Buffers),
+		leftCut:    start - offset,
+		rightCut:   (end % chunkSize) + 1,
+		totalParts: int((end - offset + chunkSize) / chunkSize),
+		offset:     offset,
+		chunkSize:  chunkSize,
+		chunkSrc:   chunkSrc,
+		timeout:    config.Stream.ChunkTimeout,
+		logger:     logging.FromContext(ctx),
+		tuner:      tuner,
+	}
+	width := 1
+	if striped, ok := chunkSrc.(*stripedSource); ok {
+		width = striped.width()
+	}
+	r.concurrency = make([]int, width)
+	r.throughput = make([]float64, width)
+	for i := range r.concurrency {
+		r.concurrency[i] = config.Stream.Concurrency
 	}
+	r.tune()
+	r.logger.Debug("stream.reader_started",
+		zap.Ints("concurrency", r.concurrency),
+		zap.Int("bots", width),
+		zap.Bool("adaptive", tuner != nil),
+		zap.Int("buffers", config.Stream.Buffers),
+		zap.Int64("chunk_size", chunkSize),
+		zap.Duration("chunk_timeout", r.timeout))
 
 	go r.fillBuffer()
 	return r, nil
@@ -152,31 +220,87 @@ func (r *tgMultiReader) fillBuffer() {
 	defer close(r.bufferChan)
 
 	for r.currentPart < r.totalParts {
-		if err := r.fillBatch(); err != nil {
-			r.cancel()
-			return
+		err := r.fillBatch()
+		if err == nil {
+			continue
 		}
+		if errors.Is(err, errBotReplaced) && r.failovers < maxFailovers {
+			r.failovers++
+			continue
+		}
+		var failed *stripeError
+		if r.tuner != nil && r.retries < maxBatchRetries && errors.As(err, &failed) {
+			// Only the bot that failed backs off
+			if concurrency, retry := r.tuner(failed.stripe).batchFailed(err); retry {
+				r.retries++
+				r.logger.Debug("stream.concurrency_reduced", zap.Error(err), zap.Int("stripe", failed.stripe),
+					zap.Int("concurrency", concurrency), zap.Int("part", r.currentPart))
+				continue
+			}
+		}
+		if !errors.Is(err, context.Canceled) {
+			r.logger.Error("stream.chunk_failed", zap.Error(err), zap.Int("part", r.currentPart),
+				zap.Int("total_parts", r.totalParts), zap.Ints("concurrency", r.concurrency))
+		}
+		r.cancel()
+		return
 	}
 }
 
+// tune sets the concurrency of every stripe to the limit of its bot.
+func (r *tgMultiReader) tune() {
+	if r.tuner == nil {
+		return
+	}
+	for i := range r.concurrency {
+		r.concurrency[i] = r.tuner(i).current()
+	}
+}
+
+// stripe returns the stripe chunk i of the batch is downloaded through.
+func (r *tgMultiReader) stripe(i int) int {
+	return int((r.offset/r.chunkSize + int64(i)) % int64(len(r.concurrency)))
+}
+
 func (r *tgMultiReader) fillBatch() error {
+	r.tune()
 	g, ctx := errgroup.WithContext(r.ctx)
-	g.SetLimit(r.concurrency)
+	// Every stripe gets as many chunks as the busiest one and downloads
+	// them within its own limit
+	n := min(slices.Max(r.concurrency)*len(r.concurrency), r.totalParts-r.currentPart)
 
-	buffers := make([]*buffer, r.concurrency)
+	slots := make([]chan struct{}, len(r.concurrency))
+	for s, concurrency := range r.concurrency {
+		slots[s] = make(chan struct{}, concurrency)
+	}
+	buffers := make([]*buffer, n)
+	latency := make([]time.Duration, n)
+	finished := make([]time.Duration, n)
+	started := time.Now()
 
-	for i := 0; i < r.concurrency && r.currentPart+i < r.totalParts; i++ {
+	for i := range n {
+		s := r.stripe(i)
 		g.Go(func() error {
+			select {
+			case slots[s] <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-slots[s] }()
+
 			chunkCtx, cancel := context.WithTimeout(ctx, r.timeout)
 			defer cancel()
 
+			chunkStarted := time.Now()
 			chunk, err := r.chunkSrc.Chunk(chunkCtx, r.offset+int64(i)*r.chunkSize, r.chunkSize)
 			if err != nil {
-				if errors.Is(err, context.DeadlineExceeded) {
-					return fmt.Errorf("chunk %d: %w", r.currentPart+i, ErrChunkTimeout)
+				if errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, errBotReplaced) {
+					err = fmt.Errorf("chunk %d: %w", r.currentPart+i, ErrChunkTimeout)
 				}
-				return err
+				return &stripeError{stripe: s, err: err}
 			}
+			latency[i] = time.Since(chunkStarted)
+			finished[i] = time.Since(started)
 
 			if r.totalParts == 1 {
 				chunk = chunk[r.leftCut:r.rightCut]
@@ -192,17 +316,10 @@ func (r *tgMultiReader) fillBatch() error {
 	}
 
 	if err := g.Wait(); err != nil {
-		if !errors.Is(err, context.Canceled) {
-			r.logger.Error("stream.chunk_failed", zap.Error(err), zap.Int("part", r.currentPart), zap.Int("total_parts", r.totalParts))
-		}
-
 		return err
 	}
 
 	for _, buf := range buffers {
-		if buf == nil {
-			break
-		}
 		select {
 		case r.bufferChan <- buf:
 		case <-r.ctx.Done():
@@ -210,8 +327,44 @@ func (r *tgMultiReader) fillBatch() error {
 		}
 	}
 
-	r.currentPart += r.concurrency
-	r.offset += r.chunkSize * int64(r.concurrency)
+	if r.tuner != nil {
+		r.learn(buffers, latency, finished)
+	}
+
+	r.currentPart += n
+	r.offset += r.chunkSize * int64(n)
 
 	return nil
 }
+
+// learn records the batch of chunks in buffers with the limit of the bot of
+// each stripe. latency is the time each chunk took and finished the time
+// since the batch started at which it was done.
+func (r *tgMultiReader) learn(buffers []*buffer, latency, finished []time.Duration) {
+	for s := range r.concurrency {
+		var (
+			chunks, size     int
+			slowest, elapsed time.Duration
+		)
+		for i, buf := range buffers {
+			if r.stripe(i) != s {
+				continue
+			}
+			chunks++
+			size += len(buf.buf)
+			slowest = max(slowest, latency[i])
+			elapsed = max(elapsed, finished[i])
+		}
+		if chunks == 0 || elapsed <= 0 {
+			continue
+		}
+		throughput := float64(size) / elapsed.Seconds()
+		concurrency := r.tuner(s).batchDone(min(chunks, r.concurrency[s]), slowest, throughput, r.throughput[s])
+		if concurrency != r.concurrency[s] {
+			r.logger.Debug("stream.concurrency_changed", zap.Int("stripe", s), zap.Int("concurrency", concurrency),
+				zap.Int("previous", r.concurrency[s]), zap.Float64("throughput", throughput), zap.Duration("latency", slowest))
+			r.concurrency[s] = concurrency
+		}
+		r.throughput[s] = throughput
+	}
+}
@@ -0,0 +1,371 @@
+// Package sigv4 verifies AWS Signature Version 4 signed requests, as sent by
+// S3 clients, both in the Authorization header and as presigned URLs.
+package sigv4
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm     = "AWS4-HMAC-SHA256"
+	timeFormat    = "20060102T150405Z"
+	maxClockSkew  = 15 * time.Minute
+	maxPresignAge = 7 * 24 * time.Hour
+
+	UnsignedPayload          = "UNSIGNED-PAYLOAD"
+	StreamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+var (
+	ErrMissingAuth       = errors.New("request is not signed")
+	ErrMalformed         = errors.New("malformed authorization")
+	ErrUnknownAccessKey  = errors.New("unknown access key")
+	ErrSignatureMismatch = errors.New("signature does not match")
+	ErrRequestExpired    = errors.New("request time too skewed or expired")
+	ErrPayloadMismatch   = errors.New("payload does not match its signed hash")
+)
+
+// SecretFunc returns the secret key of an access key, or ErrUnknownAccessKey.
+type SecretFunc func(accessKey string) (string, error)
+
+// Result is a verified request. Body yields the decoded payload and fails
+// with ErrPayloadMismatch when it does not match what was signed.
+type Result struct {
+	AccessKey     string
+	Body          io.Reader
+	ContentLength int64
+}
+
+type credential struct {
+	accessKey string
+	date      string
+	region    string
+	service   string
+}
+
+func (c *credential) scope() string {
+	return strings.Join([]string{c.date, c.region, c.service, "aws4_request"}, "/")
+}
+
+func parseCredential(v string) (*credential, error) {
+	parts := strings.Split(v, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, ErrMalformed
+	}
+	return &credential{accessKey: parts[0], date: parts[1], region: parts[2], service: parts[3]}, nil
+}
+
+// Verify checks the signature of r against the secret of its access key.
+func Verify(r *http.Request, secretFor SecretFunc, now time.Time) (*Result, error) {
+	var (
+		cred          *credential
+		signedHeaders []string
+		signature     string
+		amzDate       string
+		payloadHash   string
+		presigned     bool
+	)
+
+	query := r.URL.Query()
+	if h := r.Header.Get("Authorization"); h != "" {
+		if !strings.HasPrefix(h, algorithm+" ") {
+			return nil, ErrMalformed
+		}
+		fields := map[string]string{}
+		for _, f := range strings.Split(strings.TrimPrefix(h, algorithm+" "), ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(f), "=")
+			if !ok {
+				return nil, ErrMalformed
+			}
+			fields[k] = v
+		}
+		var err error
+		if cred, err = parseCredential(fields["Credential"]); err != nil {
+			return nil, err
+		}
+		signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+		signature = fields["Signature"]
+		amzDate = r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			if d, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+				amzDate = d.UTC().Format(timeFormat)
+			}
+		}
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = UnsignedPayload
+		}
+	} else if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != algorithm {
+			return nil, ErrMalformed
+		}
+		var err error
+		if cred, err = parseCredential(query.Get("X-Amz-Credential")); err != nil {
+			return nil, err
+		}
+		signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = UnsignedPayload
+		presigned = true
+	} else {
+		return nil, ErrMissingAuth
+	}
+
+	if signature == "" || len(signedHeaders) == 0 {
+		return nil, ErrMalformed
+	}
+	t, err := time.Parse(timeFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, cred.date) {
+		return nil, ErrMalformed
+	}
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignAge {
+			return nil, ErrMalformed
+		}
+		if now.Before(t.Add(-maxClockSkew)) || now.After(t.Add(time.Duration(expires)*time.Second)) {
+			return nil, ErrRequestExpired
+		}
+	} else if d := now.Sub(t); d > maxClockSkew || d < -maxClockSkew {
+		return nil, ErrRequestExpired
+	}
+
+	secret, err := secretFor(cred.accessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := canonicalRequest(r, signedHeaders, payloadHash, presigned)
+	key := signingKey(secret, cred)
+	stringToSign := strings.Join([]string{algorithm, amzDate, cred.scope(), hexSHA256([]byte(canonical))}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrSignatureMismatch
+	}
+
+	res := &Result{AccessKey: cred.accessKey, Body: r.Body, ContentLength: r.ContentLength}
+	switch payloadHash {
+	case UnsignedPayload:
+	case StreamingPayload, StreamingPayloadTrailer, StreamingUnsignedTrailer:
+		res.ContentLength, err = strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		cr := &chunkedReader{r: bufio.NewReader(r.Body)}
+		if payloadHash != StreamingUnsignedTrailer {
+			cr.key = key
+			cr.prevSig = signature
+			cr.amzDate = amzDate
+			cr.scope = cred.scope()
+		}
+		res.Body = cr
+	default:
+		want, err := hex.DecodeString(payloadHash)
+		if err != nil || len(want) != sha256.Size {
+			return nil, ErrMalformed
+		}
+		res.Body = &hashingReader{r: r.Body, h: sha256.New(), want: want}
+	}
+	return res, nil
+}
+
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string, presigned bool) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(r.URL.Query(), presigned))
+	b.WriteByte('\n')
+	for _, name := range signedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		switch {
+		case name == "host":
+			b.WriteString(r.Host)
+		case name == "content-length" && r.Header.Get(name) == "":
+			b.WriteString(strconv.FormatInt(r.ContentLength, 10))
+		default:
+			values := r.Header.Values(name)
+			for i, v := range values {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(strings.Join(strings.Fields(v), " "))
+			}
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+func canonicalQuery(query url.Values, presigned bool) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes everything but the RFC 3986 unreserved characters.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret string, cred *credential) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(cred.date))
+	key = hmacSHA256(key, []byte(cred.region))
+	key = hmacSHA256(key, []byte(cred.service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashingReader fails at EOF when the content does not hash to want.
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(h.h.Sum(nil), h.want) {
+		return n, ErrPayloadMismatch
+	}
+	return n, err
+}
+
+var emptySHA256 = hexSHA256(nil)
+
+// chunkedReader decodes an aws-chunked body. When key is set every chunk
+// signature is verified against the signature chain seeded by the request.
+type chunkedReader struct {
+	r       *bufio.Reader
+	key     []byte
+	prevSig string
+	amzDate string
+	scope   string
+
+	chunk []byte
+	done  bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) next() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return ErrMalformed
+	}
+	line = strings.TrimRight(line, "\r\n")
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > 64<<20 {
+		return ErrMalformed
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return ErrMalformed
+	}
+
+	if c.key != nil {
+		sig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return ErrPayloadMismatch
+		}
+		stringToSign := strings.Join([]string{algorithm + "-PAYLOAD", c.amzDate, c.scope,
+			c.prevSig, emptySHA256, hexSHA256(data)}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.key, []byte(stringToSign)))
+		if !hmac.Equal([]byte(expected), []byte(sig)) {
+			return ErrPayloadMismatch
+		}
+		c.prevSig = sig
+	}
+
+	if size == 0 {
+		// Skip trailing headers up to the terminating empty line.
+		for {
+			line, err := c.r.ReadString('\n')
+			if strings.TrimRight(line, "\r\n") == "" || err != nil {
+				break
+			}
+		}
+		c.done = true
+		return nil
+	}
+	if _, err := c.r.Discard(2); err != nil {
+		return ErrMalformed
+	}
+	c.chunk = data
+	return nil
+}
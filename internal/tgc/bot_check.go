@@ -0,0 +1,158 @@
+package tgc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+)
+
+var ErrBotNotAdmin = errors.New("bot is not an admin of the channel")
+
+// botCheckTimeout bounds the check of a bot, flood waits included.
+const botCheckTimeout = time.Minute
+
+// BotCheck is the outcome of checking a bot. A bot that is not disabled but
+// has an error could not be checked, e.g. because of a flood wait, and is
+// left as it was.
+type BotCheck struct {
+	BotID    int64  `json:"botId"`
+	UserName string `json:"userName,omitempty"`
+	Disabled bool   `json:"disabled"`
+	Error    string `json:"error,omitempty"`
+	// Changed is set when the check disabled the bot or enabled it again.
+	Changed bool `json:"changed"`
+}
+
+// CheckBot logs the bot in and verifies that it is an admin of each of the
+// channels. The info of the bot is returned once it logged in.
+func CheckBot(ctx context.Context, db *gorm.DB, cache cache.Cacher, config *config.TGConfig, token string, channelIDs []int64) (*types.BotInfo, error) {
+	middlewares := NewMiddleware(config, WithFloodWait(), WithRateLimit())
+	client, err := BotClient(ctx, db, cache, config, token, middlewares...)
+	if err != nil {
+		return nil, err
+	}
+	var info *types.BotInfo
+	err = RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+		user, err := client.Self(ctx)
+		if err != nil {
+			return err
+		}
+		info = &types.BotInfo{Id: user.ID, UserName: user.Username, Token: token}
+		for _, channelID := range channelIDs {
+			if err := checkChannelAdmin(ctx, client.API(), channelID); err != nil {
+				return fmt.Errorf("channel %d: %w", channelID, err)
+			}
+		}
+		return nil
+	})
+	return info, err
+}
+
+func checkChannelAdmin(ctx context.Context, client *tg.Client, channelID int64) error {
+	channel, err := GetChannelFull(ctx, client, channelID)
+	if errors.Is(err, ErrInValidChannelId) {
+		return ErrBotNotAdmin
+	}
+	if err != nil {
+		return err
+	}
+	if _, admin := channel.GetAdminRights(); channel.ID == channelID && (admin || channel.Creator) {
+		return nil
+	}
+	return ErrBotNotAdmin
+}
+
+// isDeadBot reports whether err from CheckBot means the bot cannot be used
+// any more: its token was revoked or it lost its rights in a channel. Errors
+// about the stored session of the bot, like AUTH_KEY_UNREGISTERED, say
+// nothing about its token and leave it as it is.
+func isDeadBot(err error) bool {
+	return errors.Is(err, ErrBotNotAdmin) || tgerr.Is(err,
+		"ACCESS_TOKEN_INVALID", "ACCESS_TOKEN_EXPIRED", "BOT_INVALID", "USER_DEACTIVATED", "USER_DEACTIVATED_BAN",
+		"CHANNEL_PRIVATE", "CHANNEL_INVALID", "CHAT_ADMIN_REQUIRED", "CHAT_FORBIDDEN")
+}
+
+// CheckBots checks every bot of the user against the channels of the user.
+// Dead bots are disabled, so that BotTokens leaves them out, and disabled
+// bots that pass are enabled again.
+func (cm *ChannelManager) CheckBots(ctx context.Context, userID int64) ([]BotCheck, error) {
+	var bots []models.Bot
+	if err := cm.db.Where("user_id = ?", userID).Order("bot_id").Find(&bots).Error; err != nil {
+		return nil, err
+	}
+	var channels []int64
+	if err := cm.db.Model(&models.Channel{}).Where("user_id = ?", userID).Pluck("channel_id", &channels).Error; err != nil {
+		return nil, err
+	}
+
+	checks := make([]BotCheck, len(bots))
+	var g errgroup.Group
+	g.SetLimit(4)
+	for i := range bots {
+		g.Go(func() error {
+			checkCtx, cancel := context.WithTimeout(ctx, botCheckTimeout)
+			defer cancel()
+			info, err := CheckBot(checkCtx, cm.db, cm.cache, cm.cnf, bots[i].Token, channels)
+			checks[i] = cm.saveBotCheck(ctx, &bots[i], info, err)
+			return nil
+		})
+	}
+	g.Wait()
+
+	for _, check := range checks {
+		if check.Changed {
+			cm.cache.Delete(ctx, cache.KeyUserBots(userID))
+			break
+		}
+	}
+	return checks, nil
+}
+
+func (cm *ChannelManager) saveBotCheck(ctx context.Context, bot *models.Bot, info *types.BotInfo, err error) BotCheck {
+	logger := logging.Component("TG").With(zap.Int64("user_id", bot.UserId), zap.Int64("bot_id", bot.BotId))
+	check := BotCheck{BotID: bot.BotId, Disabled: bot.Disabled}
+	if info != nil {
+		check.UserName = info.UserName
+	}
+	updates := map[string]any{"checked_at": time.Now().UTC(), "last_error": nil}
+	switch {
+	case err == nil:
+		check.Disabled = false
+	case isDeadBot(err):
+		check.Disabled = true
+	}
+	if err != nil {
+		check.Error = err.Error()
+		updates["last_error"] = check.Error
+	}
+	updates["disabled"] = check.Disabled
+
+	if dbErr := cm.db.WithContext(ctx).Model(&models.Bot{}).Where("user_id = ? AND token = ?", bot.UserId, bot.Token).
+		Updates(updates).Error; dbErr != nil {
+		logger.Error("bot.check.save_failed", zap.Error(dbErr))
+		check.Disabled = bot.Disabled
+		return check
+	}
+	check.Changed = check.Disabled != bot.Disabled
+	switch {
+	case check.Changed && check.Disabled:
+		logger.Warn("bot.check.disabled", zap.Error(err))
+	case check.Changed:
+		logger.Info("bot.check.enabled")
+	case err != nil && !check.Disabled:
+		logger.Warn("bot.check.failed", zap.Error(err))
+	}
+	return check
+}
@@ -0,0 +1,64 @@
+package tgc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+)
+
+// channelsClient answers channels.getChannels with chats.
+func channelsClient(chats ...tg.ChatClass) *tg.Client {
+	return tg.NewClient(invokerFunc(func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		var b bin.Buffer
+		if err := (&tg.MessagesChats{Chats: chats}).Encode(&b); err != nil {
+			return err
+		}
+		return output.Decode(&b)
+	}))
+}
+
+func channel(id int64) *tg.Channel {
+	return &tg.Channel{ID: id, Photo: &tg.ChatPhotoEmpty{}}
+}
+
+func TestCheckChannelAdmin(t *testing.T) {
+	ctx := context.Background()
+	admin := channel(1)
+	admin.SetAdminRights(tg.ChatAdminRights{PostMessages: true})
+	creator := channel(1)
+	creator.Creator = true
+
+	assert.NoError(t, checkChannelAdmin(ctx, channelsClient(admin), 1))
+	assert.NoError(t, checkChannelAdmin(ctx, channelsClient(creator), 1))
+	assert.ErrorIs(t, checkChannelAdmin(ctx, channelsClient(channel(1)), 1), ErrBotNotAdmin)
+	assert.ErrorIs(t, checkChannelAdmin(ctx, channelsClient(&tg.ChannelForbidden{ID: 1}), 1), ErrBotNotAdmin)
+	assert.ErrorIs(t, checkChannelAdmin(ctx, channelsClient(admin), 2), ErrBotNotAdmin)
+}
+
+func TestIsDeadBot(t *testing.T) {
+	for _, err := range []error{
+		fmt.Errorf("channel 1: %w", ErrBotNotAdmin),
+		tgerr.New(400, "ACCESS_TOKEN_INVALID"),
+		tgerr.New(401, "USER_DEACTIVATED"),
+		fmt.Errorf("channel 1: %w", tgerr.New(400, "CHANNEL_INVALID")),
+		tgerr.New(403, "CHAT_ADMIN_REQUIRED"),
+	} {
+		assert.True(t, isDeadBot(err), err.Error())
+	}
+	// Failures that say nothing about the bot leave it as it is
+	for _, err := range []error{
+		tgerr.New(401, "AUTH_KEY_UNREGISTERED"),
+		tgerr.New(401, "SESSION_REVOKED"),
+		tgerr.New(420, "FLOOD_WAIT_30"),
+		context.DeadlineExceeded,
+		errors.New("connection reset"),
+	} {
+		assert.False(t, isDeadBot(err), err.Error())
+	}
+}
@@ -0,0 +1,343 @@
+package tgc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// errorWindow is how long errors of a bot count against it after the
+	// last one.
+	errorWindow = 5 * time.Minute
+	// unhealthyErrors is the number of recent errors that makes a bot
+	// unhealthy.
+	unhealthyErrors = 3
+	// healthTTL is how long the health of a bot without operations is kept.
+	healthTTL = time.Hour
+)
+
+// BotStatus is the health of a bot.
+type BotStatus struct {
+	BotID      string     `json:"botId"`
+	Healthy    bool       `json:"healthy"`
+	InFlight   int64      `json:"inFlight"`
+	Errors     int64      `json:"errors"`
+	LastError  string     `json:"lastError,omitempty"`
+	FloodUntil *time.Time `json:"floodUntil,omitempty"`
+	LatencyMs  int64      `json:"latencyMs"`
+}
+
+// BotHealth is implemented by selectors that pick bots by their health.
+type BotHealth interface {
+	// Middleware records the outcome of the requests of the bot botID.
+	Middleware(botID string) telegram.Middleware
+	// Status returns the health of the bots in order.
+	Status(ctx context.Context, botIDs []string) ([]BotStatus, error)
+}
+
+// botHealth is the health of a bot as kept by a healthStore.
+type botHealth struct {
+	inFlight   int64
+	errors     int64
+	errorAt    time.Time
+	lastError  string
+	floodUntil time.Time
+	latency    time.Duration
+}
+
+func (h *botHealth) status(botID string, now time.Time) BotStatus {
+	s := BotStatus{BotID: botID, InFlight: max(h.inFlight, 0), LatencyMs: h.latency.Milliseconds()}
+	if now.Sub(h.errorAt) <= errorWindow {
+		s.Errors = h.errors
+		s.LastError = h.lastError
+	}
+	if h.floodUntil.After(now) {
+		until := h.floodUntil
+		s.FloodUntil = &until
+	}
+	s.Healthy = s.FloodUntil == nil && s.Errors < unhealthyErrors
+	return s
+}
+
+// healthStore keeps the health of bots.
+type healthStore interface {
+	begin(ctx context.Context, botID string)
+	// end records a request of botID that took latency and failed with err,
+	// if not nil, or had to wait for a flood wait ending at floodUntil.
+	end(ctx context.Context, botID string, latency time.Duration, err error, floodUntil time.Time)
+	load(ctx context.Context, botIDs []string) ([]botHealth, error)
+}
+
+// HealthBotSelector picks bots at random, weighted by their health: bots
+// waiting out a flood wait are skipped, bots with recent errors are rarely
+// picked, and busy or slow bots less often than the others. The health is
+// learned from the requests of clients using Middleware.
+type HealthBotSelector struct {
+	store  healthStore
+	now    func() time.Time
+	random func() float64
+}
+
+// NewHealthBotSelector creates a health-aware bot selector. The health of
+// bots is shared through Redis when redisClient is set.
+func NewHealthBotSelector(redisClient *redis.Client) *HealthBotSelector {
+	var store healthStore = &memoryHealthStore{bots: make(map[string]*botHealth)}
+	if redisClient != nil {
+		store = &redisHealthStore{client: redisClient}
+	}
+	return &HealthBotSelector{store: store, now: time.Now, random: rand.Float64}
+}
+
+// Next returns a healthy bot for the operation, or the bot whose flood wait
+// ends first when all of them wait.
+func (s *HealthBotSelector) Next(ctx context.Context, op BotOp, userID int64, bots []string) (string, int, error) {
+	if len(bots) == 0 {
+		return "", 0, fmt.Errorf("no bots available")
+	}
+	statuses, err := s.Status(ctx, botIDs(bots))
+	if err != nil {
+		return "", 0, err
+	}
+
+	weights := make([]float64, len(bots))
+	var total float64
+	soonest := -1
+	for i, st := range statuses {
+		if st.FloodUntil != nil {
+			if soonest < 0 || st.FloodUntil.Before(*statuses[soonest].FloodUntil) {
+				soonest = i
+			}
+			continue
+		}
+		w := 1 / float64(1+st.InFlight) / (1 + float64(st.LatencyMs)/1000)
+		if !st.Healthy {
+			w /= 100
+		}
+		weights[i] = w
+		total += w
+	}
+	if total == 0 {
+		return bots[soonest], soonest, nil
+	}
+	pick := s.random() * total
+	last := 0
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		if pick < w {
+			return bots[i], i, nil
+		}
+		pick -= w
+		last = i
+	}
+	return bots[last], last, nil
+}
+
+// Status returns the health of the bots in order.
+func (s *HealthBotSelector) Status(ctx context.Context, botIDs []string) ([]BotStatus, error) {
+	health, err := s.store.load(ctx, botIDs)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	statuses := make([]BotStatus, len(botIDs))
+	for i, id := range botIDs {
+		statuses[i] = health[i].status(id, now)
+	}
+	return statuses, nil
+}
+
+// Middleware records the outcome of the requests of the bot botID. It has to
+// come after the flood wait middleware to see flood waits.
+func (s *HealthBotSelector) Middleware(botID string) telegram.Middleware {
+	return telegram.MiddlewareFunc(func(next tg.Invoker) telegram.InvokeFunc {
+		return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+			s.store.begin(ctx, botID)
+			started := s.now()
+			err := next.Invoke(ctx, input, output)
+			var (
+				failure    error
+				floodUntil time.Time
+			)
+			if d, ok := tgerr.AsFloodWait(err); ok {
+				floodUntil = started.Add(d)
+			} else if isBotError(err) {
+				failure = err
+			}
+			// Cancelled requests are no longer in flight either
+			s.store.end(context.WithoutCancel(ctx), botID, s.now().Sub(started), failure, floodUntil)
+			return err
+		}
+	})
+}
+
+// isBotError reports whether err counts against the bot. Requests that were
+// cancelled or rejected as invalid say nothing about the bot.
+func isBotError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return !tgerr.IsCode(err, 400)
+}
+
+func botIDs(tokens []string) []string {
+	ids := make([]string, len(tokens))
+	for i, token := range tokens {
+		ids[i], _, _ = strings.Cut(token, ":")
+	}
+	return ids
+}
+
+type memoryHealthStore struct {
+	mu   sync.Mutex
+	bots map[string]*botHealth
+}
+
+func (m *memoryHealthStore) bot(botID string) *botHealth {
+	h, ok := m.bots[botID]
+	if !ok {
+		h = &botHealth{}
+		m.bots[botID] = h
+	}
+	return h
+}
+
+func (m *memoryHealthStore) begin(ctx context.Context, botID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bot(botID).inFlight++
+}
+
+func (m *memoryHealthStore) end(ctx context.Context, botID string, latency time.Duration, err error, floodUntil time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.bot(botID)
+	h.inFlight--
+	now := time.Now()
+	switch {
+	case err != nil:
+		if now.Sub(h.errorAt) > errorWindow {
+			h.errors = 0
+		}
+		h.errors++
+		h.errorAt = now
+		h.lastError = err.Error()
+	case !floodUntil.IsZero():
+		h.floodUntil = floodUntil
+	case h.latency == 0:
+		h.latency = latency
+	default:
+		h.latency = (h.latency*4 + latency) / 5
+	}
+}
+
+func (m *memoryHealthStore) load(ctx context.Context, botIDs []string) ([]botHealth, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	health := make([]botHealth, len(botIDs))
+	for i, id := range botIDs {
+		if h, ok := m.bots[id]; ok {
+			health[i] = *h
+		}
+	}
+	return health, nil
+}
+
+// redisHealthStore keeps the health of each bot in a hash shared by all
+// instances.
+type redisHealthStore struct {
+	client *redis.Client
+}
+
+func healthKey(botID string) string {
+	return "teldrive:bot_health:" + botID
+}
+
+var endScript = redis.NewScript(`
+local key = KEYS[1]
+if redis.call('HINCRBY', key, 'in_flight', -1) < 0 then
+	redis.call('HSET', key, 'in_flight', 0)
+end
+local now = tonumber(ARGV[1])
+if ARGV[3] ~= '' then
+	local at = tonumber(redis.call('HGET', key, 'error_at') or '0')
+	if now - at > tonumber(ARGV[5]) then
+		redis.call('HSET', key, 'errors', 1)
+	else
+		redis.call('HINCRBY', key, 'errors', 1)
+	end
+	redis.call('HSET', key, 'error_at', now, 'last_error', ARGV[3])
+elseif tonumber(ARGV[4]) > 0 then
+	redis.call('HSET', key, 'flood_until', ARGV[4])
+else
+	local old = tonumber(redis.call('HGET', key, 'latency_ms') or ARGV[2])
+	redis.call('HSET', key, 'latency_ms', math.floor((old * 4 + tonumber(ARGV[2])) / 5))
+end
+redis.call('PEXPIRE', key, ARGV[6])
+return 0
+`)
+
+func (r *redisHealthStore) begin(ctx context.Context, botID string) {
+	pipe := r.client.TxPipeline()
+	pipe.HIncrBy(ctx, healthKey(botID), "in_flight", 1)
+	pipe.Expire(ctx, healthKey(botID), healthTTL)
+	pipe.Exec(ctx)
+}
+
+func (r *redisHealthStore) end(ctx context.Context, botID string, latency time.Duration, err error, floodUntil time.Time) {
+	var message string
+	if err != nil {
+		message = err.Error()
+	}
+	var until int64
+	if !floodUntil.IsZero() {
+		until = floodUntil.UnixMilli()
+	}
+	endScript.Run(ctx, r.client, []string{healthKey(botID)},
+		time.Now().UnixMilli(), latency.Milliseconds(), message, until,
+		errorWindow.Milliseconds(), healthTTL.Milliseconds())
+}
+
+func (r *redisHealthStore) load(ctx context.Context, botIDs []string) ([]botHealth, error) {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(botIDs))
+	for i, id := range botIDs {
+		cmds[i] = pipe.HGetAll(ctx, healthKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("redis health failed: %w", err)
+	}
+	health := make([]botHealth, len(botIDs))
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		number := func(name string) int64 {
+			n, _ := strconv.ParseInt(fields[name], 10, 64)
+			return n
+		}
+		h := &health[i]
+		h.inFlight = number("in_flight")
+		h.errors = number("errors")
+		h.lastError = fields["last_error"]
+		h.latency = time.Duration(number("latency_ms")) * time.Millisecond
+		if at := number("error_at"); at > 0 {
+			h.errorAt = time.UnixMilli(at)
+		}
+		if until := number("flood_until"); until > 0 {
+			h.floodUntil = time.UnixMilli(until)
+		}
+	}
+	return health, nil
+}
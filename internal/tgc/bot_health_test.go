@@ -0,0 +1,101 @@
+package tgc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type invokerFunc func(ctx context.Context, input bin.Encoder, output bin.Decoder) error
+
+func (f invokerFunc) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	return f(ctx, input, output)
+}
+
+// request sends one request of botID through the middleware of s, failing
+// with err.
+func request(s *HealthBotSelector, botID string, err error) error {
+	next := invokerFunc(func(context.Context, bin.Encoder, bin.Decoder) error { return err })
+	return s.Middleware(botID).Handle(next).Invoke(context.Background(), nil, nil)
+}
+
+func TestHealthBotSelector(t *testing.T) {
+	s := NewHealthBotSelector(nil)
+	ctx := context.Background()
+	bots := []string{"1:a", "2:b", "3:c"}
+
+	flood := tgerr.New(420, "FLOOD_WAIT_1200")
+	assert.Equal(t, flood, request(s, "1", flood))
+	for range unhealthyErrors {
+		request(s, "2", tgerr.New(401, "AUTH_KEY_UNREGISTERED"))
+	}
+	// Invalid requests are not the fault of the bot
+	request(s, "3", tgerr.New(400, "FILE_REFERENCE_EXPIRED"))
+	request(s, "3", context.Canceled)
+	require.NoError(t, request(s, "3", nil))
+
+	statuses, err := s.Status(ctx, []string{"1", "2", "3"})
+	require.NoError(t, err)
+	assert.False(t, statuses[0].Healthy)
+	require.NotNil(t, statuses[0].FloodUntil)
+	assert.WithinDuration(t, time.Now().Add(20*time.Minute), *statuses[0].FloodUntil, time.Minute)
+	assert.False(t, statuses[1].Healthy)
+	assert.Equal(t, int64(unhealthyErrors), statuses[1].Errors)
+	assert.Contains(t, statuses[1].LastError, "AUTH_KEY_UNREGISTERED")
+	assert.True(t, statuses[2].Healthy)
+	assert.Zero(t, statuses[2].Errors)
+	assert.Zero(t, statuses[2].InFlight)
+
+	// The flood-waited bot is never picked, the failing one rarely
+	picks := map[string]int{}
+	for i := range 100 {
+		s.random = func() float64 { return float64(i) / 100 }
+		token, index, err := s.Next(ctx, BotOpStream, 1, bots)
+		require.NoError(t, err)
+		assert.Equal(t, bots[index], token)
+		picks[token]++
+	}
+	assert.Zero(t, picks["1:a"])
+	assert.Equal(t, 1, picks["2:b"])
+	assert.Equal(t, 99, picks["3:c"])
+
+	// With every bot waiting, the one waiting least is picked
+	request(s, "3", tgerr.New(420, "FLOOD_WAIT_60"))
+	request(s, "2", tgerr.New(420, "FLOOD_WAIT_600"))
+	token, _, err := s.Next(ctx, BotOpUpload, 1, bots)
+	require.NoError(t, err)
+	assert.Equal(t, "3:c", token)
+}
+
+func TestHealthBotSelectorLoad(t *testing.T) {
+	s := NewHealthBotSelector(nil)
+	s.random = func() float64 { return 0 }
+	ctx := context.Background()
+
+	// A bot with requests in flight is picked less often
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go s.Middleware("1").Handle(invokerFunc(func(context.Context, bin.Encoder, bin.Decoder) error {
+		close(started)
+		<-release
+		return nil
+	})).Invoke(ctx, nil, nil)
+	<-started
+	statuses, err := s.Status(ctx, []string{"1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), statuses[0].InFlight)
+
+	s.random = func() float64 { return 0.4 }
+	token, _, err := s.Next(ctx, BotOpStream, 1, []string{"1:a", "2:b"})
+	require.NoError(t, err)
+	assert.Equal(t, "2:b", token)
+	close(release)
+
+	_, _, err = s.Next(ctx, BotOpStream, 1, nil)
+	assert.Error(t, err)
+}
@@ -5,12 +5,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"runtime"
 	"strings"
 	"sync"
 
 	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/uploader"
 	"github.com/gotd/td/tg"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
@@ -47,7 +50,12 @@ func GetChannelFull(ctx context.Context, client *tg.Client, channelId int64) (*t
 	if len(channels.GetChats()) == 0 {
 		return nil, ErrInValidChannelId
 	}
-	return channels.GetChats()[0].(*tg.Channel), nil
+	// A channel the client was banned from comes back as forbidden
+	channel, ok := channels.GetChats()[0].(*tg.Channel)
+	if !ok {
+		return nil, ErrInValidChannelId
+	}
+	return channel, nil
 }
 
 func DeleteMessages(ctx context.Context, client *telegram.Client, channelId int64, ids []int) error {
@@ -152,6 +160,107 @@ func GetMessages(ctx context.Context, client *tg.Client, ids []int, channelId in
 	return allMessages, nil
 }
 
+// ForwardMessages copies messages from one channel to another in batches of
+// 100 and returns the new message id of every forwarded source id. Batches
+// are sent in order; on error the ids forwarded so far are returned with it
+// so callers can clean up. progress, if set, is called after every batch.
+func ForwardMessages(ctx context.Context, client *telegram.Client, fromChannelId, toChannelId int64, ids []int, progress func(done int)) (map[int]int, error) {
+	forwarded := make(map[int]int, len(ids))
+
+	from, err := GetChannelById(ctx, client.API(), fromChannelId)
+	if err != nil {
+		return forwarded, err
+	}
+	to, err := GetChannelById(ctx, client.API(), toChannelId)
+	if err != nil {
+		return forwarded, err
+	}
+
+	batchSize := 100
+
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		randomIds := make([]int64, len(batch))
+		sources := make(map[int64]int, len(batch))
+		for i, id := range batch {
+			randomIds[i], err = client.RandInt64()
+			if err != nil {
+				return forwarded, err
+			}
+			sources[randomIds[i]] = id
+		}
+
+		res, err := client.API().MessagesForwardMessages(ctx, &tg.MessagesForwardMessagesRequest{
+			Silent:     true,
+			DropAuthor: true,
+			FromPeer:   &tg.InputPeerChannel{ChannelID: from.ChannelID, AccessHash: from.AccessHash},
+			ID:         batch,
+			RandomID:   randomIds,
+			ToPeer:     &tg.InputPeerChannel{ChannelID: to.ChannelID, AccessHash: to.AccessHash},
+		})
+		if err != nil {
+			return forwarded, err
+		}
+		updates, ok := res.(*tg.Updates)
+		if !ok {
+			return forwarded, ErrInvalidChannelMessages
+		}
+		count := 0
+		for _, update := range updates.Updates {
+			if msg, ok := update.(*tg.UpdateMessageID); ok {
+				if id, ok := sources[msg.RandomID]; ok {
+					forwarded[id] = msg.ID
+					count++
+				}
+			}
+		}
+		if count != len(batch) {
+			return forwarded, fmt.Errorf("forwarded %d of %d messages", count, len(batch))
+		}
+		if progress != nil {
+			progress(start + len(batch))
+		}
+	}
+	return forwarded, nil
+}
+
+// UploadDocument uploads r as a file named name and posts it to the channel,
+// returning the new message.
+func UploadDocument(ctx context.Context, client *tg.Client, channelId int64, name string, r io.Reader, size int64, threads int) (*tg.Message, error) {
+	channel, err := GetChannelById(ctx, client, channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	u := uploader.NewUploader(client).WithThreads(threads).WithPartSize(512 * 1024)
+	upload, err := u.Upload(ctx, uploader.NewUpload(name, r, size))
+	if err != nil {
+		return nil, err
+	}
+
+	document := message.UploadedDocument(upload).Filename(name).ForceFile(true)
+	sender := message.NewSender(client)
+	target := sender.To(&tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash})
+
+	res, err := target.Media(ctx, document)
+	if err != nil {
+		return nil, err
+	}
+
+	updates, ok := res.(*tg.Updates)
+	if !ok {
+		return nil, ErrInvalidChannelMessages
+	}
+	for _, update := range updates.Updates {
+		if channelMsg, ok := update.(*tg.UpdateNewChannelMessage); ok {
+			if m, ok := channelMsg.Message.(*tg.Message); ok && m.ID != 0 {
+				return m, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("upload failed: invalid message ID 0 from telegram")
+}
+
 func GetChunk(ctx context.Context, client *tg.Client, location tg.InputFileLocationClass, offset int64, limit int64) ([]byte, error) {
 	req := &tg.UploadGetFileRequest{
 		Offset:   offset,
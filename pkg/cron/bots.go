@@ -0,0 +1,39 @@
+package cron
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+)
+
+// checkBots checks the bots of every user and disables those whose token was
+// revoked or that lost their admin rights in a channel of the user.
+func (c *CronService) checkBots(ctx context.Context) {
+	c.logger.Info("cron.check_bots.started")
+	var users []int64
+	if err := c.db.Model(&models.Bot{}).Distinct("user_id").Pluck("user_id", &users).Error; err != nil {
+		c.logger.Error("cron.check_bots.failed", zap.Error(err))
+		return
+	}
+	channelManager := tgc.NewChannelManager(c.db, c.cache, &c.cnf.TG)
+	for _, userID := range users {
+		checks, err := channelManager.CheckBots(ctx, userID)
+		if err != nil {
+			c.logger.Error("cron.check_bots.user_failed", zap.Int64("user_id", userID), zap.Error(err))
+			continue
+		}
+		for _, check := range checks {
+			if check.Changed && check.Disabled {
+				c.events.Record(events.OpBotDisabled, userID, &models.Source{
+					ID:   strconv.FormatInt(check.BotID, 10),
+					Type: "bot",
+					Name: check.UserName,
+				})
+			}
+		}
+	}
+}
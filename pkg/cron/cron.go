@@ -8,9 +8,12 @@ import (
 	"github.com/go-co-op/gocron/v2"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/events"
 	"github.com/tgdrive/teldrive/internal/logging"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"go.uber.org/zap"
 	"gorm.io/datatypes"
@@ -20,6 +23,7 @@ import (
 type file struct {
 	ID    string     `json:"id"`
 	Parts []api.Part `json:"parts"`
+	Hash  *string    `json:"hash"`
 }
 
 type result struct {
@@ -36,13 +40,30 @@ type uploadResult struct {
 	ChannelId int64
 }
 
+// latestSessionJoin attaches the most recent Telegram session of each user,
+// used to delete messages on their behalf.
+const latestSessionJoin = `LEFT JOIN (
+        SELECT user_id, session
+        FROM teldrive.sessions
+        WHERE created_at = (
+            SELECT MAX(created_at)
+            FROM teldrive.sessions s2
+            WHERE s2.user_id = sessions.user_id
+        )
+    ) as s ON u.user_id = s.user_id`
+
+// importStaleAfter is how long an unfinished import may go without progress.
+const importStaleAfter = 6 * time.Hour
+
 type CronService struct {
 	db     *gorm.DB
 	cnf    *config.ServerCmdConfig
+	cache  cache.Cacher
+	events events.EventBroadcaster
 	logger *zap.Logger
 }
 
-func StartCronJobs(ctx context.Context, db *gorm.DB, cnf *config.ServerCmdConfig) error {
+func StartCronJobs(ctx context.Context, db *gorm.DB, cnf *config.ServerCmdConfig, cacher cache.Cacher, eventBroadcaster events.EventBroadcaster) error {
 
 	err := db.AutoMigrate(&gormlock.CronJobLock{})
 	if err != nil {
@@ -63,7 +84,7 @@ func StartCronJobs(ctx context.Context, db *gorm.DB, cnf *config.ServerCmdConfig
 		return err
 	}
 
-	cron := CronService{db: db, cnf: cnf, logger: logging.Component("CRON")}
+	cron := CronService{db: db, cnf: cnf, cache: cacher, events: eventBroadcaster, logger: logging.Component("CRON")}
 	_, err = scheduler.NewJob(gocron.DurationJob(cnf.CronJobs.CleanFilesInterval),
 		gocron.NewTask(cron.cleanFiles, ctx))
 	if err != nil {
@@ -79,6 +100,23 @@ func StartCronJobs(ctx context.Context, db *gorm.DB, cnf *config.ServerCmdConfig
 	if err != nil {
 		return err
 	}
+	_, err = scheduler.NewJob(gocron.DurationJob(cnf.CronJobs.CleanVersionsInterval),
+		gocron.NewTask(cron.cleanVersions, ctx))
+	if err != nil {
+		return err
+	}
+	_, err = scheduler.NewJob(gocron.DurationJob(cnf.CronJobs.CheckBotsInterval),
+		gocron.NewTask(cron.checkBots, ctx), gocron.WithSingletonMode(gocron.LimitModeReschedule))
+	if err != nil {
+		return err
+	}
+	if cnf.Scrub.Enable {
+		_, err = scheduler.NewJob(gocron.DurationJob(cnf.Scrub.Interval),
+			gocron.NewTask(cron.scrubFiles, ctx), gocron.WithSingletonMode(gocron.LimitModeReschedule))
+		if err != nil {
+			return err
+		}
+	}
 	_, err = scheduler.NewJob(gocron.DurationJob(time.Hour*12),
 		gocron.NewTask(cron.cleanOldEvents))
 	if err != nil {
@@ -91,19 +129,21 @@ func StartCronJobs(ctx context.Context, db *gorm.DB, cnf *config.ServerCmdConfig
 
 func (c *CronService) cleanFiles(ctx context.Context) {
 	c.logger.Info("cron.clean_files.started")
+	if c.cnf.Files.TrashRetention > 0 {
+		c.purgeExpiredTrash()
+	}
+	// Versions go away with their file row, so their messages are deleted first
+	if err := c.deleteVersions(ctx, c.db.Table("teldrive.file_versions as v").Select("v.id").
+		Joins("JOIN teldrive.files as f ON f.id = v.file_id").
+		Where("f.status = ?", "pending_deletion")); err != nil {
+		c.logger.Error("cron.version_delete_failed", zap.Error(err))
+		return
+	}
 	var results []result
 	if err := c.db.Table("teldrive.files as f").
-		Select("JSONB_AGG(jsonb_build_object('id', f.id, 'parts', f.parts)) as files,f.channel_id,f.user_id,s.session").
+		Select("JSONB_AGG(jsonb_build_object('id', f.id, 'parts', f.parts, 'hash', f.hash)) as files,f.channel_id,f.user_id,s.session").
 		Joins("LEFT JOIN teldrive.users as u ON u.user_id = f.user_id").
-		Joins(`LEFT JOIN (
-        SELECT user_id, session
-        FROM teldrive.sessions
-        WHERE created_at = (
-            SELECT MAX(created_at)
-            FROM teldrive.sessions s2
-            WHERE s2.user_id = sessions.user_id
-        )
-    ) as s ON u.user_id = s.user_id`).
+		Joins(latestSessionJoin).
 		Where("f.type = ?", "file").
 		Where("f.status = ?", "pending_deletion").
 		Group("f.channel_id").
@@ -124,16 +164,24 @@ func (c *CronService) cleanFiles(ctx context.Context) {
 
 		fileIds := []string{}
 
+		shared, err := c.referencedParts(row.UserId, row.ChannelId, row.Files, nil)
+		if err != nil {
+			c.logger.Error("cron.file_delete_failed", zap.Error(err), zap.Int64("channel_id", row.ChannelId))
+			return
+		}
+
 		for _, file := range row.Files {
 			fileIds = append(fileIds, file.ID)
 			for _, part := range file.Parts {
-				ids = append(ids, int(part.ID))
+				if !shared[part.ID] {
+					ids = append(ids, int(part.ID))
+				}
 			}
 
 		}
 
 		client, _ := tgc.AuthClient(ctx, &c.cnf.TG, row.Session, middlewares...)
-		err := tgc.DeleteMessages(ctx, client, row.ChannelId, ids)
+		err = tgc.DeleteMessages(ctx, client, row.ChannelId, ids)
 
 		if err != nil {
 			c.logger.Error("cron.file_delete_failed", zap.Error(err), zap.Int64("channel_id", row.ChannelId))
@@ -152,21 +200,160 @@ func (c *CronService) cleanFiles(ctx context.Context) {
 	}
 }
 
+// purgeExpiredTrash hands files that outlived the trash retention over to
+// cleanFiles and drops the folders they were trashed with.
+func (c *CronService) purgeExpiredTrash() {
+	cutoff := time.Now().UTC().Add(-c.cnf.Files.TrashRetention)
+	var purged int64
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.File{}).
+			Where("status = ? AND type = ? AND trashed_at < ?", "trashed", "file", cutoff).
+			Update("status", "pending_deletion")
+		if res.Error != nil {
+			return res.Error
+		}
+		purged = res.RowsAffected
+		return tx.Where("status = ? AND type = ? AND trashed_at < ?", "trashed", "folder", cutoff).
+			Delete(&models.File{}).Error
+	})
+	if err != nil {
+		c.logger.Error("cron.trash_purge_failed", zap.Error(err))
+		return
+	}
+	if purged > 0 {
+		c.logger.Info("cron.trash_purged", zap.Int64("file_count", purged))
+	}
+}
+
+// cleanVersions removes file versions beyond the configured count or age.
+func (c *CronService) cleanVersions(ctx context.Context) {
+	maxVersions, retention := c.cnf.Files.MaxVersions, c.cnf.Files.VersionRetention
+	if maxVersions <= 0 && retention <= 0 {
+		return
+	}
+	c.logger.Info("cron.clean_versions.started")
+
+	ranked := c.db.Table("teldrive.file_versions").
+		Select("id, created_at, row_number() OVER (PARTITION BY file_id ORDER BY created_at DESC) as rn")
+	expired := c.db.Table("(?) as v", ranked).Select("v.id")
+	switch {
+	case maxVersions > 0 && retention > 0:
+		expired = expired.Where("v.rn > ? OR v.created_at < ?", maxVersions, time.Now().UTC().Add(-retention))
+	case maxVersions > 0:
+		expired = expired.Where("v.rn > ?", maxVersions)
+	default:
+		expired = expired.Where("v.created_at < ?", time.Now().UTC().Add(-retention))
+	}
+
+	if err := c.deleteVersions(ctx, expired); err != nil {
+		c.logger.Error("cron.version_delete_failed", zap.Error(err))
+	}
+}
+
+// deleteVersions deletes the messages of the versions selected by ids and
+// then the version rows themselves.
+func (c *CronService) deleteVersions(ctx context.Context, ids *gorm.DB) error {
+	var results []result
+	if err := c.db.Table("teldrive.file_versions as v").
+		Select("JSONB_AGG(jsonb_build_object('id', v.id, 'parts', v.parts, 'hash', v.hash)) as files,v.channel_id,v.user_id,s.session").
+		Joins("LEFT JOIN teldrive.users as u ON u.user_id = v.user_id").
+		Joins(latestSessionJoin).
+		Where("v.id IN (?)", ids).
+		Group("v.channel_id").
+		Group("v.user_id").
+		Group("s.session").
+		Scan(&results).Error; err != nil {
+		return err
+	}
+
+	middlewares := tgc.NewMiddleware(&c.cnf.TG, tgc.WithFloodWait(), tgc.WithRateLimit())
+
+	for _, row := range results {
+		if row.Session == "" {
+			continue
+		}
+		versionIds := utils.Map(row.Files, func(version file) string { return version.ID })
+		shared, err := c.referencedParts(row.UserId, row.ChannelId, row.Files, versionIds)
+		if err != nil {
+			return err
+		}
+		msgIds := []int{}
+		for _, version := range row.Files {
+			for _, part := range version.Parts {
+				if !shared[part.ID] {
+					msgIds = append(msgIds, int(part.ID))
+				}
+			}
+		}
+
+		client, _ := tgc.AuthClient(ctx, &c.cnf.TG, row.Session, middlewares...)
+		if err := tgc.DeleteMessages(ctx, client, row.ChannelId, msgIds); err != nil {
+			return err
+		}
+
+		items := pgtype.Array[string]{
+			Elements: versionIds,
+			Valid:    true,
+			Dims:     []pgtype.ArrayDimension{{Length: int32(len(versionIds)), LowerBound: 1}},
+		}
+		if err := c.db.Where("id = any($1)", items).Delete(&models.FileVersion{}).Error; err != nil {
+			return err
+		}
+		c.cache.Delete(ctx, utils.Map(versionIds, cache.KeyFileVersion)...)
+		c.logger.Info("cron.versions_cleaned", zap.Int64("user_id", row.UserId), zap.Int64("channel_id", row.ChannelId), zap.Int("version_count", len(versionIds)))
+	}
+	return nil
+}
+
+// referencedParts returns the messages of items that are still used by other
+// files or versions. Parts are only shared between identical content, so the
+// lookup is limited to rows with the same hash. Versions listed in
+// excludeVersions are being deleted and do not count as references.
+func (c *CronService) referencedParts(userId, channelId int64, items []file, excludeVersions []string) (map[int]bool, error) {
+	shared := map[int]bool{}
+	hashes := []string{}
+	for _, item := range items {
+		if item.Hash != nil && *item.Hash != "" {
+			hashes = append(hashes, *item.Hash)
+		}
+	}
+	if len(hashes) == 0 {
+		return shared, nil
+	}
+	if excludeVersions == nil {
+		excludeVersions = []string{}
+	}
+	excluded := pgtype.Array[string]{
+		Elements: excludeVersions,
+		Valid:    true,
+		Dims:     []pgtype.ArrayDimension{{Length: int32(len(excludeVersions)), LowerBound: 1}},
+	}
+
+	var ids []int
+	if err := c.db.Raw(`
+	SELECT (p->>'id')::int FROM teldrive.files f CROSS JOIN LATERAL jsonb_array_elements(f.parts) p
+	WHERE f.user_id = ? AND f.channel_id = ? AND f.hash IN ? AND f.status <> 'pending_deletion'
+	UNION
+	SELECT (p->>'id')::int FROM teldrive.file_versions v CROSS JOIN LATERAL jsonb_array_elements(v.parts) p
+	WHERE v.user_id = ? AND v.channel_id = ? AND v.hash IN ? AND NOT (v.id = any(?::uuid[]))
+	`, userId, channelId, hashes, userId, channelId, hashes, excluded).Scan(&ids).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		shared[id] = true
+	}
+	return shared, nil
+}
+
 func (c *CronService) cleanUploads(ctx context.Context) {
 	c.logger.Info("cron.clean_uploads.started")
+	c.cleanTusUploads()
+	c.cleanImportJobs()
 	var results []uploadResult
 	if err := c.db.Table("teldrive.uploads as up").
 		Select("JSONB_AGG(up.part_id) as parts,up.channel_id,up.user_id,s.session").
 		Joins("LEFT JOIN teldrive.users as u ON u.user_id = up.user_id").
-		Joins(`LEFT JOIN (
-        SELECT user_id, session
-        FROM teldrive.sessions
-        WHERE created_at = (
-            SELECT MAX(created_at)
-            FROM teldrive.sessions s2
-            WHERE s2.user_id = sessions.user_id
-        )
-    ) as s ON u.user_id = s.user_id`).
+		Joins(latestSessionJoin).
 		Where("up.created_at < ?", time.Now().UTC().Add(-c.cnf.TG.Uploads.Retention)).
 		Group("up.channel_id").
 		Group("up.user_id").
@@ -198,6 +385,31 @@ func (c *CronService) cleanUploads(ctx context.Context) {
 	}
 }
 
+// cleanTusUploads forgets expired tus uploads. Their stored parts are
+// removed with the other expired uploads. Uploads a request still holds a
+// lease on are left for a later run.
+func (c *CronService) cleanTusUploads() {
+	now := time.Now().UTC()
+	if err := c.db.Where("created_at < ? AND (lease_until IS NULL OR lease_until < ?)",
+		now.Add(-c.cnf.TG.Uploads.Retention), now).Delete(&models.TusUpload{}).Error; err != nil {
+		c.logger.Error("cron.clean_tus_uploads.failed", zap.Error(err))
+	}
+}
+
+// cleanImportJobs fails imports that stopped making progress, e.g. because
+// the instance running them went away, and forgets finished ones.
+func (c *CronService) cleanImportJobs() {
+	now := time.Now().UTC()
+	if err := c.db.Model(&models.ImportJob{}).Where("status IN ? AND updated_at < ?",
+		[]string{"pending", "running"}, now.Add(-importStaleAfter)).
+		Updates(map[string]any{"status": "failed", "error": "interrupted", "updated_at": now}).Error; err != nil {
+		c.logger.Error("cron.clean_import_jobs.failed", zap.Error(err))
+		return
+	}
+	c.db.Where("status IN ? AND updated_at < ?", []string{"completed", "failed", "cancelled"},
+		now.Add(-c.cnf.TG.Uploads.Retention)).Delete(&models.ImportJob{})
+}
+
 func (c *CronService) updateFolderSize() {
 	c.logger.Info("cron.folder_size.started")
 	query := `
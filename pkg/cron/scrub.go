@@ -0,0 +1,238 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/hash"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm/clause"
+)
+
+// Scrub outcomes recorded in teldrive.file_verifications.
+const (
+	scrubOK       = "ok"
+	scrubMismatch = "mismatch"
+	scrubMissing  = "missing"
+	scrubError    = "error"
+)
+
+type scrubFile struct {
+	models.File
+	Session string
+}
+
+// scrubFiles reads back the least recently verified files and checks their
+// content against the stored hash. Files are read with the owner's session
+// at no more than Scrub.Rate bytes per second across the run. Files that
+// could not be read are retried on the next run.
+func (c *CronService) scrubFiles(ctx context.Context) {
+	c.logger.Info("cron.scrub.started")
+	var files []scrubFile
+	if err := c.db.Table("teldrive.files as f").
+		Select("f.*, s.session").
+		Joins("LEFT JOIN teldrive.users as u ON u.user_id = f.user_id").
+		Joins(latestSessionJoin).
+		Joins("LEFT JOIN teldrive.file_verifications as v ON v.file_id = f.id").
+		Where("f.type = ? AND f.status = ? AND f.size > 0", "file", "active").
+		Where("f.hash IS NOT NULL AND f.hash <> '' AND f.parts IS NOT NULL").
+		Where("s.session IS NOT NULL").
+		Where("v.file_id IS NULL OR v.hash <> f.hash OR v.status = ? OR v.verified_at < ?", scrubError, time.Now().UTC().Add(-c.cnf.Scrub.MaxAge)).
+		Order("v.verified_at NULLS FIRST").
+		Limit(c.cnf.Scrub.BatchSize).
+		Scan(&files).Error; err != nil {
+		c.logger.Error("cron.scrub.failed", zap.Error(err))
+		return
+	}
+
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if c.cnf.Scrub.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(c.cnf.Scrub.Rate), int(min(c.cnf.Scrub.Rate, 1<<30)))
+	}
+	middlewares := tgc.NewMiddleware(&c.cnf.TG, tgc.WithFloodWait(), tgc.WithRateLimit())
+
+	bySession := map[string][]models.File{}
+	for _, f := range files {
+		bySession[f.Session] = append(bySession[f.Session], f.File)
+	}
+	for session, files := range bySession {
+		client, err := tgc.AuthClient(ctx, &c.cnf.TG, session, middlewares...)
+		if err != nil {
+			c.logger.Error("cron.scrub.client_failed", zap.Int64("user_id", files[0].UserId), zap.Error(err))
+			continue
+		}
+		botID := strconv.FormatInt(files[0].UserId, 10)
+		err = tgc.RunWithAuth(c.dataKeyContext(ctx, files[0].UserId), client, "", func(ctx context.Context) error {
+			for i := range files {
+				verification := c.verifyFile(ctx, client, botID, &files[i], limiter)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				c.recordVerification(&files[i], verification)
+			}
+			return nil
+		})
+		if err != nil {
+			c.logger.Error("cron.scrub.failed", zap.Int64("user_id", files[0].UserId), zap.Error(err))
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// dataKeyContext returns ctx carrying the data key of userId when the key is
+// wrapped with the master key. Keys protected by a passphrase cannot be used
+// in the background, so those files are recorded as unverified.
+func (c *CronService) dataKeyContext(ctx context.Context, userId int64) context.Context {
+	var userKey models.UserKey
+	if err := c.db.Where("user_id = ? AND protection = ?", userId, "master").First(&userKey).Error; err != nil {
+		return ctx
+	}
+	masterKey := c.cnf.Keys.MasterKey
+	if masterKey == "" {
+		masterKey = c.cnf.TG.Uploads.EncryptionKey
+	}
+	key, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, masterKey)
+	if err != nil {
+		c.logger.Error("cron.scrub.key_failed", zap.Int64("user_id", userId), zap.Error(err))
+		return ctx
+	}
+	return crypt.WithDataKey(ctx, key)
+}
+
+// verifyFile checks that every part of file still exists and that the tree
+// hash of its content matches file.Hash.
+func (c *CronService) verifyFile(ctx context.Context, client *telegram.Client, botID string,
+	file *models.File, limiter *rate.Limiter) *models.FileVerification {
+	verification := &models.FileVerification{FileId: file.ID, UserId: file.UserId, Hash: *file.Hash}
+	fail := func(err error) *models.FileVerification {
+		verification.Status = scrubError
+		verification.Error = utils.Ptr(err.Error())
+		return verification
+	}
+
+	ids := make([]int, len(*file.Parts))
+	for i, part := range *file.Parts {
+		ids[i] = part.ID
+	}
+	messages, err := tgc.GetMessages(ctx, client.API(), ids, *file.ChannelId)
+	if err != nil {
+		return fail(err)
+	}
+	sizes := map[int]int64{}
+	for _, message := range messages {
+		if item, ok := message.(*tg.Message); ok {
+			if media, ok := item.Media.(*tg.MessageMediaDocument); ok {
+				if document, ok := media.Document.(*tg.Document); ok {
+					sizes[item.ID] = document.Size
+				}
+			}
+		}
+	}
+
+	parts := make([]types.Part, 0, len(ids))
+	for _, part := range *file.Parts {
+		size, ok := sizes[part.ID]
+		if !ok {
+			verification.MissingParts = append(verification.MissingParts, part.ID)
+			continue
+		}
+		p := types.Part{ID: int64(part.ID), Size: size, Salt: part.Salt.Value}
+		if *file.Encrypted {
+			p.DecryptedSize, _ = crypt.DecryptedSize(size)
+		}
+		parts = append(parts, p)
+	}
+	if len(verification.MissingParts) > 0 {
+		verification.Status = scrubMissing
+		return verification
+	}
+
+	// Hashes are computed per uploaded part, so every part gets its own hasher
+	var blockHashes []byte
+	var start int64
+	for _, part := range parts {
+		size := part.Size
+		if *file.Encrypted {
+			size = part.DecryptedSize
+		}
+		r, err := reader.NewReader(ctx, client.API(), c.cache, file, parts, start, start+size-1, &c.cnf.TG, botID)
+		if err != nil {
+			return fail(err)
+		}
+		hasher := hash.NewBlockHasher()
+		n, err := io.Copy(hasher, &throttledReader{ctx: ctx, r: r, limiter: limiter})
+		r.Close()
+		if err == nil && n != size {
+			err = fmt.Errorf("part %d: read %d of %d bytes", part.ID, n, size)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		blockHashes = append(blockHashes, hasher.Sum()...)
+		start += size
+	}
+
+	if hash.SumToHex(hash.ComputeTreeHash(blockHashes)) != *file.Hash {
+		verification.Status = scrubMismatch
+		return verification
+	}
+	verification.Status = scrubOK
+	return verification
+}
+
+func (c *CronService) recordVerification(file *models.File, verification *models.FileVerification) {
+	verification.VerifiedAt = time.Now().UTC()
+	if err := c.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(verification).Error; err != nil {
+		c.logger.Error("cron.scrub.record_failed", zap.String("file_id", file.ID), zap.Error(err))
+		return
+	}
+	switch verification.Status {
+	case scrubOK:
+		return
+	case scrubError:
+		c.logger.Warn("cron.scrub.file_unverified", zap.String("file_id", file.ID), zap.String("error", *verification.Error))
+		return
+	}
+	c.logger.Error("cron.scrub.file_damaged", zap.String("file_id", file.ID),
+		zap.String("status", verification.Status), zap.Ints("missing_parts", verification.MissingParts))
+	source := &models.Source{ID: file.ID, Type: file.Type, Name: file.Name}
+	if file.ParentId != nil {
+		source.ParentID = *file.ParentId
+	}
+	c.events.Record(events.OpVerifyFailed, file.UserId, source)
+}
+
+// throttledReader paces reads to the rate of a limiter shared by the run.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := t.limiter.Burst(); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 && t.limiter.Limit() != rate.Inf {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -1,7 +1,13 @@
 package models
 
+import "time"
+
 type Bot struct {
 	Token  string `gorm:"type:text;primaryKey"`
 	UserId int64  `gorm:"type:bigint"`
 	BotId  int64  `gorm:"type:bigint"`
+	// Outcome of the last check of the bot. Disabled bots are not used.
+	Disabled  bool       `gorm:"default:false"`
+	LastError *string    `gorm:"type:text"`
+	CheckedAt *time.Time `gorm:"type:timestamptz"`
 }
@@ -21,4 +21,11 @@ type Source struct {
 	ParentID     string `json:"parentId,omitempty"`
 	DestParentID string `json:"destParentId,omitempty"`
 	Path         string `json:"path,omitempty"`
+	// Progress is set on events of long running operations.
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
 }
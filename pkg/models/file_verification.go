@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// FileVerification is the outcome of the last scrub of a file. Hash is the
+// hash the content was checked against, so a verification is stale once the
+// file content changes.
+type FileVerification struct {
+	FileId       string                   `gorm:"type:uuid;primaryKey"`
+	UserId       int64                    `gorm:"type:bigint"`
+	Hash         string                   `gorm:"type:text"`
+	Status       string                   `gorm:"type:text"`
+	MissingParts datatypes.JSONSlice[int] `gorm:"type:jsonb"`
+	Error        *string                  `gorm:"type:text"`
+	VerifiedAt   time.Time                `gorm:"default:timezone('utc'::text, now())"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+
+	"github.com/tgdrive/teldrive/internal/api"
+)
+
+// FileVersion is a previous content revision of a file, kept when the file
+// content is replaced.
+type FileVersion struct {
+	ID        string                         `gorm:"type:uuid;primaryKey;default:uuid7()"`
+	FileId    string                         `gorm:"type:uuid;not null"`
+	UserId    int64                          `gorm:"type:bigint;not null"`
+	Size      *int64                         `gorm:"type:bigint"`
+	Parts     *datatypes.JSONSlice[api.Part] `gorm:"type:jsonb"`
+	ChannelId *int64                         `gorm:"type:bigint"`
+	Encrypted *bool                          `gorm:"default:false"`
+	Hash      *string                        `gorm:"type:text"`
+	UpdatedAt *time.Time                     `gorm:"autoUpdateTime:false"` // last modification while it was current
+	CreatedAt *time.Time                     `gorm:"default:timezone('utc'::text, now())"`
+}
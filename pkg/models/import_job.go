@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// ImportJob downloads a remote URL into the drive in the background.
+type ImportJob struct {
+	ID         string                                `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserId     int64                                 `gorm:"type:bigint"`
+	URL        string                                `gorm:"column:url;type:text"`
+	Headers    datatypes.JSONType[map[string]string] `gorm:"type:jsonb"`
+	Path       string                                `gorm:"type:text"`
+	Name       string                                `gorm:"type:text"`
+	Status     string                                `gorm:"type:text"`
+	Size       *int64                                `gorm:"type:bigint"`
+	Downloaded int64                                 `gorm:"type:bigint"`
+	FileId     *string                               `gorm:"type:uuid"`
+	Error      *string                               `gorm:"type:text"`
+	CreatedAt  time.Time                             `gorm:"default:timezone('utc'::text, now())"`
+	UpdatedAt  time.Time                             `gorm:"default:timezone('utc'::text, now())"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// S3Key is an access key pair used to sign requests to the S3 gateway.
+type S3Key struct {
+	AccessKey string    `gorm:"type:text;primaryKey"`
+	SecretKey string    `gorm:"type:text"`
+	UserId    int64     `gorm:"type:bigint"`
+	Name      string    `gorm:"type:text"`
+	CreatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// TusUpload is a resumable upload created through the tus endpoint. Uploaded
+// counts the bytes already stored as Parts parts; the rest of the offset,
+// less than a hash block, is kept in Tail until more of the upload arrives.
+// A request writing the upload holds it through LeaseId until LeaseUntil.
+type TusUpload struct {
+	ID         string     `gorm:"type:uuid;primaryKey"`
+	UserId     int64      `gorm:"type:bigint"`
+	Name       string     `gorm:"type:text"`
+	ParentId   string     `gorm:"type:uuid"`
+	MimeType   string     `gorm:"type:text"`
+	Size       int64      `gorm:"type:bigint"`
+	Uploaded   int64      `gorm:"type:bigint"`
+	Parts      int        `gorm:"type:integer"`
+	PartSize   int64      `gorm:"type:bigint"`
+	Pending    int64      `gorm:"type:bigint"`
+	Tail       []byte     `gorm:"type:bytea"`
+	ChannelId  *int64     `gorm:"type:bigint"`
+	Encrypted  bool       `gorm:"default:false"`
+	LeaseId    *string    `gorm:"type:uuid"`
+	LeaseUntil *time.Time `gorm:"type:timestamptz"`
+	CreatedAt  time.Time  `gorm:"default:timezone('utc'::text, now())"`
+	UpdatedAt  time.Time  `gorm:"default:timezone('utc'::text, now())"`
+}
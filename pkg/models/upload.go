@@ -16,4 +16,9 @@ type Upload struct {
 	ChannelId   int64     `gorm:"type:bigint"`
 	Size        int64     `gorm:"type:bigint"`
 	CreatedAt   time.Time `gorm:"default:timezone('utc'::text, now())"`
+	// Digest of the part, hex encoded. ChecksumVerified is set when the
+	// client sent it and the content was checked against it on upload.
+	ChecksumAlgorithm *string `gorm:"type:text"`
+	Checksum          *string `gorm:"type:text"`
+	ChecksumVerified  bool    `gorm:"default:false"`
 }
@@ -11,4 +11,7 @@ type User struct {
 	IsPremium bool      `gorm:"type:bool"`
 	UpdatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
 	CreatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
+	// Quotas override the configured defaults when set, 0 meaning unlimited
+	QuotaSize  *int64 `gorm:"type:bigint"`
+	QuotaFiles *int64 `gorm:"type:bigint"`
 }
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// UserKey is the data key the encrypted uploads of a user are encrypted with,
+// sealed with the master key or with a passphrase of the user.
+type UserKey struct {
+	UserId     int64     `gorm:"type:bigint;primaryKey"`
+	WrappedKey string    `gorm:"type:text"`
+	Salt       string    `gorm:"type:text"`
+	Protection string    `gorm:"type:text"`
+	CreatedAt  time.Time `gorm:"default:timezone('utc'::text, now())"`
+	UpdatedAt  time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
@@ -2,11 +2,14 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-faster/errors"
 	"github.com/gotd/td/telegram"
 	"github.com/ogen-go/ogen/ogenerrors"
@@ -19,6 +22,7 @@ import (
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/events"
 	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/internal/version"
@@ -33,6 +37,29 @@ type apiService struct {
 	botSelector    tgc.BotSelector
 	events         events.EventBroadcaster
 	channelManager *tgc.ChannelManager
+	names          *nameCodec
+	chunks         *reader.ChunkCache
+	partSender     PartSender
+	forwarder      PartForwarder
+	unlocked       *unlockedKeys
+}
+
+// Option configures the API service.
+type Option func(*apiService)
+
+// WithPartSender makes uploaded parts go through send instead of Telegram.
+func WithPartSender(send PartSender) Option {
+	return func(a *apiService) {
+		a.partSender = send
+	}
+}
+
+// WithPartForwarder makes the parts of copied folders go through forwarder
+// instead of Telegram.
+func WithPartForwarder(forwarder PartForwarder) Option {
+	return func(a *apiService) {
+		a.forwarder = forwarder
+	}
 }
 
 func (a *apiService) newMiddlewares(ctx context.Context, retries int) []telegram.Middleware {
@@ -44,6 +71,17 @@ func (a *apiService) newMiddlewares(ctx context.Context, retries int) []telegram
 	)
 }
 
+// healthMiddlewares returns the middleware recording the health of the bot
+// with token when bots are picked by their health.
+func (a *apiService) healthMiddlewares(token string) []telegram.Middleware {
+	health, ok := a.botSelector.(tgc.BotHealth)
+	if !ok || token == "" {
+		return nil
+	}
+	botID, _, _ := strings.Cut(token, ":")
+	return []telegram.Middleware{health.Middleware(botID)}
+}
+
 func (a *apiService) VersionVersion(ctx context.Context) (*api.ApiVersion, error) {
 	return version.GetVersionInfo(), nil
 }
@@ -133,6 +171,9 @@ func (e *extendedService) EventsEventsStream(w http.ResponseWriter, r *http.Requ
 			}
 
 			jsonData, _ := eventData.MarshalJSON()
+			if src.Progress != nil {
+				jsonData = withProgress(jsonData, src.Progress)
+			}
 			fmt.Fprintf(w, "data: %s\n\n", jsonData)
 			flusher.Flush()
 
@@ -143,6 +184,25 @@ func (e *extendedService) EventsEventsStream(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// withProgress adds the progress of a long running operation to the source of
+// an encoded event, since the API event schema has no field for it.
+func withProgress(data []byte, progress *models.Progress) []byte {
+	var evt map[string]any
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return data
+	}
+	source, ok := evt["source"].(map[string]any)
+	if !ok {
+		return data
+	}
+	source["progress"] = progress
+	res, err := json.Marshal(evt)
+	if err != nil {
+		return data
+	}
+	return res
+}
+
 func (a *apiService) NewError(ctx context.Context, err error) *api.ErrorStatusCode {
 	var (
 		code     = http.StatusInternalServerError
@@ -175,32 +235,60 @@ func NewApiService(db *gorm.DB,
 	cnf *config.ServerCmdConfig,
 	cache cache.Cacher,
 	botSelector tgc.BotSelector,
-	events events.EventBroadcaster) *apiService {
+	events events.EventBroadcaster,
+	opts ...Option) *apiService {
 
-	return &apiService{
+	names, err := newNameCodec(cnf)
+	if err != nil {
+		logging.Component("API").Error("names.cipher_failed", zap.Error(err))
+	}
+	var chunks *reader.ChunkCache
+	if stream := cnf.TG.Stream; stream.CacheDir != "" {
+		chunks, err = reader.NewChunkCache(stream.CacheDir, stream.CacheSize, stream.Prefetch)
+		if err != nil {
+			logging.Component("API").Error("stream.chunk_cache_failed", zap.Error(err))
+		}
+	}
+	a := &apiService{
 		db:             db,
 		cnf:            cnf,
 		cache:          cache,
 		botSelector:    botSelector,
 		events:         events,
 		channelManager: tgc.NewChannelManager(db, cache, &cnf.TG),
+		names:          names,
+		chunks:         chunks,
+		unlocked:       newUnlockedKeys(cnf.Keys.UnlockIdle),
 	}
+	a.partSender = a.sendPart
+	a.forwarder = tgForwarder{}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 type extendedService struct {
 	api *apiService
+	// importSlots bounds the URL imports running at the same time.
+	importSlots chan struct{}
 }
 
 func NewExtendedService(api *apiService) *extendedService {
-	return &extendedService{api: api}
+	return &extendedService{api: api, importSlots: make(chan struct{}, max(api.cnf.Imports.MaxJobs, 1))}
 }
 
 type extendedMiddleware struct {
-	next *api.Server
-	srv  *extendedService
+	next   *api.Server
+	srv    *extendedService
+	routes chi.Router
 }
 
 func (m *extendedMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.routes.Match(chi.NewRouteContext(), r.Method, r.URL.Path) {
+		m.routes.ServeHTTP(w, r)
+		return
+	}
 	route, ok := m.next.FindRoute(r.Method, r.URL.Path)
 	if !ok {
 		m.next.ServeHTTP(w, r)
@@ -227,7 +315,7 @@ func (m *extendedMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func NewExtendedMiddleware(next *api.Server, srv *extendedService) *extendedMiddleware {
-	return &extendedMiddleware{next: next, srv: srv}
+	return &extendedMiddleware{next: next, srv: srv, routes: newExtendedRoutes(srv)}
 }
 
 type apiError struct {
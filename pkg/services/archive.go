@@ -0,0 +1,230 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+)
+
+var ErrArchiveEmpty = errors.New("nothing to archive")
+
+// archiveEntry is a file or folder of an archive with its path relative to
+// the archive root. PathForms holds the form of each segment of the path, see
+// pathForms.
+type archiveEntry struct {
+	models.File
+	Path      string `gorm:"column:path"`
+	PathForms string `gorm:"column:path_forms"`
+	Depth     int    `gorm:"column:depth"`
+}
+
+// archiveIds returns the ids passed as repeated or comma separated ids query
+// parameters.
+func archiveIds(r *http.Request) []string {
+	ids := []string{}
+	for _, v := range r.URL.Query()["ids"] {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// archiveEntries loads the given items and everything below them, ordered so
+// that folders come before their content.
+func (a *apiService) archiveEntries(userId int64, ids []string) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	if err := a.db.Raw(`
+	WITH RECURSIVE tree AS (
+		SELECT f.*, f.name::text AS path, `+pathForms+` AS path_forms, 0 AS depth FROM teldrive.files f
+		WHERE f.id IN ? AND f.user_id = ? AND f.status = 'active'
+		UNION ALL
+		SELECT f.*, t.path || '/' || f.name, t.path_forms || `+pathForms+`, t.depth + 1 FROM teldrive.files f
+		JOIN tree t ON f.parent_id = t.id
+		WHERE f.status = 'active'
+	)
+	SELECT * FROM tree ORDER BY depth, path
+	`, ids, userId).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+	a.names.decodeEntries(entries)
+	return entries, nil
+}
+
+func (e *extendedService) FilesArchive(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	ids := archiveIds(r)
+	if len(ids) == 0 {
+		e.writeError(w, r, &apiError{err: errors.New("ids should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+	entries, err := e.api.archiveEntries(userId, ids)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	roots := 0
+	for _, entry := range entries {
+		if entry.Depth == 0 {
+			roots++
+		}
+	}
+	if roots != len(ids) {
+		e.writeError(w, r, &apiError{err: ErrArchiveEmpty, code: http.StatusNotFound})
+		return
+	}
+	e.writeArchive(w, r, requestSession(r.Context(), userId), archiveName(entries, len(ids)), entries)
+}
+
+// SharesArchive serves the content of a public share as a ZIP. Without ids
+// the whole share is archived, otherwise the selected items which must lie
+// within the shared folder.
+func (e *extendedService) SharesArchive(w http.ResponseWriter, r *http.Request) {
+	share, err := e.api.validFileShare(r, chi.URLParam(r, "shareId"))
+	if err != nil && errors.Is(err, ErrEmptyAuth) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ids := archiveIds(r)
+	if len(ids) == 0 || share.Type != api.FileShareInfoTypeFolder {
+		ids = []string{share.FileId}
+	}
+
+	var count int64
+	if err := e.api.db.Raw(`
+	WITH RECURSIVE up AS (
+		SELECT f.id, f.parent_id, f.id AS origin FROM teldrive.files f WHERE f.id IN ?
+		UNION ALL
+		SELECT f.id, f.parent_id, up.origin FROM teldrive.files f JOIN up ON f.id = up.parent_id
+	)
+	SELECT count(DISTINCT origin) FROM up WHERE id = ?
+	`, ids, share.FileId).Scan(&count).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if int(count) != len(ids) {
+		http.Error(w, ErrArchiveEmpty.Error(), http.StatusNotFound)
+		return
+	}
+
+	entries, err := e.api.archiveEntries(share.UserId, ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		http.Error(w, ErrArchiveEmpty.Error(), http.StatusNotFound)
+		return
+	}
+	e.writeArchive(w, r, &models.Session{UserId: share.UserId}, archiveName(entries, len(ids)), entries)
+}
+
+func archiveName(entries []archiveEntry, roots int) string {
+	if roots == 1 && len(entries) > 0 {
+		return entries[0].Name + ".zip"
+	}
+	return "teldrive-" + time.Now().UTC().Format("20060102-150405") + ".zip"
+}
+
+// writeArchive streams entries as a stored (uncompressed) ZIP. Sizes are only
+// known to the writer once each entry is done, so large entries get ZIP64
+// records automatically. Errors after the first byte can only abort the
+// response.
+func (e *extendedService) writeArchive(w http.ResponseWriter, r *http.Request, session *models.Session, name string, entries []archiveEntry) {
+	ctx := r.Context()
+	logger := logging.Component("FILE").With(zap.Int64("user_id", session.UserId))
+
+	for i := range entries {
+		if needsDataKey(&entries[i].File) {
+			var err error
+			if ctx, err = e.api.withDataKey(ctx, &entries[i].File, session.Hash); err != nil {
+				e.writeError(w, r, err)
+				return
+			}
+			break
+		}
+	}
+
+	client, token, botID, err := e.api.streamClient(ctx, session)
+	if err != nil {
+		logger.Error("archive.client_failed", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	zw := zip.NewWriter(w)
+	err = tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+		for i := range entries {
+			entry := &entries[i]
+			header := &zip.FileHeader{Name: entry.Path, Method: zip.Store}
+			if entry.UpdatedAt != nil {
+				header.Modified = *entry.UpdatedAt
+			}
+			if entry.Type == string(api.FileTypeFolder) {
+				header.Name += "/"
+				if _, err := zw.CreateHeader(header); err != nil {
+					return err
+				}
+				continue
+			}
+			if entry.Size != nil {
+				header.UncompressedSize64 = uint64(*entry.Size)
+			}
+			fw, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if entry.Size == nil || *entry.Size == 0 || entry.Parts == nil || entry.ChannelId == nil {
+				continue
+			}
+			parts, err := getParts(ctx, client, e.api.cache, &entry.File)
+			if err != nil {
+				return err
+			}
+			lr, err := reader.NewReader(reader.WithChunkCache(ctx, e.api.chunks), client.API(), e.api.cache, &entry.File, parts,
+				0, *entry.Size-1, &e.api.cnf.TG, botID)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(fw, lr, *entry.Size)
+			lr.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		logger.Debug("archive.aborted", zap.Error(err))
+	}
+}
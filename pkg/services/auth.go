@@ -138,6 +138,7 @@ func (a *apiService) AuthLogout(ctx context.Context) (*api.AuthLogoutNoContent,
 	a.db.Where("hash = ?", authUser.Hash).Delete(&models.Session{})
 	userId, _ := strconv.ParseInt(authUser.Subject, 10, 64)
 	a.cache.Delete(ctx, cache.KeySessionHash(authUser.Hash), cache.KeyUserSessions(userId))
+	a.unlocked.forget(userId, authUser.Hash)
 	return &api.AuthLogoutNoContent{SetCookie: setCookie(authCookieName, "", -1)}, nil
 }
 
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+// UsersCheckBots checks that the bots of the user can still log in and are
+// admins of each of their channels. Dead bots are disabled and no longer
+// used for streams and uploads.
+func (e *extendedService) UsersCheckBots(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	checks, err := e.api.channelManager.CheckBots(r.Context(), userId)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	for _, check := range checks {
+		if check.Changed && check.Disabled {
+			e.api.events.Record(events.OpBotDisabled, userId, &models.Source{
+				ID:   strconv.FormatInt(check.BotID, 10),
+				Type: "bot",
+				Name: check.UserName,
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, checks)
+}
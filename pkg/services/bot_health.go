@@ -0,0 +1,37 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+)
+
+var ErrBotHealthNotEnabled = errors.New("bots are not picked by health")
+
+// UsersBotStatus returns the health of the bots of the user: recent errors,
+// flood waits, latency and requests in flight.
+func (e *extendedService) UsersBotStatus(w http.ResponseWriter, r *http.Request) {
+	health, ok := e.api.botSelector.(tgc.BotHealth)
+	if !ok {
+		e.writeError(w, r, &apiError{err: ErrBotHealthNotEnabled, code: http.StatusNotFound})
+		return
+	}
+	tokens, err := e.api.channelManager.BotTokens(r.Context(), auth.GetUser(r.Context()))
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	statuses, err := health.Status(r.Context(), utils.Map(tokens, func(token string) string {
+		botID, _, _ := strings.Cut(token, ":")
+		return botID
+	}))
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
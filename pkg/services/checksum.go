@@ -0,0 +1,87 @@
+package services
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/zeebo/blake3"
+)
+
+var (
+	ErrChecksum          = errors.New("checksum mismatch")
+	ErrChecksumAlgo      = errors.New("unsupported checksum algorithm")
+	ErrChecksumMalformed = errors.New("malformed checksum")
+)
+
+// checksumAlgorithms lists the digests clients may send along with content.
+const checksumAlgorithms = "blake3,sha256,sha1,md5"
+
+var checksumHashes = map[string]func() hash.Hash{
+	"blake3": func() hash.Hash { return blake3.New() },
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+// checksum hashes content as it is read and compares it to the digest the
+// client expects.
+type checksum struct {
+	hash.Hash
+	algorithm string
+	want      []byte
+}
+
+// parseChecksum parses an "<algorithm> <digest>" value, as sent in an
+// Upload-Checksum header. The digest may be base64 or hex encoded.
+func parseChecksum(value string) (*checksum, error) {
+	algorithm, digest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	algorithm = strings.ToLower(algorithm)
+	newHash, ok := checksumHashes[algorithm]
+	if !ok {
+		return nil, ErrChecksumAlgo
+	}
+	h := newHash()
+	digest = strings.TrimSpace(digest)
+	want, err := hex.DecodeString(digest)
+	if err != nil || len(want) != h.Size() {
+		want, err = base64.StdEncoding.DecodeString(digest)
+	}
+	if err != nil || len(want) != h.Size() {
+		return nil, ErrChecksumMalformed
+	}
+	return &checksum{Hash: h, algorithm: algorithm, want: want}, nil
+}
+
+// newChecksum hashes content with algorithm without expecting a digest.
+func newChecksum(algorithm string) *checksum {
+	return &checksum{Hash: checksumHashes[algorithm](), algorithm: algorithm}
+}
+
+// valid reports whether the content hashed so far has the expected digest.
+func (c *checksum) valid() bool {
+	return c.want == nil || bytes.Equal(c.Sum(nil), c.want)
+}
+
+// hex returns the digest of the content hashed so far.
+func (c *checksum) hex() string {
+	return hex.EncodeToString(c.Sum(nil))
+}
+
+// allPartsVerified reports whether the client sent a checksum with every
+// part and each was hashed, so the whole-file hash it sends can be checked.
+func allPartsVerified(uploads []models.Upload) bool {
+	for _, upload := range uploads {
+		if len(upload.BlockHashes) == 0 || !upload.ChecksumVerified {
+			return false
+		}
+	}
+	return true
+}
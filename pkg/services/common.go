@@ -65,15 +65,22 @@ func getParts(ctx context.Context, client *telegram.Client, c cache.Cacher, file
 	})
 }
 
-func resolvePathID(db *gorm.DB, path string, userId int64) (*string, error) {
+// resolvePathID returns the id of the file at path. Each segment matches a
+// name stored in either form, see nameCodec.
+func resolvePathID(db *gorm.DB, names *nameCodec, path string, userId int64) (*string, error) {
 	if !strings.HasPrefix(path, "/root") {
 		path = "/root/" + strings.Trim(path, "/")
 	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	encrypted := make([]string, len(segments))
+	for i, segment := range segments {
+		encrypted[i], _ = names.encryptedName(segment)
+	}
 	var id string
 	query := `
 	WITH RECURSIVE path_parts AS (
-		SELECT ordinality as depth, part as name
-		FROM unnest(string_to_array(trim(both '/' from ?), '/')) WITH ORDINALITY as part
+		SELECT depth, name, enc
+		FROM unnest(string_to_array(?, '/'), string_to_array(?, '/')) WITH ORDINALITY as part(name, enc, depth)
 	),
 	max_depth AS (
 		SELECT max(depth) as val FROM path_parts
@@ -81,19 +88,20 @@ func resolvePathID(db *gorm.DB, path string, userId int64) (*string, error) {
 	hierarchy AS (
 		SELECT f.id, 1 as depth
 		FROM teldrive.files f
-		JOIN path_parts p ON p.depth = 1 AND f.name = p.name
+		JOIN path_parts p ON p.depth = 1 AND f.name = p.name AND NOT f.name_encrypted
 		WHERE f.user_id = ? AND f.parent_id IS NULL AND f.status = 'active'
 		UNION ALL
 		SELECT child.id, h.depth + 1
 		FROM teldrive.files child
 		JOIN hierarchy h ON child.parent_id = h.id
-		JOIN path_parts p ON p.depth = h.depth + 1 AND child.name = p.name
+		JOIN path_parts p ON p.depth = h.depth + 1 AND (child.name = p.name AND NOT child.name_encrypted
+			OR child.name = p.enc AND child.name_encrypted)
 		JOIN max_depth md ON h.depth < md.val
 		WHERE child.status = 'active'
 	)
 	SELECT id FROM hierarchy WHERE depth = (SELECT val FROM max_depth) LIMIT 1;
 	`
-	if err := db.Raw(query, path, userId).Scan(&id).Error; err != nil {
+	if err := db.Raw(query, strings.Join(segments, "/"), strings.Join(encrypted, "/"), userId).Scan(&id).Error; err != nil {
 		return nil, err
 	}
 	if id == "" {
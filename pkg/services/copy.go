@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var ErrCopyConflict = errors.New("an item with the same name already exists at the destination")
+
+// copyBatchSize is the number of messages forwarded in one request, the most
+// Telegram accepts.
+const copyBatchSize = 100
+
+// PartForwarder forwards the messages holding the parts of copied folders
+// with the client of the caller.
+type PartForwarder interface {
+	// Run calls fn while client is connected.
+	Run(ctx context.Context, client *telegram.Client, fn func(ctx context.Context) error) error
+	// Forward forwards up to copyBatchSize messages of channel from to
+	// channel to and returns the new message of each of ids.
+	Forward(ctx context.Context, client *telegram.Client, from, to int64, ids []int) (map[int]int, error)
+	// Delete deletes the messages forwarded by a copy that failed.
+	Delete(ctx context.Context, client *telegram.Client, channelId int64, ids []int) error
+}
+
+// tgForwarder is the PartForwarder forwarding messages in Telegram.
+type tgForwarder struct{}
+
+func (tgForwarder) Run(ctx context.Context, client *telegram.Client, fn func(ctx context.Context) error) error {
+	return tgc.RunWithAuth(ctx, client, "", fn)
+}
+
+func (tgForwarder) Forward(ctx context.Context, client *telegram.Client, from, to int64, ids []int) (map[int]int, error) {
+	return tgc.ForwardMessages(ctx, client, from, to, ids, nil)
+}
+
+func (tgForwarder) Delete(ctx context.Context, client *telegram.Client, channelId int64, ids []int) error {
+	return tgc.DeleteMessages(ctx, client, channelId, ids)
+}
+
+// copyFolder copies a folder and everything below it. Parts are forwarded to
+// the current channel in batches, then the whole hierarchy is created in one
+// transaction. When anything fails the forwarded messages are deleted again,
+// so a failed copy leaves nothing behind.
+func (a *apiService) copyFolder(ctx context.Context, client *telegram.Client, userId int64, folder *models.File, req *api.FileCopy) (*api.File, error) {
+	var items []models.File
+	if err := a.db.Raw(`
+	WITH RECURSIVE tree AS (
+		SELECT f.*, 0 AS depth FROM teldrive.files f
+		WHERE f.id = ? AND f.user_id = ? AND f.status = 'active'
+		UNION ALL
+		SELECT f.*, t.depth + 1 FROM teldrive.files f
+		JOIN tree t ON f.parent_id = t.id
+		WHERE f.status = 'active'
+	)
+	SELECT * FROM tree ORDER BY depth
+	`, folder.ID, userId).Scan(&items).Error; err != nil {
+		return nil, &apiError{err: err}
+	}
+	if len(items) == 0 {
+		return nil, &apiError{err: errors.New("file not found"), code: http.StatusNotFound}
+	}
+
+	parentId, err := a.copyDestination(userId, req.Destination)
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+
+	channelId, err := a.channelManager.CurrentChannel(ctx, userId)
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+
+	var size, files int64
+	for _, item := range items {
+		if item.Type == string(api.FileTypeFile) {
+			files++
+			if item.Size != nil {
+				size += *item.Size
+			}
+		}
+	}
+	if err := a.checkQuota(userId, size, files); err != nil {
+		return nil, err
+	}
+
+	sources := map[int64][]int{}
+	total := 0
+	for _, item := range items {
+		if item.Type != string(api.FileTypeFile) || item.Parts == nil || item.ChannelId == nil {
+			continue
+		}
+		for _, part := range *item.Parts {
+			sources[*item.ChannelId] = append(sources[*item.ChannelId], part.ID)
+		}
+		total += len(*item.Parts)
+	}
+
+	progress := func(done int) {
+		a.events.Record(events.OpCopyProgress, userId, &models.Source{
+			ID:           folder.ID,
+			Type:         folder.Type,
+			Name:         a.names.plain(folder),
+			DestParentID: parentId,
+			Progress:     &models.Progress{Done: done, Total: total},
+		})
+	}
+
+	forwarded := map[int64]map[int]int{}
+	newMessages := []int{}
+	rollback := func() {
+		if len(newMessages) == 0 {
+			return
+		}
+		if err := a.forwarder.Delete(context.WithoutCancel(ctx), client, channelId, newMessages); err != nil {
+			logging.Component("FILE").Error("copy.rollback_failed", zap.Error(err),
+				zap.String("file_id", folder.ID), zap.Int("message_count", len(newMessages)))
+		}
+	}
+
+	err = a.forwarder.Run(ctx, client, func(ctx context.Context) error {
+		done := 0
+		for sourceChannel, ids := range sources {
+			forwarded[sourceChannel] = map[int]int{}
+			for start := 0; start < len(ids); start += copyBatchSize {
+				batch := ids[start:min(start+copyBatchSize, len(ids))]
+				res, err := a.forwarder.Forward(ctx, client, sourceChannel, channelId, batch)
+				for source, id := range res {
+					forwarded[sourceChannel][source] = id
+					newMessages = append(newMessages, id)
+				}
+				if err != nil {
+					return err
+				}
+				done += len(batch)
+				progress(done)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		rollback()
+		return nil, &apiError{err: err}
+	}
+
+	rootName, rootEncrypted, err := a.copyName(folder, req)
+	if err != nil {
+		rollback()
+		return nil, &apiError{err: err, code: http.StatusBadRequest}
+	}
+	ids := map[string]string{}
+	rows := make([]models.File, 0, len(items))
+	for i, item := range items {
+		id, err := uuid.NewV7()
+		if err != nil {
+			rollback()
+			return nil, &apiError{err: err}
+		}
+		ids[item.ID] = id.String()
+
+		row := models.File{
+			ID:            id.String(),
+			Name:          item.Name,
+			NameEncrypted: item.NameEncrypted,
+			Type:          item.Type,
+			MimeType:      item.MimeType,
+			Size:          item.Size,
+			Category:      item.Category,
+			Encrypted:     item.Encrypted,
+			UserId:        userId,
+			Status:        "active",
+			Hash:          item.Hash,
+			UpdatedAt:     item.UpdatedAt,
+		}
+		if i == 0 {
+			row.Name, row.NameEncrypted = rootName, rootEncrypted
+			row.ParentId = utils.Ptr(parentId)
+			row.UpdatedAt = copyUpdatedAt(req)
+		} else {
+			row.ParentId = utils.Ptr(ids[*item.ParentId])
+		}
+		if item.Type == string(api.FileTypeFile) && item.Parts != nil && item.ChannelId != nil {
+			parts := utils.Map(*item.Parts, func(part api.Part) api.Part {
+				p := api.Part{ID: forwarded[*item.ChannelId][part.ID]}
+				if part.Salt.Value != "" {
+					p.Salt = part.Salt
+				}
+				return p
+			})
+			row.Parts = utils.Ptr(datatypes.NewJSONSlice(parts))
+			row.ChannelId = &channelId
+		}
+		rows = append(rows, row)
+	}
+
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(rows, 500).Error
+	})
+	if err != nil {
+		rollback()
+		if database.IsKeyConflictErr(err) {
+			return nil, &apiError{err: ErrCopyConflict, code: http.StatusConflict}
+		}
+		return nil, &apiError{err: err}
+	}
+
+	root := rows[0]
+	a.events.Record(events.OpCopy, userId, &models.Source{
+		ID:       root.ID,
+		Type:     root.Type,
+		Name:     a.names.plain(&root),
+		ParentID: parentId,
+	})
+	return a.fileOut(root), nil
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var ErrHashNotFound = errors.New("no file with this hash")
+
+type hashLookup struct {
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Exists bool   `json:"exists"`
+}
+
+// findDuplicate returns an active file of the user with the same content,
+// or nil when there is none.
+func findDuplicate(tx *gorm.DB, userId int64, hash string, size int64) (*models.File, error) {
+	var files []models.File
+	if err := tx.Where("user_id = ? AND hash = ? AND size = ?", userId, hash, size).
+		Where("type = 'file' AND status = 'active' AND parts IS NOT NULL AND channel_id IS NOT NULL").
+		Order("created_at").Limit(1).Find(&files).Error; err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return &files[0], nil
+}
+
+// dedupContent points file at the parts of an identical existing file. The
+// parts that were uploaded for file are handed to the clean files job through
+// a pending_deletion row, since nothing else references them.
+func dedupContent(tx *gorm.DB, userId int64, file *models.File) (bool, error) {
+	if file.Hash == nil || file.Size == nil || *file.Size == 0 {
+		return false, nil
+	}
+	dup, err := findDuplicate(tx, userId, *file.Hash, *file.Size)
+	if err != nil || dup == nil {
+		return false, err
+	}
+	if file.Parts != nil && len(*file.Parts) > 0 && file.ChannelId != nil {
+		if err := discardParts(tx, userId, *file.ChannelId, *file.Parts); err != nil {
+			return false, err
+		}
+	}
+	file.Parts = dup.Parts
+	file.ChannelId = dup.ChannelId
+	file.Encrypted = dup.Encrypted
+	return true, nil
+}
+
+func discardParts(tx *gorm.DB, userId, channelId int64, parts datatypes.JSONSlice[api.Part]) error {
+	return tx.Create(&models.File{
+		Name:      "dedup",
+		Type:      "file",
+		MimeType:  defaultContentType,
+		UserId:    userId,
+		Status:    "pending_deletion",
+		Parts:     &parts,
+		ChannelId: &channelId,
+	}).Error
+}
+
+// discardUploads hands the parts of upload rows to the clean files job and
+// removes the rows.
+func discardUploads(tx *gorm.DB, userId int64, uploads []models.Upload) error {
+	byChannel := map[int64]datatypes.JSONSlice[api.Part]{}
+	for _, u := range uploads {
+		byChannel[u.ChannelId] = append(byChannel[u.ChannelId], api.Part{ID: u.PartId})
+	}
+	for channelId, parts := range byChannel {
+		if err := discardParts(tx, userId, channelId, parts); err != nil {
+			return err
+		}
+	}
+	for _, u := range uploads {
+		if err := tx.Where("upload_id = ? AND part_id = ?", u.UploadId, u.PartId).
+			Delete(&models.Upload{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilesLookupHash tells clients whether content with the given BLAKE3 tree
+// hash and size is already stored, so the upload can be skipped by creating
+// the file with only its hash.
+func (e *extendedService) FilesLookupHash(w http.ResponseWriter, r *http.Request) {
+	userId := auth.GetUser(r.Context())
+	res := hashLookup{Hash: chi.URLParam(r, "hash")}
+
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size <= 0 {
+		e.writeError(w, r, &apiError{err: errors.New("size is required"), code: http.StatusBadRequest})
+		return
+	}
+	res.Size = size
+
+	if e.api.cnf.Files.Dedup {
+		dup, err := findDuplicate(e.api.db, userId, res.Hash, size)
+		if err != nil {
+			e.writeError(w, r, &apiError{err: err})
+			return
+		}
+		res.Exists = dup != nil
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/tg"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/tgdrive/teldrive/internal/api"
@@ -24,11 +24,9 @@ import (
 	"github.com/tgdrive/teldrive/internal/hash"
 	"github.com/tgdrive/teldrive/internal/http_range"
 	"github.com/tgdrive/teldrive/internal/logging"
-	"github.com/tgdrive/teldrive/internal/md5"
 	"github.com/tgdrive/teldrive/internal/reader"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/internal/utils"
-	"github.com/tgdrive/teldrive/pkg/mapper"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/types"
 	"go.uber.org/zap"
@@ -76,6 +74,18 @@ func (a *apiService) FilesCopy(ctx context.Context, req *api.FileCopy, params ap
 
 	file := res[0]
 
+	if file.Type == string(api.FileTypeFolder) {
+		return a.copyFolder(ctx, client, userId, &file, req)
+	}
+
+	var size int64
+	if file.Size != nil {
+		size = *file.Size
+	}
+	if err := a.checkQuota(userId, size, 1); err != nil {
+		return nil, err
+	}
+
 	newIds := []api.Part{}
 
 	channelId, err := a.channelManager.CurrentChannel(ctx, userId)
@@ -145,21 +155,16 @@ func (a *apiService) FilesCopy(ctx context.Context, req *api.FileCopy, params ap
 		return nil, &apiError{err: errors.New("failed to copy all file parts")}
 	}
 
-	var parentId string
-	if !isUUID(req.Destination) {
-		var destRes []models.File
-		if err := a.db.Raw("select * from teldrive.create_directories(?, ?)", userId, req.Destination).
-			Scan(&destRes).Error; err != nil {
-			return nil, &apiError{err: err}
-		}
-		parentId = destRes[0].ID
-	} else {
-		parentId = req.Destination
+	parentId, err := a.copyDestination(userId, req.Destination)
+	if err != nil {
+		return nil, &apiError{err: err}
 	}
 
 	dbFile := models.File{}
 
-	dbFile.Name = req.NewName.Or(file.Name)
+	if dbFile.Name, dbFile.NameEncrypted, err = a.copyName(&file, req); err != nil {
+		return nil, &apiError{err: err, code: http.StatusBadRequest}
+	}
 	dbFile.Size = file.Size
 	dbFile.Type = file.Type
 	dbFile.MimeType = file.MimeType
@@ -173,11 +178,7 @@ func (a *apiService) FilesCopy(ctx context.Context, req *api.FileCopy, params ap
 	dbFile.Encrypted = file.Encrypted
 	dbFile.Category = file.Category
 	dbFile.Hash = file.Hash // Preserve hash during copy (content is identical)
-	if req.UpdatedAt.IsSet() && !req.UpdatedAt.Value.IsZero() {
-		dbFile.UpdatedAt = utils.Ptr(req.UpdatedAt.Value)
-	} else {
-		dbFile.UpdatedAt = utils.Ptr(time.Now().UTC())
-	}
+	dbFile.UpdatedAt = copyUpdatedAt(req)
 
 	if err := a.db.Create(&dbFile).Error; err != nil {
 		return nil, &apiError{err: err}
@@ -186,10 +187,81 @@ func (a *apiService) FilesCopy(ctx context.Context, req *api.FileCopy, params ap
 	a.events.Record(events.OpCopy, userId, &models.Source{
 		ID:       dbFile.ID,
 		Type:     dbFile.Type,
-		Name:     dbFile.Name,
+		Name:     a.names.plain(&dbFile),
 		ParentID: parentId,
 	})
-	return mapper.ToFileOut(dbFile), nil
+	return a.fileOut(dbFile), nil
+}
+
+// copyName returns the stored name of a copy of file and whether it is
+// encrypted. The copy takes the new name of req if one is set.
+func (a *apiService) copyName(file *models.File, req *api.FileCopy) (string, bool, error) {
+	if !req.NewName.IsSet() || req.NewName.Value == "" {
+		return file.Name, file.NameEncrypted, nil
+	}
+	return a.names.storedName(req.NewName.Value, file.Type, file.Encrypted != nil && *file.Encrypted)
+}
+
+// copyUpdatedAt returns the modification time of a copy, the one of req if
+// set and now otherwise.
+func copyUpdatedAt(req *api.FileCopy) *time.Time {
+	if req.UpdatedAt.IsSet() && !req.UpdatedAt.Value.IsZero() {
+		return utils.Ptr(req.UpdatedAt.Value)
+	}
+	return utils.Ptr(time.Now().UTC())
+}
+
+// copyDestination resolves the destination of a copy, creating the
+// directories of a path destination as needed.
+func (a *apiService) copyDestination(userId int64, destination string) (string, error) {
+	if isUUID(destination) {
+		return destination, nil
+	}
+	return a.mkdirAll(userId, destination)
+}
+
+// mkdirAll creates the folders of p below the root folder of userId that do
+// not exist yet and returns the id of the last one. Folders are looked up by
+// either form of their name and created in the form names are stored in.
+func (a *apiService) mkdirAll(userId int64, p string) (string, error) {
+	var id string
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		var root models.File
+		if err := tx.Select("id").Where("parent_id IS NULL AND user_id = ? AND type = 'folder'", userId).
+			First(&root).Error; err != nil {
+			return err
+		}
+		id = root.ID
+		for name := range strings.SplitSeq(strings.Trim(p, "/"), "/") {
+			if name == "" {
+				continue
+			}
+			var folder models.File
+			if err := tx.Select("id").Where(a.names.nameIs(name)).
+				Where("parent_id = ? AND user_id = ? AND status = 'active'", id, userId).
+				Limit(1).Find(&folder).Error; err != nil {
+				return err
+			}
+			if folder.ID == "" {
+				folder = models.File{
+					Type:     string(api.FileTypeFolder),
+					MimeType: "drive/folder",
+					ParentId: utils.Ptr(id),
+					UserId:   userId,
+					Status:   "active",
+				}
+				if err := a.names.setName(&folder, name); err != nil {
+					return &apiError{err: err, code: http.StatusBadRequest}
+				}
+				if err := tx.Create(&folder).Error; err != nil {
+					return err
+				}
+			}
+			id = folder.ID
+		}
+		return nil
+	})
+	return id, err
 }
 
 func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.File, error) {
@@ -203,6 +275,7 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 		channelId int64
 		uploadId  string
 		uploads   []models.Upload
+		hashOnly  bool
 	)
 
 	if fileIn.Path.Value == "" && fileIn.ParentId.Value == "" {
@@ -215,7 +288,7 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 	}
 
 	if path != "" && fileIn.ParentId.Value == "" {
-		parentID, err = resolvePathID(a.db, path, userId)
+		parentID, err = resolvePathID(a.db, a.names, path, userId)
 		if err != nil {
 			return nil, &apiError{err: err, code: 404}
 		}
@@ -271,6 +344,10 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 
 		if len(parts) > 0 {
 			fileDB.Parts = utils.Ptr(datatypes.NewJSONSlice(mapParts(parts)))
+		} else if a.cnf.Files.Dedup && fileIn.Hash.Value != "" && fileIn.Size.Value > 0 {
+			// Content is already stored, parts are resolved from the hash below
+			hashOnly = true
+			fileDB.Hash = utils.Ptr(fileIn.Hash.Value)
 		}
 
 		// Compute BLAKE3 tree hash from block hashes if uploadId is provided
@@ -283,6 +360,11 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 			if len(allBlockHashes) > 0 {
 				treeHashBytes := hash.ComputeTreeHash(allBlockHashes)
 				treeHash := hash.SumToHex(treeHashBytes)
+				// Clients that sent a checksum with every part have the
+				// hash they send checked against the content received
+				if fileIn.Hash.Value != "" && allPartsVerified(uploads) && !strings.EqualFold(fileIn.Hash.Value, treeHash) {
+					return nil, &apiError{err: ErrChecksum, code: 400}
+				}
 				fileDB.Hash = &treeHash
 			}
 		} else if fileIn.Size.Value == 0 {
@@ -294,11 +376,11 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 
 		fileDB.Size = utils.Ptr(fileIn.Size.Value)
 	}
-	fileDB.Name = fileIn.Name
 	fileDB.Type = string(fileIn.Type)
 	fileDB.UserId = userId
 	fileDB.Status = "active"
 	fileDB.Encrypted = utils.Ptr(fileIn.Encrypted.Value)
+	fileDB.Name = fileIn.Name
 	if fileIn.UpdatedAt.IsSet() && !fileIn.UpdatedAt.Value.IsZero() {
 		fileDB.UpdatedAt = utils.Ptr(fileIn.UpdatedAt.Value)
 	} else {
@@ -307,16 +389,74 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 
 	// Use transaction to ensure file creation and upload cleanup are atomic
 	err = a.db.Transaction(func(tx *gorm.DB) error {
+		var existing models.File
+		if fileDB.Type == string(api.FileTypeFile) {
+			// Overwriting an existing file keeps its content as a version
+			query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where(a.names.nameIs(fileIn.Name)).
+				Where("user_id = ? AND status = 'active' AND type = 'file'", userId)
+			if fileDB.ParentId == nil {
+				query = query.Where("parent_id IS NULL")
+			} else {
+				query = query.Where("parent_id = ?", *fileDB.ParentId)
+			}
+			if err := query.Limit(1).Find(&existing).Error; err != nil {
+				return err
+			}
+			if existing.ID != "" {
+				if err := saveFileVersion(tx, &existing); err != nil {
+					return err
+				}
+			}
+			// Versions are not counted, so an overwrite only adds the change in size
+			size, files := *fileDB.Size, int64(1)
+			if existing.ID != "" {
+				files = 0
+				if existing.Size != nil {
+					size -= *existing.Size
+				}
+			}
+			if err := a.checkQuota(userId, size, files); err != nil {
+				return err
+			}
+		}
+
+		if a.cnf.Files.Dedup && fileDB.Type == string(api.FileTypeFile) {
+			found, err := dedupContent(tx, userId, &fileDB)
+			if err != nil {
+				return err
+			}
+			if hashOnly && !found {
+				return &apiError{err: ErrHashNotFound, code: http.StatusNotFound}
+			}
+		}
+
+		// The name of a file is stored in the form of the content the file
+		// ends up with, which dedup may have taken from a file encrypted
+		// otherwise
+		if err := a.names.setName(&fileDB, fileIn.Name); err != nil {
+			return &apiError{err: err, code: http.StatusBadRequest}
+		}
+		// An overwritten file is renamed to that form, so the insert below
+		// still updates it
+		if existing.ID != "" && existing.Name != fileDB.Name {
+			if err := tx.Model(&models.File{}).Where("id = ?", existing.ID).
+				Updates(map[string]any{"name": fileDB.Name, "name_encrypted": fileDB.NameEncrypted}).Error; err != nil {
+				return err
+			}
+		}
+
 		//For some reason, gorm conflict clauses are not working with partial index so using raw query
 		if err := tx.Raw(`
 			INSERT INTO teldrive.files (
-				name, parent_id, user_id, mime_type, category, parts,
+				name, name_encrypted, parent_id, user_id, mime_type, category, parts,
 				size, type, encrypted, updated_at, channel_id, status, hash
 			)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 			ON CONFLICT (name, COALESCE(parent_id, '00000000-0000-0000-0000-000000000000'::uuid), user_id)
 			WHERE status = 'active'
 			DO UPDATE SET
+				name_encrypted = EXCLUDED.name_encrypted,
 				mime_type = EXCLUDED.mime_type,
 				category = EXCLUDED.category,
 				parts = EXCLUDED.parts,
@@ -329,7 +469,7 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 				hash = EXCLUDED.hash
 			RETURNING *
 		`,
-			fileDB.Name, fileDB.ParentId, fileDB.UserId, fileDB.MimeType,
+			fileDB.Name, fileDB.NameEncrypted, fileDB.ParentId, fileDB.UserId, fileDB.MimeType,
 			fileDB.Category, fileDB.Parts, fileDB.Size, fileDB.Type,
 			fileDB.Encrypted, fileDB.UpdatedAt, fileDB.ChannelId, fileDB.Status,
 			fileDB.Hash,
@@ -348,6 +488,10 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 	})
 
 	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return nil, err
+		}
 		return nil, &apiError{err: err}
 	}
 
@@ -358,10 +502,10 @@ func (a *apiService) FilesCreate(ctx context.Context, fileIn *api.File) (*api.Fi
 	a.events.Record(events.OpCreate, userId, &models.Source{
 		ID:       fileDB.ID,
 		Type:     fileDB.Type,
-		Name:     fileDB.Name,
+		Name:     fileIn.Name,
 		ParentID: *parentID,
 	})
-	return mapper.ToFileOut(fileDB), nil
+	return a.fileOut(fileDB), nil
 }
 
 func (a *apiService) FilesCreateShare(ctx context.Context, req *api.FileShareCreate, params api.FilesCreateShareParams) error {
@@ -390,39 +534,49 @@ func (a *apiService) FilesCreateShare(ctx context.Context, req *api.FileShareCre
 	return nil
 }
 
+// deleteFilesBulk moves the given items and everything below them to the
+// trash. Rows keep their parent so they can be restored in place; the
+// trash_root_id links every descendant to the item the user deleted.
 func (a *apiService) deleteFilesBulk(db *gorm.DB, fileIds []string, userId int64) error {
 	query := `
-	WITH RECURSIVE target_folders AS (
-		SELECT id FROM teldrive.files WHERE id IN (?) AND user_id = ?
+	WITH RECURSIVE targets AS (
+		SELECT id, id AS root_id FROM teldrive.files
+		WHERE id IN (?) AND user_id = ? AND status = 'active'
 		UNION ALL
-		SELECT f.id FROM teldrive.files f JOIN target_folders tf ON f.parent_id = tf.id
-	),
-	mark_deleted AS (
-		UPDATE teldrive.files SET status = 'pending_deletion'
-		WHERE (parent_id IN (SELECT id FROM target_folders) OR id IN (?))
-		AND type = 'file'
+		SELECT f.id, t.root_id FROM teldrive.files f
+		JOIN targets t ON f.parent_id = t.id
+		WHERE f.status = 'active'
 	)
-	DELETE FROM teldrive.files WHERE id IN (SELECT id FROM target_folders) AND type = 'folder';
+	UPDATE teldrive.files f SET status = 'trashed',
+		trashed_at = timezone('utc'::text, now()),
+		trash_root_id = t.root_id
+	FROM targets t WHERE f.id = t.id;
 	`
-	return db.Exec(query, fileIds, userId, fileIds).Error
+	return db.Exec(query, fileIds, userId).Error
 }
 
 func (a *apiService) getFullPath(db *gorm.DB, fileID string) (string, error) {
-	var path string
+	var path struct {
+		Path  string
+		Forms string
+	}
 	query := `
 	WITH RECURSIVE path_tree AS (
-		SELECT id, parent_id, name, 0 as lvl FROM teldrive.files WHERE id = ?
+		SELECT id, parent_id, name, name_encrypted, 0 as lvl FROM teldrive.files WHERE id = ?
 		UNION ALL
-		SELECT f.id, f.parent_id, f.name, pt.lvl + 1
+		SELECT f.id, f.parent_id, f.name, f.name_encrypted, pt.lvl + 1
 		FROM teldrive.files f JOIN path_tree pt ON f.id = pt.parent_id
 	)
-	SELECT string_agg(name, '/' ORDER BY lvl DESC) FROM path_tree;
+	SELECT string_agg(name, '/' ORDER BY lvl DESC) AS path,
+		string_agg(name_encrypted::int::text, '' ORDER BY lvl DESC) AS forms
+	FROM path_tree;
 	`
 	err := db.Raw(query, fileID).Scan(&path).Error
-	if path != "" {
-		path = "/" + path
+	p := a.names.decodePath(path.Path, path.Forms)
+	if p != "" {
+		p = "/" + p
 	}
-	return strings.TrimPrefix(path, "/root"), err
+	return strings.TrimPrefix(p, "/root"), err
 }
 
 func (a *apiService) FilesDelete(ctx context.Context, req *api.FileDelete) error {
@@ -520,7 +674,7 @@ func (a *apiService) FilesGetById(ctx context.Context, params api.FilesGetByIdPa
 		return nil, &apiError{err: err}
 	}
 
-	res := mapper.ToFileOut(file)
+	res := a.fileOut(file)
 	res.Path = api.NewOptString(path)
 	if file.ChannelId != nil {
 		res.ChannelId = api.NewOptInt64(*file.ChannelId)
@@ -532,7 +686,7 @@ func (a *apiService) FilesGetById(ctx context.Context, params api.FilesGetByIdPa
 func (a *apiService) FilesList(ctx context.Context, params api.FilesListParams) (*api.FileList, error) {
 	userId := auth.GetUser(ctx)
 
-	queryBuilder := &fileQueryBuilder{db: a.db}
+	queryBuilder := &fileQueryBuilder{db: a.db, names: a.names}
 
 	return queryBuilder.execute(&params, userId)
 }
@@ -540,7 +694,11 @@ func (a *apiService) FilesList(ctx context.Context, params api.FilesListParams)
 func (a *apiService) FilesMkdir(ctx context.Context, req *api.FileMkDir) error {
 	userId := auth.GetUser(ctx)
 
-	if err := a.db.Exec("select * from teldrive.create_directories(?, ?)", userId, req.Path).Error; err != nil {
+	if _, err := a.mkdirAll(userId, req.Path); err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return err
+		}
 		return &apiError{err: err}
 	}
 	return nil
@@ -552,7 +710,7 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 	var destParentID *string
 
 	if !isUUID(req.DestinationParent) {
-		r, err := resolvePathID(a.db, req.DestinationParent, userId)
+		r, err := resolvePathID(a.db, a.names, req.DestinationParent, userId)
 		if err != nil {
 			return &apiError{err: err}
 		}
@@ -568,9 +726,13 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 			return err
 		}
 		if len(req.Ids) == 1 && req.DestinationName.Value != "" {
+			renamed := srcFile
+			if err := a.names.setName(&renamed, req.DestinationName.Value); err != nil {
+				return &apiError{err: err, code: http.StatusBadRequest}
+			}
 			var existing models.File
-			query := tx.Where("name = ? AND user_id = ? AND status = 'active'",
-				req.DestinationName.Value, userId)
+			query := tx.Where(a.names.nameIs(req.DestinationName.Value)).
+				Where("user_id = ? AND status = 'active'", userId)
 			if destParentID == nil {
 				query = query.Where("parent_id IS NULL")
 			} else {
@@ -597,8 +759,9 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 			return tx.Model(&models.File{}).
 				Where("id = ? AND user_id = ?", req.Ids[0], userId).
 				Updates(map[string]any{
-					"parent_id": destParentID,
-					"name":      req.DestinationName.Value,
+					"parent_id":      destParentID,
+					"name":           renamed.Name,
+					"name_encrypted": renamed.NameEncrypted,
 				}).Error
 		}
 		items := pgtype.Array[string]{
@@ -624,7 +787,7 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 		a.events.Record(events.OpMove, userId, &models.Source{
 			ID:           destParentIDStr,
 			Type:         srcFile.Type,
-			Name:         srcFile.Name,
+			Name:         a.names.plain(&srcFile),
 			ParentID:     parentID,
 			DestParentID: destParentIDStr,
 		})
@@ -632,6 +795,10 @@ func (a *apiService) FilesMove(ctx context.Context, req *api.FileMove) error {
 
 	})
 	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return err
+		}
 		return &apiError{err: err}
 	}
 	return nil
@@ -693,10 +860,6 @@ func (a *apiService) FilesUpdate(ctx context.Context, req *api.FileUpdate, param
 		}
 	}
 
-	if req.Name.IsSet() && req.Name.Value != "" {
-		updateDb.Name = req.Name.Value
-	}
-
 	if req.ParentId.IsSet() && req.ParentId.Value != "" {
 		updateDb.ParentId = utils.Ptr(req.ParentId.Value)
 	}
@@ -729,9 +892,22 @@ func (a *apiService) FilesUpdate(ctx context.Context, req *api.FileUpdate, param
 		}
 	}
 
+	contentReplaced := updateDb.Parts != nil || (req.Size.IsSet() && req.Size.Value == 0)
+
 	// Use transaction for atomic update
 	var file models.File
 	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if contentReplaced {
+			var current models.File
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id = ?", params.ID).First(&current).Error; err != nil {
+				return err
+			}
+			if err := saveFileVersion(tx, &current); err != nil {
+				return err
+			}
+		}
+
 		// Compute BLAKE3 tree hash if uploadId provided
 		if uploadId != "" && len(uploads) > 0 {
 			var allBlockHashes []byte
@@ -744,6 +920,40 @@ func (a *apiService) FilesUpdate(ctx context.Context, req *api.FileUpdate, param
 				treeHash := hash.SumToHex(treeHashBytes)
 				updateDb.Hash = &treeHash
 			}
+
+			if a.cnf.Files.Dedup && updateDb.Hash != nil {
+				if updateDb.ChannelId == nil && len(uploads) > 0 {
+					updateDb.ChannelId = utils.Ptr(uploads[0].ChannelId)
+				}
+				if _, err := dedupContent(tx, userId, &updateDb); err != nil {
+					return err
+				}
+			}
+		}
+
+		// The name is stored in the form of the encryption the file ends up
+		// with, which the request or dedup may change
+		if (req.Name.IsSet() && req.Name.Value != "") || updateDb.Encrypted != nil {
+			var current models.File
+			if err := tx.Where("id = ?", params.ID).First(&current).Error; err != nil {
+				return err
+			}
+			name := a.names.plain(&current)
+			if req.Name.IsSet() && req.Name.Value != "" {
+				name = req.Name.Value
+			}
+			if updateDb.Encrypted != nil {
+				current.Encrypted = updateDb.Encrypted
+			}
+			if err := a.names.setName(&current, name); err != nil {
+				return &apiError{err: err, code: http.StatusBadRequest}
+			}
+			updateDb.Name = current.Name
+			// Updates leaves out false, so the form is written on its own
+			if err := tx.Model(&models.File{}).Where("id = ?", params.ID).
+				Update("name_encrypted", current.NameEncrypted).Error; err != nil {
+				return err
+			}
 		}
 
 		// Build update query - explicitly select UpdatedAt if it's the only change
@@ -767,6 +977,10 @@ func (a *apiService) FilesUpdate(ctx context.Context, req *api.FileUpdate, param
 	})
 
 	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return nil, err
+		}
 		return nil, &apiError{err: err}
 	}
 
@@ -785,18 +999,14 @@ func (a *apiService) FilesUpdate(ctx context.Context, req *api.FileUpdate, param
 	a.events.Record(events.OpUpdate, userId, &models.Source{
 		ID:       file.ID,
 		Type:     file.Type,
-		Name:     file.Name,
+		Name:     a.names.plain(&file),
 		ParentID: parentID,
 	})
-	return mapper.ToFileOut(file), nil
+	return a.fileOut(file), nil
 }
 
 func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fileId string, userId int64) {
 	ctx := r.Context()
-	logger := logging.Component("FILE").With(
-		zap.String("file_id", fileId),
-		zap.Int64("user_id", userId),
-	)
 	var (
 		session *models.Session
 		err     error
@@ -816,7 +1026,7 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 				http.Error(w, "invalid token", http.StatusUnauthorized)
 			}
 			userId, _ := strconv.ParseInt(user.Subject, 10, 64)
-			session = &models.Session{UserId: userId, Session: user.TgSession}
+			session = &models.Session{UserId: userId, Session: user.TgSession, Hash: user.Hash}
 		} else {
 			session, err = auth.GetSessionByHash(ctx, e.api.db, e.api.cache, authHash)
 			if err != nil {
@@ -828,6 +1038,18 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 		session = &models.Session{UserId: userId}
 	}
 
+	e.serveFile(w, r, fileId, session, streamETag)
+}
+
+// serveFile streams the content of a file with the client of session,
+// handling conditional and range requests against the ETag given by etag.
+func (e *extendedService) serveFile(w http.ResponseWriter, r *http.Request, fileId string, session *models.Session, etag func(*models.File) string) {
+	ctx := r.Context()
+	logger := logging.Component("FILE").With(
+		zap.String("file_id", fileId),
+		zap.Int64("user_id", session.UserId),
+	)
+
 	file, err := cache.Fetch(ctx, e.api.cache, cache.Key("files", fileId), 0, func() (*models.File, error) {
 		var result models.File
 		if err := e.api.db.Model(&result).Where("id = ?", fileId).First(&result).Error; err != nil {
@@ -841,11 +1063,49 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 		return
 	}
 
+	if versionId := r.URL.Query().Get("version"); versionId != "" {
+		file, err = e.api.fileAtVersion(ctx, file, versionId)
+		if errors.Is(err, ErrVersionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Files encrypted with a passphrase protected key are refused while the
+	// key is locked.
+	if ctx, err = e.api.withDataKey(ctx, file, session.Hash); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+
 	w.Header().Set("Accept-Ranges", "bytes")
 
-	var start, end int64
+	tag := etag(file)
+	var modtime time.Time
+	if file.UpdatedAt != nil {
+		modtime = file.UpdatedAt.UTC()
+		w.Header().Set("Last-Modified", modtime.Format(http.TimeFormat))
+	}
+	w.Header().Set("ETag", tag)
 
-	rangeHeader := r.Header.Get("Range")
+	status, useRange := http_range.Preconditions(r, tag, modtime)
+	if status == http.StatusNotModified {
+		w.WriteHeader(status)
+		return
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	rangeHeader := ""
+	if useRange {
+		rangeHeader = r.Header.Get("Range")
+	}
 	contentType := defaultContentType
 
 	if file.MimeType != "" {
@@ -855,44 +1115,44 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 	if file.Size == nil || *file.Size == 0 {
 		w.Header().Set("Content-Type", contentType)
 		w.Header().Set("Content-Length", "0")
-		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": file.Name}))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": e.api.names.plain(file)}))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	status := http.StatusOK
-	if rangeHeader == "" {
-		start = 0
-		end = *file.Size - 1
-	} else {
-		ranges, err := http_range.Parse(rangeHeader, *file.Size)
-		if err == http_range.ErrNoOverlap {
+	status = http.StatusOK
+	ranges := []*http_range.Range{{Start: 0, End: *file.Size - 1}}
+	if rangeHeader != "" {
+		ranges, err = http_range.ParseCoalesced(rangeHeader, *file.Size, maxStreamRanges)
+		if err == http_range.ErrNoOverlap || err == http_range.ErrTooManyRanges {
 			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", *file.Size))
-			http.Error(w, http_range.ErrNoOverlap.Error(), http.StatusRequestedRangeNotSatisfiable)
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
 			return
 		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if len(ranges) > 1 {
-			http.Error(w, "multiple ranges are not supported", http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
-		start = ranges[0].Start
-		end = ranges[0].End
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, *file.Size))
 		status = http.StatusPartialContent
-
 	}
 
-	contentLength := end - start + 1
-
-	w.Header().Set("Content-Type", contentType)
+	var (
+		contentLength int64
+		boundary      string
+	)
+	if len(ranges) == 1 {
+		if status == http.StatusPartialContent {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ranges[0].Start, ranges[0].End, *file.Size))
+		}
+		contentLength = ranges[0].Length()
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		boundary = multipart.NewWriter(io.Discard).Boundary()
+		contentLength = multipartRangesLength(ranges, boundary, contentType, *file.Size)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	}
 
 	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", md5.FromString(fileId+strconv.FormatInt(*file.Size, 10))))
-	w.Header().Set("Last-Modified", file.UpdatedAt.UTC().Format(http.TimeFormat))
 
 	disposition := "inline"
 
@@ -902,7 +1162,7 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 		disposition = "attachment"
 	}
 
-	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": e.api.names.plain(file)}))
 
 	w.WriteHeader(status)
 
@@ -910,99 +1170,67 @@ func (e *extendedService) FilesStream(w http.ResponseWriter, r *http.Request, fi
 		return
 	}
 
-	tokens, err := e.api.channelManager.BotTokens(ctx, session.UserId)
-
+	client, token, botID, err := e.api.streamClient(ctx, session)
 	if err != nil {
-		logger.Error("stream.bots_fetch_failed", zap.Error(err))
-		http.Error(w, "failed to get bots", http.StatusInternalServerError)
+		logger.Error("stream.client_failed", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Limit the number of bots used for streaming if configured
-	if limit := e.api.cnf.TG.Stream.BotsLimit; limit > 0 && len(tokens) > limit {
-		tokens = tokens[:limit]
-	}
-
-	var (
-		lr     io.ReadCloser
-		client *telegram.Client
-		token  string
-	)
-
-	if len(tokens) == 0 {
-		client, err = tgc.AuthClient(ctx, &e.api.cnf.TG, session.Session, e.api.newMiddlewares(ctx, 5)...)
+	tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+		parts, err := getParts(ctx, client, e.api.cache, file)
 		if err != nil {
-			logger.Error("stream.auth_client_failed", zap.Error(err))
+			logger.Error("stream.parts_fetch_failed", zap.Error(err))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil
 		}
 
-	} else {
-		token, _, err = e.api.botSelector.Next(ctx, tgc.BotOpStream, session.UserId, tokens)
-		if err != nil {
-			logger.Error("stream.bot_selection_failed", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		stripes := e.api.streamStripes(ctx, session, token)
+		inUse := []string{botID}
+		for _, stripe := range stripes {
+			inUse = append(inUse, stripe.BotID)
 		}
-		client, err = tgc.BotClient(ctx, e.api.db, e.api.cache, &e.api.cnf.TG, token, e.api.newMiddlewares(ctx, 5)...)
-		if err != nil {
-			logger.Error("stream.bot_client_failed", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
+		readerCtx := reader.WithChunkCache(ctx, e.api.chunks)
+		readerCtx = reader.WithStripes(readerCtx, stripes)
+		readerCtx = reader.WithFallback(readerCtx, e.api.streamFallback(ctx, session, inUse...))
 
-	botID := strconv.FormatInt(session.UserId, 10)
-	if token != "" {
-		parts := strings.Split(token, ":")
-		if len(parts) > 0 {
-			botID = parts[0]
-		}
-	}
-
-	if r.Method != http.MethodHead {
-		handleStream := func() error {
-			parts, err := getParts(ctx, client, e.api.cache, file)
-			if err != nil {
-				logger.Error("stream.parts_fetch_failed", zap.Error(err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return nil
-			}
-
-			lr, err = reader.NewReader(ctx,
+		open := func(rg *http_range.Range) (io.ReadCloser, error) {
+			lr, err := reader.NewReader(readerCtx,
 				client.API(),
 				e.api.cache,
 				file,
 				parts,
-				start,
-				end,
+				rg.Start,
+				rg.End,
 				&e.api.cnf.TG,
 				botID,
 			)
-
 			if err != nil {
-				logger.Error("stream.reader_create_failed", zap.Error(err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return nil
+				return nil, err
 			}
 			if lr == nil {
-				logger.Error("stream.reader_nil")
-				http.Error(w, "failed to initialise reader", http.StatusInternalServerError)
-				return nil
+				return nil, errors.New("failed to initialise reader")
 			}
+			return lr, nil
+		}
 
-			_, err = io.CopyN(w, lr, contentLength)
+		if boundary == "" {
+			lr, err := open(ranges[0])
 			if err != nil {
-				lr.Close()
+				logger.Error("stream.reader_create_failed", zap.Error(err))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return nil
 			}
+			defer lr.Close()
+			io.CopyN(w, lr, contentLength)
 			return nil
 		}
 
-		tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
-			return handleStream()
-		})
-
-	}
+		if err := writeMultipartRanges(w, ranges, boundary, contentType, *file.Size, open); err != nil {
+			logger.Debug("stream.multipart_aborted", zap.Error(err))
+		}
+		return nil
+	})
 }
 
 func (e *extendedService) SharesStream(w http.ResponseWriter, r *http.Request, shareId, fileId string) {
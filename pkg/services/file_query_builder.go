@@ -17,7 +17,8 @@ import (
 )
 
 type fileQueryBuilder struct {
-	db *gorm.DB
+	db    *gorm.DB
+	names *nameCodec
 }
 
 type fileResponse struct {
@@ -27,7 +28,7 @@ type fileResponse struct {
 
 const folderCategory = "folder"
 
-var selectedFields = []string{"id", "name", "type", "mime_type", "category", "hash", "channel_id", "encrypted", "size", "parent_id", "updated_at"}
+var selectedFields = []string{"id", "name", "name_encrypted", "type", "mime_type", "category", "hash", "channel_id", "encrypted", "size", "parent_id", "updated_at"}
 
 func (afb *fileQueryBuilder) execute(filesQuery *api.FilesListParams, userId int64) (*api.FileList, error) {
 	query := afb.db.Where("user_id = ?", userId).Where("status = ?", filesQuery.Status.Value)
@@ -56,7 +57,10 @@ func (afb *fileQueryBuilder) execute(filesQuery *api.FilesListParams, userId int
 		count = res[0].Total
 	}
 
-	files := utils.Map(res, func(item fileResponse) api.File { return *mapper.ToFileOut(item.File) })
+	files := utils.Map(res, func(item fileResponse) api.File {
+		item.Name = afb.names.plain(&item.File)
+		return *mapper.ToFileOut(item.File)
+	})
 
 	return &api.FileList{Items: files,
 		Meta: api.Meta{Count: count,
@@ -66,7 +70,7 @@ func (afb *fileQueryBuilder) execute(filesQuery *api.FilesListParams, userId int
 
 func (afb *fileQueryBuilder) applyListFilters(query *gorm.DB, filesQuery *api.FilesListParams, userId int64) *gorm.DB {
 	if filesQuery.Path.Value != "" && filesQuery.ParentId.Value == "" {
-		id, err := resolvePathID(afb.db, filesQuery.Path.Value, userId)
+		id, err := resolvePathID(afb.db, afb.names, filesQuery.Path.Value, userId)
 		if err != nil {
 			return query.Where("1 = 0")
 		}
@@ -107,7 +111,7 @@ func (afb *fileQueryBuilder) applyFindFilters(query *gorm.DB, filesQuery *api.Fi
 
 func (afb *fileQueryBuilder) applyFileSpecificFilters(query *gorm.DB, filesQuery *api.FilesListParams, userId int64) *gorm.DB {
 	if filesQuery.Name.Value != "" {
-		query = query.Where("name = ?", filesQuery.Name.Value)
+		query = query.Where(afb.names.nameIs(filesQuery.Name.Value))
 	}
 
 	if filesQuery.ParentId.Value != "" {
@@ -120,7 +124,7 @@ func (afb *fileQueryBuilder) applyFileSpecificFilters(query *gorm.DB, filesQuery
 	}
 
 	if filesQuery.ParentId.Value == "" && filesQuery.Path.Value != "" && filesQuery.Query.Value == "" {
-		id, err := resolvePathID(afb.db, filesQuery.Path.Value, userId)
+		id, err := resolvePathID(afb.db, afb.names, filesQuery.Path.Value, userId)
 		if err != nil {
 			return query.Where("1 = 0")
 		}
@@ -180,9 +184,14 @@ func (afb *fileQueryBuilder) applySingleDateFilter(query *gorm.DB, dateFilter st
 func (afb *fileQueryBuilder) applySearchQuery(query *gorm.DB, filesQuery *api.FilesListParams) *gorm.DB {
 	switch filesQuery.SearchType.Value {
 	case api.FileQuerySearchTypeText:
-		query = query.Where("teldrive.clean_name(name) &@~ teldrive.clean_name(?)", filesQuery.Query.Value)
+		// Encrypted names only match the whole name
+		search := afb.db.Where("NOT name_encrypted AND teldrive.clean_name(name) &@~ teldrive.clean_name(?)", filesQuery.Query.Value)
+		if encrypted, ok := afb.names.encryptedName(filesQuery.Query.Value); ok {
+			search = search.Or("name_encrypted AND name = ?", encrypted)
+		}
+		query = query.Where(search)
 	case api.FileQuerySearchTypeRegex:
-		query = query.Where("name &~ ?", filesQuery.Query.Value)
+		query = query.Where("NOT name_encrypted AND name &~ ?", filesQuery.Query.Value)
 	}
 	return query
 }
@@ -252,7 +261,7 @@ func getValidOrderDirection(order api.FileQueryOrder) string {
 
 func (afb *fileQueryBuilder) buildSubqueryCTE(query *gorm.DB, filesQuery *api.FilesListParams, userId int64) *gorm.DB {
 	if filesQuery.DeepSearch.Value && filesQuery.Query.Value != "" && filesQuery.Path.Value != "" {
-		id, _ := resolvePathID(afb.db, filesQuery.Path.Value, userId)
+		id, _ := resolvePathID(afb.db, afb.names, filesQuery.Path.Value, userId)
 		var whereClause string
 		var args []any
 		if id == nil {
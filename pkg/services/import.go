@@ -0,0 +1,423 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	importPending   = "pending"
+	importRunning   = "running"
+	importCompleted = "completed"
+	importFailed    = "failed"
+	importCancelled = "cancelled"
+
+	importProgressInterval = 2 * time.Second
+)
+
+var (
+	ErrImportNotFound     = errors.New("import not found")
+	ErrImportURL          = errors.New("url must be an absolute http or https url")
+	ErrImportCancelled    = errors.New("import cancelled")
+	ErrImportNotResumable = errors.New("server does not support resuming the download")
+	ErrImportNoName       = errors.New("name is required when it cannot be derived from the url")
+	ErrImportPrivate      = errors.New("importing from private network addresses is not allowed")
+)
+
+type importCreate struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Path    string            `json:"path"`
+	Name    string            `json:"name"`
+}
+
+// importJob is the public view of an import. Request headers may carry
+// credentials and are never returned.
+type importJob struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Path       string    `json:"path"`
+	Name       string    `json:"name,omitempty"`
+	Status     string    `json:"status"`
+	Size       *int64    `json:"size,omitempty"`
+	Downloaded int64     `json:"downloaded"`
+	FileId     *string   `json:"fileId,omitempty"`
+	Error      *string   `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func toImportJob(j models.ImportJob) importJob {
+	return importJob{
+		ID:         j.ID,
+		URL:        j.URL,
+		Path:       j.Path,
+		Name:       j.Name,
+		Status:     j.Status,
+		Size:       j.Size,
+		Downloaded: j.Downloaded,
+		FileId:     j.FileId,
+		Error:      j.Error,
+		CreatedAt:  j.CreatedAt,
+		UpdatedAt:  j.UpdatedAt,
+	}
+}
+
+// importClient returns the HTTP client imports download with. Unless private
+// networks are allowed it refuses to connect to loopback, private and link
+// local addresses, whatever the URL resolves to.
+func (a *apiService) importClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !a.cnf.Imports.AllowPrivateNetworks {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+				ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+				return ErrImportPrivate
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	// Compressed responses cannot be resumed by byte offset.
+	transport.DisableCompression = true
+	return &http.Client{Transport: transport}
+}
+
+func (e *extendedService) ImportsCreate(w http.ResponseWriter, r *http.Request) {
+	var req importCreate
+	if err := decodeJSON(r, &req); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e.writeError(w, r, &apiError{err: ErrImportURL, code: http.StatusBadRequest})
+		return
+	}
+	if strings.Contains(req.Name, "/") {
+		e.writeError(w, r, &apiError{err: ErrUploadName, code: http.StatusBadRequest})
+		return
+	}
+	if req.Path == "" {
+		req.Path = "/"
+	}
+
+	job := models.ImportJob{
+		UserId:  auth.GetUser(r.Context()),
+		URL:     u.String(),
+		Headers: datatypes.NewJSONType(req.Headers),
+		Path:    req.Path,
+		Name:    req.Name,
+		Status:  importPending,
+	}
+	if err := e.api.db.Create(&job).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	// The job outlives the request but keeps acting as its user.
+	ctx := auth.WithUser(context.Background(), auth.GetJWTUser(r.Context()))
+	go e.runImport(ctx, job)
+
+	writeJSON(w, http.StatusAccepted, toImportJob(job))
+}
+
+func (e *extendedService) ImportsList(w http.ResponseWriter, r *http.Request) {
+	var jobs []models.ImportJob
+	if err := e.api.db.Where("user_id = ?", auth.GetUser(r.Context())).Order("created_at DESC").
+		Limit(queryInt(r, "limit", 100)).Find(&jobs).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, utils.Map(jobs, toImportJob))
+}
+
+func (e *extendedService) importJob(r *http.Request) (*models.ImportJob, error) {
+	var job models.ImportJob
+	id := chi.URLParam(r, "id")
+	if !isUUID(id) {
+		return nil, &apiError{err: ErrImportNotFound, code: http.StatusNotFound}
+	}
+	if err := e.api.db.Where("id = ? AND user_id = ?", id, auth.GetUser(r.Context())).
+		First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &apiError{err: ErrImportNotFound, code: http.StatusNotFound}
+		}
+		return nil, &apiError{err: err}
+	}
+	return &job, nil
+}
+
+func (e *extendedService) ImportsGet(w http.ResponseWriter, r *http.Request) {
+	job, err := e.importJob(r)
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toImportJob(*job))
+}
+
+// ImportsCancel stops a pending or running import. The runner notices the
+// status change at its next progress update.
+func (e *extendedService) ImportsCancel(w http.ResponseWriter, r *http.Request) {
+	job, err := e.importJob(r)
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	if err := e.api.db.Model(job).Where("status IN ?", []string{importPending, importRunning}).
+		Updates(map[string]any{"status": importCancelled, "updated_at": time.Now().UTC()}).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setImportStatus moves a job on from status from. It reports false when the
+// job was changed meanwhile, i.e. cancelled.
+func (a *apiService) setImportStatus(job *models.ImportJob, from string, values map[string]any) (bool, error) {
+	values["updated_at"] = time.Now().UTC()
+	res := a.db.Model(&models.ImportJob{}).Where("id = ? AND status = ?", job.ID, from).Updates(values)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (e *extendedService) runImport(ctx context.Context, job models.ImportJob) {
+	a := e.api
+	logger := logging.Component("IMPORT").With(zap.String("job_id", job.ID), zap.String("url", job.URL))
+
+	e.importSlots <- struct{}{}
+	defer func() { <-e.importSlots }()
+
+	if ok, err := a.setImportStatus(&job, importPending, map[string]any{"status": importRunning}); !ok || err != nil {
+		return
+	}
+	job.Status = importRunning
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fileId, err := a.importURL(ctx, &job, cancel)
+	if err != nil {
+		if errors.Is(err, ErrImportCancelled) {
+			logger.Info("import.cancelled")
+			return
+		}
+		logger.Error("import.failed", zap.Error(err))
+		a.setImportStatus(&job, importRunning, map[string]any{"status": importFailed, "error": err.Error()})
+		a.events.Record(events.OpImportFailed, job.UserId, &models.Source{
+			ID:   job.ID,
+			Type: "import",
+			Name: job.Name,
+			Path: job.Path,
+		})
+		return
+	}
+	a.setImportStatus(&job, importRunning, map[string]any{"status": importCompleted, "file_id": fileId})
+	a.events.Record(events.OpImportDone, job.UserId, &models.Source{
+		ID:   job.ID,
+		Type: "import",
+		Name: job.Name,
+		Path: job.Path,
+	})
+	logger.Info("import.completed", zap.Int64("size", job.Downloaded))
+}
+
+// importName derives a file name from the response or the URL.
+func importName(res *http.Response) string {
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		if name := path.Base(params["filename"]); name != "." && name != "/" {
+			return name
+		}
+	}
+	if name := path.Base(res.Request.URL.Path); name != "." && name != "/" {
+		return name
+	}
+	return ""
+}
+
+// importURL downloads the job's URL into a new file. Interrupted downloads
+// resume with range requests, guarded with If-Range so a changed resource is
+// not stitched together from two versions.
+func (a *apiService) importURL(ctx context.Context, job *models.ImportJob, cancel context.CancelFunc) (string, error) {
+	parentId, err := a.copyDestination(job.UserId, job.Path)
+	if err != nil {
+		return "", err
+	}
+	partSize, err := a.uploadPartSize(ctx, job.UserId)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		client    = a.importClient()
+		upload    *spoolUpload
+		validator string
+		total     int64 = -1
+		lastSaved time.Time
+	)
+	defer func() {
+		if upload != nil && err != nil {
+			upload.abort()
+		}
+	}()
+
+	progress := func(force bool) error {
+		if !force && time.Since(lastSaved) < importProgressInterval {
+			return nil
+		}
+		lastSaved = time.Now()
+		values := map[string]any{"downloaded": job.Downloaded, "name": job.Name}
+		if total >= 0 {
+			values["size"] = total
+		}
+		ok, err := a.setImportStatus(job, importRunning, values)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			cancel()
+			return ErrImportCancelled
+		}
+		a.events.Record(events.OpImportProgress, job.UserId, &models.Source{
+			ID:       job.ID,
+			Type:     "import",
+			Name:     job.Name,
+			Path:     job.Path,
+			Progress: &models.Progress{Done: int(job.Downloaded), Total: int(max(total, 0))},
+		})
+		return nil
+	}
+
+	attempt := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.URL, nil)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		for k, v := range job.Headers.Data() {
+			req.Header.Set(k, v)
+		}
+		if job.Downloaded > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", job.Downloaded))
+			if validator != "" {
+				req.Header.Set("If-Range", validator)
+			}
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			if errors.Is(err, ErrImportPrivate) || ctx.Err() != nil {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		defer res.Body.Close()
+
+		switch {
+		case job.Downloaded == 0 && res.StatusCode == http.StatusOK:
+			total = res.ContentLength
+			if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				validator = etag
+			} else {
+				validator = res.Header.Get("Last-Modified")
+			}
+			if res.Header.Get("Accept-Ranges") != "bytes" {
+				validator = ""
+			}
+			if job.Name == "" {
+				if job.Name = importName(res); job.Name == "" {
+					return backoff.Permanent(ErrImportNoName)
+				}
+			}
+			if upload == nil {
+				upload = a.newSpoolUpload(ctx, parentId, job.Name, partSize)
+				upload.setConcurrency(a.cnf.TG.Uploads.Threads)
+			}
+		case job.Downloaded > 0 && res.StatusCode == http.StatusPartialContent:
+			if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", job.Downloaded)) {
+				return backoff.Permanent(ErrImportNotResumable)
+			}
+		case job.Downloaded > 0 && res.StatusCode == http.StatusOK:
+			return backoff.Permanent(ErrImportNotResumable)
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			return fmt.Errorf("unexpected status %s", res.Status)
+		default:
+			return backoff.Permanent(fmt.Errorf("unexpected status %s", res.Status))
+		}
+
+		buf := make([]byte, 256*1024)
+		for {
+			n, readErr := res.Body.Read(buf)
+			if n > 0 {
+				if _, err := upload.Write(buf[:n]); err != nil {
+					return backoff.Permanent(err)
+				}
+				job.Downloaded += int64(n)
+				if err := progress(false); err != nil {
+					return backoff.Permanent(err)
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				if validator == "" {
+					return backoff.Permanent(fmt.Errorf("%w: %w", ErrImportNotResumable, readErr))
+				}
+				return readErr
+			}
+		}
+		if total >= 0 && job.Downloaded != total {
+			if validator == "" {
+				return backoff.Permanent(ErrImportNotResumable)
+			}
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+
+	policy := backoff.WithContext(backoff.WithMaxRetries(backoff.NewExponentialBackOff(),
+		uint64(max(a.cnf.Imports.MaxRetries, 0))), ctx)
+	if err = backoff.RetryNotify(attempt, policy, func(err error, wait time.Duration) {
+		logging.Component("IMPORT").Warn("import.retrying", zap.String("job_id", job.ID),
+			zap.Int64("downloaded", job.Downloaded), zap.Duration("wait", wait), zap.Error(err))
+	}); err != nil {
+		return "", err
+	}
+	if err = progress(true); err != nil {
+		return "", err
+	}
+	// Close discards the stored parts itself when it fails.
+	closing := upload
+	upload = nil
+	file, err := closing.Close()
+	if err != nil {
+		return "", err
+	}
+	return file.ID.Value, nil
+}
@@ -0,0 +1,338 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrNoDataKey = errors.New("user has no data key")
+
+const (
+	keyProtectionMaster     = "master"
+	keyProtectionPassphrase = "passphrase"
+
+	// masterSession is the slot of the unlocked keys holding a data key
+	// unwrapped with the master key, which every session of the user shares.
+	masterSession = ""
+
+	// defaultUnlockIdle is how long an unlocked data key is kept unused when
+	// the configuration does not say.
+	defaultUnlockIdle = 15 * time.Minute
+)
+
+type dataKeyStatus struct {
+	PerUser    bool   `json:"perUser"`
+	Created    bool   `json:"created"`
+	Protection string `json:"protection,omitempty"`
+	Unlocked   bool   `json:"unlocked"`
+}
+
+type passphraseRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// unlockedKeys holds unwrapped data keys by user and session. They only live
+// in the memory of this process, never in the shared cache, and are forgotten
+// once unused for idle. Each key is only used while the user key is still
+// wrapped with the salt it was unwrapped from, so a key wrapped again by
+// another instance is not served from here.
+type unlockedKeys struct {
+	mu   sync.Mutex
+	idle time.Duration
+	keys map[int64]map[string]*unlockedKey
+}
+
+type unlockedKey struct {
+	key   string
+	salt  string
+	timer *time.Timer
+}
+
+func newUnlockedKeys(idle time.Duration) *unlockedKeys {
+	if idle <= 0 {
+		idle = defaultUnlockIdle
+	}
+	return &unlockedKeys{idle: idle, keys: map[int64]map[string]*unlockedKey{}}
+}
+
+// get returns the key unlocked in the session with sessionHash from the key
+// wrapped with salt, and keeps it for another idle period.
+func (u *unlockedKeys) get(userId int64, sessionHash, salt string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	unlocked, ok := u.keys[userId][sessionHash]
+	if !ok || unlocked.salt != salt {
+		return "", false
+	}
+	unlocked.timer.Reset(u.idle)
+	return unlocked.key, true
+}
+
+func (u *unlockedKeys) set(userId int64, sessionHash, salt, key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	sessions := u.keys[userId]
+	if sessions == nil {
+		sessions = map[string]*unlockedKey{}
+		u.keys[userId] = sessions
+	}
+	if unlocked, ok := sessions[sessionHash]; ok {
+		unlocked.timer.Stop()
+	}
+	sessions[sessionHash] = &unlockedKey{key: key, salt: salt, timer: time.AfterFunc(u.idle, func() {
+		u.forget(userId, sessionHash)
+	})}
+}
+
+// forget drops the key unlocked in the session with sessionHash.
+func (u *unlockedKeys) forget(userId int64, sessionHash string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if unlocked, ok := u.keys[userId][sessionHash]; ok {
+		unlocked.timer.Stop()
+		delete(u.keys[userId], sessionHash)
+	}
+	if len(u.keys[userId]) == 0 {
+		delete(u.keys, userId)
+	}
+}
+
+// forgetUser drops the keys unlocked in every session of userId.
+func (u *unlockedKeys) forgetUser(userId int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, unlocked := range u.keys[userId] {
+		unlocked.timer.Stop()
+	}
+	delete(u.keys, userId)
+}
+
+func errKeyLocked() error {
+	return &apiError{err: crypt.ErrKeyLocked, code: http.StatusLocked}
+}
+
+// sessionHash returns the hash of the session ctx is authenticated with. Data
+// keys protected by a passphrase are unlocked per session.
+func sessionHash(ctx context.Context) string {
+	if claims := auth.GetJWTUser(ctx); claims != nil {
+		return claims.Hash
+	}
+	return ""
+}
+
+// masterKey returns the key that wraps the data keys of users without a
+// passphrase.
+func (a *apiService) masterKey() string {
+	if a.cnf.Keys.MasterKey != "" {
+		return a.cnf.Keys.MasterKey
+	}
+	return a.cnf.TG.Uploads.EncryptionKey
+}
+
+// dataKey returns the data key of userId. Keys wrapped with the master key
+// are always available; keys protected by a passphrase only once unlocked in
+// the session with sessionHash. A missing key is generated when create is set.
+// The protection of the key is read every time, so a passphrase set on any
+// instance locks the key everywhere.
+func (a *apiService) dataKey(ctx context.Context, userId int64, sessionHash string, create bool) (string, error) {
+	var userKey models.UserKey
+	err := a.db.Where("user_id = ?", userId).First(&userKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !create {
+			return "", &apiError{err: ErrNoDataKey, code: http.StatusNotFound}
+		}
+		return a.createDataKey(ctx, userId, sessionHash)
+	}
+	if err != nil {
+		return "", &apiError{err: err}
+	}
+	if userKey.Protection == keyProtectionMaster {
+		sessionHash = masterSession
+	} else if sessionHash == "" {
+		return "", errKeyLocked()
+	}
+	if key, ok := a.unlocked.get(userId, sessionHash, userKey.Salt); ok {
+		return key, nil
+	}
+	if userKey.Protection != keyProtectionMaster {
+		return "", errKeyLocked()
+	}
+	key, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, a.masterKey())
+	if err != nil {
+		return "", &apiError{err: err}
+	}
+	a.unlocked.set(userId, masterSession, userKey.Salt, key)
+	return key, nil
+}
+
+func (a *apiService) createDataKey(ctx context.Context, userId int64, sessionHash string) (string, error) {
+	key, err := crypt.NewDataKey()
+	if err != nil {
+		return "", &apiError{err: err}
+	}
+	wrapped, salt, err := crypt.WrapKey(key, a.masterKey())
+	if err != nil {
+		return "", &apiError{err: err}
+	}
+	res := a.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.UserKey{
+		UserId:     userId,
+		WrappedKey: wrapped,
+		Salt:       salt,
+		Protection: keyProtectionMaster,
+	})
+	if res.Error != nil {
+		return "", &apiError{err: res.Error}
+	}
+	if res.RowsAffected == 0 {
+		// Another upload created the key first
+		return a.dataKey(ctx, userId, sessionHash, false)
+	}
+	a.unlocked.set(userId, masterSession, salt, key)
+	return key, nil
+}
+
+// needsDataKey reports whether any part of file was encrypted with the data
+// key of its owner.
+func needsDataKey(file *models.File) bool {
+	if file.Encrypted == nil || !*file.Encrypted || file.Parts == nil {
+		return false
+	}
+	for _, part := range *file.Parts {
+		if crypt.IsUserSalt(part.Salt.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// withDataKey returns ctx carrying the data key of the owner of file when
+// file needs it.
+func (a *apiService) withDataKey(ctx context.Context, file *models.File, sessionHash string) (context.Context, error) {
+	if !needsDataKey(file) {
+		return ctx, nil
+	}
+	key, err := a.dataKey(ctx, file.UserId, sessionHash, false)
+	if err != nil {
+		return ctx, err
+	}
+	return crypt.WithDataKey(ctx, key), nil
+}
+
+func (a *apiService) dataKeyStatus(ctx context.Context, userId int64) (*dataKeyStatus, error) {
+	status := &dataKeyStatus{PerUser: a.cnf.Keys.PerUser}
+	var userKey models.UserKey
+	err := a.db.Where("user_id = ?", userId).First(&userKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+	status.Created = true
+	status.Protection = userKey.Protection
+	_, err = a.dataKey(ctx, userId, sessionHash(ctx), false)
+	status.Unlocked = err == nil
+	return status, nil
+}
+
+func (e *extendedService) UsersKeyStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := e.api.dataKeyStatus(r.Context(), auth.GetUser(r.Context()))
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// UsersKeyUnlock unwraps the data key with the passphrase of the user and
+// keeps it for the calling session.
+func (e *extendedService) UsersKeyUnlock(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := auth.GetUser(ctx)
+	var req passphraseRequest
+	if err := decodeJSON(r, &req); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	var userKey models.UserKey
+	if err := e.api.db.Where("user_id = ?", userId).First(&userKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = &apiError{err: ErrNoDataKey, code: http.StatusNotFound}
+		}
+		e.writeError(w, r, err)
+		return
+	}
+	if userKey.Protection == keyProtectionPassphrase {
+		key, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, req.Passphrase)
+		if err != nil {
+			e.writeError(w, r, &apiError{err: err, code: http.StatusForbidden})
+			return
+		}
+		e.api.unlocked.set(userId, sessionHash(ctx), userKey.Salt, key)
+	}
+	e.UsersKeyStatus(w, r)
+}
+
+// UsersKeyLock forgets the data key unlocked in the calling session.
+func (e *extendedService) UsersKeyLock(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	e.api.unlocked.forget(auth.GetUser(ctx), sessionHash(ctx))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UsersKeyPassphrase wraps the data key with a new passphrase, or with the
+// master key again when the passphrase is empty. The key itself is kept, so
+// stored files stay readable. Other sessions have to unlock it again.
+func (e *extendedService) UsersKeyPassphrase(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := auth.GetUser(ctx)
+	hash := sessionHash(ctx)
+	var req passphraseRequest
+	if err := decodeJSON(r, &req); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	if e.api.masterKey() == "" {
+		e.writeError(w, r, &apiError{err: errors.New("encryption is not enabled"), code: http.StatusBadRequest})
+		return
+	}
+	key, err := e.api.dataKey(ctx, userId, hash, true)
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	kek, protection := e.api.masterKey(), keyProtectionMaster
+	if req.Passphrase != "" {
+		kek, protection = req.Passphrase, keyProtectionPassphrase
+	}
+	wrapped, salt, err := crypt.WrapKey(key, kek)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	if err := e.api.db.Model(&models.UserKey{}).Where("user_id = ?", userId).Updates(map[string]any{
+		"wrapped_key": wrapped,
+		"salt":        salt,
+		"protection":  protection,
+		"updated_at":  time.Now().UTC(),
+	}).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	e.api.unlocked.forgetUser(userId)
+	if protection == keyProtectionPassphrase {
+		e.api.unlocked.set(userId, hash, salt, key)
+	} else {
+		e.api.unlocked.set(userId, masterSession, salt, key)
+	}
+	e.UsersKeyStatus(w, r)
+}
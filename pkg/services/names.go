@@ -0,0 +1,237 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrNamesNotEnabled = errors.New("name encryption is not enabled")
+
+// nameCodec encrypts the names of encrypted files and of folders with the
+// name cipher of the upload key. Encryption is deterministic, so an encrypted
+// name can still be looked up by its plaintext, and paths are resolved one
+// segment at a time. Each row records in name_encrypted which form its name
+// is stored in; the root folder always keeps its plain name.
+//
+// A nil codec (no encryption key) leaves every name as it is.
+type nameCodec struct {
+	cipher *crypt.Cipher
+	// store encrypts the names kept in teldrive.files.
+	store bool
+	// telegram encrypts the file names of uploaded parts.
+	telegram bool
+}
+
+func newNameCodec(cnf *config.ServerCmdConfig) (*nameCodec, error) {
+	if cnf.TG.Uploads.EncryptionKey == "" {
+		return nil, nil
+	}
+	cipher, err := crypt.NewNameCipher(cnf.TG.Uploads.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return &nameCodec{cipher: cipher, store: cnf.Files.EncryptNames, telegram: cnf.TG.Uploads.EncryptNames}, nil
+}
+
+// storedName returns the name a file of fileType is saved under in
+// teldrive.files and whether that is its encrypted form.
+func (n *nameCodec) storedName(name, fileType string, encrypted bool) (string, bool, error) {
+	if n == nil || !n.store || (fileType != string(api.FileTypeFolder) && !encrypted) {
+		return name, false, nil
+	}
+	stored, err := n.cipher.EncryptName(name)
+	if err != nil {
+		return "", false, err
+	}
+	return stored, true, nil
+}
+
+// setName stores name as the name of file, in the form its type and
+// encryption call for.
+func (n *nameCodec) setName(file *models.File, name string) error {
+	stored, encrypted, err := n.storedName(name, file.Type, file.Encrypted != nil && *file.Encrypted)
+	if err != nil {
+		return err
+	}
+	file.Name, file.NameEncrypted = stored, encrypted
+	return nil
+}
+
+// plainOrder reports whether stored names compare like their plaintext, which
+// they do unless the names of encrypted files are encrypted.
+func (n *nameCodec) plainOrder() bool {
+	return n == nil || !n.store
+}
+
+// partName returns the file name an uploaded part is sent to Telegram with.
+func (n *nameCodec) partName(name string, encrypted bool) (string, error) {
+	if n == nil || !n.telegram || !encrypted {
+		return name, nil
+	}
+	return n.cipher.EncryptName(name)
+}
+
+// plain returns the plaintext name of file.
+func (n *nameCodec) plain(file *models.File) string {
+	return n.plainName(file.Name, file.NameEncrypted)
+}
+
+// plainName returns the plaintext of a name stored in encrypted form when
+// encrypted is set. A name that no longer decrypts, e.g. because the key
+// changed, is returned as it is.
+func (n *nameCodec) plainName(name string, encrypted bool) string {
+	if n == nil || !encrypted {
+		return name
+	}
+	plain, err := n.cipher.DecryptName(name)
+	if err != nil {
+		return name
+	}
+	return plain
+}
+
+// encryptedName returns the encrypted form of name, if names can be
+// encrypted at all.
+func (n *nameCodec) encryptedName(name string) (string, bool) {
+	if n == nil {
+		return "", false
+	}
+	encrypted, err := n.cipher.EncryptName(name)
+	return encrypted, err == nil
+}
+
+// nameIs returns the condition matching the rows stored under name, in
+// either form.
+func (n *nameCodec) nameIs(name string) clause.Expr {
+	if encrypted, ok := n.encryptedName(name); ok {
+		return gorm.Expr("(name = ? AND NOT name_encrypted OR name = ? AND name_encrypted)", name, encrypted)
+	}
+	return gorm.Expr("name = ? AND NOT name_encrypted", name)
+}
+
+// decode replaces the stored names of files by their plaintext.
+func (n *nameCodec) decode(files []models.File) {
+	for i := range files {
+		files[i].Name, files[i].NameEncrypted = n.plain(&files[i]), false
+	}
+}
+
+// pathForms is the SQL expression giving the form of the name of the files
+// row aliased f as one character: 1 when it is encrypted, 0 otherwise.
+// Queries that build paths concatenate it alongside the names, into the
+// path_forms column of archiveEntry.
+const pathForms = "f.name_encrypted::int::text"
+
+// decodeEntries replaces the stored names of entries and the segments of
+// their paths by the plaintext.
+func (n *nameCodec) decodeEntries(entries []archiveEntry) {
+	for i := range entries {
+		entries[i].Path = n.decodePath(entries[i].Path, entries[i].PathForms)
+		entries[i].Name, entries[i].NameEncrypted = n.plain(&entries[i].File), false
+	}
+}
+
+// decodePath returns the plaintext of a path of stored names, whose forms
+// give for each segment whether it is encrypted, as built with pathForms.
+func (n *nameCodec) decodePath(p, forms string) string {
+	if n == nil || !strings.Contains(forms, "1") {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	for i := range segments {
+		if i < len(forms) && forms[i] == '1' {
+			segments[i] = n.plainName(segments[i], true)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// fileOut maps file to its API form with the plaintext name.
+func (a *apiService) fileOut(file models.File) *api.File {
+	file.Name = a.names.plain(&file)
+	return mapper.ToFileOut(file)
+}
+
+type nameMigration struct {
+	Files int64 `json:"files"`
+}
+
+// convertNames rewrites the stored names of the encrypted files and the
+// folders of userId: plaintext names are encrypted when encrypt is set,
+// encrypted names are decrypted otherwise. Names already in the wanted form
+// are left alone, so the conversion can be repeated safely.
+func (a *apiService) convertNames(ctx context.Context, userId int64, encrypt bool) (int64, error) {
+	var converted int64
+	var files []models.File
+	query := a.db.Model(&models.File{}).Select("id", "name", "name_encrypted").
+		Where("user_id = ? AND name_encrypted = ?", userId, !encrypt)
+	if encrypt {
+		// The root folder keeps its plain name
+		query = query.Where("(type = 'file' AND encrypted OR type = 'folder' AND parent_id IS NOT NULL)")
+	}
+	err := query.FindInBatches(&files, 500, func(tx *gorm.DB, batch int) error {
+		keys := []string{}
+		for i := range files {
+			var name string
+			var err error
+			if encrypt {
+				name, err = a.names.cipher.EncryptName(files[i].Name)
+			} else {
+				name, err = a.names.cipher.DecryptName(files[i].Name)
+			}
+			if err != nil {
+				continue
+			}
+			if err := a.db.Model(&models.File{}).Where("id = ?", files[i].ID).
+				Updates(map[string]any{"name": name, "name_encrypted": encrypt}).Error; err != nil {
+				return err
+			}
+			keys = append(keys, cache.KeyFile(files[i].ID))
+			converted++
+		}
+		if len(keys) > 0 {
+			a.cache.Delete(ctx, keys...)
+		}
+		return nil
+	}).Error
+	return converted, err
+}
+
+// FilesEncryptNames stores the names of the caller's encrypted files and
+// folders in encrypted form, converting those created before name encryption
+// was enabled.
+func (e *extendedService) FilesEncryptNames(w http.ResponseWriter, r *http.Request) {
+	e.migrateNames(w, r, true)
+}
+
+// FilesDecryptNames reverses FilesEncryptNames, for turning name encryption
+// off again.
+func (e *extendedService) FilesDecryptNames(w http.ResponseWriter, r *http.Request) {
+	e.migrateNames(w, r, false)
+}
+
+func (e *extendedService) migrateNames(w http.ResponseWriter, r *http.Request, encrypt bool) {
+	if e.api.names == nil {
+		e.writeError(w, r, &apiError{err: ErrNamesNotEnabled, code: http.StatusBadRequest})
+		return
+	}
+	userId := auth.GetUser(r.Context())
+	count, err := e.api.convertNames(r.Context(), userId, encrypt)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, nameMigration{Files: count})
+}
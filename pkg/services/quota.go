@@ -0,0 +1,183 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	ErrQuotaAdmin    = errors.New("only quota admins can manage quotas")
+	ErrUserNotFound  = errors.New("user not found")
+)
+
+// storageQuota is the usage and effective quota of a user. A quota of 0 is
+// unlimited.
+type storageQuota struct {
+	UserId      int64
+	UserName    string
+	QuotaSize   *int64
+	QuotaFiles  *int64
+	Size        int64
+	Files       int64
+	TrashedSize int64
+}
+
+func (a *apiService) quotaQuery() *gorm.DB {
+	return a.db.Table("teldrive.users as u").
+		Select("u.user_id, u.user_name, u.quota_size, u.quota_files, COALESCE(s.size, 0) as size, COALESCE(s.files, 0) as files, COALESCE(s.trashed_size, 0) as trashed_size").
+		Joins("LEFT JOIN teldrive.user_usage as s ON s.user_id = u.user_id")
+}
+
+func (a *apiService) storageQuota(userId int64) (*storageQuota, error) {
+	var quota storageQuota
+	if err := a.quotaQuery().Where("u.user_id = ?", userId).Scan(&quota).Error; err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+func (q *storageQuota) maxSize(defaultSize int64) int64 {
+	if q.QuotaSize != nil {
+		return *q.QuotaSize
+	}
+	return defaultSize
+}
+
+func (q *storageQuota) maxFiles(defaultFiles int64) int64 {
+	if q.QuotaFiles != nil {
+		return *q.QuotaFiles
+	}
+	return defaultFiles
+}
+
+// checkQuota fails when storing size more bytes in files more files would
+// take userId over its quota.
+func (a *apiService) checkQuota(userId, size, files int64) error {
+	quota, err := a.storageQuota(userId)
+	if err != nil {
+		return &apiError{err: err}
+	}
+	if limit := quota.maxSize(a.cnf.Quota.MaxSize); limit > 0 && quota.Size+size > limit {
+		return &apiError{err: ErrQuotaExceeded, code: http.StatusInsufficientStorage}
+	}
+	if limit := quota.maxFiles(a.cnf.Quota.MaxFiles); limit > 0 && quota.Files+files > limit {
+		return &apiError{err: ErrQuotaExceeded, code: http.StatusInsufficientStorage}
+	}
+	return nil
+}
+
+// storageUsage follows the fields of rclone's about output. Total and Free
+// are left out when the user has no size quota, MaxObjects and FreeObjects
+// when there is no file quota.
+type storageUsage struct {
+	Total       *int64 `json:"total,omitempty"`
+	Used        int64  `json:"used"`
+	Trashed     int64  `json:"trashed"`
+	Free        *int64 `json:"free,omitempty"`
+	Objects     int64  `json:"objects"`
+	MaxObjects  *int64 `json:"maxObjects,omitempty"`
+	FreeObjects *int64 `json:"freeObjects,omitempty"`
+}
+
+type userQuota struct {
+	UserId   int64  `json:"userId"`
+	UserName string `json:"userName"`
+	storageUsage
+}
+
+func (a *apiService) toStorageUsage(q *storageQuota) storageUsage {
+	usage := storageUsage{Used: q.Size, Trashed: q.TrashedSize, Objects: q.Files}
+	if limit := q.maxSize(a.cnf.Quota.MaxSize); limit > 0 {
+		usage.Total = utils.Ptr(limit)
+		usage.Free = utils.Ptr(max(limit-q.Size, 0))
+	}
+	if limit := q.maxFiles(a.cnf.Quota.MaxFiles); limit > 0 {
+		usage.MaxObjects = utils.Ptr(limit)
+		usage.FreeObjects = utils.Ptr(max(limit-q.Files, 0))
+	}
+	return usage
+}
+
+// UsersUsage returns the storage used by the user and what is left of its
+// quota.
+func (e *extendedService) UsersUsage(w http.ResponseWriter, r *http.Request) {
+	quota, err := e.api.storageQuota(auth.GetUser(r.Context()))
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, e.api.toStorageUsage(quota))
+}
+
+func (e *extendedService) quotaAdmin(r *http.Request) bool {
+	return slices.Contains(e.api.cnf.Quota.Admins, auth.GetJWTUser(r.Context()).UserName)
+}
+
+// QuotasList returns the usage and quota of every user. Quota admins only.
+func (e *extendedService) QuotasList(w http.ResponseWriter, r *http.Request) {
+	if !e.quotaAdmin(r) {
+		e.writeError(w, r, &apiError{err: ErrQuotaAdmin, code: http.StatusForbidden})
+		return
+	}
+	var quotas []storageQuota
+	if err := e.api.quotaQuery().Order("u.user_id").Scan(&quotas).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, utils.Map(quotas, func(q storageQuota) userQuota {
+		return userQuota{UserId: q.UserId, UserName: q.UserName, storageUsage: e.api.toStorageUsage(&q)}
+	}))
+}
+
+type quotaUpdate struct {
+	Size  *int64 `json:"size"`
+	Files *int64 `json:"files"`
+}
+
+// QuotasUpdate sets the quota of a user. A null limit falls back to the
+// configured default and 0 lifts it. Quota admins only.
+func (e *extendedService) QuotasUpdate(w http.ResponseWriter, r *http.Request) {
+	if !e.quotaAdmin(r) {
+		e.writeError(w, r, &apiError{err: ErrQuotaAdmin, code: http.StatusForbidden})
+		return
+	}
+	userId, err := strconv.ParseInt(chi.URLParam(r, "userId"), 10, 64)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: ErrUserNotFound, code: http.StatusNotFound})
+		return
+	}
+	var req quotaUpdate
+	if err := decodeJSON(r, &req); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	if (req.Size != nil && *req.Size < 0) || (req.Files != nil && *req.Files < 0) {
+		e.writeError(w, r, &apiError{err: errors.New("quotas must not be negative"), code: http.StatusBadRequest})
+		return
+	}
+	res := e.api.db.Model(&models.User{}).Where("user_id = ?", userId).
+		Updates(map[string]any{"quota_size": req.Size, "quota_files": req.Files})
+	if res.Error != nil {
+		e.writeError(w, r, &apiError{err: res.Error})
+		return
+	}
+	if res.RowsAffected == 0 {
+		e.writeError(w, r, &apiError{err: ErrUserNotFound, code: http.StatusNotFound})
+		return
+	}
+	quota, err := e.api.storageQuota(userId)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, userQuota{UserId: quota.UserId, UserName: quota.UserName, storageUsage: e.api.toStorageUsage(quota)})
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Files move between teldrive and an rclone crypt remote whose password is
+// the upload encryption key and that has no salt (password2). Names are
+// encrypted the same way as well, see nameCodec.
+var (
+	ErrRcloneNotEnabled = errors.New("encryption is not enabled")
+	ErrRcloneDataKey    = errors.New("files encrypted with a data key cannot be exported")
+)
+
+// isRcloneFile reports whether file was stored from an rclone crypt object,
+// so that its parts still join up to that object.
+func isRcloneFile(file *models.File) bool {
+	if file.Encrypted == nil || !*file.Encrypted || file.Parts == nil || len(*file.Parts) == 0 {
+		return false
+	}
+	for _, part := range *file.Parts {
+		if part.Salt.Value != crypt.RcloneSalt {
+			return false
+		}
+	}
+	return true
+}
+
+// UploadsRclone stores the rclone crypt object sent as the request body as an
+// encrypted file. Its blocks are stored as they are, so the content is never
+// decrypted. The name query parameter may be the encrypted name of the object;
+// the destination is given as for UploadsStream.
+func (e *extendedService) UploadsRclone(w http.ResponseWriter, r *http.Request) {
+	if e.api.names == nil {
+		e.writeError(w, r, &apiError{err: ErrRcloneNotEnabled, code: http.StatusBadRequest})
+		return
+	}
+	header, err := crypt.ReadRcloneHeader(r.Body)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err, code: http.StatusBadRequest})
+		return
+	}
+	upload, err := e.newStreamUpload(r)
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	if plain, err := e.api.names.cipher.DecryptName(upload.name); err == nil {
+		upload.name = plain
+	}
+	upload.encrypted = true
+	upload.rclone = header
+	// Parts hold whole blocks and have to fit with their header
+	upload.partSize = max((upload.partSize-crypt.PartSize(0))/crypt.EncryptedBlockSize, 1) * crypt.EncryptedBlockSize
+	length := r.ContentLength
+	if length >= 0 {
+		length -= int64(crypt.RcloneHeaderSize)
+	}
+	e.finishStreamUpload(w, r, upload, r.Body, length)
+}
+
+// FilesRcloneExport streams a file as an rclone crypt object, to be stored
+// under the encrypted name given in Content-Disposition. Files uploaded with
+// UploadsRclone are sent as they were received, others are encrypted for the
+// remote while they are sent.
+func (e *extendedService) FilesRcloneExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if e.api.names == nil {
+		e.writeError(w, r, &apiError{err: ErrRcloneNotEnabled, code: http.StatusBadRequest})
+		return
+	}
+	userId := auth.GetUser(ctx)
+	var file models.File
+	if err := e.api.db.Where("id = ? AND user_id = ? AND type = ?", chi.URLParam(r, "id"), userId,
+		api.FileTypeFile).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = &apiError{err: err, code: http.StatusNotFound}
+		}
+		e.writeError(w, r, err)
+		return
+	}
+	// Encrypting for the remote would hand the content to the instance key
+	if needsDataKey(&file) {
+		e.writeError(w, r, &apiError{err: ErrRcloneDataKey, code: http.StatusBadRequest})
+		return
+	}
+	name, err := e.api.names.cipher.EncryptName(e.api.names.plain(&file))
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	var size int64
+	if file.Size != nil {
+		size = *file.Size
+	}
+
+	start := func() {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(crypt.RcloneSize(size), 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		w.WriteHeader(http.StatusOK)
+	}
+	// The name cipher is the cipher of the remote
+	encrypt := func(content io.Reader) error {
+		object, err := e.api.names.cipher.EncryptRclone(content)
+		if err != nil {
+			return err
+		}
+		start()
+		_, err = io.Copy(w, object)
+		return err
+	}
+	if r.Method == http.MethodHead {
+		start()
+		return
+	}
+	if size == 0 || file.Parts == nil || len(*file.Parts) == 0 {
+		if err := encrypt(http.NoBody); err != nil {
+			e.writeError(w, r, &apiError{err: err})
+		}
+		return
+	}
+
+	logger := logging.Component("FILE").With(zap.String("file_id", file.ID), zap.Int64("user_id", userId))
+	client, token, botID, err := e.api.streamClient(ctx, requestSession(ctx, userId))
+	if err != nil {
+		logger.Error("rclone.client_failed", zap.Error(err))
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	err = tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+		parts, err := getParts(ctx, client, e.api.cache, &file)
+		if err != nil {
+			e.writeError(w, r, &apiError{err: err})
+			return nil
+		}
+		ctx = reader.WithChunkCache(ctx, e.api.chunks)
+		if !isRcloneFile(&file) {
+			lr, err := reader.NewReader(ctx, client.API(), e.api.cache, &file, parts, 0, size-1, &e.api.cnf.TG, botID)
+			if err != nil {
+				e.writeError(w, r, &apiError{err: err})
+				return nil
+			}
+			defer lr.Close()
+			return encrypt(lr)
+		}
+
+		// Read the parts as stored and only swap their headers
+		raw := file
+		raw.Encrypted = utils.Ptr(false)
+		sizes := utils.Map(parts, func(p types.Part) int64 { return p.Size })
+		var total int64
+		for _, s := range sizes {
+			total += s
+		}
+		lr, err := reader.NewReader(ctx, client.API(), e.api.cache, &raw, parts, 0, total-1, &e.api.cnf.TG, botID)
+		if err != nil {
+			e.writeError(w, r, &apiError{err: err})
+			return nil
+		}
+		defer lr.Close()
+		start()
+		_, err = io.Copy(w, crypt.JoinRclone(lr, sizes))
+		return err
+	})
+	if err != nil {
+		logger.Debug("rclone.export_aborted", zap.Error(err))
+	}
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+)
+
+var errUnauthorized = errors.New("missing or invalid token")
+
+// newExtendedRoutes registers the hand-written endpoints that are served next
+// to the generated API. Routes matched here take precedence over ogen routes.
+func newExtendedRoutes(e *extendedService) chi.Router {
+	r := chi.NewRouter()
+	r.Get("/shares/{shareId}/archive", e.SharesArchive)
+	r.Options("/uploads/tus", e.TusOptions)
+	r.Options("/uploads/tus/{id}", e.TusOptions)
+	r.Group(func(r chi.Router) {
+		r.Use(e.authenticate)
+		r.Get("/files/archive", e.FilesArchive)
+		r.Get("/files/hashes/{hash}", e.FilesLookupHash)
+		r.Post("/files/names/decrypt", e.FilesDecryptNames)
+		r.Post("/files/names/encrypt", e.FilesEncryptNames)
+		r.Get("/files/verifications", e.FilesListVerifications)
+		r.Get("/files/{id}/rclone", e.FilesRcloneExport)
+		r.Get("/files/{id}/verification", e.FilesGetVerification)
+		r.Get("/files/{id}/versions", e.FilesListVersions)
+		r.Post("/files/{id}/versions/{versionId}/restore", e.FilesRestoreVersion)
+		r.Get("/imports", e.ImportsList)
+		r.Get("/stream/cache", e.StreamCacheStats)
+		r.Post("/imports", e.ImportsCreate)
+		r.Get("/imports/{id}", e.ImportsGet)
+		r.Delete("/imports/{id}", e.ImportsCancel)
+		r.Get("/trash", e.TrashList)
+		r.Delete("/trash", e.TrashEmpty)
+		r.Post("/trash/restore", e.TrashRestore)
+		r.Put("/uploads/rclone", e.UploadsRclone)
+		r.Post("/uploads/rclone", e.UploadsRclone)
+		r.Put("/uploads/stream", e.UploadsStream)
+		r.Post("/uploads/stream", e.UploadsStream)
+		r.Post("/uploads/tus", e.TusCreate)
+		r.Head("/uploads/tus/{id}", e.TusHead)
+		r.Patch("/uploads/tus/{id}", e.TusPatch)
+		r.Delete("/uploads/tus/{id}", e.TusDelete)
+		r.Post("/users/bots/check", e.UsersCheckBots)
+		r.Get("/users/bots/status", e.UsersBotStatus)
+		r.Get("/users/usage", e.UsersUsage)
+		r.Get("/users/keys", e.UsersKeyStatus)
+		r.Post("/users/keys/lock", e.UsersKeyLock)
+		r.Put("/users/keys/passphrase", e.UsersKeyPassphrase)
+		r.Post("/users/keys/unlock", e.UsersKeyUnlock)
+		r.Get("/users/quotas", e.QuotasList)
+		r.Put("/users/{userId}/quota", e.QuotasUpdate)
+		r.Get("/users/s3-keys", e.S3KeysList)
+		r.Post("/users/s3-keys", e.S3KeysCreate)
+		r.Delete("/users/s3-keys/{accessKey}", e.S3KeysDelete)
+	})
+	return r
+}
+
+// authenticate accepts the same credentials as the generated security
+// handler: a bearer token or the session cookie.
+func (e *extendedService) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimPrefix(h, "Bearer ")
+		} else if cookie, err := r.Cookie(authCookieName); err == nil {
+			token = cookie.Value
+		}
+		if token == "" {
+			e.writeError(w, r, &apiError{err: errUnauthorized, code: http.StatusUnauthorized})
+			return
+		}
+		claims, err := auth.VerifyUser(r.Context(), e.api.db, e.api.cache, e.api.cnf.JWT.Secret, token)
+		if err != nil {
+			e.writeError(w, r, &apiError{err: errUnauthorized, code: http.StatusUnauthorized})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), claims)))
+	})
+}
+
+type errorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (e *extendedService) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	res := e.api.NewError(r.Context(), err)
+	writeJSON(w, res.StatusCode, errorResponse{Code: res.Response.Code, Message: res.Response.Message})
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &apiError{err: err, code: http.StatusBadRequest}
+	}
+	return nil
+}
+
+// queryInt returns the integer query parameter name, or def when it is absent
+// or not a positive number.
+func queryInt(r *http.Request, name string, def int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
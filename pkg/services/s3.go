@@ -0,0 +1,1055 @@
+package services
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/hash"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/sigv4"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+	s3MaxParts   = 10000
+)
+
+// s3Error is an S3 error response. It doubles as error value inside the
+// gateway so handlers can return the exact S3 code.
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestId string   `xml:"RequestId"`
+	status    int
+}
+
+func (e *s3Error) Error() string { return e.Code + ": " + e.Message }
+
+func newS3Error(status int, code, message string) *s3Error {
+	return &s3Error{Code: code, Message: message, status: status}
+}
+
+var (
+	errS3NoSuchBucket   = newS3Error(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+	errS3NoSuchKey      = newS3Error(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	errS3NoSuchUpload   = newS3Error(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+	errS3InvalidPart    = newS3Error(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+	errS3PartOrder      = newS3Error(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+	errS3MalformedXML   = newS3Error(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+	errS3NotEmpty       = newS3Error(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.")
+	errS3BucketExists   = newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists.")
+	errS3NoLength       = newS3Error(http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header.")
+	errS3BadDigest      = newS3Error(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+	errS3InvalidDigest  = newS3Error(http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid.")
+	errS3NotImplemented = newS3Error(http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented.")
+)
+
+func s3AuthError(err error) *s3Error {
+	switch {
+	case errors.Is(err, sigv4.ErrUnknownAccessKey):
+		return newS3Error(http.StatusForbidden, "InvalidAccessKeyId", err.Error())
+	case errors.Is(err, sigv4.ErrSignatureMismatch):
+		return newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+	case errors.Is(err, sigv4.ErrRequestExpired):
+		return newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", err.Error())
+	case errors.Is(err, sigv4.ErrMalformed):
+		return newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", err.Error())
+	case errors.Is(err, sigv4.ErrPayloadMismatch):
+		return newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error())
+	default:
+		return newS3Error(http.StatusForbidden, "AccessDenied", err.Error())
+	}
+}
+
+// s3Handler serves an S3 compatible API with path-style addressing. Buckets
+// are the folders in the user's root folder and keys are paths below them.
+type s3Handler struct {
+	srv    *extendedService
+	prefix string
+}
+
+// NewS3Handler returns the S3 endpoint mounted at prefix. Requests are
+// authenticated with SigV4 against the access keys of users.
+func NewS3Handler(srv *extendedService, prefix string) http.Handler {
+	return &s3Handler{srv: srv, prefix: prefix}
+}
+
+// s3Request is an authenticated request split into bucket and key.
+type s3Request struct {
+	*http.Request
+	session *models.Session
+	userId  int64
+	bucket  string
+	key     string
+	body    io.Reader
+	length  int64
+}
+
+func (h *s3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a := h.srv.api
+	var userId int64
+	res, err := sigv4.Verify(r, func(accessKey string) (string, error) {
+		var key models.S3Key
+		if err := a.db.Where("access_key = ?", accessKey).First(&key).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", sigv4.ErrUnknownAccessKey
+			}
+			return "", err
+		}
+		userId = key.UserId
+		return key.SecretKey, nil
+	}, time.Now().UTC())
+	if err != nil {
+		h.writeError(w, r, s3AuthError(err))
+		return
+	}
+
+	// Operations on Telegram run with the most recent session of the user.
+	var session models.Session
+	if err := a.db.Where("user_id = ?", userId).Order("created_at DESC").Limit(1).
+		Find(&session).Error; err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	session.UserId = userId
+	ctx := auth.WithUser(r.Context(), &types.JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.FormatInt(userId, 10)},
+		Hash:             session.Hash,
+		TgSession:        session.Session,
+	})
+
+	p := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+	bucket, key, _ := strings.Cut(p, "/")
+	req := &s3Request{
+		Request: r.WithContext(ctx),
+		session: &session,
+		userId:  userId,
+		bucket:  bucket,
+		key:     key,
+		body:    res.Body,
+		length:  res.ContentLength,
+	}
+
+	if err := h.route(w, req); err != nil {
+		h.writeError(w, r, err)
+	}
+}
+
+func (h *s3Handler) route(w http.ResponseWriter, r *s3Request) error {
+	q := r.URL.Query()
+	switch {
+	case r.bucket == "":
+		if r.Method != http.MethodGet {
+			return errS3NotImplemented
+		}
+		return h.listBuckets(w, r)
+	case r.key == "":
+		switch {
+		case r.Method == http.MethodGet && q.Has("location"):
+			return writeXML(w, http.StatusOK, &struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		case r.Method == http.MethodGet:
+			return h.listObjects(w, r)
+		case r.Method == http.MethodHead:
+			_, err := h.bucketFolder(r)
+			if err == nil {
+				w.WriteHeader(http.StatusOK)
+			}
+			return err
+		case r.Method == http.MethodPut:
+			return h.createBucket(w, r)
+		case r.Method == http.MethodDelete:
+			return h.deleteBucket(w, r)
+		case r.Method == http.MethodPost && q.Has("delete"):
+			return h.deleteObjects(w, r)
+		}
+	default:
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			return h.getObject(w, r)
+		case r.Method == http.MethodPut && q.Has("uploadId"):
+			return h.uploadPart(w, r)
+		case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+			return h.copyObject(w, r)
+		case r.Method == http.MethodPut:
+			return h.putObject(w, r)
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			return h.createMultipartUpload(w, r)
+		case r.Method == http.MethodPost && q.Has("uploadId"):
+			return h.completeMultipartUpload(w, r)
+		case r.Method == http.MethodDelete && q.Has("uploadId"):
+			return h.abortMultipartUpload(w, r)
+		case r.Method == http.MethodDelete:
+			return h.deleteObject(w, r)
+		}
+	}
+	return errS3NotImplemented
+}
+
+func (h *s3Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		status := http.StatusInternalServerError
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.code != 0 {
+			status = apiErr.code
+		}
+		logging.Component("S3").Error("request.failed", zap.String("method", r.Method),
+			zap.String("path", r.URL.Path), zap.Error(err))
+		s3Err = newS3Error(status, "InternalError", err.Error())
+	}
+	res := *s3Err
+	res.Resource = r.URL.Path
+	if r.Method == http.MethodHead {
+		w.WriteHeader(res.status)
+		return
+	}
+	writeXML(w, res.status, &res)
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	return xml.NewEncoder(w).Encode(v)
+}
+
+func readXML(r *s3Request, v any) error {
+	if err := xml.NewDecoder(io.LimitReader(r.body, 2<<20)).Decode(v); err != nil {
+		return errS3MalformedXML
+	}
+	return nil
+}
+
+// s3ETag returns the ETag of a stored object. The MD5 of the content is not
+// kept with files, and clients check ETags that look like one against the
+// content, so the ETag carries a "-" suffix like those of multipart uploads.
+func s3ETag(file *models.File) string {
+	return strings.TrimSuffix(streamETag(file), `"`) + `-1"`
+}
+
+// s3MD5ETag returns the ETag of content with the MD5 sum.
+func s3MD5ETag(sum *checksum) string {
+	return `"` + sum.hex() + `"`
+}
+
+// contentMD5 returns a checksum hashing the body of r with MD5, expecting the
+// digest of the Content-MD5 header when there is one.
+func contentMD5(r *s3Request) (*checksum, error) {
+	value := r.Header.Get("Content-MD5")
+	if value == "" {
+		return newChecksum("md5"), nil
+	}
+	want, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(want) != md5.Size {
+		return nil, errS3InvalidDigest
+	}
+	return &checksum{Hash: md5.New(), algorithm: "md5", want: want}, nil
+}
+
+// lookup returns the file at path below the user's root folder.
+func (h *s3Handler) lookup(userId int64, p string) (*models.File, error) {
+	id, err := resolvePathID(h.srv.api.db, h.srv.api.names, p, userId)
+	if err != nil {
+		return nil, err
+	}
+	var file models.File
+	if err := h.srv.api.db.Where("id = ?", *id).First(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (h *s3Handler) bucketFolder(r *s3Request) (*models.File, error) {
+	folder, err := h.lookup(r.userId, "/"+r.bucket)
+	if err != nil || folder.Type != "folder" {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errS3NoSuchBucket
+		}
+		return nil, err
+	}
+	return folder, nil
+}
+
+func (h *s3Handler) object(r *s3Request, bucket, key string) (*models.File, error) {
+	file, err := h.lookup(r.userId, "/"+bucket+"/"+strings.TrimSuffix(key, "/"))
+	if err != nil || (file.Type != "file") != strings.HasSuffix(key, "/") {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errS3NoSuchKey
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// keyParent returns the folder a key is stored in, creating the folders of
+// the key path as needed.
+func (h *s3Handler) keyParent(r *s3Request, key string) (string, error) {
+	if _, err := h.bucketFolder(r); err != nil {
+		return "", err
+	}
+	dir := path.Dir("/" + r.bucket + "/" + strings.TrimSuffix(key, "/"))
+	return h.srv.api.copyDestination(r.userId, dir)
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (h *s3Handler) listBuckets(w http.ResponseWriter, r *s3Request) error {
+	var folders []models.File
+	if err := h.srv.api.db.Raw(`
+	SELECT f.* FROM teldrive.files f
+	JOIN teldrive.files root ON root.id = f.parent_id AND root.parent_id IS NULL
+	WHERE f.user_id = ? AND f.type = 'folder' AND f.status = 'active'
+	ORDER BY f.name
+	`, r.userId).Scan(&folders).Error; err != nil {
+		return err
+	}
+	owner := s3Owner{ID: strconv.FormatInt(r.userId, 10), DisplayName: strconv.FormatInt(r.userId, 10)}
+	res := struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Owner   s3Owner    `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: owner, Buckets: []s3Bucket{}}
+	// Buckets are listed by name, which encrypted names do not sort like
+	h.srv.api.names.decode(folders)
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	for _, f := range folders {
+		bucket := s3Bucket{Name: f.Name}
+		if f.CreatedAt != nil {
+			bucket.CreationDate = f.CreatedAt.UTC().Format(s3TimeFormat)
+		}
+		res.Buckets = append(res.Buckets, bucket)
+	}
+	return writeXML(w, http.StatusOK, &res)
+}
+
+func (h *s3Handler) createBucket(w http.ResponseWriter, r *s3Request) error {
+	if _, err := h.bucketFolder(r); err == nil {
+		return errS3BucketExists
+	}
+	if err := h.srv.api.FilesMkdir(r.Context(), &api.FileMkDir{Path: "/" + r.bucket}); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+r.bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *s3Handler) deleteBucket(w http.ResponseWriter, r *s3Request) error {
+	folder, err := h.bucketFolder(r)
+	if err != nil {
+		return err
+	}
+	var count int64
+	if err := h.srv.api.db.Model(&models.File{}).Where("parent_id = ? AND status = 'active'", folder.ID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errS3NotEmpty
+	}
+	if err := h.srv.api.FilesDelete(r.Context(), &api.FileDelete{Ids: []string{folder.ID}}); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	KeyCount              int        `xml:"KeyCount,omitempty"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Marker                string     `xml:"Marker,omitempty"`
+	NextMarker            string     `xml:"NextMarker,omitempty"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// listEntry is a candidate of a listing: an object or, with a delimiter, a
+// common prefix.
+type listEntry struct {
+	key    string
+	file   *models.File
+	prefix bool
+}
+
+// listObjects implements ListObjectsV2 and, for older clients, ListObjects.
+// Listing starts at the deepest folder named by the prefix; with the "/"
+// delimiter only that folder is read, otherwise its whole subtree. Without a
+// delimiter the page is selected by the query, as long as stored names sort
+// like the keys.
+func (h *s3Handler) listObjects(w http.ResponseWriter, r *s3Request) error {
+	folder, err := h.bucketFolder(r)
+	if err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < s3MaxKeys {
+			maxKeys = n
+		}
+	}
+
+	res := s3ListResult{
+		Xmlns:     s3Namespace,
+		Name:      r.bucket,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	after := ""
+	if v2 {
+		res.StartAfter = q.Get("start-after")
+		res.ContinuationToken = q.Get("continuation-token")
+		after = res.StartAfter
+		if res.ContinuationToken != "" {
+			token, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+			if err != nil {
+				return newS3Error(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect.")
+			}
+			after = string(token)
+		}
+	} else {
+		res.Marker = q.Get("marker")
+		after = res.Marker
+	}
+
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	base := folder
+	if dir != "" {
+		base, err = h.lookup(r.userId, "/"+r.bucket+"/"+strings.TrimSuffix(dir, "/"))
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if base != nil && base.Type != "folder" {
+			base = nil
+		}
+	}
+
+	// Keys start with dir, so below dir they only differ in their path.
+	relAfter := ""
+	if strings.HasPrefix(after, dir) {
+		relAfter = after[len(dir):]
+	} else if after > dir {
+		base = nil
+	}
+
+	entries := []listEntry{}
+	if base != nil {
+		var items []archiveEntry
+		if delimiter == "/" {
+			err = h.srv.api.db.Raw(`
+			SELECT f.*, f.name AS path, `+pathForms+` AS path_forms, 0 AS depth FROM teldrive.files f
+			WHERE f.parent_id = ? AND f.status = 'active'
+			`, base.ID).Scan(&items).Error
+		} else {
+			query := `
+			WITH RECURSIVE tree AS (
+				SELECT f.*, f.name::text AS path, ` + pathForms + ` AS path_forms, 0 AS depth FROM teldrive.files f
+				WHERE f.parent_id = ? AND f.status = 'active'
+				UNION ALL
+				SELECT f.*, t.path || '/' || f.name, t.path_forms || ` + pathForms + `, t.depth + 1 FROM teldrive.files f
+				JOIN tree t ON f.parent_id = t.id
+				WHERE f.status = 'active'
+			)
+			SELECT * FROM tree WHERE type = 'file'`
+			args := []any{base.ID}
+			if delimiter == "" && h.srv.api.names.plainOrder() {
+				// Paths are compared bytewise, like keys.
+				query += ` AND path COLLATE "C" > ? AND starts_with(path, ?) ORDER BY path COLLATE "C" LIMIT ?`
+				args = append(args, relAfter, prefix[len(dir):], maxKeys+1)
+			}
+			err = h.srv.api.db.Raw(query, args...).Scan(&items).Error
+		}
+		if err != nil {
+			return err
+		}
+		h.srv.api.names.decodeEntries(items)
+		seen := map[string]bool{}
+		for i := range items {
+			key := dir + items[i].Path
+			if items[i].Type == "folder" {
+				key += "/"
+			}
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if delimiter != "" {
+				if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+					common := key[:len(prefix)+idx+len(delimiter)]
+					if !seen[common] {
+						seen[common] = true
+						entries = append(entries, listEntry{key: common, prefix: true})
+					}
+					continue
+				}
+			}
+			if items[i].Type == "file" {
+				entries = append(entries, listEntry{key: key, file: &items[i].File})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	res.Contents = []s3Object{}
+	last := ""
+	for _, entry := range entries {
+		if entry.key <= after {
+			continue
+		}
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		res.KeyCount++
+		last = entry.key
+		if entry.prefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{Prefix: entry.key})
+			continue
+		}
+		obj := s3Object{Key: entry.key, ETag: s3ETag(entry.file), StorageClass: "STANDARD"}
+		if entry.file.Size != nil {
+			obj.Size = *entry.file.Size
+		}
+		if entry.file.UpdatedAt != nil {
+			obj.LastModified = entry.file.UpdatedAt.UTC().Format(s3TimeFormat)
+		}
+		res.Contents = append(res.Contents, obj)
+	}
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			res.NextMarker = last
+		}
+	}
+	if !v2 {
+		res.KeyCount = 0
+	}
+	return writeXML(w, http.StatusOK, &res)
+}
+
+func (h *s3Handler) getObject(w http.ResponseWriter, r *s3Request) error {
+	file, err := h.object(r, r.bucket, r.key)
+	if err != nil {
+		return err
+	}
+	if file.Type == "folder" {
+		w.Header().Set("Content-Type", "application/x-directory")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	h.srv.serveFile(w, r.Request, file.ID, r.session, s3ETag)
+	return nil
+}
+
+func (h *s3Handler) putObject(w http.ResponseWriter, r *s3Request) error {
+	if r.length < 0 {
+		return errS3NoLength
+	}
+	parentId, err := h.keyParent(r, r.key)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(r.key, "/") {
+		// Folder markers become folders.
+		if err := h.srv.api.FilesMkdir(r.Context(), &api.FileMkDir{Path: "/" + r.bucket + "/" + strings.TrimSuffix(r.key, "/")}); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", `"`+emptyETag+`"`)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	sum, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+	upload := h.srv.api.newSpoolUpload(r.Context(), parentId, path.Base(r.key), h.srv.api.cnf.S3.PartSize)
+	if _, err := io.Copy(upload, io.TeeReader(r.body, sum)); err != nil {
+		upload.abort()
+		if errors.Is(err, sigv4.ErrPayloadMismatch) {
+			return s3AuthError(err)
+		}
+		return err
+	}
+	if !sum.valid() {
+		upload.abort()
+		return errS3BadDigest
+	}
+	if _, err := upload.Close(); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", s3MD5ETag(sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// emptyETag is the MD5 of no content, returned for folder markers.
+const emptyETag = "d41d8cd98f00b204e9800998ecf8427e"
+
+func (h *s3Handler) copyObject(w http.ResponseWriter, r *s3Request) error {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "Invalid copy source.")
+	}
+	source, _, _ = strings.Cut(source, "?")
+	srcBucket, srcKey, ok := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	if !ok || srcKey == "" {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "Invalid copy source.")
+	}
+	src, err := h.object(r, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	if src.Type != "file" {
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "Only objects can be copied.")
+	}
+	parentId, err := h.keyParent(r, r.key)
+	if err != nil {
+		return err
+	}
+	name := path.Base(r.key)
+	existing, err := h.object(r, r.bucket, r.key)
+	if err == nil && existing.ID == src.ID {
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "An object cannot be copied onto itself.")
+	}
+	// An object that is replaced stays until its copy exists, which is made
+	// under a name of its own.
+	copyName := name
+	if err == nil {
+		copyName = "." + name + "." + uuid.NewString()
+	}
+	created, err := h.srv.api.FilesCopy(r.Context(), &api.FileCopy{
+		NewName:     api.NewOptString(copyName),
+		Destination: parentId,
+	}, api.FilesCopyParams{ID: src.ID})
+	if err != nil {
+		return err
+	}
+	var file models.File
+	if copyName != name {
+		if err := h.replaceObject(r, existing, created.ID.Value, name, &file); err != nil {
+			return err
+		}
+	} else if err := h.srv.api.db.Where("id = ?", created.ID.Value).First(&file).Error; err != nil {
+		return err
+	}
+	res := struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{Xmlns: s3Namespace, ETag: s3ETag(&file)}
+	if file.UpdatedAt != nil {
+		res.LastModified = file.UpdatedAt.UTC().Format(s3TimeFormat)
+	}
+	return writeXML(w, http.StatusOK, &res)
+}
+
+// replaceObject moves existing to the trash and renames the file with id to
+// name in one transaction, so the key names one of them at all times. The
+// renamed file is loaded into file. When it fails, the file with id is moved
+// to the trash instead.
+func (h *s3Handler) replaceObject(r *s3Request, existing *models.File, id, name string, file *models.File) error {
+	a := h.srv.api
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := a.deleteFilesBulk(tx, []string{existing.ID}, r.userId); err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", id).First(file).Error; err != nil {
+			return err
+		}
+		if err := a.names.setName(file, name); err != nil {
+			return err
+		}
+		return tx.Model(&models.File{}).Where("id = ?", id).
+			Updates(map[string]any{"name": file.Name, "name_encrypted": file.NameEncrypted}).Error
+	})
+	if err != nil {
+		if err := a.deleteFilesBulk(a.db, []string{id}, r.userId); err != nil {
+			logging.Component("S3").Error("copy.discard_failed", zap.String("file_id", id), zap.Error(err))
+		}
+		return err
+	}
+	a.cache.Delete(r.Context(), cache.KeyFile(existing.ID), cache.KeyFileMessages(existing.ID), cache.KeyFile(id))
+
+	var parentID string
+	if existing.ParentId != nil {
+		parentID = *existing.ParentId
+	}
+	a.events.Record(events.OpDelete, r.userId, &models.Source{
+		ID:       existing.ID,
+		Type:     existing.Type,
+		Name:     a.names.plain(existing),
+		ParentID: parentID,
+	})
+	a.events.Record(events.OpUpdate, r.userId, &models.Source{
+		ID:       file.ID,
+		Type:     file.Type,
+		Name:     a.names.plain(file),
+		ParentID: parentID,
+	})
+	return nil
+}
+
+// deleteKey moves the object at key to the trash. Folder markers are only
+// removed when the folder is empty, like a marker object in S3.
+func (h *s3Handler) deleteKey(r *s3Request, key string) error {
+	file, err := h.object(r, r.bucket, key)
+	if err != nil {
+		if errors.Is(err, errS3NoSuchKey) {
+			return nil
+		}
+		return err
+	}
+	if file.Type == "folder" {
+		var count int64
+		if err := h.srv.api.db.Model(&models.File{}).Where("parent_id = ? AND status = 'active'", file.ID).
+			Count(&count).Error; err != nil || count > 0 {
+			return err
+		}
+	}
+	return h.srv.api.FilesDelete(r.Context(), &api.FileDelete{Ids: []string{file.ID}})
+}
+
+func (h *s3Handler) deleteObject(w http.ResponseWriter, r *s3Request) error {
+	if err := h.deleteKey(r, r.key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *s3Handler) deleteObjects(w http.ResponseWriter, r *s3Request) error {
+	if _, err := h.bucketFolder(r); err != nil {
+		return err
+	}
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := readXML(r, &req); err != nil {
+		return err
+	}
+	if len(req.Objects) > s3MaxKeys {
+		return errS3MalformedXML
+	}
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	type deleteError struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	res := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{Xmlns: s3Namespace}
+	for _, obj := range req.Objects {
+		if err := h.deleteKey(r, obj.Key); err != nil {
+			res.Errors = append(res.Errors, deleteError{Key: obj.Key, Code: "InternalError", Message: err.Error()})
+			continue
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deleted{Key: obj.Key})
+		}
+	}
+	return writeXML(w, http.StatusOK, &res)
+}
+
+// Multipart uploads are regular uploads: every part is a row in the uploads
+// table keyed by the upload id, and completing the upload creates the file
+// from them with FilesCreate.
+
+func (h *s3Handler) createMultipartUpload(w http.ResponseWriter, r *s3Request) error {
+	if _, err := h.bucketFolder(r); err != nil {
+		return err
+	}
+	res := struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadId string   `xml:"UploadId"`
+	}{Xmlns: s3Namespace, Bucket: r.bucket, Key: r.key, UploadId: uuid.NewString()}
+	return writeXML(w, http.StatusOK, &res)
+}
+
+// partMD5 returns the MD5 of the content of part, kept with parts uploaded
+// through the gateway.
+func partMD5(part *models.Upload) ([]byte, bool) {
+	if part.Checksum == nil || part.ChecksumAlgorithm == nil || *part.ChecksumAlgorithm != "md5" {
+		return nil, false
+	}
+	sum, err := hex.DecodeString(*part.Checksum)
+	return sum, err == nil
+}
+
+// s3PartETag returns the ETag of part: the MD5 of its content or, for parts
+// stored without one, an ETag that does not look like an MD5.
+func s3PartETag(part *models.Upload) string {
+	if sum, ok := partMD5(part); ok {
+		return fmt.Sprintf(`"%x"`, sum)
+	}
+	return fmt.Sprintf(`"%s-%d"`, part.UploadId, part.PartId)
+}
+
+func (h *s3Handler) uploadPart(w http.ResponseWriter, r *s3Request) error {
+	q := r.URL.Query()
+	uploadId := q.Get("uploadId")
+	partNo, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || partNo < 1 || partNo > s3MaxParts {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000.")
+	}
+	if r.length < 0 {
+		return errS3NoLength
+	}
+	if _, err := uuid.Parse(uploadId); err != nil {
+		return errS3NoSuchUpload
+	}
+
+	db := h.srv.api.db
+	var existing []models.Upload
+	if err := db.Where("upload_id = ? AND user_id = ?", uploadId, r.userId).Find(&existing).Error; err != nil {
+		return err
+	}
+	params := api.UploadsUploadParams{
+		ID:            uploadId,
+		PartName:      fmt.Sprintf("%s.part.%05d", path.Base(r.key), partNo),
+		FileName:      path.Base(r.key),
+		PartNo:        partNo,
+		Hashing:       api.NewOptBool(true),
+		ContentLength: r.length,
+	}
+	if len(existing) > 0 {
+		params.ChannelId = api.NewOptInt64(existing[0].ChannelId)
+	}
+	sum, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+	_, err = h.srv.api.uploadPart(r.Context(), &api.UploadsUploadReqWithContentType{
+		ContentType: "application/octet-stream",
+		Content:     api.UploadsUploadReq{Data: r.body},
+	}, params, sum)
+	if err != nil {
+		switch {
+		case errors.Is(err, sigv4.ErrPayloadMismatch):
+			return s3AuthError(err)
+		case errors.Is(err, ErrChecksum):
+			return errS3BadDigest
+		}
+		return err
+	}
+
+	// A part uploaded again replaces the previous one.
+	replaced := []models.Upload{}
+	for _, u := range existing {
+		if u.PartNo == partNo {
+			replaced = append(replaced, u)
+		}
+	}
+	if len(replaced) > 0 {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return discardUploads(tx, r.userId, replaced)
+		}); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("ETag", s3MD5ETag(sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *s3Handler) completeMultipartUpload(w http.ResponseWriter, r *s3Request) error {
+	uploadId := r.URL.Query().Get("uploadId")
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := readXML(r, &req); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return errS3InvalidPart
+	}
+
+	db := h.srv.api.db
+	var uploads []models.Upload
+	if err := db.Where("upload_id = ? AND user_id = ?", uploadId, r.userId).Order("part_no").
+		Find(&uploads).Error; err != nil {
+		return err
+	}
+	if len(uploads) == 0 {
+		return errS3NoSuchUpload
+	}
+	byPart := map[int]models.Upload{}
+	for _, u := range uploads {
+		byPart[u.PartNo] = u
+	}
+
+	listed := map[int]bool{}
+	var size int64
+	aligned := true
+	// The ETag of a multipart upload is the MD5 of the MD5s of its parts,
+	// followed by the number of parts.
+	sums := md5.New()
+	hasSums := true
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return errS3PartOrder
+		}
+		u, ok := byPart[p.PartNumber]
+		if !ok || (p.ETag != "" && strings.Trim(p.ETag, `"`) != strings.Trim(s3PartETag(&u), `"`)) {
+			return errS3InvalidPart
+		}
+		listed[p.PartNumber] = true
+		if sum, ok := partMD5(&u); ok {
+			sums.Write(sum)
+		} else {
+			hasSums = false
+		}
+		size += u.Size
+		if i < len(req.Parts)-1 && u.Size%hash.BlockSize != 0 {
+			aligned = false
+		}
+	}
+
+	parentId, err := h.keyParent(r, r.key)
+	if err != nil {
+		return err
+	}
+
+	unlisted := []models.Upload{}
+	for _, u := range uploads {
+		if !listed[u.PartNo] {
+			unlisted = append(unlisted, u)
+		}
+	}
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := discardUploads(tx, r.userId, unlisted); err != nil {
+			return err
+		}
+		// Block hashes only add up to the file hash when parts are made of
+		// whole blocks.
+		if !aligned {
+			return tx.Model(&models.Upload{}).Where("upload_id = ?", uploadId).
+				Update("block_hashes", nil).Error
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if _, err := h.srv.api.FilesCreate(r.Context(), &api.File{
+		Name:      path.Base(r.key),
+		Type:      api.FileTypeFile,
+		ParentId:  api.NewOptString(parentId),
+		MimeType:  api.NewOptString(mimeTypeOf(r.key)),
+		Size:      api.NewOptInt64(size),
+		UploadId:  api.NewOptString(uploadId),
+		ChannelId: api.NewOptInt64(uploads[0].ChannelId),
+	}); err != nil {
+		return err
+	}
+	etag := fmt.Sprintf(`"%x-%d"`, sums.Sum(nil), len(req.Parts))
+	if !hasSums {
+		etag = fmt.Sprintf(`"%s-%d"`, uploadId, len(req.Parts))
+	}
+	res := struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{Xmlns: s3Namespace, Location: h.prefix + "/" + r.bucket + "/" + r.key, Bucket: r.bucket, Key: r.key, ETag: etag}
+	return writeXML(w, http.StatusOK, &res)
+}
+
+func (h *s3Handler) abortMultipartUpload(w http.ResponseWriter, r *s3Request) error {
+	uploadId := r.URL.Query().Get("uploadId")
+	var uploads []models.Upload
+	db := h.srv.api.db
+	if err := db.Where("upload_id = ? AND user_id = ?", uploadId, r.userId).Find(&uploads).Error; err != nil {
+		return err
+	}
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return discardUploads(tx, r.userId, uploads)
+	}); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+var ErrS3KeyNotFound = errors.New("access key not found")
+
+type s3Key struct {
+	AccessKey string    `json:"accessKey"`
+	SecretKey string    `json:"secretKey,omitempty"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type s3KeyCreate struct {
+	Name string `json:"name"`
+}
+
+const accessKeyAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// newS3Credentials returns a random access key in the usual 20 character
+// form and a 40 character secret.
+func newS3Credentials() (string, string, error) {
+	buf := make([]byte, 48)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	var access strings.Builder
+	access.WriteString("TD")
+	for _, b := range buf[:18] {
+		access.WriteByte(accessKeyAlphabet[int(b)%len(accessKeyAlphabet)])
+	}
+	secret := base64.RawStdEncoding.EncodeToString(buf[18:])
+	return access.String(), secret[:40], nil
+}
+
+func (e *extendedService) S3KeysList(w http.ResponseWriter, r *http.Request) {
+	var keys []models.S3Key
+	if err := e.api.db.Where("user_id = ?", auth.GetUser(r.Context())).Order("created_at").
+		Find(&keys).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, utils.Map(keys, func(k models.S3Key) s3Key {
+		return s3Key{AccessKey: k.AccessKey, Name: k.Name, CreatedAt: k.CreatedAt}
+	}))
+}
+
+// S3KeysCreate issues a new key pair. The secret is only returned here.
+func (e *extendedService) S3KeysCreate(w http.ResponseWriter, r *http.Request) {
+	var req s3KeyCreate
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil {
+			e.writeError(w, r, err)
+			return
+		}
+	}
+	access, secret, err := newS3Credentials()
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	key := models.S3Key{
+		AccessKey: access,
+		SecretKey: secret,
+		UserId:    auth.GetUser(r.Context()),
+		Name:      req.Name,
+	}
+	if err := e.api.db.Create(&key).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusCreated, s3Key{
+		AccessKey: key.AccessKey,
+		SecretKey: key.SecretKey,
+		Name:      key.Name,
+		CreatedAt: key.CreatedAt,
+	})
+}
+
+func (e *extendedService) S3KeysDelete(w http.ResponseWriter, r *http.Request) {
+	res := e.api.db.Where("access_key = ? AND user_id = ?", chi.URLParam(r, "accessKey"),
+		auth.GetUser(r.Context())).Delete(&models.S3Key{})
+	if res.Error != nil {
+		e.writeError(w, r, &apiError{err: res.Error})
+		return
+	}
+	if res.RowsAffected == 0 {
+		e.writeError(w, r, &apiError{err: ErrS3KeyNotFound, code: http.StatusNotFound})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
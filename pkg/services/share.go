@@ -12,7 +12,6 @@ import (
 	"github.com/tgdrive/teldrive/internal/appcontext"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/database"
-	"github.com/tgdrive/teldrive/pkg/mapper"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -34,13 +33,15 @@ type fileShare struct {
 func (a *apiService) shareGetById(id string) (*fileShare, error) {
 	var result []struct {
 		models.FileShare
-		Type api.FileShareInfoType `gorm:"column:type"`
-		Name string                `gorm:"column:name"`
+		Type          api.FileShareInfoType `gorm:"column:type"`
+		Name          string                `gorm:"column:name"`
+		NameEncrypted bool                  `gorm:"column:name_encrypted"`
 	}
 
 	if err := a.db.Model(&models.FileShare{}).Where("file_shares.id = ?", id).
-		Select("file_shares.*", "f.type", "f.name").
+		Select("file_shares.*", "f.type", "f.name", "f.name_encrypted").
 		Joins("left join teldrive.files as f on f.id = file_shares.file_id").
+		Where("f.status = ?", "active").
 		Scan(&result).Error; err != nil {
 		return nil, &apiError{err: err}
 	}
@@ -61,7 +62,7 @@ func (a *apiService) shareGetById(id string) (*fileShare, error) {
 	return &fileShare{
 		FileShare: result[0].FileShare,
 		Type:      result[0].Type,
-		Name:      result[0].Name,
+		Name:      a.names.plainName(result[0].Name, result[0].NameEncrypted),
 		Path:      path,
 	}, nil
 }
@@ -110,7 +111,7 @@ func (a *apiService) SharesListFiles(ctx context.Context, params api.SharesListF
 	fileType := share.Type
 
 	if fileType == api.FileShareInfoTypeFolder {
-		queryBuilder := &fileQueryBuilder{db: a.db}
+		queryBuilder := &fileQueryBuilder{db: a.db, names: a.names}
 		return queryBuilder.execute(&api.FilesListParams{
 			Path:      api.NewOptString(share.Path + params.Path.Or("")),
 			Limit:     params.Limit,
@@ -127,7 +128,7 @@ func (a *apiService) SharesListFiles(ctx context.Context, params api.SharesListF
 			}
 			return nil, &apiError{err: err}
 		}
-		return &api.FileList{Items: []api.File{*mapper.ToFileOut(file)},
+		return &api.FileList{Items: []api.File{*a.fileOut(file)},
 			Meta: api.Meta{Count: 1, TotalPages: 1, CurrentPage: 1}}, nil
 	}
 
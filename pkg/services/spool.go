@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/hash"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+)
+
+// spoolUpload turns a stream of unknown length into a file. Content is
+// spooled to a temporary file one part at a time and each full part goes
+// through UploadsUpload; Close creates the file from the upload.
+type spoolUpload struct {
+	ctx       context.Context
+	api       *apiService
+	parentId  string
+	name      string
+	partSize  int64
+	uploadId  string
+	channelId int64
+	modTime   time.Time
+	encrypted bool
+	// rclone is the header of the rclone crypt object whose blocks are
+	// written, for uploads that store the object as it is.
+	rclone *crypt.RcloneHeader
+
+	spool   *os.File
+	pending int64
+	size    int64
+	partNo  int
+	group   *errgroup.Group
+	gctx    context.Context
+	err     error
+}
+
+// newSpoolUpload returns a writer for a new file name in folder parentId.
+// partSize is rounded down to whole hash blocks so the tree hash of the file
+// can be assembled from the block hashes of its parts.
+func (a *apiService) newSpoolUpload(ctx context.Context, parentId, name string, partSize int64) *spoolUpload {
+	group, gctx := errgroup.WithContext(ctx)
+	group.SetLimit(1)
+	return &spoolUpload{
+		ctx:      ctx,
+		api:      a,
+		parentId: parentId,
+		name:     name,
+		partSize: max(partSize/hash.BlockSize, 1) * hash.BlockSize,
+		uploadId: uuid.NewString(),
+		modTime:  time.Now().UTC(),
+		group:    group,
+		gctx:     gctx,
+	}
+}
+
+// setConcurrency lets n parts upload at the same time. Every part in flight
+// keeps its own spool file until it is stored.
+func (u *spoolUpload) setConcurrency(n int) {
+	u.group.SetLimit(max(n, 1))
+}
+
+func (u *spoolUpload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if u.spool == nil {
+			u.spool, u.err = os.CreateTemp("", "teldrive-spool-*")
+			if u.err != nil {
+				return written, u.err
+			}
+		}
+		n := int(min(int64(len(p)), u.partSize-u.pending))
+		n, u.err = u.spool.Write(p[:n])
+		written += n
+		u.pending += int64(n)
+		u.size += int64(n)
+		p = p[n:]
+		if u.err != nil {
+			return written, u.err
+		}
+		if u.pending == u.partSize {
+			if u.err = u.flush(); u.err != nil {
+				return written, u.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush hands the spooled part to an upload worker, waiting for one to be
+// free.
+func (u *spoolUpload) flush() error {
+	if u.gctx.Err() != nil {
+		return u.group.Wait()
+	}
+	if u.channelId == 0 {
+		// Parts uploaded side by side must end up in the same channel.
+		channelId, err := u.api.uploadChannel(u.ctx, auth.GetUser(u.ctx), logging.Component("UPLOAD"))
+		if err != nil {
+			return err
+		}
+		u.channelId = channelId
+	}
+	spool, size := u.spool, u.pending
+	u.spool, u.pending = nil, 0
+	u.partNo++
+	params := api.UploadsUploadParams{
+		ID:            u.uploadId,
+		PartName:      fmt.Sprintf("%s.part.%03d", u.name, u.partNo),
+		FileName:      u.name,
+		PartNo:        u.partNo,
+		ChannelId:     api.NewOptInt64(u.channelId),
+		Encrypted:     api.NewOptBool(u.encrypted),
+		Hashing:       api.NewOptBool(u.rclone == nil),
+		ContentLength: size,
+	}
+	ctx := u.gctx
+	if u.rclone != nil {
+		params.ContentLength = crypt.PartSize(size)
+		ctx = withPartSalt(ctx, crypt.RcloneSalt)
+	}
+	// Parts hold whole blocks, so every part continues the object at a block
+	// boundary and its blocks are numbered from there
+	first := int64(u.partNo-1) * (u.partSize / crypt.EncryptedBlockSize)
+	u.group.Go(func() error {
+		defer removeSpool(spool)
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var data io.Reader = io.LimitReader(spool, size)
+		if u.rclone != nil {
+			data = u.rclone.Part(first, data)
+		}
+		_, err := u.api.uploadPart(ctx, &api.UploadsUploadReqWithContentType{
+			ContentType: "application/octet-stream",
+			Content:     api.UploadsUploadReq{Data: data},
+		}, params, nil)
+		return err
+	})
+	return nil
+}
+
+// Close uploads the remaining content and creates the file. Nothing of a
+// failed upload is kept.
+func (u *spoolUpload) Close() (*api.File, error) {
+	file, err := u.close()
+	if err != nil {
+		u.abort()
+	}
+	return file, err
+}
+
+func (u *spoolUpload) close() (*api.File, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	// A request that went away has not delivered the whole content.
+	if err := u.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if u.pending > 0 {
+		if err := u.flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := u.group.Wait(); err != nil {
+		return nil, err
+	}
+
+	size := u.size
+	if u.rclone != nil {
+		var err error
+		if size, err = crypt.DecryptedSize(crypt.PartSize(u.size)); err != nil {
+			return nil, &apiError{err: err, code: http.StatusBadRequest}
+		}
+	}
+	file := &api.File{
+		Name:      u.name,
+		Type:      api.FileTypeFile,
+		ParentId:  api.NewOptString(u.parentId),
+		MimeType:  api.NewOptString(mimeTypeOf(u.name)),
+		Size:      api.NewOptInt64(size),
+		Encrypted: api.NewOptBool(u.encrypted),
+		UpdatedAt: api.NewOptDateTime(u.modTime),
+	}
+	if u.partNo > 0 {
+		file.UploadId = api.NewOptString(u.uploadId)
+		file.ChannelId = api.NewOptInt64(u.channelId)
+	}
+	return u.api.FilesCreate(u.ctx, file)
+}
+
+// abort stops the upload and discards the parts stored so far.
+func (u *spoolUpload) abort() {
+	if u.spool != nil {
+		removeSpool(u.spool)
+		u.spool = nil
+	}
+	u.group.Wait()
+	if u.partNo == 0 {
+		return
+	}
+	if err := u.api.db.Transaction(func(tx *gorm.DB) error {
+		var parts []models.Upload
+		if err := tx.Where("upload_id = ?", u.uploadId).Find(&parts).Error; err != nil {
+			return err
+		}
+		return discardUploads(tx, auth.GetUser(u.ctx), parts)
+	}); err != nil {
+		logging.Component("UPLOAD").Error("upload.discard_failed", zap.String("upload_id", u.uploadId), zap.Error(err))
+	}
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// mimeTypeOf guesses the mime type of a file from its extension.
+func mimeTypeOf(name string) string {
+	if t, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name))); err == nil {
+		return t
+	}
+	return defaultContentType
+}
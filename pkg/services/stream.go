@@ -0,0 +1,282 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/http_range"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/md5"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+)
+
+// maxStreamRanges caps the distinct ranges served in one multipart response.
+const maxStreamRanges = 16
+
+// requestSession returns the session of the authenticated user, which
+// streamClient downloads with when the user has no bots.
+func requestSession(ctx context.Context, userId int64) *models.Session {
+	session := &models.Session{UserId: userId}
+	if claims := auth.GetJWTUser(ctx); claims != nil {
+		session.Session = claims.TgSession
+		session.Hash = claims.Hash
+	}
+	return session
+}
+
+// streamClient returns the Telegram client used to download file content: a
+// bot of the user picked round-robin when bots are configured, otherwise the
+// user session itself. botID identifies the client in location caches.
+func (a *apiService) streamClient(ctx context.Context, session *models.Session) (client *telegram.Client, token string, botID string, err error) {
+	tokens, err := a.streamTokens(ctx, session.UserId)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if len(tokens) == 0 {
+		client, err = tgc.AuthClient(ctx, &a.cnf.TG, session.Session, a.newMiddlewares(ctx, 5)...)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return client, "", strconv.FormatInt(session.UserId, 10), nil
+	}
+
+	token, _, err = a.botSelector.Next(ctx, tgc.BotOpStream, session.UserId, tokens)
+	if err != nil {
+		return nil, "", "", err
+	}
+	client, err = tgc.BotClient(ctx, a.db, a.cache, &a.cnf.TG, token,
+		append(a.newMiddlewares(ctx, 5), a.healthMiddlewares(token)...)...)
+	if err != nil {
+		return nil, "", "", err
+	}
+	botID, _, _ = strings.Cut(token, ":")
+	return client, token, botID, nil
+}
+
+// streamTokens returns the tokens of the bots of the user that stream files.
+func (a *apiService) streamTokens(ctx context.Context, userId int64) ([]string, error) {
+	tokens, err := a.channelManager.BotTokens(ctx, userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bots: %w", err)
+	}
+
+	// Limit the number of bots used for streaming if configured
+	if limit := a.cnf.TG.Stream.BotsLimit; limit > 0 && len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
+	return tokens, nil
+}
+
+// startStreamClient starts the client of the bot with token, or of the user
+// session for an empty token, to download chunks with until ctx ends. It
+// waits for the client to be authorized for up to the chunk timeout.
+func (a *apiService) startStreamClient(ctx context.Context, session *models.Session, token string) (reader.Stripe, error) {
+	var (
+		client *telegram.Client
+		err    error
+		botID  = strconv.FormatInt(session.UserId, 10)
+	)
+	if token == "" {
+		client, err = tgc.AuthClient(ctx, &a.cnf.TG, session.Session, a.newMiddlewares(ctx, 5)...)
+	} else {
+		client, err = tgc.BotClient(ctx, a.db, a.cache, &a.cnf.TG, token,
+			append(a.newMiddlewares(ctx, 5), a.healthMiddlewares(token)...)...)
+		botID, _, _ = strings.Cut(token, ":")
+	}
+	if err != nil {
+		return reader.Stripe{}, err
+	}
+
+	ready := make(chan struct{})
+	failed := make(chan error, 1)
+	go func() {
+		err := tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+			close(ready)
+			<-ctx.Done()
+			return nil
+		})
+		if err != nil {
+			failed <- err
+		}
+	}()
+	select {
+	case <-ready:
+		return reader.Stripe{Client: client.API(), BotID: botID}, nil
+	case err := <-failed:
+		return reader.Stripe{}, err
+	case <-time.After(a.cnf.TG.Stream.ChunkTimeout):
+		return reader.Stripe{}, fmt.Errorf("bot %s: %w", botID, reader.ErrChunkTimeout)
+	case <-ctx.Done():
+		return reader.Stripe{}, ctx.Err()
+	}
+}
+
+// streamStripes starts the clients of the stream bots of the user other than
+// the bot with token for striped streaming. The clients run until ctx ends;
+// bots that fail to start are left out, so the stream goes on with fewer bots.
+func (a *apiService) streamStripes(ctx context.Context, session *models.Session, token string) []reader.Stripe {
+	if !a.cnf.TG.Stream.Striped || token == "" {
+		return nil
+	}
+	tokens, err := a.streamTokens(ctx, session.UserId)
+	if err != nil {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+	started := make([]reader.Stripe, len(tokens))
+	var wg sync.WaitGroup
+	for i, t := range tokens {
+		if t == token {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stripe, err := a.startStreamClient(ctx, session, t)
+			if err != nil {
+				logger.Warn("stream.stripe_failed", zap.Error(err))
+				return
+			}
+			started[i] = stripe
+		}()
+	}
+	wg.Wait()
+
+	var stripes []reader.Stripe
+	for _, stripe := range started {
+		if stripe.Client != nil {
+			stripes = append(stripes, stripe)
+		}
+	}
+	return stripes
+}
+
+// streamFallback returns the fallback for a stream of the user whose bots in
+// use fail: the other stream bots in turn, then the user session, which every
+// failed bot shares. inUse are the bot IDs of the clients of the stream.
+// Clients run until ctx ends.
+func (a *apiService) streamFallback(ctx context.Context, session *models.Session, inUse ...string) reader.Fallback {
+	var (
+		mu     sync.Mutex
+		tried  = make(map[string]bool)
+		user   *reader.Stripe
+		userID = strconv.FormatInt(session.UserId, 10)
+	)
+	for _, botID := range inUse {
+		tried[botID] = true
+	}
+	return func(wait context.Context) (reader.Stripe, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if user != nil {
+			return *user, nil
+		}
+		logger := logging.FromContext(ctx)
+		tokens, err := a.streamTokens(wait, session.UserId)
+		if err != nil {
+			logger.Warn("stream.fallback_tokens_failed", zap.Error(err))
+		}
+		for _, token := range append(tokens, "") {
+			botID, _, _ := strings.Cut(token, ":")
+			if token == "" {
+				botID = userID
+			}
+			if tried[botID] {
+				continue
+			}
+			tried[botID] = true
+			stripe, err := a.startStreamClient(ctx, session, token)
+			if err != nil {
+				logger.Warn("stream.fallback_failed", zap.String("bot_id", botID), zap.Error(err))
+				continue
+			}
+			if token == "" {
+				user = &stripe
+			}
+			return stripe, nil
+		}
+		return reader.Stripe{}, reader.ErrNoFallback
+	}
+}
+
+// streamETag returns a strong validator for the content of file. The content
+// hash identifies the bytes exactly; files uploaded without one fall back to
+// a digest of their identity, size and modification time.
+func streamETag(file *models.File) string {
+	if file.Hash != nil && *file.Hash != "" {
+		return fmt.Sprintf("%q", *file.Hash)
+	}
+	var size, modtime int64
+	if file.Size != nil {
+		size = *file.Size
+	}
+	if file.UpdatedAt != nil {
+		modtime = file.UpdatedAt.UnixNano()
+	}
+	return fmt.Sprintf("%q", md5.FromString(file.ID+strconv.FormatInt(size, 10)+strconv.FormatInt(modtime, 10)))
+}
+
+func rangePartHeader(rg *http_range.Range, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", rg.Start, rg.End, size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// multipartRangesLength returns the exact size of the multipart/byteranges
+// body written by writeMultipartRanges, so Content-Length can be set upfront.
+func multipartRangesLength(ranges []*http_range.Range, boundary, contentType string, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, rg := range ranges {
+		mw.CreatePart(rangePartHeader(rg, contentType, size))
+		w += countingWriter(rg.Length())
+	}
+	mw.Close()
+	return int64(w)
+}
+
+func writeMultipartRanges(w io.Writer, ranges []*http_range.Range, boundary, contentType string, size int64,
+	open func(*http_range.Range) (io.ReadCloser, error)) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for _, rg := range ranges {
+		pw, err := mw.CreatePart(rangePartHeader(rg, contentType, size))
+		if err != nil {
+			return err
+		}
+		lr, err := open(rg)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(pw, lr, rg.Length())
+		lr.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,18 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+)
+
+var ErrChunkCacheNotEnabled = errors.New("chunk cache is not enabled")
+
+// StreamCacheStats returns the hit, miss and size counters of the chunk cache
+// streams read through.
+func (e *extendedService) StreamCacheStats(w http.ResponseWriter, r *http.Request) {
+	if e.api.chunks == nil {
+		e.writeError(w, r, &apiError{err: ErrChunkCacheNotEnabled, code: http.StatusNotFound})
+		return
+	}
+	writeJSON(w, http.StatusOK, e.api.chunks.Stats())
+}
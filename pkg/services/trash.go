@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTrashItemNotFound = errors.New("item not found in trash")
+	ErrRestoreConflict   = errors.New("an item with the same name already exists at the restore location")
+)
+
+type trashItem struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Type         string     `json:"type"`
+	MimeType     string     `json:"mimeType"`
+	Category     string     `json:"category,omitempty"`
+	Size         int64      `json:"size"`
+	Encrypted    bool       `json:"encrypted"`
+	ParentId     string     `json:"parentId,omitempty"`
+	OriginalPath string     `json:"originalPath"`
+	TrashedAt    time.Time  `json:"trashedAt"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+}
+
+type listMeta struct {
+	Count       int `json:"count"`
+	TotalPages  int `json:"totalPages"`
+	CurrentPage int `json:"currentPage"`
+}
+
+type trashList struct {
+	Items []trashItem `json:"items"`
+	Meta  listMeta    `json:"meta"`
+}
+
+type trashRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// trashRoots selects the items a user deleted explicitly; descendants that
+// were trashed along with a folder are only reachable through their root.
+func trashRoots(userId int64) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id = ? AND status = 'trashed' AND trash_root_id = id", userId)
+	}
+}
+
+func (e *extendedService) TrashList(w http.ResponseWriter, r *http.Request) {
+	a := e.api
+	userId := auth.GetUser(r.Context())
+	page, limit := queryInt(r, "page", 1), queryInt(r, "limit", 500)
+
+	var count int64
+	if err := a.db.Model(&models.File{}).Scopes(trashRoots(userId)).Count(&count).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	var files []models.File
+	if err := a.db.Model(&models.File{}).Scopes(trashRoots(userId)).
+		Order("trashed_at DESC").Order("id").
+		Offset((page - 1) * limit).Limit(limit).
+		Find(&files).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	paths := map[string]string{}
+	items := make([]trashItem, 0, len(files))
+	for _, f := range files {
+		item := trashItem{
+			ID:        f.ID,
+			Name:      a.names.plain(&f),
+			Type:      f.Type,
+			MimeType:  f.MimeType,
+			TrashedAt: *f.TrashedAt,
+		}
+		if f.Category != nil {
+			item.Category = *f.Category
+		}
+		if f.Size != nil {
+			item.Size = *f.Size
+		}
+		if f.Encrypted != nil {
+			item.Encrypted = *f.Encrypted
+		}
+		if f.ParentId != nil {
+			item.ParentId = *f.ParentId
+			path, ok := paths[item.ParentId]
+			if !ok {
+				path, _ = a.getFullPath(a.db, item.ParentId)
+				paths[item.ParentId] = path
+			}
+			item.OriginalPath = path
+		}
+		if item.OriginalPath == "" {
+			item.OriginalPath = "/"
+		}
+		if a.cnf.Files.TrashRetention > 0 {
+			expires := f.TrashedAt.Add(a.cnf.Files.TrashRetention)
+			item.ExpiresAt = &expires
+		}
+		items = append(items, item)
+	}
+
+	writeJSON(w, http.StatusOK, trashList{
+		Items: items,
+		Meta: listMeta{
+			Count:       int(count),
+			TotalPages:  int(math.Ceil(float64(count) / float64(limit))),
+			CurrentPage: page,
+		},
+	})
+}
+
+func (e *extendedService) TrashRestore(w http.ResponseWriter, r *http.Request) {
+	var req trashRequest
+	if err := decodeJSON(r, &req); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	if len(req.Ids) == 0 {
+		e.writeError(w, r, &apiError{err: errors.New("ids should not be empty"), code: http.StatusBadRequest})
+		return
+	}
+	if err := e.api.restoreFromTrash(r.Context(), auth.GetUser(r.Context()), req.Ids); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *extendedService) TrashEmpty(w http.ResponseWriter, r *http.Request) {
+	var req trashRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil {
+			e.writeError(w, r, err)
+			return
+		}
+	}
+	if err := e.api.emptyTrash(auth.GetUser(r.Context()), req.Ids); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreFromTrash reactivates the given trash roots together with the items
+// that were trashed with them. Items whose parent is no longer active are
+// restored into the user's root folder.
+func (a *apiService) restoreFromTrash(ctx context.Context, userId int64, ids []string) error {
+	var roots []models.File
+
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Scopes(trashRoots(userId)).Where("id IN ?", ids).Find(&roots).Error; err != nil {
+			return err
+		}
+		if len(roots) != len(ids) {
+			return &apiError{err: ErrTrashItemNotFound, code: http.StatusNotFound}
+		}
+
+		var rootFolderId string
+		if err := tx.Model(&models.File{}).Select("id").
+			Where("user_id = ? AND parent_id IS NULL AND type = 'folder'", userId).
+			Scan(&rootFolderId).Error; err != nil {
+			return err
+		}
+
+		for i, root := range roots {
+			if root.ParentId != nil {
+				var active int64
+				if err := tx.Model(&models.File{}).
+					Where("id = ? AND status = 'active'", *root.ParentId).
+					Count(&active).Error; err != nil {
+					return err
+				}
+				if active == 0 {
+					if err := tx.Model(&models.File{}).Where("id = ?", root.ID).
+						Update("parent_id", rootFolderId).Error; err != nil {
+						return err
+					}
+					roots[i].ParentId = &rootFolderId
+				}
+			}
+			if err := tx.Model(&models.File{}).Where("trash_root_id = ?", root.ID).
+				Updates(map[string]any{
+					"status":        "active",
+					"trashed_at":    nil,
+					"trash_root_id": nil,
+				}).Error; err != nil {
+				if database.IsKeyConflictErr(err) {
+					return &apiError{err: ErrRestoreConflict, code: http.StatusConflict}
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return err
+		}
+		return &apiError{err: err}
+	}
+
+	keys := []string{}
+	for _, root := range roots {
+		keys = append(keys, cache.KeyFile(root.ID), cache.KeyFileMessages(root.ID))
+
+		var parentID string
+		if root.ParentId != nil {
+			parentID = *root.ParentId
+		}
+		a.events.Record(events.OpRestore, userId, &models.Source{
+			ID:       root.ID,
+			Type:     root.Type,
+			Name:     a.names.plain(&root),
+			ParentID: parentID,
+		})
+	}
+	a.cache.Delete(ctx, keys...)
+
+	return nil
+}
+
+// emptyTrash permanently deletes the given trash roots, or the whole trash
+// when ids is empty. Files are handed over to the clean files job which
+// removes their messages from Telegram.
+func (a *apiService) emptyTrash(userId int64, ids []string) error {
+	scope := func(db *gorm.DB) *gorm.DB {
+		db = db.Where("user_id = ? AND status = 'trashed'", userId)
+		if len(ids) > 0 {
+			db = db.Where("trash_root_id IN ?", ids)
+		}
+		return db
+	}
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.File{}).Scopes(scope).Where("type = 'file'").
+			Update("status", "pending_deletion").Error; err != nil {
+			return err
+		}
+		return tx.Scopes(scope).Where("type = 'folder'").Delete(&models.File{}).Error
+	})
+	if err != nil {
+		return &apiError{err: err}
+	}
+	return nil
+}
@@ -0,0 +1,553 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
+	blockhash "github.com/tgdrive/teldrive/internal/hash"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The tus 1.0 resumable upload protocol, see https://tus.io/protocols/resumable-upload.
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,creation-with-upload,termination,checksum,expiration"
+	tusContentType = "application/offset+octet-stream"
+
+	statusChecksumMismatch = 460
+)
+
+var (
+	ErrTusVersion     = errors.New("unsupported tus version")
+	ErrTusNotFound    = errors.New("upload not found")
+	ErrTusExpired     = errors.New("upload expired")
+	ErrTusOffset      = errors.New("upload offset does not match")
+	ErrTusLocked      = errors.New("upload is being written by another request")
+	ErrTusContentType = errors.New("content type must be " + tusContentType)
+	ErrTusLength      = errors.New("invalid upload length")
+	ErrTusTooLarge    = errors.New("upload exceeds the maximum size")
+	ErrTusMetadata    = errors.New("invalid upload metadata")
+)
+
+// tusLeaseTime is how long an upload stays leased to a request that stopped
+// renewing the lease, e.g. because its instance went away.
+const tusLeaseTime = time.Minute
+
+func (a *apiService) tusExpires(t *models.TusUpload) time.Time {
+	return t.CreatedAt.Add(a.cnf.TG.Uploads.Retention)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated keys,
+// each followed by its base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, ErrTusMetadata
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+func (e *extendedService) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", checksumAlgorithms)
+	if e.api.cnf.Tus.MaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(e.api.cnf.Tus.MaxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusVersionOk(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	return r.Header.Get("Tus-Resumable") == tusVersion
+}
+
+// TusCreate creates an upload. Metadata names the file (filename), its
+// folder as a path or id (path, parentId, defaulting to the root), its mime
+// type (filetype) and whether it is encrypted (encrypted).
+func (e *extendedService) TusCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusVersionOk(w, r) {
+		w.Header().Set("Tus-Version", tusVersion)
+		e.writeError(w, r, &apiError{err: ErrTusVersion, code: http.StatusPreconditionFailed})
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		e.writeError(w, r, &apiError{err: ErrTusLength, code: http.StatusBadRequest})
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		e.writeError(w, r, &apiError{err: ErrTusLength, code: http.StatusBadRequest})
+		return
+	}
+	if limit := e.api.cnf.Tus.MaxSize; limit > 0 && size > limit {
+		e.writeError(w, r, &apiError{err: ErrTusTooLarge, code: http.StatusRequestEntityTooLarge})
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err, code: http.StatusBadRequest})
+		return
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	if name == "" || strings.Contains(name, "/") {
+		e.writeError(w, r, &apiError{err: ErrTusMetadata, code: http.StatusBadRequest})
+		return
+	}
+	destination := meta["parentId"]
+	if destination == "" {
+		destination = meta["path"]
+	}
+	if destination == "" {
+		destination = "/"
+	}
+	encrypted := meta["encrypted"] == "true"
+	if encrypted && e.api.cnf.TG.Uploads.EncryptionKey == "" {
+		e.writeError(w, r, &apiError{err: errors.New("encryption is not enabled"), code: http.StatusBadRequest})
+		return
+	}
+	mimeType := meta["filetype"]
+	if mimeType == "" {
+		mimeType = mimeTypeOf(name)
+	}
+
+	userId := auth.GetUser(r.Context())
+	parentId, err := e.api.copyDestination(userId, destination)
+	if err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	id := uuid.NewString()
+	upload := &models.TusUpload{
+		ID:        id,
+		UserId:    userId,
+		Name:      name,
+		ParentId:  parentId,
+		MimeType:  mimeType,
+		Size:      size,
+		PartSize:  max(e.api.cnf.Tus.PartSize/blockhash.BlockSize, 1) * blockhash.BlockSize,
+		Encrypted: encrypted,
+	}
+	if err := e.api.db.Create(upload).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	// The API is mounted below a prefix that is stripped from r.URL.
+	location := r.URL.Path
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		location = u.Path
+	}
+	w.Header().Set("Location", strings.TrimSuffix(location, "/")+"/"+id)
+	w.Header().Set("Upload-Expires", e.api.tusExpires(upload).Format(http.TimeFormat))
+
+	offset := int64(0)
+	if r.Header.Get("Content-Type") == tusContentType || size == 0 {
+		if err := e.api.tusLeased(r.Context(), id, func(ctx context.Context, t *models.TusUpload) error {
+			if size == 0 {
+				return e.api.tusFinish(ctx, t)
+			}
+			offset, err = e.api.tusWrite(ctx, t, r, 0)
+			return err
+		}); err != nil {
+			e.writeError(w, r, err)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusLeased runs fn with upload id leased to the request, so requests
+// writing the same upload are serialized across instances. The lease is
+// taken in a short transaction and renewed while fn runs; a request finding
+// the upload leased fails with 423 instead of waiting. ctx is canceled when
+// the lease is lost.
+func (a *apiService) tusLeased(ctx context.Context, id string, fn func(ctx context.Context, t *models.TusUpload) error) error {
+	lease := uuid.NewString()
+	var t *models.TusUpload
+	if err := a.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		t, err = a.tusUpload(ctx, tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "NOWAIT"}), id)
+		if err != nil {
+			return err
+		}
+		if t.LeaseUntil != nil && t.LeaseUntil.After(time.Now()) {
+			return &apiError{err: ErrTusLocked, code: http.StatusLocked}
+		}
+		until := time.Now().UTC().Add(tusLeaseTime)
+		if err := tx.Model(t).Updates(map[string]any{"lease_id": lease, "lease_until": until}).Error; err != nil {
+			return &apiError{err: err}
+		}
+		t.LeaseId, t.LeaseUntil = &lease, &until
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(tusLeaseTime / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				res := a.db.Model(&models.TusUpload{}).Where("id = ? AND lease_id = ?", id, lease).
+					Update("lease_until", time.Now().UTC().Add(tusLeaseTime))
+				if res.Error == nil && res.RowsAffected == 0 {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	err := fn(ctx, t)
+	cancel()
+	<-renewed
+	if err := a.db.Model(&models.TusUpload{}).Where("id = ? AND lease_id = ?", id, lease).
+		Updates(map[string]any{"lease_id": nil, "lease_until": nil}).Error; err != nil {
+		logging.Component("TUS").Warn("lease.release_failed", zap.String("upload_id", id), zap.Error(err))
+	}
+	return err
+}
+
+// tusUpdate writes updates to the upload row of t as long as the request
+// still holds its lease.
+func tusUpdate(tx *gorm.DB, t *models.TusUpload, updates map[string]any) error {
+	updates["updated_at"] = time.Now().UTC()
+	res := tx.Model(&models.TusUpload{}).Where("id = ? AND lease_id = ?", t.ID, *t.LeaseId).Updates(updates)
+	if res.Error != nil {
+		return &apiError{err: res.Error}
+	}
+	if res.RowsAffected == 0 {
+		return &apiError{err: ErrTusLocked, code: http.StatusLocked}
+	}
+	return nil
+}
+
+func (a *apiService) tusUpload(ctx context.Context, db *gorm.DB, id string) (*models.TusUpload, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, &apiError{err: ErrTusNotFound, code: http.StatusNotFound}
+	}
+	var upload models.TusUpload
+	if err := db.Omit("tail").Where("id = ? AND user_id = ?", id, auth.GetUser(ctx)).First(&upload).Error; err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, &apiError{err: ErrTusNotFound, code: http.StatusNotFound}
+		case database.IsLockNotAvailableErr(err):
+			return nil, &apiError{err: ErrTusLocked, code: http.StatusLocked}
+		}
+		return nil, &apiError{err: err}
+	}
+	if time.Now().After(a.tusExpires(&upload)) {
+		return nil, &apiError{err: ErrTusExpired, code: http.StatusGone}
+	}
+	return &upload, nil
+}
+
+func (e *extendedService) TusHead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !tusVersionOk(w, r) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	upload, err := e.api.tusUpload(r.Context(), e.api.db, chi.URLParam(r, "id"))
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.code != 0 {
+			w.WriteHeader(apiErr.code)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Uploaded+upload.Pending, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Upload-Expires", e.api.tusExpires(upload).Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *extendedService) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusVersionOk(w, r) {
+		e.writeError(w, r, &apiError{err: ErrTusVersion, code: http.StatusPreconditionFailed})
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		e.writeError(w, r, &apiError{err: ErrTusContentType, code: http.StatusUnsupportedMediaType})
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		e.writeError(w, r, &apiError{err: ErrTusOffset, code: http.StatusBadRequest})
+		return
+	}
+	if err := e.api.tusLeased(r.Context(), chi.URLParam(r, "id"), func(ctx context.Context, t *models.TusUpload) error {
+		w.Header().Set("Upload-Expires", e.api.tusExpires(t).Format(http.TimeFormat))
+		offset, err = e.api.tusWrite(ctx, t, r, offset)
+		return err
+	}); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *extendedService) TusDelete(w http.ResponseWriter, r *http.Request) {
+	if !tusVersionOk(w, r) {
+		e.writeError(w, r, &apiError{err: ErrTusVersion, code: http.StatusPreconditionFailed})
+		return
+	}
+	if err := e.api.tusLeased(r.Context(), chi.URLParam(r, "id"), func(ctx context.Context, t *models.TusUpload) error {
+		if err := e.api.db.Transaction(func(tx *gorm.DB) error {
+			var parts []models.Upload
+			if err := tx.Where("upload_id = ?", t.ID).Find(&parts).Error; err != nil {
+				return err
+			}
+			if err := discardUploads(tx, t.UserId, parts); err != nil {
+				return err
+			}
+			return tx.Delete(t).Error
+		}); err != nil {
+			return &apiError{err: err}
+		}
+		return nil
+	}); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusWrite appends the request body at offset. Complete parts are stored as
+// soon as they are received. When the body ends before a part is complete,
+// what was received is stored down to whole hash blocks and the rest kept in
+// the upload row, so the upload can go on through any instance and a dropped
+// connection loses nothing that arrived. With a checksum the whole body is
+// verified before any of it is stored. Returns the new offset.
+func (a *apiService) tusWrite(ctx context.Context, t *models.TusUpload, r *http.Request, offset int64) (int64, error) {
+	if current := t.Uploaded + t.Pending; offset != current {
+		return 0, &apiError{err: ErrTusOffset, code: http.StatusConflict}
+	}
+	if r.ContentLength > t.Size-offset {
+		return 0, &apiError{err: ErrTusTooLarge, code: http.StatusRequestEntityTooLarge}
+	}
+	var sum *checksum
+	if h := r.Header.Get("Upload-Checksum"); h != "" {
+		var err error
+		if sum, err = parseChecksum(h); err != nil {
+			return 0, &apiError{err: err, code: http.StatusBadRequest}
+		}
+	}
+
+	var tail []byte
+	if t.Pending > 0 {
+		var row models.TusUpload
+		if err := a.db.Select("tail").Where("id = ?", t.ID).Take(&row).Error; err != nil {
+			return 0, &apiError{err: err}
+		}
+		tail = row.Tail
+	}
+	body := io.LimitReader(r.Body, t.Size-offset)
+	buf, err := os.CreateTemp(a.cnf.Tus.SpoolDir, "teldrive-tus-*")
+	if err != nil {
+		return 0, &apiError{err: err}
+	}
+	defer func() {
+		buf.Close()
+		os.Remove(buf.Name())
+	}()
+
+	src := io.MultiReader(bytes.NewReader(tail), body)
+	if sum != nil {
+		// Receive the whole body before storing any of it
+		received, err := os.CreateTemp(a.cnf.Tus.SpoolDir, "teldrive-tus-*")
+		if err != nil {
+			return 0, &apiError{err: err}
+		}
+		defer func() {
+			received.Close()
+			os.Remove(received.Name())
+		}()
+		if _, err := io.Copy(received, io.TeeReader(body, sum)); err != nil {
+			return offset, err
+		}
+		if !sum.valid() {
+			return offset, &apiError{err: ErrChecksum, code: statusChecksumMismatch}
+		}
+		if _, err := received.Seek(0, io.SeekStart); err != nil {
+			return offset, &apiError{err: err}
+		}
+		src = io.MultiReader(bytes.NewReader(tail), received)
+	}
+
+	if err := a.tusStore(ctx, t, src, buf); err != nil {
+		return t.Uploaded + t.Pending, err
+	}
+	if t.Uploaded == t.Size {
+		if err := a.tusFinish(ctx, t); err != nil {
+			return t.Size, err
+		}
+	}
+	return t.Uploaded + t.Pending, nil
+}
+
+// tusStore stores src, the content of t following its stored parts, as
+// parts of t, collecting each part in buf first. What is left once src ends
+// is stored down to whole hash blocks and the rest kept as the tail of t. A
+// read error of src is returned after storing what was read.
+func (a *apiService) tusStore(ctx context.Context, t *models.TusUpload, src io.Reader, buf *os.File) error {
+	var buffered int64
+	for t.Uploaded < t.Size {
+		want := min(t.PartSize, t.Size-t.Uploaded)
+		n, readErr := io.CopyN(buf, src, want-buffered)
+		buffered += n
+		if buffered == want {
+			if err := a.tusStorePart(ctx, t, buf, want); err != nil {
+				return err
+			}
+			buffered = 0
+			if err := buf.Truncate(0); err != nil {
+				return &apiError{err: err}
+			}
+			if _, err := buf.Seek(0, io.SeekStart); err != nil {
+				return &apiError{err: err}
+			}
+			continue
+		}
+		if errors.Is(readErr, io.EOF) {
+			readErr = nil
+		}
+
+		tail := make([]byte, buffered%blockhash.BlockSize)
+		if stored := buffered - int64(len(tail)); stored > 0 {
+			if err := a.tusStorePart(ctx, t, buf, stored); err != nil {
+				return err
+			}
+		}
+		if _, err := buf.ReadAt(tail, buffered-int64(len(tail))); err != nil {
+			return &apiError{err: err}
+		}
+		if err := tusUpdate(a.db, t, map[string]any{"pending": len(tail), "tail": tail}); err != nil {
+			return err
+		}
+		t.Pending = int64(len(tail))
+		return readErr
+	}
+	return nil
+}
+
+// tusStorePart stores the first size bytes of buf as the next part of t.
+func (a *apiService) tusStorePart(ctx context.Context, t *models.TusUpload, buf *os.File, size int64) error {
+	partNo := t.Parts + 1
+	params := api.UploadsUploadParams{
+		ID:            t.ID,
+		PartName:      fmt.Sprintf("%s.part.%03d", t.Name, partNo),
+		FileName:      t.Name,
+		PartNo:        partNo,
+		Encrypted:     api.NewOptBool(t.Encrypted),
+		Hashing:       api.NewOptBool(true),
+		ContentLength: size,
+	}
+	if t.ChannelId != nil {
+		params.ChannelId = api.NewOptInt64(*t.ChannelId)
+	}
+	part, err := a.uploadPart(ctx, &api.UploadsUploadReqWithContentType{
+		ContentType: "application/octet-stream",
+		Content:     api.UploadsUploadReq{Data: io.NewSectionReader(buf, 0, size)},
+	}, params, nil)
+	if err != nil {
+		return err
+	}
+
+	// A part stored before the upload row was updated, e.g. by a request that
+	// failed halfway, is replaced by this one.
+	if err := a.db.Transaction(func(tx *gorm.DB) error {
+		var stale []models.Upload
+		if err := tx.Where("upload_id = ? AND part_no = ? AND part_id <> ?", t.ID, partNo, part.PartId).
+			Find(&stale).Error; err != nil {
+			return err
+		}
+		if err := discardUploads(tx, t.UserId, stale); err != nil {
+			return err
+		}
+		return tusUpdate(tx, t, map[string]any{
+			"uploaded":   t.Uploaded + size,
+			"parts":      partNo,
+			"pending":    0,
+			"tail":       nil,
+			"channel_id": part.ChannelId,
+		})
+	}); err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return err
+		}
+		return &apiError{err: err}
+	}
+	t.Uploaded += size
+	t.Parts = partNo
+	t.Pending = 0
+	t.ChannelId = &part.ChannelId
+	return nil
+}
+
+// tusFinish creates the file from the stored parts and forgets the upload.
+func (a *apiService) tusFinish(ctx context.Context, t *models.TusUpload) error {
+	file := &api.File{
+		Name:      t.Name,
+		Type:      api.FileTypeFile,
+		ParentId:  api.NewOptString(t.ParentId),
+		MimeType:  api.NewOptString(t.MimeType),
+		Size:      api.NewOptInt64(t.Size),
+		Encrypted: api.NewOptBool(t.Encrypted),
+	}
+	if t.Size > 0 {
+		file.UploadId = api.NewOptString(t.ID)
+		file.ChannelId = api.NewOptInt64(*t.ChannelId)
+	}
+	if _, err := a.FilesCreate(ctx, file); err != nil {
+		return err
+	}
+	if err := a.db.Delete(t).Error; err != nil {
+		return &apiError{err: err}
+	}
+	return nil
+}
@@ -2,38 +2,32 @@ package services
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/base64"
 	"errors"
-	"fmt"
 	"io"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/appcontext"
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/crypt"
 	"github.com/tgdrive/teldrive/internal/hash"
 	"github.com/tgdrive/teldrive/internal/logging"
 	"github.com/tgdrive/teldrive/internal/pool"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
 	"go.uber.org/zap"
 
 	"github.com/gotd/td/telegram"
-	"github.com/gotd/td/telegram/message"
-	"github.com/gotd/td/telegram/uploader"
 	"github.com/gotd/td/tg"
 	"github.com/tgdrive/teldrive/pkg/mapper"
 	"github.com/tgdrive/teldrive/pkg/models"
 )
 
-var (
-	saltLength      = 32
-	ErrUploadFailed = errors.New("upload failed")
-)
+var ErrUploadFailed = errors.New("upload failed")
 
 func (a *apiService) UploadsDelete(ctx context.Context, params api.UploadsDeleteParams) error {
 	if err := a.db.Where("upload_id = ?", params.ID).Delete(&models.Upload{}).Error; err != nil {
@@ -84,15 +78,41 @@ func (a *apiService) UploadsStats(ctx context.Context, params api.UploadsStatsPa
 	return stats, nil
 }
 
-func (a *apiService) prepareEncryption(params *api.UploadsUploadParams, fileStream io.Reader, fileSize int64, logger *zap.Logger) (io.Reader, int64, string, error) {
+type partSaltKey struct{}
+
+// withPartSalt marks the parts uploaded with ctx as encrypted already, with a
+// key derived from salt.
+func withPartSalt(ctx context.Context, salt string) context.Context {
+	return context.WithValue(ctx, partSaltKey{}, salt)
+}
+
+func partSalt(ctx context.Context) (string, bool) {
+	salt, ok := ctx.Value(partSaltKey{}).(string)
+	return salt, ok
+}
+
+// prepareEncryption wraps fileStream in the cipher of a new part. Parts are
+// encrypted with the instance key, or with the data key of userId when
+// per-user keys are enabled. Parts encrypted already are stored as they are.
+func (a *apiService) prepareEncryption(ctx context.Context, userId int64, params *api.UploadsUploadParams, fileStream io.Reader, fileSize int64, logger *zap.Logger) (io.Reader, int64, string, error) {
 	if !params.Encrypted.Value {
 		return fileStream, fileSize, "", nil
 	}
-	salt, err := generateRandomSalt()
+	if salt, ok := partSalt(ctx); ok {
+		return fileStream, fileSize, salt, nil
+	}
+	salt, err := crypt.NewSalt()
 	if err != nil {
 		return nil, 0, "", err
 	}
-	cipher, err := crypt.NewCipher(a.cnf.TG.Uploads.EncryptionKey, salt)
+	password := a.cnf.TG.Uploads.EncryptionKey
+	if a.cnf.Keys.PerUser {
+		if password, err = a.dataKey(ctx, userId, sessionHash(ctx), true); err != nil {
+			return nil, 0, "", err
+		}
+		salt = crypt.UserSalt(salt)
+	}
+	cipher, err := crypt.NewCipher(password, salt)
 	if err != nil {
 		return nil, 0, "", err
 	}
@@ -122,59 +142,133 @@ func (a *apiService) getUploadClient(ctx context.Context, userId int64) (*telegr
 	if err != nil {
 		return nil, "", 0, "", err
 	}
-	client, err := tgc.BotClient(ctx, a.db, a.cache, &a.cnf.TG, token)
+	client, err := tgc.BotClient(ctx, a.db, a.cache, &a.cnf.TG, token, a.healthMiddlewares(token)...)
 	if err != nil {
 		return nil, "", 0, "", err
 	}
 	return client, token, index, strings.Split(token, ":")[0], nil
 }
 
-func (a *apiService) uploadToTelegram(ctx context.Context, client *tg.Client, channelId int64, params *api.UploadsUploadParams, fileStream io.Reader, fileSize int64, logger *zap.Logger) (*tg.Message, error) {
-	channel, err := tgc.GetChannelById(ctx, client, channelId)
-	if err != nil {
-		return nil, err
+// uploadChannel returns the channel new parts of userId are stored in,
+// creating a channel when there is none or the current one is full.
+func (a *apiService) uploadChannel(ctx context.Context, userId int64, logger *zap.Logger) (int64, error) {
+	channelId, err := a.channelManager.CurrentChannel(ctx, userId)
+	if err != nil && err != tgc.ErrNoDefaultChannel {
+		return 0, &apiError{err: err}
+	}
+	if err == tgc.ErrNoDefaultChannel || (a.cnf.TG.AutoChannelCreate && a.channelManager.ChannelLimitReached(channelId)) {
+		newChannelId, err := a.channelManager.CreateNewChannel(ctx, "", userId, true)
+		if err != nil {
+			logger.Error("channel.create.failed", zap.Error(err))
+			return 0, &apiError{err: err}
+		}
+		channelId = newChannelId
+		logger.Debug("channel.created", zap.Int64("new_channel_id", channelId))
 	}
+	return channelId, nil
+}
+
+// uploadChecksum returns the digest the client expects for the part uploaded
+// with r, sent in the Upload-Checksum header or the checksum query parameter
+// as "<algorithm> <digest>".
+func uploadChecksum(r *http.Request) (*checksum, error) {
+	value := r.Header.Get("Upload-Checksum")
+	if value == "" {
+		value = r.URL.Query().Get("checksum")
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return parseChecksum(value)
+}
 
-	u := uploader.NewUploader(client).WithThreads(a.cnf.TG.Uploads.Threads).WithPartSize(512 * 1024)
-	upload, err := u.Upload(ctx, uploader.NewUpload(params.PartName, fileStream, fileSize))
+// deletePartMessage removes a part that was stored but must not be used.
+func deletePartMessage(ctx context.Context, client *tg.Client, channelId int64, id int) error {
+	channel, err := tgc.GetChannelById(ctx, client, channelId)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	_, err = client.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{Channel: channel, ID: []int{id}})
+	return err
+}
 
-	document := message.UploadedDocument(upload).Filename(params.PartName).ForceFile(true)
-	sender := message.NewSender(client)
-	target := sender.To(&tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash})
+// PartSender sends size bytes of r to a channel as a document named name and
+// returns the id of its message. verify is called once the content was sent;
+// when it fails the message is deleted again and its error returned.
+type PartSender func(ctx context.Context, userId, channelId int64, name string, r io.Reader, size int64, verify func() error) (int, error)
 
-	res, err := target.Media(ctx, document)
+// sendPart is the PartSender storing parts in Telegram, through a bot of the
+// user or the user session.
+func (a *apiService) sendPart(ctx context.Context, userId, channelId int64, name string, r io.Reader, size int64, verify func() error) (int, error) {
+	client, token, index, channelUser, err := a.getUploadClient(ctx, userId)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	logger := logging.Component("UPLOAD").With(zap.String("part_name", name))
+	logger.Debug("upload.client", zap.String("bot", channelUser), zap.Int("bot_no", index))
 
-	updates := res.(*tg.Updates)
-	var message *tg.Message
-	for _, update := range updates.Updates {
-		if channelMsg, ok := update.(*tg.UpdateNewChannelMessage); ok {
-			if msg, ok := channelMsg.Message.AsNotEmpty(); ok {
-				if m, ok := msg.(*tg.Message); ok {
-					message = m
-					break
-				}
+	uploadPool := pool.NewPool(client, int64(a.cnf.TG.PoolSize), a.newMiddlewares(ctx, a.cnf.TG.Uploads.MaxRetries)...)
+	defer func() { uploadPool.Close() }()
+
+	var messageId int
+	err = tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
+		client := uploadPool.Default(ctx)
+		message, err := tgc.UploadDocument(ctx, client, channelId, name, r, size, a.cnf.TG.Uploads.Threads)
+		if err != nil {
+			return err
+		}
+		doc, ok := msgDocument(message)
+		if !ok || (doc.Size == 0 && doc.Size != size) {
+			return ErrUploadFailed
+		}
+		if err := verify(); err != nil {
+			if err := deletePartMessage(ctx, client, channelId, message.ID); err != nil {
+				logger.Error("upload.part_delete_failed", zap.Int("message_id", message.ID), zap.Error(err))
 			}
+			return err
 		}
-	}
+		messageId = message.ID
+		return nil
+	})
+	return messageId, err
+}
 
-	if message == nil || message.ID == 0 {
-		return nil, fmt.Errorf("upload failed: invalid message ID 0 from telegram")
+func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadReqWithContentType, params api.UploadsUploadParams) (*api.UploadPart, error) {
+	var sum *checksum
+	if c, ok := appcontext.FromContext(ctx); ok {
+		var err error
+		if sum, err = uploadChecksum(c.Request); err != nil {
+			return nil, &apiError{err: err, code: 400}
+		}
 	}
-	return message, nil
+	return a.uploadPart(ctx, req, params, sum)
 }
 
-func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadReqWithContentType, params api.UploadsUploadParams) (*api.UploadPart, error) {
+// uploadPart stores a part of an upload. The content is verified against sum
+// when it is not nil, and the digest is kept with the part either way.
+// Uploads made of parts of a larger request, like tus or streamed uploads,
+// verify the request themselves and pass no sum.
+func (a *apiService) uploadPart(ctx context.Context, req *api.UploadsUploadReqWithContentType, params api.UploadsUploadParams, sum *checksum) (*api.UploadPart, error) {
 	if params.Encrypted.Value && a.cnf.TG.Uploads.EncryptionKey == "" {
 		return nil, &apiError{err: errors.New("encryption is not enabled"), code: 400}
 	}
 
 	userId := auth.GetUser(ctx)
+	// Parts already stored for the upload count towards the file it becomes
+	var stored int64
+	if err := a.db.Model(&models.Upload{}).Select("COALESCE(SUM(size), 0)").
+		Where("upload_id = ?", params.ID).Scan(&stored).Error; err != nil {
+		return nil, &apiError{err: err}
+	}
+	if err := a.checkQuota(userId, stored+params.ContentLength, 1); err != nil {
+		return nil, err
+	}
+	if _, ok := partSalt(ctx); params.Encrypted.Value && a.cnf.Keys.PerUser && !ok {
+		// Fail before anything is sent when the key is locked
+		if _, err := a.dataKey(ctx, userId, sessionHash(ctx), true); err != nil {
+			return nil, err
+		}
+	}
 	// Create upload component logger with common fields
 	logger := logging.Component("UPLOAD").With(
 		zap.String("file_name", params.FileName),
@@ -186,107 +280,97 @@ func (a *apiService) UploadsUpload(ctx context.Context, req *api.UploadsUploadRe
 	channelId := params.ChannelId.Value
 	if channelId == 0 {
 		var err error
-		channelId, err = a.channelManager.CurrentChannel(ctx, userId)
-		if err != nil && err != tgc.ErrNoDefaultChannel {
-			return nil, &apiError{err: err}
-		}
-		if err == tgc.ErrNoDefaultChannel || (a.cnf.TG.AutoChannelCreate && a.channelManager.ChannelLimitReached(channelId)) {
-			newChannelId, err := a.channelManager.CreateNewChannel(ctx, "", userId, true)
-			if err != nil {
-				logger.Error("channel.create.failed", zap.Error(err))
-				return nil, &apiError{err: err}
-			}
-			channelId = newChannelId
-			logger.Debug("channel.created", zap.Int64("new_channel_id", channelId))
+		if channelId, err = a.uploadChannel(ctx, userId, logger); err != nil {
+			return nil, err
 		}
-
-	} else {
-		channelId = params.ChannelId.Value
 	}
 
-	client, token, index, channelUser, err := a.getUploadClient(ctx, userId)
+	logger.Debug("upload.started", zap.Int64("size", params.ContentLength))
+
+	out, err := a.storePart(ctx, userId, channelId, &params, req.Content.Data, sum, logger)
 	if err != nil {
+		logger.Error("upload.failed", zap.String("file_name", params.FileName),
+			zap.String("part_name", params.PartName),
+			zap.Int("part_no", params.PartNo), zap.Error(err))
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return nil, apiErr
+		}
 		return nil, &apiError{err: err}
 	}
+	logger.Debug("upload.complete", zap.Int("message_id", out.PartId), zap.Int64("final_size", out.Size), zap.Bool("encrypted", out.Encrypted))
+	return out, nil
+}
 
-	logger.Debug("upload.started", zap.String("bot", channelUser), zap.Int("bot_no", index), zap.Int64("size", params.ContentLength))
-
-	uploadPool := pool.NewPool(client, int64(a.cnf.TG.PoolSize), a.newMiddlewares(ctx, a.cnf.TG.Uploads.MaxRetries)...)
-	defer func() { uploadPool.Close() }()
-
-	var out api.UploadPart
+// storePart sends the content of a part and records it in the uploads table.
+func (a *apiService) storePart(ctx context.Context, userId, channelId int64, params *api.UploadsUploadParams, reader io.Reader, sum *checksum, logger *zap.Logger) (*api.UploadPart, error) {
 	// Compute BLAKE3 block hashes on plaintext BEFORE encryption
 	var blockHasher *hash.BlockHasher
-	var reader io.Reader = req.Content.Data
-
 	if params.Hashing.Value {
 		blockHasher = hash.NewBlockHasher()
-		reader = io.TeeReader(req.Content.Data, blockHasher)
+		reader = io.TeeReader(reader, blockHasher)
+	}
+	if sum != nil {
+		reader = io.TeeReader(reader, sum)
 	}
 
-	err = tgc.RunWithAuth(ctx, client, token, func(ctx context.Context) error {
-
-		client := uploadPool.Default(ctx)
-
-		fileStream, fileSize, salt, err := a.prepareEncryption(&params, reader, params.ContentLength, logger)
-		if err != nil {
-			return err
-		}
-
-		message, err := a.uploadToTelegram(ctx, client, channelId, &params, fileStream, fileSize, logger)
-
-		if err != nil {
-			return err
-		}
-
-		doc, ok := msgDocument(message)
-
-		if !ok || (doc.Size == 0 && doc.Size != fileSize) {
-			return ErrUploadFailed
-		}
+	fileStream, fileSize, salt, err := a.prepareEncryption(ctx, userId, params, reader, params.ContentLength, logger)
+	if err != nil {
+		return nil, err
+	}
+	name, err := a.names.partName(params.PartName, params.Encrypted.Value)
+	if err != nil {
+		return nil, err
+	}
 
-		var blockHashes []byte
-		if blockHasher != nil {
-			blockHashes = blockHasher.Sum()
+	messageId, err := a.partSender(ctx, userId, channelId, name, fileStream, fileSize, func() error {
+		if sum != nil && !sum.valid() {
+			logger.Warn("upload.checksum_mismatch", zap.String("algorithm", sum.algorithm))
+			return &apiError{err: ErrChecksum, code: 400}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		partUpload := &models.Upload{
-			Name:        params.PartName,
-			UploadId:    params.ID,
-			PartId:      message.ID,
-			ChannelId:   channelId,
-			Size:        fileSize,
-			PartNo:      params.PartNo,
-			UserId:      userId,
-			Encrypted:   params.Encrypted.Value,
-			Salt:        salt,
-			BlockHashes: blockHashes,
-		}
+	var blockHashes []byte
+	if blockHasher != nil {
+		blockHashes = blockHasher.Sum()
+	}
 
-		if err := a.db.Create(partUpload).Error; err != nil {
-			return err
-		}
+	partUpload := &models.Upload{
+		Name:        params.PartName,
+		UploadId:    params.ID,
+		PartId:      messageId,
+		ChannelId:   channelId,
+		Size:        fileSize,
+		PartNo:      params.PartNo,
+		UserId:      userId,
+		Encrypted:   params.Encrypted.Value,
+		Salt:        salt,
+		BlockHashes: blockHashes,
+	}
+	if sum != nil {
+		partUpload.ChecksumAlgorithm = &sum.algorithm
+		partUpload.Checksum = utils.Ptr(sum.hex())
+		partUpload.ChecksumVerified = sum.want != nil
+	}
 
-		out = api.UploadPart{
-			Name:      partUpload.Name,
-			PartId:    partUpload.PartId,
-			ChannelId: partUpload.ChannelId,
-			PartNo:    partUpload.PartNo,
-			Size:      partUpload.Size,
-			Encrypted: partUpload.Encrypted,
-		}
-		out.SetSalt(api.NewOptString(partUpload.Salt))
-		return nil
-	})
+	if err := a.db.Create(partUpload).Error; err != nil {
+		return nil, err
+	}
 
-	if err != nil {
-		logger.Error("upload.failed", zap.String("file_name", params.FileName),
-			zap.String("part_name", params.PartName),
-			zap.Int("part_no", params.PartNo), zap.Error(err))
-		return nil, &apiError{err: err}
+	out := &api.UploadPart{
+		Name:      partUpload.Name,
+		PartId:    partUpload.PartId,
+		ChannelId: partUpload.ChannelId,
+		PartNo:    partUpload.PartNo,
+		Size:      partUpload.Size,
+		Encrypted: partUpload.Encrypted,
 	}
-	logger.Debug("upload.complete", zap.Int("message_id", out.PartId), zap.Int64("final_size", out.Size), zap.Bool("encrypted", out.Encrypted))
-	return &out, nil
+	out.SetSalt(api.NewOptString(partUpload.Salt))
+	return out, nil
 }
 
 func msgDocument(m tg.MessageClass) (*tg.Document, bool) {
@@ -309,17 +393,3 @@ func msgDocument(m tg.MessageClass) (*tg.Document, bool) {
 	}
 	return doc, true
 }
-
-func generateRandomSalt() (string, error) {
-	randomBytes := make([]byte, saltLength)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		return "", err
-	}
-
-	hasher := sha256.New()
-	hasher.Write(randomBytes)
-	hashedSalt := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
-
-	return hashedSalt, nil
-}
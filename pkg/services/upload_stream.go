@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tgdrive/teldrive/internal/auth"
+)
+
+// Telegram accepts documents of up to 4000 (8000 for premium accounts) chunks
+// of 512KB. Both limits are whole hash blocks.
+const (
+	maxPartSize        = 4000 * 512 * 1024
+	maxPremiumPartSize = 8000 * 512 * 1024
+)
+
+var ErrUploadName = errors.New("name is required")
+
+// uploadPartSize returns the largest part the uploader of userId can send.
+// Bots are never premium, so the premium limit only applies to uploads made
+// with the user's own session.
+func (a *apiService) uploadPartSize(ctx context.Context, userId int64) (int64, error) {
+	tokens, err := a.channelManager.BotTokens(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 && auth.GetJWTUser(ctx).IsPremium {
+		return maxPremiumPartSize, nil
+	}
+	return maxPartSize, nil
+}
+
+// UploadsStream stores the request body as a file in a single request. The
+// body is split into parts that are uploaded TG.Uploads.Threads at a time
+// while it is read, each buffered in a temporary file, and the file is only
+// created once every part is stored.
+//
+// The file is named by the name query parameter and goes to the folder given
+// by parentId or path (created when missing, the root by default). Set
+// encrypted=true to encrypt the parts.
+func (e *extendedService) UploadsStream(w http.ResponseWriter, r *http.Request) {
+	encrypted := r.URL.Query().Get("encrypted") == "true"
+	if encrypted && e.api.cnf.TG.Uploads.EncryptionKey == "" {
+		e.writeError(w, r, &apiError{err: errors.New("encryption is not enabled"), code: http.StatusBadRequest})
+		return
+	}
+	upload, err := e.newStreamUpload(r)
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	upload.encrypted = encrypted
+	e.finishStreamUpload(w, r, upload, r.Body, r.ContentLength)
+}
+
+// newStreamUpload returns the upload of a file named by the name query
+// parameter into the folder given by parentId or path.
+func (e *extendedService) newStreamUpload(r *http.Request) (*spoolUpload, error) {
+	q := r.URL.Query()
+	name := q.Get("name")
+	if name == "" || strings.Contains(name, "/") {
+		return nil, &apiError{err: ErrUploadName, code: http.StatusBadRequest}
+	}
+	destination := q.Get("parentId")
+	if destination == "" {
+		destination = q.Get("path")
+	}
+	if destination == "" {
+		destination = "/"
+	}
+
+	userId := auth.GetUser(r.Context())
+	parentId, err := e.api.copyDestination(userId, destination)
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+	partSize, err := e.api.uploadPartSize(r.Context(), userId)
+	if err != nil {
+		return nil, &apiError{err: err}
+	}
+	upload := e.api.newSpoolUpload(r.Context(), parentId, name, partSize)
+	upload.setConcurrency(e.api.cnf.TG.Uploads.Threads)
+	return upload, nil
+}
+
+// finishStreamUpload copies body, of length bytes when known, into upload and
+// creates the file.
+func (e *extendedService) finishStreamUpload(w http.ResponseWriter, r *http.Request, upload *spoolUpload, body io.Reader, length int64) {
+	if _, err := io.Copy(upload, body); err != nil {
+		upload.abort()
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	if length >= 0 && upload.size != length {
+		upload.abort()
+		e.writeError(w, r, &apiError{err: io.ErrUnexpectedEOF, code: http.StatusBadRequest})
+		return
+	}
+	file, err := upload.Close()
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, file)
+}
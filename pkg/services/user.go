@@ -55,7 +55,11 @@ func (a *apiService) UsersAddBots(ctx context.Context, req *api.AddBots) error {
 
 			payload = append(payload, models.Bot{UserId: userID, Token: token, BotId: botID})
 		}
-		if err := a.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&payload).Error; err != nil {
+		// Bots added again are enabled until their next check
+		if err := a.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "token"}},
+			DoUpdates: clause.Assignments(map[string]any{"disabled": false, "last_error": nil}),
+		}).Create(&payload).Error; err != nil {
 			logger.Error("users.add_bots.persist_failed", zap.Error(err))
 			return err
 		}
@@ -324,6 +328,7 @@ func (a *apiService) UsersRemoveSession(ctx context.Context, params api.UsersRem
 
 	a.db.Where("user_id = ?", userId).Where("hash = ?", session.Hash).Delete(&models.Session{})
 	a.cache.Delete(ctx, cache.KeyUserSessions(userId))
+	a.unlocked.forget(userId, session.Hash)
 
 	return nil
 }
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var ErrVerificationNotFound = errors.New("file has not been verified")
+
+// fileVerification is the last scrub result of a file, as recorded by the
+// scrub cron job.
+type fileVerification struct {
+	FileId       string    `json:"fileId"`
+	Name         string    `json:"name"`
+	ParentId     *string   `json:"parentId,omitempty"`
+	Hash         string    `json:"hash"`
+	Status       string    `json:"status"`
+	MissingParts []int     `json:"missingParts,omitempty"`
+	Error        *string   `json:"error,omitempty"`
+	VerifiedAt   time.Time `json:"verifiedAt"`
+	// Stale is set when the file content changed after the verification.
+	Stale bool `json:"stale"`
+}
+
+func (a *apiService) verificationQuery(userId int64) *gorm.DB {
+	return a.db.Table("teldrive.file_verifications as v").
+		Select("v.file_id, f.name, f.name_encrypted, f.parent_id, v.hash, v.status, v.missing_parts, v.error, v.verified_at, f.hash IS DISTINCT FROM v.hash as stale").
+		Joins("JOIN teldrive.files as f ON f.id = v.file_id").
+		Where("v.user_id = ?", userId)
+}
+
+type verificationRow struct {
+	FileId        string
+	Name          string
+	NameEncrypted bool
+	ParentId      *string
+	Hash          string
+	Status        string
+	MissingParts  datatypes.JSONSlice[int]
+	Error         *string
+	VerifiedAt    time.Time
+	Stale         bool
+}
+
+func (a *apiService) toFileVerification(v verificationRow) fileVerification {
+	return fileVerification{
+		FileId:       v.FileId,
+		Name:         a.names.plainName(v.Name, v.NameEncrypted),
+		ParentId:     v.ParentId,
+		Hash:         v.Hash,
+		Status:       v.Status,
+		MissingParts: v.MissingParts,
+		Error:        v.Error,
+		VerifiedAt:   v.VerifiedAt,
+		Stale:        v.Stale,
+	}
+}
+
+// FilesListVerifications lists the scrub results of the user's files, most
+// recent first. Pass status (ok, mismatch, missing or error) to filter them.
+func (e *extendedService) FilesListVerifications(w http.ResponseWriter, r *http.Request) {
+	query := e.api.verificationQuery(auth.GetUser(r.Context()))
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("v.status = ?", status)
+	}
+	var rows []verificationRow
+	if err := query.Order("v.verified_at DESC").Limit(queryInt(r, "limit", 100)).
+		Offset(queryInt(r, "offset", 0)).Scan(&rows).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	writeJSON(w, http.StatusOK, utils.Map(rows, e.api.toFileVerification))
+}
+
+func (e *extendedService) FilesGetVerification(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !isUUID(id) {
+		e.writeError(w, r, &apiError{err: ErrVerificationNotFound, code: http.StatusNotFound})
+		return
+	}
+	var rows []verificationRow
+	if err := e.api.verificationQuery(auth.GetUser(r.Context())).Where("v.file_id = ?", id).
+		Scan(&rows).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	if len(rows) == 0 {
+		e.writeError(w, r, &apiError{err: ErrVerificationNotFound, code: http.StatusNotFound})
+		return
+	}
+	writeJSON(w, http.StatusOK, e.api.toFileVerification(rows[0]))
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// versionCacheTTL bounds how long a version removed along with its file is
+// still served from the cache.
+const versionCacheTTL = 10 * time.Minute
+
+type fileVersion struct {
+	ID        string     `json:"id"`
+	FileId    string     `json:"fileId"`
+	Size      int64      `json:"size"`
+	Encrypted bool       `json:"encrypted"`
+	Hash      string     `json:"hash,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// saveFileVersion records the current content of file as a version before it
+// gets replaced. Files without parts have nothing worth keeping.
+func saveFileVersion(tx *gorm.DB, file *models.File) error {
+	if file.Type != "file" || file.Parts == nil || len(*file.Parts) == 0 {
+		return nil
+	}
+	return tx.Create(&models.FileVersion{
+		FileId:    file.ID,
+		UserId:    file.UserId,
+		Size:      file.Size,
+		Parts:     file.Parts,
+		ChannelId: file.ChannelId,
+		Encrypted: file.Encrypted,
+		Hash:      file.Hash,
+		UpdatedAt: file.UpdatedAt,
+	}).Error
+}
+
+// fileAtVersion returns file with its content swapped for the given version.
+// The version ID is used as file ID so message and location caches of
+// different versions never collide.
+func (a *apiService) fileAtVersion(ctx context.Context, file *models.File, versionId string) (*models.File, error) {
+	version, err := cache.Fetch(ctx, a.cache, cache.KeyFileVersion(versionId), versionCacheTTL, func() (*models.FileVersion, error) {
+		var result models.FileVersion
+		if err := a.db.Where("id = ? AND file_id = ?", versionId, file.ID).First(&result).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrVersionNotFound
+			}
+			return nil, err
+		}
+		return &result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version.FileId != file.ID {
+		return nil, ErrVersionNotFound
+	}
+	res := *file
+	res.ID = version.ID
+	res.Size = version.Size
+	res.Parts = version.Parts
+	res.ChannelId = version.ChannelId
+	res.Encrypted = version.Encrypted
+	res.Hash = version.Hash
+	res.UpdatedAt = version.UpdatedAt
+	return &res, nil
+}
+
+func (e *extendedService) FilesListVersions(w http.ResponseWriter, r *http.Request) {
+	a := e.api
+	userId := auth.GetUser(r.Context())
+	fileId := chi.URLParam(r, "id")
+
+	var count int64
+	if err := a.db.Model(&models.File{}).Where("id = ? AND user_id = ?", fileId, userId).
+		Count(&count).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+	if count == 0 {
+		e.writeError(w, r, &apiError{err: errors.New("file not found"), code: http.StatusNotFound})
+		return
+	}
+
+	var versions []models.FileVersion
+	if err := a.db.Where("file_id = ?", fileId).Order("created_at DESC").
+		Find(&versions).Error; err != nil {
+		e.writeError(w, r, &apiError{err: err})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, utils.Map(versions, func(v models.FileVersion) fileVersion {
+		res := fileVersion{
+			ID:        v.ID,
+			FileId:    v.FileId,
+			UpdatedAt: v.UpdatedAt,
+			CreatedAt: *v.CreatedAt,
+		}
+		if v.Size != nil {
+			res.Size = *v.Size
+		}
+		if v.Encrypted != nil {
+			res.Encrypted = *v.Encrypted
+		}
+		if v.Hash != nil {
+			res.Hash = *v.Hash
+		}
+		return res
+	}))
+}
+
+func (e *extendedService) FilesRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	if err := e.api.restoreFileVersion(r.Context(), auth.GetUser(r.Context()),
+		chi.URLParam(r, "id"), chi.URLParam(r, "versionId")); err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreFileVersion makes a version the current content of its file. The
+// content it replaces is kept as a new version, so a restore can be undone.
+func (a *apiService) restoreFileVersion(ctx context.Context, userId int64, fileId, versionId string) error {
+	var file models.File
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ? AND status = 'active'", fileId, userId).
+			First(&file).Error; err != nil {
+			return &apiError{err: errors.New("file not found"), code: http.StatusNotFound}
+		}
+
+		var version models.FileVersion
+		if err := tx.Where("id = ? AND file_id = ?", versionId, fileId).First(&version).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &apiError{err: ErrVersionNotFound, code: http.StatusNotFound}
+			}
+			return err
+		}
+
+		if err := saveFileVersion(tx, &file); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.File{}).Where("id = ?", fileId).Updates(map[string]any{
+			"parts":      version.Parts,
+			"size":       version.Size,
+			"channel_id": version.ChannelId,
+			"encrypted":  version.Encrypted,
+			"hash":       version.Hash,
+			"updated_at": time.Now().UTC(),
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&version).Error
+	})
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return err
+		}
+		return &apiError{err: err}
+	}
+
+	a.cache.Delete(ctx, cache.KeyFile(fileId), cache.KeyFileMessages(fileId), cache.KeyFileVersion(versionId))
+	a.cache.DeletePattern(ctx, cache.KeyFileLocationPattern(fileId))
+
+	var parentID string
+	if file.ParentId != nil {
+		parentID = *file.ParentId
+	}
+	a.events.Record(events.OpUpdate, userId, &models.Source{
+		ID:       file.ID,
+		Type:     file.Type,
+		Name:     a.names.plain(&file),
+		ParentID: parentID,
+	})
+	return nil
+}
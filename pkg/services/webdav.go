@@ -0,0 +1,438 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+	"gorm.io/gorm"
+)
+
+var webdavMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"}
+
+// webdavHandler serves the file tree of the authenticated user over WebDAV.
+// Most methods are handled by x/net/webdav on top of davFS; GET and COPY are
+// served directly so that downloads go through the stream pipeline and
+// copies forward Telegram messages instead of re-uploading content.
+type webdavHandler struct {
+	srv    *extendedService
+	prefix string
+
+	mu    sync.Mutex
+	locks map[int64]webdav.LockSystem
+}
+
+// NewWebDAVHandler returns the WebDAV endpoint mounted at prefix. Clients
+// authenticate with a bearer token or with basic auth using the token as
+// password.
+func NewWebDAVHandler(srv *extendedService, prefix string) http.Handler {
+	for _, method := range webdavMethods {
+		chi.RegisterMethod(method)
+	}
+	return &webdavHandler{srv: srv, prefix: prefix, locks: map[int64]webdav.LockSystem{}}
+}
+
+func (h *webdavHandler) lockSystem(userId int64) webdav.LockSystem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ls, ok := h.locks[userId]
+	if !ok {
+		ls = webdav.NewMemLS()
+		h.locks[userId] = ls
+	}
+	return ls
+}
+
+func (h *webdavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a := h.srv.api
+	token := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	} else if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		token = strings.TrimPrefix(v, "Bearer ")
+	}
+	claims, err := auth.VerifyUser(r.Context(), a.db, a.cache, a.cnf.JWT.Secret, token)
+	if token == "" || err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="teldrive"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	r = r.WithContext(auth.WithUser(r.Context(), claims))
+	userId := auth.GetUser(r.Context())
+	davFs := &davFS{api: a}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		name, ok := h.davPath(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		file, err := davFs.lookup(r.Context(), name)
+		if err == nil && file.Type == "file" {
+			h.srv.serveFile(w, r, file.ID, &models.Session{UserId: userId, Session: claims.TgSession, Hash: claims.Hash}, streamETag)
+			return
+		}
+	case "COPY":
+		status, err := h.copy(r, davFs)
+		if err != nil {
+			logging.Component("WEBDAV").Debug("copy.failed", zap.Error(err))
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	dav := &webdav.Handler{
+		Prefix:     h.prefix,
+		FileSystem: davFs,
+		LockSystem: h.lockSystem(userId),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logging.Component("WEBDAV").Debug("request.failed", zap.String("method", r.Method),
+					zap.String("path", r.URL.Path), zap.Error(err))
+			}
+		},
+	}
+	dav.ServeHTTP(w, r)
+}
+
+func (h *webdavHandler) davPath(p string) (string, bool) {
+	name, ok := strings.CutPrefix(p, h.prefix)
+	if !ok {
+		return "", false
+	}
+	return path.Clean("/" + name), true
+}
+
+// copy handles COPY with FilesCopy so that parts are forwarded on Telegram.
+func (h *webdavHandler) copy(r *http.Request, davFs *davFS) (int, error) {
+	ctx := r.Context()
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || r.Header.Get("Destination") == "" {
+		return http.StatusBadRequest, errors.New("invalid destination")
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return http.StatusBadGateway, errors.New("invalid destination")
+	}
+	src, ok := h.davPath(r.URL.Path)
+	if !ok {
+		return http.StatusNotFound, os.ErrNotExist
+	}
+	dst, ok := h.davPath(u.Path)
+	if !ok || dst == "/" {
+		return http.StatusBadGateway, errors.New("invalid destination")
+	}
+	if dst == src {
+		return http.StatusForbidden, errors.New("destination equals source")
+	}
+
+	file, err := davFs.lookup(ctx, src)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	parent, err := davFs.lookup(ctx, path.Dir(dst))
+	if err != nil || parent.Type != "folder" {
+		return http.StatusConflict, os.ErrNotExist
+	}
+
+	status := http.StatusCreated
+	existing, err := davFs.lookup(ctx, dst)
+	if err == nil {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, os.ErrExist
+		}
+		if err := h.srv.api.FilesDelete(ctx, &api.FileDelete{Ids: []string{existing.ID}}); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		status = http.StatusNoContent
+	}
+
+	if _, err := h.srv.api.FilesCopy(ctx, &api.FileCopy{
+		NewName:     api.NewOptString(path.Base(dst)),
+		Destination: parent.ID,
+	}, api.FilesCopyParams{ID: file.ID}); err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.code != 0 {
+			return apiErr.code, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	return status, nil
+}
+
+// davFS maps WebDAV paths onto the file tree of the user in the context.
+// Paths are relative to the user's root folder.
+type davFS struct {
+	api *apiService
+}
+
+func (d *davFS) lookup(ctx context.Context, name string) (*models.File, error) {
+	userId := auth.GetUser(ctx)
+	id, err := resolvePathID(d.api.db, d.api.names, name, userId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	var file models.File
+	if err := d.api.db.Where("id = ? AND user_id = ?", *id, userId).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = path.Clean(name)
+	if _, err := d.lookup(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	parent, err := d.lookup(ctx, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if parent.Type != "folder" {
+		return os.ErrNotExist
+	}
+	return d.api.FilesMkdir(ctx, &api.FileMkDir{Path: name})
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = path.Clean(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		file, err := d.lookup(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{fs: d, file: file}, nil
+	}
+
+	existing, err := d.lookup(ctx, name)
+	switch {
+	case err == nil && existing.Type == "folder":
+		return nil, fs.ErrInvalid
+	case errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	parent, err := d.lookup(ctx, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	if parent.Type != "folder" {
+		return nil, os.ErrNotExist
+	}
+	return &davUpload{d.api.newSpoolUpload(ctx, parent.ID, path.Base(name), d.api.cnf.WebDAV.PartSize)}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	file, err := d.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if file.ParentId == nil {
+		return os.ErrPermission
+	}
+	return d.api.FilesDelete(ctx, &api.FileDelete{Ids: []string{file.ID}})
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	file, err := d.lookup(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if file.ParentId == nil {
+		return os.ErrPermission
+	}
+	parent, err := d.lookup(ctx, path.Dir(path.Clean(newName)))
+	if err != nil {
+		return err
+	}
+	if parent.Type != "folder" {
+		return os.ErrNotExist
+	}
+	return d.api.FilesMove(ctx, &api.FileMove{
+		Ids:               []string{file.ID},
+		DestinationParent: parent.ID,
+		DestinationName:   api.NewOptString(path.Base(newName)),
+	})
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, err := d.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &davInfo{file: file}, nil
+}
+
+// davInfo exposes a file row as os.FileInfo. It also provides the content
+// type and ETag so PROPFIND never has to read content.
+type davInfo struct {
+	file *models.File
+}
+
+func (i *davInfo) Name() string {
+	if i.file.ParentId == nil {
+		return "/"
+	}
+	return i.file.Name
+}
+
+func (i *davInfo) Size() int64 {
+	if i.file.Size == nil {
+		return 0
+	}
+	return *i.file.Size
+}
+
+func (i *davInfo) Mode() os.FileMode {
+	if i.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *davInfo) ModTime() time.Time {
+	if i.file.UpdatedAt == nil {
+		return time.Time{}
+	}
+	return *i.file.UpdatedAt
+}
+
+func (i *davInfo) IsDir() bool { return i.file.Type == "folder" }
+
+func (i *davInfo) Sys() any { return nil }
+
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.file.MimeType == "" {
+		return defaultContentType, nil
+	}
+	return i.file.MimeType, nil
+}
+
+func (i *davInfo) ETag(ctx context.Context) (string, error) {
+	return streamETag(i.file), nil
+}
+
+// davFile is an opened file or folder. Folder listings are read from the
+// database; file content is served by webdavHandler, so reads are refused.
+type davFile struct {
+	fs   *davFS
+	file *models.File
+	pos  int64
+	list []os.FileInfo
+}
+
+func (f *davFile) Close() error { return nil }
+
+func (f *davFile) Read(p []byte) (int, error) {
+	return 0, fs.ErrInvalid
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, fs.ErrPermission
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += (&davInfo{file: f.file}).Size()
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.file.Type != "folder" {
+		return nil, fs.ErrInvalid
+	}
+	if f.list == nil {
+		var children []models.File
+		if err := f.fs.api.db.Where("parent_id = ? AND status = 'active'", f.file.ID).
+			Order("name").Find(&children).Error; err != nil {
+			return nil, err
+		}
+		f.fs.api.names.decode(children)
+		f.list = make([]os.FileInfo, 0, len(children))
+		for i := range children {
+			f.list = append(f.list, &davInfo{file: &children[i]})
+		}
+	}
+	if count <= 0 {
+		list := f.list
+		f.list = f.list[len(f.list):]
+		return list, nil
+	}
+	if len(f.list) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.list))
+	list := f.list[:n]
+	f.list = f.list[n:]
+	return list, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return &davInfo{file: f.file}, nil
+}
+
+// davUpload is the target of a PUT. Content is spooled into upload parts and
+// the file is created once the body is complete.
+type davUpload struct {
+	*spoolUpload
+}
+
+func (u *davUpload) Close() error {
+	_, err := u.spoolUpload.Close()
+	return err
+}
+
+func (u *davUpload) Read(p []byte) (int, error) {
+	return 0, fs.ErrInvalid
+}
+
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
+
+func (u *davUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fs.ErrInvalid
+}
+
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	return &davInfo{file: &models.File{
+		Name:      u.name,
+		Type:      "file",
+		Size:      &u.size,
+		UpdatedAt: &u.modTime,
+		ParentId:  &u.parentId,
+	}}, nil
+}
+
+var _ webdav.FileSystem = (*davFS)(nil)
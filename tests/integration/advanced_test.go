@@ -88,7 +88,9 @@ func TestBulkOperations(t *testing.T) {
 		var dbFile models.File
 		err := testDB.Where("id = ?", id).First(&dbFile).Error
 		require.NoError(t, err)
-		assert.Equal(t, "pending_deletion", dbFile.Status)
+		assert.Equal(t, "trashed", dbFile.Status)
+		require.NotNil(t, dbFile.TrashRootId)
+		assert.Equal(t, id, *dbFile.TrashRootId)
 	}
 }
 
@@ -153,23 +155,23 @@ func TestNestedStructuresAndCascade(t *testing.T) {
 	pathFile, _ = service.FilesGetById(ctx, api.FilesGetByIdParams{ID: file.ID.Value})
 	assert.Equal(t, "/B/deep_file.txt", pathFile.Path.Value)
 
-	// 5. Delete B (Cascade?)
-	// FilesDelete calls deleteFilesBulk which deletes folder and updates files to pending_deletion.
+	// 5. Delete B (Cascade)
+	// FilesDelete calls deleteFilesBulk which moves B and everything below it to the trash.
 	err = service.FilesDelete(ctx, &api.FileDelete{
 		Ids: []string{folderB.ID.Value},
 	})
 	require.NoError(t, err)
 
-	// Verify B is GONE (Hard delete for folders as per my implementation)
-	// getById should fail
-	_, err = service.FilesGetById(ctx, api.FilesGetByIdParams{ID: folderB.ID.Value})
-	assert.Error(t, err)
-
-	// Verify File is PENDING_DELETION
-	var dbFile models.File
-	err = testDB.Where("id = ?", file.ID.Value).First(&dbFile).Error
-	require.NoError(t, err)
-	assert.Equal(t, "pending_deletion", dbFile.Status)
+	// Verify B and its file are trashed together, rooted at B
+	for _, id := range []string{folderB.ID.Value, file.ID.Value} {
+		var dbFile models.File
+		err = testDB.Where("id = ?", id).First(&dbFile).Error
+		require.NoError(t, err)
+		assert.Equal(t, "trashed", dbFile.Status)
+		require.NotNil(t, dbFile.TrashRootId)
+		assert.Equal(t, folderB.ID.Value, *dbFile.TrashRootId)
+		assert.NotNil(t, dbFile.TrashedAt)
+	}
 }
 
 func TestEdgeCases(t *testing.T) {
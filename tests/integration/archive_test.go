@@ -0,0 +1,56 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+)
+
+func TestArchiveRejectsInvalidSelections(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+
+	do := func(path string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	shared, err := service.FilesCreate(ctx, &api.File{
+		Name: "archive_shared",
+		Type: api.FileTypeFolder,
+		Path: api.NewOptString("/"),
+	})
+	require.NoError(t, err)
+	other, err := service.FilesCreate(ctx, &api.File{
+		Name: "archive_other",
+		Type: api.FileTypeFolder,
+		Path: api.NewOptString("/"),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, service.FilesCreateShare(ctx, &api.FileShareCreate{},
+		api.FilesCreateShareParams{ID: shared.ID.Value}))
+	share, err := service.FilesShareByid(ctx, api.FilesShareByidParams{ID: shared.ID.Value})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, do("/files/archive?ids="+shared.ID.Value, false).Code)
+	assert.Equal(t, http.StatusBadRequest, do("/files/archive", true).Code)
+	assert.Equal(t, http.StatusNotFound,
+		do("/files/archive?ids="+shared.ID.Value+",00000000-0000-0000-0000-000000000000", true).Code)
+
+	// Items outside the shared folder cannot be fetched through the share
+	assert.Equal(t, http.StatusNotFound, do("/shares/"+share.ID+"/archive?ids="+other.ID.Value, false).Code)
+}
@@ -0,0 +1,94 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/hash"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestFilesCreateChecksum(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, token := getAuthenticatedContext(t, service)
+	require.NoError(t, createDefaultChannel(testDB))
+
+	blockHashes := bytes.Repeat([]byte{0xcd}, 32)
+	treeHash := hash.SumToHex(hash.ComputeTreeHash(blockHashes))
+	upload := func(uploadId string, partId int, verified bool) {
+		require.NoError(t, testDB.Create(&models.Upload{
+			UploadId:          uploadId,
+			UserId:            testUserID,
+			Name:              "checksum.bin",
+			PartNo:            1,
+			PartId:            partId,
+			ChannelId:         999999,
+			Size:              300,
+			BlockHashes:       blockHashes,
+			ChecksumAlgorithm: utils.Ptr("md5"),
+			Checksum:          utils.Ptr(strings.Repeat("0", 32)),
+			ChecksumVerified:  verified,
+		}).Error)
+	}
+	create := func(name, uploadId, fileHash string) error {
+		_, err := service.FilesCreate(ctx, &api.File{
+			Name:      name,
+			Type:      api.FileTypeFile,
+			Size:      api.NewOptInt64(300),
+			Path:      api.NewOptString("/"),
+			ChannelId: api.NewOptInt64(999999),
+			UploadId:  api.NewOptString(uploadId),
+			Hash:      api.NewOptString(fileHash),
+		})
+		return err
+	}
+
+	// Hashes of other kinds are accepted from clients that sent no checksums
+	upload("checksum-upload-1", 1300, false)
+	require.NoError(t, create("checksum_unverified.bin", "checksum-upload-1", "client-side-hash"))
+
+	// Clients that sent checksums have the whole-file hash checked too
+	upload("checksum-upload-2", 1301, true)
+	err := create("checksum_mismatch.bin", "checksum-upload-2", "client-side-hash")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, service.NewError(ctx, err).StatusCode)
+
+	upload("checksum-upload-3", 1302, true)
+	require.NoError(t, create("checksum_verified.bin", "checksum-upload-3", strings.ToUpper(treeHash)))
+
+	// A malformed digest is told apart from an unsupported algorithm
+	handler := newTestHandler(t, testDB)
+	req := httptest.NewRequest(http.MethodPost, "/uploads/tus", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", "4")
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("malformed.bin")))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location := rec.Header().Get("Location")
+
+	for value, message := range map[string]string{"sha1 not-a-digest": "malformed checksum", "crc32 00000000": "unsupported checksum algorithm"} {
+		req = httptest.NewRequest(http.MethodPatch, location, strings.NewReader("data"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		req.Header.Set("Upload-Checksum", value)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, value)
+		assert.Contains(t, rec.Body.String(), message, value)
+	}
+}
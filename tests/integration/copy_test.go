@@ -0,0 +1,173 @@
+package integration
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"gorm.io/gorm/clause"
+)
+
+func TestCopyFolderOnlyActiveOwnFolders(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, _ := getAuthenticatedContext(t, service)
+
+	copyStatus := func(id string) int {
+		_, err := service.FilesCopy(ctx, &api.FileCopy{Destination: "/"}, api.FilesCopyParams{ID: id})
+		require.Error(t, err)
+		return service.NewError(ctx, err).StatusCode
+	}
+
+	// A folder of another user cannot be copied
+	const otherUserID = testUserID + 1
+	require.NoError(t, testDB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.User{
+		UserId:   otherUserID,
+		Name:     "Other User",
+		UserName: "otheruser",
+	}).Error)
+	foreign, err := service.FilesCreate(ctx, &api.File{
+		Name: "foreign_folder",
+		Type: api.FileTypeFolder,
+		Path: api.NewOptString("/"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, testDB.Model(&models.File{}).Where("id = ?", foreign.ID.Value).
+		Update("user_id", otherUserID).Error)
+	assert.Equal(t, http.StatusNotFound, copyStatus(foreign.ID.Value))
+
+	// Nor can a trashed one
+	trashed, err := service.FilesCreate(ctx, &api.File{
+		Name: "trashed_folder",
+		Type: api.FileTypeFolder,
+		Path: api.NewOptString("/"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, service.FilesDelete(ctx, &api.FileDelete{Ids: []string{trashed.ID.Value}}))
+	assert.Equal(t, http.StatusNotFound, copyStatus(trashed.ID.Value))
+
+	var count int64
+	require.NoError(t, testDB.Model(&models.File{}).
+		Where("name IN ? AND user_id = ? AND status = ?", []string{"foreign_folder", "trashed_folder"}, testUserID, "active").
+		Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+func TestCopyFolderTree(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	forwarder := &partForwarder{}
+	service := newTestApiService(testDB, services.WithPartForwarder(forwarder))
+	ctx, _ := getAuthenticatedContext(t, service)
+	require.NoError(t, createDefaultChannel(testDB))
+
+	src, err := service.FilesCreate(ctx, &api.File{
+		Name: "copy_tree",
+		Type: api.FileTypeFolder,
+		Path: api.NewOptString("/"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, service.FilesMkdir(ctx, &api.FileMkDir{Path: "/copy_tree/sub/deep"}))
+	create := func(path, name string, channelId int64, first, count int) {
+		parts := make([]api.Part, count)
+		for i := range parts {
+			parts[i] = api.Part{ID: first + i}
+		}
+		_, err := service.FilesCreate(ctx, &api.File{
+			Name:      name,
+			Type:      api.FileTypeFile,
+			Size:      api.NewOptInt64(1000),
+			MimeType:  api.NewOptString("application/octet-stream"),
+			Path:      api.NewOptString(path),
+			ChannelId: api.NewOptInt64(channelId),
+			Parts:     parts,
+		})
+		require.NoError(t, err)
+	}
+	create("/copy_tree", "top.bin", 999999, 7000, 150)
+	create("/copy_tree/sub/deep", "deep.bin", 888888, 8000, 2)
+
+	tree := func(id string) map[string]models.File {
+		var rows []models.File
+		require.NoError(t, testDB.Raw(`
+		WITH RECURSIVE tree AS (
+			SELECT * FROM teldrive.files WHERE id = ?
+			UNION ALL
+			SELECT f.* FROM teldrive.files f JOIN tree t ON f.parent_id = t.id
+		)
+		SELECT * FROM tree`, id).Scan(&rows).Error)
+		byName := map[string]models.File{}
+		for _, row := range rows {
+			byName[row.Name] = row
+		}
+		return byName
+	}
+	copyTo := func(name string) (*api.File, error) {
+		return service.FilesCopy(ctx, &api.FileCopy{
+			Destination: "/copy_dest",
+			NewName:     api.NewOptString(name),
+		}, api.FilesCopyParams{ID: src.ID.Value})
+	}
+
+	out, err := copyTo("copied")
+	require.NoError(t, err)
+	assert.Equal(t, "copied", out.Name)
+
+	// Parts are forwarded in batches of at most 100 per source channel
+	sizes := []int{}
+	for _, batch := range forwarder.batches {
+		sizes = append(sizes, len(batch))
+	}
+	assert.ElementsMatch(t, []int{100, 50, 2}, sizes)
+
+	copied := tree(out.ID.Value)
+	require.Len(t, copied, 5)
+	assert.Equal(t, copied["copied"].ID, *copied["sub"].ParentId)
+	assert.Equal(t, copied["sub"].ID, *copied["deep"].ParentId)
+	assert.Equal(t, copied["deep"].ID, *copied["deep.bin"].ParentId)
+	for _, name := range []string{"top.bin", "deep.bin"} {
+		file := copied[name]
+		require.NotNil(t, file.Parts)
+		assert.Equal(t, int64(999999), *file.ChannelId)
+		for _, part := range *file.Parts {
+			assert.Greater(t, part.ID, 100000)
+		}
+	}
+	assert.Len(t, *copied["top.bin"].Parts, 150)
+	assert.Len(t, *copied["deep.bin"].Parts, 2)
+	// The source is left alone
+	assert.Len(t, tree(src.ID.Value), 5)
+
+	// A flood wait halfway deletes the messages forwarded so far and
+	// creates nothing
+	forwarded := len(forwarder.batches)
+	forwarder.failAt = forwarded + 2
+	_, err = copyTo("copied_again")
+	require.Error(t, err)
+	require.Len(t, forwarder.batches, forwarded+2)
+	assert.Len(t, forwarder.deleted, len(forwarder.batches[forwarded]))
+	var count int64
+	require.NoError(t, testDB.Model(&models.File{}).Where("name = ? AND user_id = ?", "copied_again", testUserID).
+		Count(&count).Error)
+	assert.Zero(t, count)
+
+	// A copy that does not fit the quota forwards nothing
+	forwarder.failAt = 0
+	forwarded = len(forwarder.batches)
+	require.NoError(t, testDB.Exec(`UPDATE teldrive.users SET quota_size =
+		(SELECT size FROM teldrive.user_usage WHERE user_id = ?) + 1 WHERE user_id = ?`, testUserID, testUserID).Error)
+	t.Cleanup(func() {
+		testDB.Exec("UPDATE teldrive.users SET quota_size = NULL WHERE user_id = ?", testUserID)
+	})
+	_, err = copyTo("copied_over_quota")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusInsufficientStorage, service.NewError(ctx, err).StatusCode)
+	assert.Len(t, forwarder.batches, forwarded)
+}
@@ -0,0 +1,105 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestDedupByHash(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+
+	blockHashes := bytes.Repeat([]byte{0xab}, 32)
+	upload := func(uploadId string, partId int) {
+		require.NoError(t, testDB.Create(&models.Upload{
+			UploadId:    uploadId,
+			UserId:      testUserID,
+			Name:        "dedup.bin",
+			PartNo:      1,
+			PartId:      partId,
+			ChannelId:   999999,
+			Size:        300,
+			BlockHashes: blockHashes,
+		}).Error)
+	}
+
+	upload("dedup-upload-1", 1200)
+	first, err := service.FilesCreate(ctx, &api.File{
+		Name:      "dedup_first.bin",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(300),
+		Path:      api.NewOptString("/"),
+		ChannelId: api.NewOptInt64(999999),
+		UploadId:  api.NewOptString("dedup-upload-1"),
+	})
+	require.NoError(t, err)
+	require.True(t, first.Hash.IsSet())
+
+	// Identical content reuses the parts of the first file
+	upload("dedup-upload-2", 1201)
+	second, err := service.FilesCreate(ctx, &api.File{
+		Name:      "dedup_second.bin",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(300),
+		Path:      api.NewOptString("/"),
+		ChannelId: api.NewOptInt64(999999),
+		UploadId:  api.NewOptString("dedup-upload-2"),
+	})
+	require.NoError(t, err)
+
+	var dbFile models.File
+	require.NoError(t, testDB.Where("id = ?", second.ID.Value).First(&dbFile).Error)
+	assert.Equal(t, 1200, (*dbFile.Parts)[0].ID)
+
+	// The redundant upload is queued for deletion
+	var discarded models.File
+	require.NoError(t, testDB.Where("status = 'pending_deletion' AND user_id = ? AND parts @> ?", testUserID, `[{"id":1201}]`).
+		First(&discarded).Error)
+
+	// Clients can check for the hash and create the file without uploading
+	req := httptest.NewRequest(http.MethodGet, "/files/hashes/"+first.Hash.Value+"?size=300", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var lookup struct {
+		Exists bool `json:"exists"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lookup))
+	assert.True(t, lookup.Exists)
+
+	third, err := service.FilesCreate(ctx, &api.File{
+		Name:      "dedup_third.bin",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(300),
+		Path:      api.NewOptString("/"),
+		ChannelId: api.NewOptInt64(999999),
+		Hash:      api.NewOptString(first.Hash.Value),
+	})
+	require.NoError(t, err)
+	require.NoError(t, testDB.Where("id = ?", third.ID.Value).First(&dbFile).Error)
+	assert.Equal(t, 1200, (*dbFile.Parts)[0].ID)
+
+	// Unknown hashes cannot be used to create files
+	_, err = service.FilesCreate(ctx, &api.File{
+		Name:      "dedup_missing.bin",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(300),
+		Path:      api.NewOptString("/"),
+		ChannelId: api.NewOptInt64(999999),
+		Hash:      api.NewOptString("0000"),
+	})
+	assert.Error(t, err)
+}
@@ -113,9 +113,9 @@ func TestWholeFileFlow(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	// Verify deletion (status pending_deletion)
+	// Verify deletion (file moved to trash)
 	var dbFile models.File
 	err = testDB.Where("id = ?", file.ID.Value).First(&dbFile).Error
 	require.NoError(t, err)
-	assert.Equal(t, "pending_deletion", dbFile.Status)
+	assert.Equal(t, "trashed", dbFile.Status)
 }
@@ -4,10 +4,17 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"io"
+	"net/http"
 	"strconv"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/require"
 	"github.com/tgdrive/teldrive/internal/api"
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
@@ -38,6 +45,16 @@ func createDummyUser(db *gorm.DB) error {
 	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&user).Error
 }
 
+// createDefaultChannel selects a channel for the test user so files can be
+// created without naming one.
+func createDefaultChannel(db *gorm.DB) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Channel{
+		ChannelId: 999999,
+		UserId:    testUserID,
+		Selected:  true,
+	}).Error
+}
+
 func createSession(db *gorm.DB) (string, error) {
 	session := "1AgAAAAAAAAAAAA..." // Dummy session string
 	tokenhash := md5.Sum([]byte(session))
@@ -70,8 +87,8 @@ func createSession(db *gorm.DB) (string, error) {
 	return auth.Encode(testJWTSecret, claims)
 }
 
-func newTestApiService(db *gorm.DB) api.Handler {
-	cnf := &config.ServerCmdConfig{
+func newTestConfig() *config.ServerCmdConfig {
+	return &config.ServerCmdConfig{
 		JWT: config.JWTConfig{
 			Secret:       testJWTSecret,
 			SessionTime:  24 * time.Hour,
@@ -82,9 +99,110 @@ func newTestApiService(db *gorm.DB) api.Handler {
 				Retention: 7 * 24 * time.Hour,
 			},
 		},
+		Files: config.FilesConfig{
+			Dedup:          true,
+			TrashRetention: 30 * 24 * time.Hour,
+		},
+		Imports: config.ImportConfig{
+			MaxJobs:              1,
+			AllowPrivateNetworks: true,
+		},
+		Quota: config.QuotaConfig{
+			Admins: []string{testUserName},
+		},
 	}
+}
+
+func newTestApiService(db *gorm.DB, opts ...services.Option) api.Handler {
+	cnf := newTestConfig()
 	c := cache.NewCache(context.Background(), config.CacheConfig{}.MaxSize, nil,nil)
 	botSelector := tgc.NewBotSelector(nil)
 	ev := events.NewBroadcaster(context.Background(), db, nil, time.Duration(10*time.Second), events.BroadcasterConfig{}, zap.NewNop())
-	return services.NewApiService(db, cnf, c, botSelector, ev)
+	return services.NewApiService(db, cnf, c, botSelector, ev, opts...)
+}
+
+// newTestHandler builds the HTTP handler mounted under /api, including the
+// hand-written routes served by the extended middleware.
+func newTestHandler(t *testing.T, db *gorm.DB, opts ...services.Option) http.Handler {
+	cnf := newTestConfig()
+	c := cache.NewCache(context.Background(), config.CacheConfig{}.MaxSize, nil, nil)
+	ev := events.NewBroadcaster(context.Background(), db, nil, 10*time.Second, events.BroadcasterConfig{}, zap.NewNop())
+	apiSrv := services.NewApiService(db, cnf, c, tgc.NewBotSelector(nil), ev, opts...)
+	srv, err := api.NewServer(apiSrv, auth.NewSecurityHandler(db, c, &cnf.JWT))
+	require.NoError(t, err)
+	return services.NewExtendedMiddleware(srv, services.NewExtendedService(apiSrv))
+}
+
+func newTestWebDAVHandler(db *gorm.DB) http.Handler {
+	cnf := newTestConfig()
+	c := cache.NewCache(context.Background(), config.CacheConfig{}.MaxSize, nil, nil)
+	ev := events.NewBroadcaster(context.Background(), db, nil, 10*time.Second, events.BroadcasterConfig{}, zap.NewNop())
+	apiSrv := services.NewApiService(db, cnf, c, tgc.NewBotSelector(nil), ev)
+	return services.NewWebDAVHandler(services.NewExtendedService(apiSrv), "/webdav")
+}
+
+func newTestS3Handler(db *gorm.DB, opts ...services.Option) http.Handler {
+	cnf := newTestConfig()
+	c := cache.NewCache(context.Background(), config.CacheConfig{}.MaxSize, nil, nil)
+	ev := events.NewBroadcaster(context.Background(), db, nil, 10*time.Second, events.BroadcasterConfig{}, zap.NewNop())
+	apiSrv := services.NewApiService(db, cnf, c, tgc.NewBotSelector(nil), ev, opts...)
+	return services.NewS3Handler(services.NewExtendedService(apiSrv), "/s3")
+}
+
+// partRecorder stands in for Telegram when parts are uploaded: it reads and
+// verifies them the way the real sender does and records their sizes.
+type partRecorder struct {
+	mu    sync.Mutex
+	sizes []int64
+}
+
+func (p *partRecorder) send(ctx context.Context, userId, channelId int64, name string, r io.Reader, size int64, verify func() error) (int, error) {
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := verify(); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sizes = append(p.sizes, n)
+	return len(p.sizes), nil
+}
+
+// partForwarder stands in for Telegram when folders are copied: it numbers
+// forwarded messages from 100000 on and records the batches it was sent.
+// The batch numbered failAt fails with a flood wait.
+type partForwarder struct {
+	mu      sync.Mutex
+	failAt  int
+	next    int
+	batches [][]int
+	deleted []int
+}
+
+func (f *partForwarder) Run(ctx context.Context, client *telegram.Client, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func (f *partForwarder) Forward(ctx context.Context, client *telegram.Client, from, to int64, ids []int) (map[int]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, ids)
+	if len(f.batches) == f.failAt {
+		return nil, tgerr.New(420, "FLOOD_WAIT_30")
+	}
+	res := make(map[int]int, len(ids))
+	for _, id := range ids {
+		f.next++
+		res[id] = 100000 + f.next
+	}
+	return res, nil
+}
+
+func (f *partForwarder) Delete(ctx context.Context, client *telegram.Client, channelId int64, ids []int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, ids...)
+	return nil
 }
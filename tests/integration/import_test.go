@@ -0,0 +1,77 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestImportsFromURL(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	_, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+	require.NoError(t, createDefaultChannel(testDB))
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="remote.txt"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer remote.Close()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	wait := func(id string) map[string]any {
+		var job map[string]any
+		require.Eventually(t, func() bool {
+			rec := do(http.MethodGet, "/imports/"+id, "")
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+			return job["status"] != "pending" && job["status"] != "running"
+		}, 10*time.Second, 50*time.Millisecond)
+		return job
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/imports", `{"url":"ftp://example.com/a"}`).Code)
+
+	rec := do(http.MethodPost, "/imports", `{"url":"`+remote.URL+`/files/x","path":"/imports_dir"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var created map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	job := wait(created["id"].(string))
+	assert.Equal(t, "failed", job["status"])
+	assert.Contains(t, job["error"], "403")
+
+	rec = do(http.MethodPost, "/imports", `{"url":"`+remote.URL+`/files/x","path":"/imports_dir","headers":{"X-Token":"secret"}}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.NotContains(t, rec.Body.String(), "secret")
+	job = wait(created["id"].(string))
+	require.Equal(t, "completed", job["status"], job["error"])
+	assert.Equal(t, "remote.txt", job["name"])
+
+	var file models.File
+	require.NoError(t, testDB.Where("id = ?", job["fileId"]).First(&file).Error)
+	assert.Equal(t, "remote.txt", file.Name)
+	assert.Equal(t, int64(0), *file.Size)
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/imports/00000000-0000-0000-0000-000000000000", "").Code)
+}
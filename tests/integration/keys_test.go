@@ -0,0 +1,137 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"go.uber.org/zap"
+)
+
+func TestUserKeys(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	cnf := newTestConfig()
+	cnf.TG.Uploads.EncryptionKey = "keys-test-key"
+	cnf.Keys.PerUser = true
+	c := cache.NewCache(context.Background(), config.CacheConfig{}.MaxSize, nil, nil)
+	ev := events.NewBroadcaster(context.Background(), testDB, nil, 10*time.Second, events.BroadcasterConfig{}, zap.NewNop())
+	service := services.NewApiService(testDB, cnf, c, tgc.NewBotSelector(nil), ev)
+	srv, err := api.NewServer(service, auth.NewSecurityHandler(testDB, c, &cnf.JWT))
+	require.NoError(t, err)
+	handler := services.NewExtendedMiddleware(srv, services.NewExtendedService(service))
+	ctx, token := getAuthenticatedContext(t, service)
+
+	type keyStatus struct {
+		PerUser    bool
+		Created    bool
+		Protection string
+		Unlocked   bool
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, path, r)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	status := func(rec *httptest.ResponseRecorder) keyStatus {
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var out keyStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out
+	}
+
+	assert.Equal(t, keyStatus{PerUser: true}, status(do(http.MethodGet, "/users/keys", "")))
+
+	// Setting a passphrase creates the key and unlocks it for this session
+	s := status(do(http.MethodPut, "/users/keys/passphrase", `{"passphrase":"secret"}`))
+	assert.Equal(t, keyStatus{PerUser: true, Created: true, Protection: "passphrase", Unlocked: true}, s)
+
+	var userKey models.UserKey
+	require.NoError(t, testDB.Where("user_id = ?", auth.GetUser(ctx)).First(&userKey).Error)
+	dataKey, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, "secret")
+	require.NoError(t, err)
+	assert.NotEmpty(t, dataKey)
+
+	require.NoError(t, service.FilesMkdir(ctx, &api.FileMkDir{Path: "/keys"}))
+	file, err := service.FilesCreate(ctx, &api.File{
+		Name:      "locked.bin",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(10),
+		Path:      api.NewOptString("/keys"),
+		ChannelId: api.NewOptInt64(999999),
+		Parts:     []api.Part{{ID: 1, Salt: api.NewOptString(crypt.UserSalt("salt"))}},
+		Encrypted: api.NewOptBool(true),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/users/keys/lock", "").Code)
+	assert.False(t, status(do(http.MethodGet, "/users/keys", "")).Unlocked)
+	assert.Equal(t, http.StatusLocked, do(http.MethodGet, "/files/archive?ids="+file.ID.Value, "").Code)
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/users/keys/unlock", `{"passphrase":"wrong"}`).Code)
+	assert.True(t, status(do(http.MethodPost, "/users/keys/unlock", `{"passphrase":"secret"}`)).Unlocked)
+
+	// Removing the passphrase wraps the same key with the master key again
+	s = status(do(http.MethodPut, "/users/keys/passphrase", `{"passphrase":""}`))
+	assert.Equal(t, "master", s.Protection)
+	require.NoError(t, testDB.Where("user_id = ?", auth.GetUser(ctx)).First(&userKey).Error)
+	got, err := crypt.UnwrapKey(userKey.WrappedKey, userKey.Salt, cnf.TG.Uploads.EncryptionKey)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, got)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/users/keys/lock", "").Code)
+	assert.True(t, status(do(http.MethodGet, "/users/keys", "")).Unlocked)
+
+	// Unlocked keys stay in the memory of the instance that unlocked them,
+	// and only while they are used
+	idleCnf := *cnf
+	idleCnf.Keys.UnlockIdle = 200 * time.Millisecond
+	idleService := services.NewApiService(testDB, &idleCnf, c, tgc.NewBotSelector(nil), ev)
+	idleSrv, err := api.NewServer(idleService, auth.NewSecurityHandler(testDB, c, &idleCnf.JWT))
+	require.NoError(t, err)
+	idleHandler := services.NewExtendedMiddleware(idleSrv, services.NewExtendedService(idleService))
+	doIdle := func(method, path, body string) *httptest.ResponseRecorder {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, path, r)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		idleHandler.ServeHTTP(rec, req)
+		return rec
+	}
+	// A passphrase set on one instance locks the key the others unwrapped
+	// with the master key at once
+	assert.True(t, status(doIdle(http.MethodPut, "/users/keys/passphrase", `{"passphrase":"secret"}`)).Unlocked)
+	assert.False(t, status(do(http.MethodGet, "/users/keys", "")).Unlocked)
+	assert.Equal(t, http.StatusLocked, do(http.MethodGet, "/files/archive?ids="+file.ID.Value, "").Code)
+	time.Sleep(time.Second)
+	assert.False(t, status(doIdle(http.MethodGet, "/users/keys", "")).Unlocked)
+
+	assert.True(t, status(doIdle(http.MethodPost, "/users/keys/unlock", `{"passphrase":"secret"}`)).Unlocked)
+	assert.Equal(t, "master", status(doIdle(http.MethodPut, "/users/keys/passphrase", `{"passphrase":""}`)).Protection)
+}
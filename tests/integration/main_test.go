@@ -68,6 +68,8 @@ func truncateTables(db *gorm.DB) {
 		"teldrive.bots",
 		"teldrive.uploads",
 		"teldrive.file_shares",
+		"teldrive.file_versions",
+		"teldrive.user_usage",
 	}
 	for _, table := range tables {
 		if err := db.Exec("TRUNCATE TABLE " + table + " CASCADE").Error; err != nil {
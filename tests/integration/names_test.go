@@ -0,0 +1,175 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"go.uber.org/zap"
+)
+
+func TestEncryptedNames(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	const key = "names-test-key"
+	newServer := func(store bool) (api.Handler, http.Handler) {
+		cnf := newTestConfig()
+		cnf.TG.Uploads.EncryptionKey = key
+		cnf.Files.EncryptNames = store
+		c := cache.NewCache(context.Background(), config.CacheConfig{}.MaxSize, nil, nil)
+		ev := events.NewBroadcaster(context.Background(), testDB, nil, 10*time.Second, events.BroadcasterConfig{}, zap.NewNop())
+		apiSrv := services.NewApiService(testDB, cnf, c, tgc.NewBotSelector(nil), ev)
+		srv, err := api.NewServer(apiSrv, auth.NewSecurityHandler(testDB, c, &cnf.JWT))
+		require.NoError(t, err)
+		return apiSrv, services.NewExtendedMiddleware(srv, services.NewExtendedService(apiSrv))
+	}
+	plainService, _ := newServer(false)
+	service, handler := newServer(true)
+	ctx, token := getAuthenticatedContext(t, service)
+	cipher, err := crypt.NewNameCipher(key)
+	require.NoError(t, err)
+
+	create := func(service api.Handler, name string) *api.File {
+		file, err := service.FilesCreate(ctx, &api.File{
+			Name:      name,
+			Type:      api.FileTypeFile,
+			Size:      api.NewOptInt64(10),
+			Path:      api.NewOptString("/names"),
+			ChannelId: api.NewOptInt64(999999),
+			Parts:     []api.Part{{ID: 1}},
+			Encrypted: api.NewOptBool(true),
+		})
+		require.NoError(t, err)
+		return file
+	}
+	storedName := func(id string) string {
+		var file models.File
+		require.NoError(t, testDB.Where("id = ?", id).First(&file).Error)
+		return file.Name
+	}
+	find := func(params api.FilesListParams) []api.File {
+		params.Status = api.NewOptFileQueryStatus(api.FileQueryStatusActive)
+		params.Operation = api.NewOptFileQueryOperation(api.FileQueryOperationFind)
+		params.Limit = api.NewOptInt(10)
+		params.Page = api.NewOptInt(1)
+		list, err := service.FilesList(ctx, params)
+		require.NoError(t, err)
+		return list.Items
+	}
+	migrate := func(direction string) int {
+		req := httptest.NewRequest(http.MethodPost, "/files/names/"+direction, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var out struct{ Files int }
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out.Files
+	}
+
+	require.NoError(t, service.FilesMkdir(ctx, &api.FileMkDir{Path: "/names"}))
+	older := create(plainService, "older.txt")
+	assert.Equal(t, "older.txt", storedName(older.ID.Value))
+
+	secret := create(service, "secret.txt")
+	assert.Equal(t, "secret.txt", secret.Name)
+	encrypted, err := cipher.EncryptName("secret.txt")
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, storedName(secret.ID.Value))
+
+	items := find(api.FilesListParams{Name: api.NewOptString("secret.txt")})
+	require.Len(t, items, 1)
+	assert.Equal(t, "secret.txt", items[0].Name)
+
+	items = find(api.FilesListParams{Query: api.NewOptString("secret.txt"),
+		SearchType: api.OptFileQuerySearchType{Value: api.FileQuerySearchTypeText, Set: true}})
+	require.Len(t, items, 1)
+	assert.Equal(t, secret.ID.Value, items[0].ID.Value)
+
+	// Folders are stored encrypted as well and paths resolve one segment at
+	// a time
+	encryptedFolder, err := cipher.EncryptName("names")
+	require.NoError(t, err)
+	var folder models.File
+	require.NoError(t, testDB.Where("name = ? AND name_encrypted AND user_id = ?", encryptedFolder, testUserID).First(&folder).Error)
+	require.NoError(t, service.FilesMkdir(ctx, &api.FileMkDir{Path: "/names/sub/deeper"}))
+	nested, err := service.FilesCreate(ctx, &api.File{
+		Name:      "nested.txt",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(10),
+		Path:      api.NewOptString("/names/sub/deeper"),
+		ChannelId: api.NewOptInt64(999999),
+		Parts:     []api.Part{{ID: 1}},
+		Encrypted: api.NewOptBool(true),
+	})
+	require.NoError(t, err)
+	got, err := service.FilesGetById(ctx, api.FilesGetByIdParams{ID: nested.ID.Value})
+	require.NoError(t, err)
+	assert.Equal(t, "/names/sub/deeper/nested.txt", got.Path.Value)
+	items = find(api.FilesListParams{Path: api.NewOptString("/names/sub")})
+	require.Len(t, items, 1)
+	assert.Equal(t, "deeper", items[0].Name)
+
+	// A plain name is never taken for an encrypted one, whatever it looks like
+	lookalike := create(plainService, encryptedFolder)
+	assert.Equal(t, encryptedFolder, storedName(lookalike.ID.Value))
+	items = find(api.FilesListParams{Name: api.NewOptString(encryptedFolder)})
+	require.Len(t, items, 1)
+	assert.Equal(t, encryptedFolder, items[0].Name)
+
+	// Overwriting by the plain name keeps a single file
+	again := create(service, "older.txt")
+	assert.Equal(t, older.ID.Value, again.ID.Value)
+
+	assert.Positive(t, migrate("encrypt"))
+	assert.NotEqual(t, "older.txt", storedName(older.ID.Value))
+	assert.Equal(t, 0, migrate("encrypt"))
+	items = find(api.FilesListParams{Name: api.NewOptString("older.txt")})
+	require.Len(t, items, 1)
+	assert.Equal(t, "older.txt", items[0].Name)
+
+	assert.Positive(t, migrate("decrypt"))
+	assert.Equal(t, "secret.txt", storedName(secret.ID.Value))
+	assert.Equal(t, "older.txt", storedName(older.ID.Value))
+	assert.Equal(t, "names", storedName(folder.ID))
+	assert.Equal(t, encryptedFolder, storedName(lookalike.ID.Value))
+	got, err = service.FilesGetById(ctx, api.FilesGetByIdParams{ID: nested.ID.Value})
+	require.NoError(t, err)
+	assert.Equal(t, "/names/sub/deeper/nested.txt", got.Path.Value)
+
+	// A plain file deduplicated onto encrypted content becomes encrypted and
+	// stores its name in that form
+	require.NoError(t, testDB.Model(&models.File{}).Where("id = ?", secret.ID.Value).
+		Update("hash", "names-dedup-hash").Error)
+	dup, err := service.FilesCreate(ctx, &api.File{
+		Name:      "dup.txt",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(10),
+		Path:      api.NewOptString("/names"),
+		Hash:      api.NewOptString("names-dedup-hash"),
+		Encrypted: api.NewOptBool(false),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "dup.txt", dup.Name)
+	encrypted, err = cipher.EncryptName("dup.txt")
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, storedName(dup.ID.Value))
+	items = find(api.FilesListParams{Name: api.NewOptString("dup.txt")})
+	require.Len(t, items, 1)
+	assert.Equal(t, "dup.txt", items[0].Name)
+}
@@ -0,0 +1,84 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+)
+
+func TestStorageQuota(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	usage := func() map[string]any {
+		rec := do(http.MethodGet, "/users/usage", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var out map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out
+	}
+	create := func(name string, size int64) error {
+		_, err := service.FilesCreate(ctx, &api.File{
+			Name:      name,
+			Type:      api.FileTypeFile,
+			Size:      api.NewOptInt64(size),
+			MimeType:  api.NewOptString("text/plain"),
+			Path:      api.NewOptString("/quota"),
+			ChannelId: api.NewOptInt64(999999),
+			Parts:     []api.Part{{ID: 1400}},
+		})
+		return err
+	}
+
+	require.NoError(t, service.FilesMkdir(ctx, &api.FileMkDir{Path: "/quota"}))
+
+	before := usage()
+	assert.NotContains(t, before, "total")
+	require.NoError(t, create("a.txt", 100))
+	after := usage()
+	assert.Equal(t, before["used"].(float64)+100, after["used"])
+	assert.Equal(t, before["objects"].(float64)+1, after["objects"])
+
+	used := int64(after["used"].(float64))
+	quotaPath := "/users/" + strconv.FormatInt(testUserID, 10) + "/quota"
+	rec := do(http.MethodPut, quotaPath, `{"size": `+strconv.FormatInt(used+50, 10)+`}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	limited := usage()
+	assert.Equal(t, float64(used+50), limited["total"])
+	assert.Equal(t, float64(50), limited["free"])
+
+	err := create("b.txt", 100)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "quota")
+	// Overwriting only counts the change in size
+	require.NoError(t, create("a.txt", 140))
+
+	rec = do(http.MethodPut, quotaPath, `{"size": null}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, create("b.txt", 100))
+
+	rec = do(http.MethodGet, "/users/quotas", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var quotas []map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &quotas))
+	assert.NotEmpty(t, quotas)
+}
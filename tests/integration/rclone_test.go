@@ -0,0 +1,75 @@
+package integration
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/services"
+	"go.uber.org/zap"
+)
+
+func TestRcloneExport(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	const key = "rclone-test-key"
+	cnf := newTestConfig()
+	cnf.TG.Uploads.EncryptionKey = key
+	c := cache.NewCache(context.Background(), config.CacheConfig{}.MaxSize, nil, nil)
+	ev := events.NewBroadcaster(context.Background(), testDB, nil, 10*time.Second, events.BroadcasterConfig{}, zap.NewNop())
+	service := services.NewApiService(testDB, cnf, c, tgc.NewBotSelector(nil), ev)
+	srv, err := api.NewServer(service, auth.NewSecurityHandler(testDB, c, &cnf.JWT))
+	require.NoError(t, err)
+	handler := services.NewExtendedMiddleware(srv, services.NewExtendedService(service))
+	ctx, token := getAuthenticatedContext(t, service)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	file, err := service.FilesCreate(ctx, &api.File{
+		Name:      "empty.txt",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(0),
+		Path:      api.NewOptString("/"),
+		ChannelId: api.NewOptInt64(999999),
+		Encrypted: api.NewOptBool(true),
+	})
+	require.NoError(t, err)
+
+	rec := do(http.MethodGet, "/files/"+file.ID.Value+"/rclone", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, crypt.RcloneSize(0), int64(rec.Body.Len()))
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "RCLONE\x00\x00"))
+
+	remote, err := crypt.NewRcloneCipher(key)
+	require.NoError(t, err)
+	encrypted, err := remote.EncryptName("empty.txt")
+	require.NoError(t, err)
+	_, params, err := mime.ParseMediaType(rec.Header().Get("Content-Disposition"))
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, params["filename"])
+
+	assert.Equal(t, http.StatusNotFound,
+		do(http.MethodGet, "/files/00000000-0000-0000-0000-000000000000/rclone", "").Code)
+	assert.Equal(t, http.StatusBadRequest,
+		do(http.MethodPut, "/uploads/rclone?name=x.bin", "TELDRIVE\x00\x00not an rclone object").Code)
+}
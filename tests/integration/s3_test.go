@@ -0,0 +1,223 @@
+package integration
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+)
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request signs r with SigV4 for an unsigned payload.
+func signS3Request(r *http.Request, accessKey, secretKey string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		"host:" + r.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	scope := date + "/us-east-1/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, "us-east-1")
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		accessKey, scope, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func TestS3BucketOperations(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, _ := getAuthenticatedContext(t, service)
+	handler := newTestS3Handler(testDB)
+
+	key := models.S3Key{
+		AccessKey: "TDTESTACCESSKEY00001",
+		SecretKey: "test-secret-key",
+		UserId:    auth.GetUser(ctx),
+		Name:      "test",
+	}
+	require.NoError(t, testDB.Create(&key).Error)
+
+	do := func(method, path string, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		signS3Request(req, key.AccessKey, secret)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/s3/", "wrong-secret")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "SignatureDoesNotMatch")
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodHead, "/s3/s3-bucket", key.SecretKey).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/s3/s3-bucket", key.SecretKey).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodHead, "/s3/s3-bucket", key.SecretKey).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/s3/s3-bucket/nested/", key.SecretKey).Code)
+
+	rec = do(http.MethodGet, "/s3/", key.SecretKey)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<Name>s3-bucket</Name>")
+
+	rec = do(http.MethodGet, "/s3/s3-bucket?delimiter=%2F&list-type=2", key.SecretKey)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<Prefix>nested/</Prefix>")
+
+	rec = do(http.MethodDelete, "/s3/s3-bucket", key.SecretKey)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "BucketNotEmpty")
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/s3/s3-bucket/nested/", key.SecretKey).Code)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/s3/s3-bucket", key.SecretKey).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodHead, "/s3/s3-bucket", key.SecretKey).Code)
+}
+
+func TestS3ObjectETagsAndPaging(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, _ := getAuthenticatedContext(t, service)
+	require.NoError(t, createDefaultChannel(testDB))
+	handler := newTestS3Handler(testDB, services.WithPartSender((&partRecorder{}).send))
+
+	key := models.S3Key{
+		AccessKey: "TDTESTACCESSKEY00002",
+		SecretKey: "test-secret-key",
+		UserId:    auth.GetUser(ctx),
+		Name:      "etags",
+	}
+	require.NoError(t, testDB.Create(&key).Error)
+
+	// Queries are written in canonical form, as the test signer uses them as is
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, path, r)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		signS3Request(req, key.AccessKey, key.SecretKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	md5ETag := func(content string) string {
+		sum := md5.Sum([]byte(content))
+		return `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/s3/s3-etags", "", nil).Code)
+
+	rec := do(http.MethodPut, "/s3/s3-etags/a.txt", "alpha", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, md5ETag("alpha"), rec.Header().Get("ETag"))
+
+	sum := md5.Sum([]byte("other"))
+	rec = do(http.MethodPut, "/s3/s3-etags/bad.txt", "beta", map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "BadDigest")
+
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/s3/s3-etags/b.txt", "beta", nil).Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/s3/s3-etags/c/d.txt", "delta", nil).Code)
+
+	type listing struct {
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+		Contents              []struct {
+			Key  string `xml:"Key"`
+			ETag string `xml:"ETag"`
+		} `xml:"Contents"`
+	}
+	list := func(query string) listing {
+		rec := do(http.MethodGet, "/s3/s3-etags?"+query, "", nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var res listing
+		require.NoError(t, xml.Unmarshal(rec.Body.Bytes(), &res))
+		return res
+	}
+	keys := func(res listing) []string {
+		out := []string{}
+		for _, c := range res.Contents {
+			out = append(out, c.Key)
+		}
+		return out
+	}
+
+	page := list("list-type=2&max-keys=2")
+	assert.Equal(t, []string{"a.txt", "b.txt"}, keys(page))
+	assert.True(t, page.IsTruncated)
+	// Stored objects have no content MD5, so their ETags must not look like one
+	for _, c := range page.Contents {
+		assert.True(t, strings.HasSuffix(c.ETag, `-1"`), c.ETag)
+	}
+	page = list("continuation-token=" + page.NextContinuationToken + "&list-type=2&max-keys=2")
+	assert.Equal(t, []string{"c/d.txt"}, keys(page))
+	assert.False(t, page.IsTruncated)
+	assert.Equal(t, []string{"c/d.txt"}, keys(list("list-type=2&prefix=c%2Fd")))
+
+	rec = do(http.MethodPost, "/s3/s3-etags/multi.bin?uploads=", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	require.NoError(t, xml.Unmarshal(rec.Body.Bytes(), &initiated))
+
+	rec = do(http.MethodPut, "/s3/s3-etags/multi.bin?partNumber=1&uploadId="+initiated.UploadId, "gamma", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	partETag := rec.Header().Get("ETag")
+	assert.Equal(t, md5ETag("gamma"), partETag)
+
+	complete := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>", partETag)
+	rec = do(http.MethodPost, "/s3/s3-etags/multi.bin?uploadId="+initiated.UploadId, complete, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var completed struct {
+		ETag string `xml:"ETag"`
+	}
+	require.NoError(t, xml.Unmarshal(rec.Body.Bytes(), &completed))
+	partSum := md5.Sum([]byte("gamma"))
+	multiSum := md5.Sum(partSum[:])
+	assert.Equal(t, `"`+hex.EncodeToString(multiSum[:])+`-1"`, completed.ETag)
+}
@@ -0,0 +1,108 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestTrashRestoreAndEmpty(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	folder, err := service.FilesCreate(ctx, &api.File{
+		Name: "trash_folder",
+		Type: api.FileTypeFolder,
+		Path: api.NewOptString("/"),
+	})
+	require.NoError(t, err)
+
+	file, err := service.FilesCreate(ctx, &api.File{
+		Name:      "trash_file.txt",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(10),
+		MimeType:  api.NewOptString("text/plain"),
+		ParentId:  api.NewOptString(folder.ID.Value),
+		ChannelId: api.NewOptInt64(999999),
+		Parts:     []api.Part{{ID: 700}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, service.FilesDelete(ctx, &api.FileDelete{Ids: []string{folder.ID.Value}}))
+
+	// Requests without credentials are rejected
+	req := httptest.NewRequest(http.MethodGet, "/trash", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Only the deleted folder is listed, with its original location
+	rec = do(http.MethodGet, "/trash", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Items []struct {
+			ID           string `json:"id"`
+			OriginalPath string `json:"originalPath"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, folder.ID.Value, list.Items[0].ID)
+	assert.Equal(t, "/", list.Items[0].OriginalPath)
+
+	// Restoring the folder brings back its content
+	rec = do(http.MethodPost, "/trash/restore", `{"ids":["`+folder.ID.Value+`"]}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	var dbFile models.File
+	require.NoError(t, testDB.Where("id = ?", file.ID.Value).First(&dbFile).Error)
+	assert.Equal(t, "active", dbFile.Status)
+	assert.Nil(t, dbFile.TrashRootId)
+	require.NotNil(t, dbFile.ParentId)
+	assert.Equal(t, folder.ID.Value, *dbFile.ParentId)
+
+	// Restoring an item that is not in the trash fails
+	rec = do(http.MethodPost, "/trash/restore", `{"ids":["`+folder.ID.Value+`"]}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// A restore conflicting with an active item is rejected
+	require.NoError(t, service.FilesDelete(ctx, &api.FileDelete{Ids: []string{folder.ID.Value}}))
+	_, err = service.FilesCreate(ctx, &api.File{
+		Name: "trash_folder",
+		Type: api.FileTypeFolder,
+		Path: api.NewOptString("/"),
+	})
+	require.NoError(t, err)
+	rec = do(http.MethodPost, "/trash/restore", `{"ids":["`+folder.ID.Value+`"]}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// Emptying the trash hands files to the cleanup job and drops folders
+	rec = do(http.MethodDelete, "/trash", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	require.NoError(t, testDB.Where("id = ?", file.ID.Value).First(&dbFile).Error)
+	assert.Equal(t, "pending_deletion", dbFile.Status)
+
+	var count int64
+	require.NoError(t, testDB.Model(&models.File{}).Where("id = ?", folder.ID.Value).Count(&count).Error)
+	assert.Zero(t, count)
+}
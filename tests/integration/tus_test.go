@@ -0,0 +1,198 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/hash"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/services"
+)
+
+func TestTusResumableUpload(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	_, token := getAuthenticatedContext(t, service)
+	require.NoError(t, createDefaultChannel(testDB))
+	handler := newTestHandler(t, testDB)
+	// Another instance sharing the database
+	parts := &partRecorder{}
+	other := newTestHandler(t, testDB, services.WithPartSender(parts.send))
+
+	serve := func(handler http.Handler, method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	do := func(method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		return serve(handler, method, path, body, headers)
+	}
+	patchOn := func(handler http.Handler, location, offset, body string, headers map[string]string) *httptest.ResponseRecorder {
+		h := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}
+		for k, v := range headers {
+			h[k] = v
+		}
+		return serve(handler, http.MethodPatch, location, strings.NewReader(body), h)
+	}
+	patch := func(location, offset, body string, headers map[string]string) *httptest.ResponseRecorder {
+		return patchOn(handler, location, offset, body, headers)
+	}
+
+	rec := do(http.MethodOptions, "/uploads/tus", nil, nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Contains(t, rec.Header().Get("Tus-Extension"), "checksum")
+	assert.Contains(t, rec.Header().Get("Tus-Checksum-Algorithm"), "blake3")
+
+	rec = do(http.MethodPost, "/uploads/tus", nil, map[string]string{"Tus-Resumable": "0.2.0", "Upload-Length": "10"})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("tus.bin"))
+	rec = do(http.MethodPost, "/uploads/tus", nil, map[string]string{"Upload-Length": "10", "Upload-Metadata": metadata})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location := rec.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, "/uploads/tus/"))
+
+	rec = do(http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("Upload-Offset"))
+	assert.Equal(t, "10", rec.Header().Get("Upload-Length"))
+
+	rec = patch(location, "0", "hello", nil)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+
+	assert.Equal(t, http.StatusConflict, patch(location, "2", "xyz", nil).Code)
+
+	sum := sha1.Sum([]byte("other"))
+	rec = patch(location, "5", "world", map[string]string{
+		"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	assert.Equal(t, 460, rec.Code)
+	assert.Equal(t, "5", do(http.MethodHead, location, nil, nil).Header().Get("Upload-Offset"))
+
+	// An upload leased by a request, on this or another instance, is not
+	// written until the lease ends
+	lease := func(until time.Time) {
+		require.NoError(t, testDB.Model(&models.TusUpload{}).Where("id = ?", path.Base(location)).
+			Updates(map[string]any{"lease_id": uuid.NewString(), "lease_until": until}).Error)
+	}
+	lease(time.Now().Add(time.Minute))
+	assert.Equal(t, http.StatusLocked, patch(location, "5", "world", nil).Code)
+	assert.Equal(t, http.StatusLocked, do(http.MethodDelete, location, nil, nil).Code)
+	lease(time.Now().Add(-time.Second))
+
+	// The bytes received so far are seen and completed by another instance
+	rec = serve(other, http.MethodHead, location, nil, nil)
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+	rec = patchOn(other, location, "5", "world", nil)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	assert.Equal(t, "10", rec.Header().Get("Upload-Offset"))
+	assert.Equal(t, []int64{10}, parts.sizes)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodHead, location, nil, nil).Code)
+	var file models.File
+	require.NoError(t, testDB.Where("name = ? AND user_id = ? AND status = 'active'", "tus.bin", testUserID).First(&file).Error)
+	assert.Equal(t, int64(10), *file.Size)
+
+	metadata = "filename " + base64.StdEncoding.EncodeToString([]byte("tus-deleted.bin"))
+	rec = do(http.MethodPost, "/uploads/tus", nil, map[string]string{"Upload-Length": "10", "Upload-Metadata": metadata})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location = rec.Header().Get("Location")
+	require.Equal(t, http.StatusNoContent, patch(location, "0", "hello", nil).Code)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, location, nil, nil).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodHead, location, nil, nil).Code)
+
+	var count int64
+	require.NoError(t, testDB.Model(&models.TusUpload{}).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestTusChecksumAcrossParts(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	_, token := getAuthenticatedContext(t, service)
+	require.NoError(t, createDefaultChannel(testDB))
+
+	parts := &partRecorder{}
+	handler := newTestHandler(t, testDB, services.WithPartSender(parts.send))
+
+	do := func(method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := bytes.Repeat([]byte("teldrive"), (2*hash.BlockSize+16)/8)
+	size := strconv.Itoa(len(body))
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("parts.bin"))
+	rec := do(http.MethodPost, "/uploads/tus", nil, map[string]string{"Upload-Length": size, "Upload-Metadata": metadata})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location := rec.Header().Get("Location")
+
+	// The checksum covers the whole body, not any of the parts it is split in
+	sum := sha1.Sum(body)
+	rec = do(http.MethodPatch, location, bytes.NewReader(body), map[string]string{
+		"Content-Type":    "application/offset+octet-stream",
+		"Upload-Offset":   "0",
+		"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	assert.Equal(t, size, rec.Header().Get("Upload-Offset"))
+	assert.Equal(t, []int64{hash.BlockSize, hash.BlockSize, 16}, parts.sizes)
+
+	var file models.File
+	require.NoError(t, testDB.Where("name = ? AND user_id = ? AND status = 'active'", "parts.bin", testUserID).First(&file).Error)
+	assert.Equal(t, int64(len(body)), *file.Size)
+
+	// A dropped connection keeps the whole blocks received as a part and the
+	// rest in the upload
+	metadata = "filename " + base64.StdEncoding.EncodeToString([]byte("dropped.bin"))
+	rec = do(http.MethodPost, "/uploads/tus", nil, map[string]string{"Upload-Length": size, "Upload-Metadata": metadata})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location = rec.Header().Get("Location")
+	parts.sizes = nil
+	dropped := io.MultiReader(bytes.NewReader(body[:hash.BlockSize+5]), iotest.ErrReader(io.ErrUnexpectedEOF))
+	rec = do(http.MethodPatch, location, dropped, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	assert.NotEqual(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, []int64{hash.BlockSize}, parts.sizes)
+	offset := strconv.Itoa(hash.BlockSize + 5)
+	assert.Equal(t, offset, do(http.MethodHead, location, nil, nil).Header().Get("Upload-Offset"))
+
+	rec = do(http.MethodPatch, location, bytes.NewReader(body[hash.BlockSize+5:]), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": offset,
+	})
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	assert.Equal(t, []int64{hash.BlockSize, hash.BlockSize, 16}, parts.sizes)
+}
@@ -0,0 +1,42 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestUploadsStream(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	_, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+	require.NoError(t, createDefaultChannel(testDB))
+
+	do := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do("/uploads/stream?path=/stream_dir", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do("/uploads/stream?name=a/b", "").Code)
+
+	rec := do("/uploads/stream?path=/stream_dir&name=empty.txt", "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var folder, file models.File
+	require.NoError(t, testDB.Where("name = ? AND type = 'folder'", "stream_dir").First(&folder).Error)
+	require.NoError(t, testDB.Where("name = ? AND parent_id = ?", "empty.txt", folder.ID).First(&file).Error)
+	assert.Equal(t, int64(0), *file.Size)
+	assert.Equal(t, "text/plain", file.MimeType)
+}
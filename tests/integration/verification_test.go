@@ -0,0 +1,74 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestFileVerifications(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	file, err := service.FilesCreate(ctx, &api.File{
+		Name:      "scrubbed.bin",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(100),
+		MimeType:  api.NewOptString("application/octet-stream"),
+		Path:      api.NewOptString("/"),
+		ChannelId: api.NewOptInt64(999999),
+		Parts:     []api.Part{{ID: 1300}, {ID: 1301}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusNotFound, do("/files/"+file.ID.Value+"/verification").Code)
+
+	var stored models.File
+	require.NoError(t, testDB.Where("id = ?", file.ID.Value).First(&stored).Error)
+	require.NoError(t, testDB.Create(&models.FileVerification{
+		FileId:       stored.ID,
+		UserId:       stored.UserId,
+		Hash:         "previous",
+		Status:       "missing",
+		MissingParts: []int{1301},
+	}).Error)
+
+	rec := do("/files/" + file.ID.Value + "/verification")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var verification map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &verification))
+	assert.Equal(t, "missing", verification["status"])
+	assert.Equal(t, "scrubbed.bin", verification["name"])
+	assert.Equal(t, []any{float64(1301)}, verification["missingParts"])
+	assert.Equal(t, true, verification["stale"])
+
+	rec = do("/files/verifications?status=missing")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list []map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, file.ID.Value, list[0]["fileId"])
+
+	rec = do("/files/verifications?status=ok")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Empty(t, list)
+}
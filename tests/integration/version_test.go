@@ -0,0 +1,87 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/api"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestFileVersions(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	ctx, token := getAuthenticatedContext(t, service)
+	handler := newTestHandler(t, testDB)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	file, err := service.FilesCreate(ctx, &api.File{
+		Name:      "versioned.txt",
+		Type:      api.FileTypeFile,
+		Size:      api.NewOptInt64(100),
+		MimeType:  api.NewOptString("text/plain"),
+		Path:      api.NewOptString("/"),
+		ChannelId: api.NewOptInt64(999999),
+		Parts:     []api.Part{{ID: 1100}},
+	})
+	require.NoError(t, err)
+
+	// Metadata changes do not create versions
+	_, err = service.FilesUpdate(ctx, &api.FileUpdate{
+		Name: api.NewOptString("versioned_renamed.txt"),
+	}, api.FilesUpdateParams{ID: file.ID.Value})
+	require.NoError(t, err)
+
+	var count int64
+	require.NoError(t, testDB.Model(&models.FileVersion{}).Where("file_id = ?", file.ID.Value).Count(&count).Error)
+	assert.Zero(t, count)
+
+	// Replacing the content keeps the previous parts
+	_, err = service.FilesUpdate(ctx, &api.FileUpdate{
+		Size:  api.NewOptInt64(200),
+		Parts: []api.Part{{ID: 1101}},
+	}, api.FilesUpdateParams{ID: file.ID.Value})
+	require.NoError(t, err)
+
+	rec := do(http.MethodGet, "/files/"+file.ID.Value+"/versions")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var versions []struct {
+		ID   string `json:"id"`
+		Size int64  `json:"size"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &versions))
+	require.Len(t, versions, 1)
+	assert.Equal(t, int64(100), versions[0].Size)
+
+	// Restoring swaps the version with the current content
+	rec = do(http.MethodPost, "/files/"+file.ID.Value+"/versions/"+versions[0].ID+"/restore")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	var dbFile models.File
+	require.NoError(t, testDB.Where("id = ?", file.ID.Value).First(&dbFile).Error)
+	assert.Equal(t, int64(100), *dbFile.Size)
+	assert.Equal(t, 1100, (*dbFile.Parts)[0].ID)
+
+	var remaining []models.FileVersion
+	require.NoError(t, testDB.Where("file_id = ?", file.ID.Value).Find(&remaining).Error)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, int64(200), *remaining[0].Size)
+	assert.Equal(t, 1101, (*remaining[0].Parts)[0].ID)
+
+	// Unknown versions are rejected
+	rec = do(http.MethodPost, "/files/"+file.ID.Value+"/versions/"+versions[0].ID+"/restore")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
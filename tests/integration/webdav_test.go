@@ -0,0 +1,61 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestWebDAVFolderOperations(t *testing.T) {
+	if testDB == nil {
+		t.Fatal("DB not initialized")
+	}
+	service := newTestApiService(testDB)
+	_, token := getAuthenticatedContext(t, service)
+	handler := newTestWebDAVHandler(testDB)
+
+	do := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("teldrive", token)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/webdav/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+
+	assert.Equal(t, http.StatusCreated, do("MKCOL", "/webdav/dav_folder", nil).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("MKCOL", "/webdav/dav_folder", nil).Code)
+	assert.Equal(t, http.StatusConflict, do("MKCOL", "/webdav/missing/child", nil).Code)
+	assert.Equal(t, http.StatusCreated, do("MKCOL", "/webdav/dav_folder/child", nil).Code)
+
+	rec = do("PROPFIND", "/webdav/", map[string]string{"Depth": "1"})
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	assert.Contains(t, rec.Body.String(), "/webdav/dav_folder/")
+
+	rec = do("MOVE", "/webdav/dav_folder", map[string]string{"Destination": "/webdav/dav_renamed"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = do("PROPFIND", "/webdav/dav_renamed", map[string]string{"Depth": "1"})
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	assert.True(t, strings.Contains(rec.Body.String(), "/webdav/dav_renamed/child/"))
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/webdav/dav_renamed", nil).Code)
+	assert.Equal(t, http.StatusNotFound, do("PROPFIND", "/webdav/dav_renamed", nil).Code)
+
+	var folder models.File
+	require.NoError(t, testDB.Where("name = ? AND type = 'folder'", "dav_renamed").First(&folder).Error)
+	assert.Equal(t, "trashed", folder.Status)
+}